@@ -0,0 +1,508 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        v5.29.3
+// source: secret/v1/secret.proto
+
+package secretv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// File is a file attached to a secret message.
+type File struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// name is the original file name. It must not contain path separators.
+	Name string `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	// content is the raw file content (max 50MB).
+	Content       []byte `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *File) Reset() {
+	*x = File{}
+	mi := &file_secret_v1_secret_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *File) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*File) ProtoMessage() {}
+
+func (x *File) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use File.ProtoReflect.Descriptor instead.
+func (*File) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *File) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *File) GetContent() []byte {
+	if x != nil {
+		return x.Content
+	}
+	return nil
+}
+
+type CreateSecretRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// msg is the secret message content (required, max 1MB).
+	Msg string `protobuf:"bytes,1,opt,name=msg,proto3" json:"msg,omitempty"`
+	// ttl is the time-to-live as a Go duration (e.g. "1h"), between 1m and 168h. Defaults to 48h.
+	Ttl string `protobuf:"bytes,2,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	// file is an optional file to store alongside the message.
+	File *File `protobuf:"bytes,3,opt,name=file,proto3" json:"file,omitempty"`
+	// reads is how many times the secret can be retrieved (1 to 10). Defaults to 1.
+	Reads int32 `protobuf:"varint,4,opt,name=reads,proto3" json:"reads,omitempty"`
+	// allowed_cidrs restricts the retrieval to these networks, as CIDRs (e.g. "10.0.0.0/8") or
+	// IP addresses. Requires a storage backend supporting access policies.
+	AllowedCidrs []string `protobuf:"bytes,5,rep,name=allowed_cidrs,json=allowedCidrs,proto3" json:"allowed_cidrs,omitempty"`
+	// recipients restricts the retrieval to these email addresses, checked with single sign-on.
+	Recipients []string `protobuf:"bytes,6,rep,name=recipients,proto3" json:"recipients,omitempty"`
+	// recipient_groups restricts the retrieval to the members of these groups, checked with
+	// single sign-on.
+	RecipientGroups []string `protobuf:"bytes,7,rep,name=recipient_groups,json=recipientGroups,proto3" json:"recipient_groups,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *CreateSecretRequest) Reset() {
+	*x = CreateSecretRequest{}
+	mi := &file_secret_v1_secret_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateSecretRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateSecretRequest) ProtoMessage() {}
+
+func (x *CreateSecretRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateSecretRequest.ProtoReflect.Descriptor instead.
+func (*CreateSecretRequest) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CreateSecretRequest) GetMsg() string {
+	if x != nil {
+		return x.Msg
+	}
+	return ""
+}
+
+func (x *CreateSecretRequest) GetTtl() string {
+	if x != nil {
+		return x.Ttl
+	}
+	return ""
+}
+
+func (x *CreateSecretRequest) GetFile() *File {
+	if x != nil {
+		return x.File
+	}
+	return nil
+}
+
+func (x *CreateSecretRequest) GetReads() int32 {
+	if x != nil {
+		return x.Reads
+	}
+	return 0
+}
+
+func (x *CreateSecretRequest) GetAllowedCidrs() []string {
+	if x != nil {
+		return x.AllowedCidrs
+	}
+	return nil
+}
+
+func (x *CreateSecretRequest) GetRecipients() []string {
+	if x != nil {
+		return x.Recipients
+	}
+	return nil
+}
+
+func (x *CreateSecretRequest) GetRecipientGroups() []string {
+	if x != nil {
+		return x.RecipientGroups
+	}
+	return nil
+}
+
+type CreateSecretResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// token retrieves the secret message.
+	Token string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	// file_token retrieves the uploaded file, if any. The file is returned base64 encoded.
+	FileToken string `protobuf:"bytes,2,opt,name=file_token,json=fileToken,proto3" json:"file_token,omitempty"`
+	// file_name is the original name of the uploaded file, if any.
+	FileName      string `protobuf:"bytes,3,opt,name=file_name,json=fileName,proto3" json:"file_name,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateSecretResponse) Reset() {
+	*x = CreateSecretResponse{}
+	mi := &file_secret_v1_secret_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateSecretResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateSecretResponse) ProtoMessage() {}
+
+func (x *CreateSecretResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateSecretResponse.ProtoReflect.Descriptor instead.
+func (*CreateSecretResponse) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CreateSecretResponse) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+func (x *CreateSecretResponse) GetFileToken() string {
+	if x != nil {
+		return x.FileToken
+	}
+	return ""
+}
+
+func (x *CreateSecretResponse) GetFileName() string {
+	if x != nil {
+		return x.FileName
+	}
+	return ""
+}
+
+type GetSecretRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// token is the one-time token returned by CreateSecret.
+	Token         string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetSecretRequest) Reset() {
+	*x = GetSecretRequest{}
+	mi := &file_secret_v1_secret_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetSecretRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetSecretRequest) ProtoMessage() {}
+
+func (x *GetSecretRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetSecretRequest.ProtoReflect.Descriptor instead.
+func (*GetSecretRequest) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetSecretRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+type GetSecretResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// msg is the secret content.
+	Msg           string `protobuf:"bytes,1,opt,name=msg,proto3" json:"msg,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetSecretResponse) Reset() {
+	*x = GetSecretResponse{}
+	mi := &file_secret_v1_secret_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetSecretResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetSecretResponse) ProtoMessage() {}
+
+func (x *GetSecretResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetSecretResponse.ProtoReflect.Descriptor instead.
+func (*GetSecretResponse) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetSecretResponse) GetMsg() string {
+	if x != nil {
+		return x.Msg
+	}
+	return ""
+}
+
+type RevokeSecretRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// token is the one-time token returned by CreateSecret.
+	Token         string `protobuf:"bytes,1,opt,name=token,proto3" json:"token,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RevokeSecretRequest) Reset() {
+	*x = RevokeSecretRequest{}
+	mi := &file_secret_v1_secret_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RevokeSecretRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RevokeSecretRequest) ProtoMessage() {}
+
+func (x *RevokeSecretRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RevokeSecretRequest.ProtoReflect.Descriptor instead.
+func (*RevokeSecretRequest) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *RevokeSecretRequest) GetToken() string {
+	if x != nil {
+		return x.Token
+	}
+	return ""
+}
+
+type RevokeSecretResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RevokeSecretResponse) Reset() {
+	*x = RevokeSecretResponse{}
+	mi := &file_secret_v1_secret_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RevokeSecretResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RevokeSecretResponse) ProtoMessage() {}
+
+func (x *RevokeSecretResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_secret_v1_secret_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RevokeSecretResponse.ProtoReflect.Descriptor instead.
+func (*RevokeSecretResponse) Descriptor() ([]byte, []int) {
+	return file_secret_v1_secret_proto_rawDescGZIP(), []int{6}
+}
+
+var File_secret_v1_secret_proto protoreflect.FileDescriptor
+
+const file_secret_v1_secret_proto_rawDesc = "" +
+	"\n" +
+	"\x16secret/v1/secret.proto\x12\tsecret.v1\"4\n" +
+	"\x04File\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x18\n" +
+	"\acontent\x18\x02 \x01(\fR\acontent\"\xe4\x01\n" +
+	"\x13CreateSecretRequest\x12\x10\n" +
+	"\x03msg\x18\x01 \x01(\tR\x03msg\x12\x10\n" +
+	"\x03ttl\x18\x02 \x01(\tR\x03ttl\x12#\n" +
+	"\x04file\x18\x03 \x01(\v2\x0f.secret.v1.FileR\x04file\x12\x14\n" +
+	"\x05reads\x18\x04 \x01(\x05R\x05reads\x12#\n" +
+	"\rallowed_cidrs\x18\x05 \x03(\tR\fallowedCidrs\x12\x1e\n" +
+	"\n" +
+	"recipients\x18\x06 \x03(\tR\n" +
+	"recipients\x12)\n" +
+	"\x10recipient_groups\x18\a \x03(\tR\x0frecipientGroups\"h\n" +
+	"\x14CreateSecretResponse\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\x12\x1d\n" +
+	"\n" +
+	"file_token\x18\x02 \x01(\tR\tfileToken\x12\x1b\n" +
+	"\tfile_name\x18\x03 \x01(\tR\bfileName\"(\n" +
+	"\x10GetSecretRequest\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\"%\n" +
+	"\x11GetSecretResponse\x12\x10\n" +
+	"\x03msg\x18\x01 \x01(\tR\x03msg\"+\n" +
+	"\x13RevokeSecretRequest\x12\x14\n" +
+	"\x05token\x18\x01 \x01(\tR\x05token\"\x16\n" +
+	"\x14RevokeSecretResponse2\xf9\x01\n" +
+	"\rSecretService\x12O\n" +
+	"\fCreateSecret\x12\x1e.secret.v1.CreateSecretRequest\x1a\x1f.secret.v1.CreateSecretResponse\x12F\n" +
+	"\tGetSecret\x12\x1b.secret.v1.GetSecretRequest\x1a\x1c.secret.v1.GetSecretResponse\x12O\n" +
+	"\fRevokeSecret\x12\x1e.secret.v1.RevokeSecretRequest\x1a\x1f.secret.v1.RevokeSecretResponseB>Z<github.com/algolia/sup3rS3cretMes5age/api/secret/v1;secretv1b\x06proto3"
+
+var (
+	file_secret_v1_secret_proto_rawDescOnce sync.Once
+	file_secret_v1_secret_proto_rawDescData []byte
+)
+
+func file_secret_v1_secret_proto_rawDescGZIP() []byte {
+	file_secret_v1_secret_proto_rawDescOnce.Do(func() {
+		file_secret_v1_secret_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_secret_v1_secret_proto_rawDesc), len(file_secret_v1_secret_proto_rawDesc)))
+	})
+	return file_secret_v1_secret_proto_rawDescData
+}
+
+var file_secret_v1_secret_proto_msgTypes = make([]protoimpl.MessageInfo, 7)
+var file_secret_v1_secret_proto_goTypes = []any{
+	(*File)(nil),                 // 0: secret.v1.File
+	(*CreateSecretRequest)(nil),  // 1: secret.v1.CreateSecretRequest
+	(*CreateSecretResponse)(nil), // 2: secret.v1.CreateSecretResponse
+	(*GetSecretRequest)(nil),     // 3: secret.v1.GetSecretRequest
+	(*GetSecretResponse)(nil),    // 4: secret.v1.GetSecretResponse
+	(*RevokeSecretRequest)(nil),  // 5: secret.v1.RevokeSecretRequest
+	(*RevokeSecretResponse)(nil), // 6: secret.v1.RevokeSecretResponse
+}
+var file_secret_v1_secret_proto_depIdxs = []int32{
+	0, // 0: secret.v1.CreateSecretRequest.file:type_name -> secret.v1.File
+	1, // 1: secret.v1.SecretService.CreateSecret:input_type -> secret.v1.CreateSecretRequest
+	3, // 2: secret.v1.SecretService.GetSecret:input_type -> secret.v1.GetSecretRequest
+	5, // 3: secret.v1.SecretService.RevokeSecret:input_type -> secret.v1.RevokeSecretRequest
+	2, // 4: secret.v1.SecretService.CreateSecret:output_type -> secret.v1.CreateSecretResponse
+	4, // 5: secret.v1.SecretService.GetSecret:output_type -> secret.v1.GetSecretResponse
+	6, // 6: secret.v1.SecretService.RevokeSecret:output_type -> secret.v1.RevokeSecretResponse
+	4, // [4:7] is the sub-list for method output_type
+	1, // [1:4] is the sub-list for method input_type
+	1, // [1:1] is the sub-list for extension type_name
+	1, // [1:1] is the sub-list for extension extendee
+	0, // [0:1] is the sub-list for field type_name
+}
+
+func init() { file_secret_v1_secret_proto_init() }
+func file_secret_v1_secret_proto_init() {
+	if File_secret_v1_secret_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_secret_v1_secret_proto_rawDesc), len(file_secret_v1_secret_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   7,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_secret_v1_secret_proto_goTypes,
+		DependencyIndexes: file_secret_v1_secret_proto_depIdxs,
+		MessageInfos:      file_secret_v1_secret_proto_msgTypes,
+	}.Build()
+	File_secret_v1_secret_proto = out.File
+	file_secret_v1_secret_proto_goTypes = nil
+	file_secret_v1_secret_proto_depIdxs = nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// readPaths returns the file to upload for the given paths. A single regular file is
+// sent as is, while directories and multiple paths are bundled into a .tar.gz archive.
+func readPaths(paths []string) (name string, content []byte, err error) {
+	if len(paths) == 1 {
+		fi, err := os.Stat(paths[0])
+		if err != nil {
+			return "", nil, err
+		}
+		if fi.Mode().IsRegular() {
+			content, err := os.ReadFile(paths[0])
+			return filepath.Base(paths[0]), content, err
+		}
+	}
+
+	name = "files.tar.gz"
+	if len(paths) == 1 {
+		name = filepath.Base(filepath.Clean(paths[0])) + ".tar.gz"
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeArchive(buf, paths); err != nil {
+		return "", nil, err
+	}
+	return name, buf.Bytes(), nil
+}
+
+// writeArchive writes a gzipped tarball of paths to w. Entries are named relative to
+// the parent directory of each path, so directory names are preserved. Only regular
+// files and directories are archived; symlinks and special files are skipped.
+func writeArchive(w io.Writer, paths []string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	for _, p := range paths {
+		root := filepath.Dir(filepath.Clean(p))
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && !d.Type().IsRegular() {
+				return nil
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			hdr, err := tar.FileInfoHeader(fi, "")
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			hdr.Name = filepath.ToSlash(rel)
+			if d.IsDir() {
+				hdr.Name += "/"
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer func() { _ = f.Close() }()
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("archiving %s: %w", p, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
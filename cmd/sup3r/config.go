@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables overriding the configuration file.
+const (
+	// ConfigVarenv is the environment variable holding the configuration file path.
+	ConfigVarenv = "SUP3R_CONFIG"
+	// URLVarenv is the environment variable holding the server URL.
+	URLVarenv = "SUP3R_URL"
+	// TTLVarenv is the environment variable holding the default secret TTL.
+	TTLVarenv = "SUP3R_TTL"
+	// ReadsVarenv is the environment variable holding the default number of reads.
+	ReadsVarenv = "SUP3R_READS"
+	// CopyVarenv is the environment variable enabling clipboard copy by default.
+	CopyVarenv = "SUP3R_COPY"
+	// APIKeyVarenv is the environment variable holding the API key authenticating sent secrets.
+	APIKeyVarenv = "SUP3R_API_KEY"
+)
+
+// cliConfig holds the defaults used by sup3r commands.
+type cliConfig struct {
+	// URL is the sup3rS3cretMes5age server URL.
+	URL string `yaml:"url"`
+	// TTL is the default time-to-live of sent secrets (server default when zero).
+	TTL time.Duration `yaml:"ttl"`
+	// Reads is the default number of times sent secrets can be read (server default when zero).
+	Reads int `yaml:"reads"`
+	// Copy copies share URLs to the clipboard.
+	Copy bool `yaml:"copy"`
+	// APIKey authenticates the secrets sent to the server, when it requires a login or a
+	// challenge (no API key when empty).
+	APIKey string `yaml:"api_key"`
+}
+
+// defaultConfigPath returns the path of the configuration file used when none is specified.
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sup3r", "config.yaml")
+}
+
+// loadCLIConfig reads the configuration file, then applies environment variable overrides.
+// A missing default configuration file is not an error, but a missing explicit one is.
+func loadCLIConfig(path string, getenv func(string) string) (cliConfig, error) {
+	var cnf cliConfig
+
+	explicit := true
+	if path == "" {
+		path = getenv(ConfigVarenv)
+	}
+	if path == "" {
+		path, explicit = defaultConfigPath(), false
+	}
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := yaml.Unmarshal(b, &cnf); err != nil {
+				return cnf, fmt.Errorf("parsing %s: %w", path, err)
+			}
+		case explicit || !errors.Is(err, os.ErrNotExist):
+			return cnf, err
+		}
+	}
+
+	if v := getenv(URLVarenv); v != "" {
+		cnf.URL = v
+	}
+	if v := getenv(TTLVarenv); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cnf, fmt.Errorf("invalid %s: %w", TTLVarenv, err)
+		}
+		cnf.TTL = d
+	}
+	if v := getenv(ReadsVarenv); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cnf, fmt.Errorf("invalid %s: %w", ReadsVarenv, err)
+		}
+		cnf.Reads = n
+	}
+	if v := getenv(CopyVarenv); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return cnf, fmt.Errorf("invalid %s: %w", CopyVarenv, err)
+		}
+		cnf.Copy = b
+	}
+	if v := getenv(APIKeyVarenv); v != "" {
+		cnf.APIKey = v
+	}
+
+	return cnf, nil
+}
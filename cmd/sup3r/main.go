@@ -0,0 +1,329 @@
+// Package main provides sup3r, a command-line client for sup3rS3cretMes5age.
+// It sends messages, files and directories as self-destructing secrets and retrieves them.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/client"
+)
+
+// version holds the application version string, injected at build time via ldflags.
+var version = ""
+
+const usage = `Usage: sup3r <command> [flags] [arguments]
+
+Commands:
+  send [flags] [path...]   Send stdin, a file, or files/directories (as a .tar.gz) as a secret
+  get [flags] <token|url>  Retrieve a secret, writing attached files to disk
+  version                  Print version
+
+Run "sup3r <command> -h" for the flags of each command.
+
+Configuration is read from $SUP3R_CONFIG or %s,
+then from SUP3R_URL, SUP3R_TTL, SUP3R_READS and SUP3R_COPY, then from flags.
+`
+
+// cli holds the process streams so that commands can be tested without a terminal.
+type cli struct {
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	getenv func(string) string
+	// copy places text on the system clipboard.
+	copy func(string) error
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	c := &cli{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, getenv: os.Getenv, copy: copyToClipboard}
+	if err := c.run(ctx, os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			_, _ = fmt.Fprintf(os.Stderr, "sup3r: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run dispatches args to the matching command.
+func (c *cli) run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		_, _ = fmt.Fprintf(c.stderr, usage, defaultConfigPath())
+		return flag.ErrHelp
+	}
+
+	switch args[0] {
+	case "send":
+		return c.send(ctx, args[1:])
+	case "get":
+		return c.get(ctx, args[1:])
+	case "version":
+		_, _ = fmt.Fprintln(c.stdout, version)
+		return nil
+	case "-h", "-help", "--help", "help":
+		_, _ = fmt.Fprintf(c.stdout, usage, defaultConfigPath())
+		return nil
+	}
+	return fmt.Errorf("unknown command %q (run \"sup3r help\")", args[0])
+}
+
+// commonFlags are the flags shared by all commands.
+type commonFlags struct {
+	url        string
+	configPath string
+	json       bool
+}
+
+// newFlagSet creates a flag set for a command with the common flags registered.
+func (c *cli) newFlagSet(name, args string) (*flag.FlagSet, *commonFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(c.stderr, "Usage: sup3r %s [flags] %s\n\nFlags:\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	cf := &commonFlags{}
+	fs.StringVar(&cf.url, "url", "", "server URL (e.g. https://secrets.example.com)")
+	fs.StringVar(&cf.configPath, "config", "", "configuration file (default $SUP3R_CONFIG or "+defaultConfigPath()+")")
+	fs.BoolVar(&cf.json, "json", false, "print the result as JSON")
+	return fs, cf
+}
+
+// loadConfig resolves the configuration from the config file, the environment and the flags set on fs.
+func (c *cli) loadConfig(fs *flag.FlagSet, cf *commonFlags) (cliConfig, error) {
+	cnf, err := loadCLIConfig(cf.configPath, c.getenv)
+	if err != nil {
+		return cnf, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "url" {
+			cnf.URL = cf.url
+		}
+	})
+	return cnf, nil
+}
+
+// sendOutput is the JSON output of the send command.
+type sendOutput struct {
+	// URL is the share URL to send to the recipient.
+	URL string `json:"url"`
+	api.TokenResponse
+}
+
+// send creates a secret from stdin or from the given paths and prints its share URL.
+func (c *cli) send(ctx context.Context, args []string) error {
+	fs, cf := c.newFlagSet("send", "[path...]")
+	ttl := fs.Duration("ttl", 0, "time-to-live of the secret, within the server limits (default: server default)")
+	reads := fs.Int("reads", 0, "number of times the secret can be read (default 1)")
+	message := fs.String("m", "", "message sent alongside files (default: the file name)")
+	copyURL := fs.Bool("copy", false, "copy the share URL to the clipboard")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cnf, err := c.loadConfig(fs, cf)
+	if err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ttl":
+			cnf.TTL = *ttl
+		case "reads":
+			cnf.Reads = *reads
+		case "copy":
+			cnf.Copy = *copyURL
+		}
+	})
+
+	cl, err := newClient(cnf.URL, cnf.APIKey)
+	if err != nil {
+		return err
+	}
+
+	msg := *message
+	var file *client.File
+	if fs.NArg() == 0 {
+		b, err := io.ReadAll(c.stdin)
+		if err != nil {
+			return fmt.Errorf("reading stdin: %w", err)
+		}
+		if msg != "" {
+			return fmt.Errorf("-m cannot be used when reading the secret from stdin")
+		}
+		msg = string(b)
+		if strings.TrimSpace(msg) == "" {
+			return fmt.Errorf("nothing to send: stdin is empty")
+		}
+	} else {
+		name, content, err := readPaths(fs.Args())
+		if err != nil {
+			return err
+		}
+		file = &client.File{Name: name, Content: bytes.NewReader(content)}
+		if msg == "" {
+			msg = name
+		}
+	}
+
+	tr, err := cl.CreateSecretWithFile(ctx, msg, file, &client.CreateOptions{TTL: cnf.TTL, Reads: cnf.Reads})
+	if err != nil {
+		return err
+	}
+
+	out := sendOutput{URL: cl.ShareURL(tr), TokenResponse: *tr}
+	if cnf.Copy {
+		if err := c.copy(out.URL); err != nil {
+			_, _ = fmt.Fprintf(c.stderr, "sup3r: could not copy to clipboard: %v\n", err)
+		}
+	}
+
+	if cf.json {
+		return json.NewEncoder(c.stdout).Encode(out)
+	}
+	_, err = fmt.Fprintln(c.stdout, out.URL)
+	return err
+}
+
+// getOutput is the JSON output of the get command.
+type getOutput struct {
+	api.MsgResponse
+	// File is the path of the downloaded file, if any.
+	File string `json:"file,omitempty"`
+}
+
+// get retrieves a secret from a token or a share URL, printing the message and saving any file.
+func (c *cli) get(ctx context.Context, args []string) error {
+	fs, cf := c.newFlagSet("get", "<token|url>")
+	outputDir := fs.String("o", ".", "directory where attached files are written")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+
+	cnf, err := c.loadConfig(fs, cf)
+	if err != nil {
+		return err
+	}
+
+	tr := &api.TokenResponse{Token: fs.Arg(0)}
+	serverURL := cnf.URL
+	if strings.Contains(fs.Arg(0), "://") {
+		if tr, err = client.ParseShareURL(fs.Arg(0)); err != nil {
+			return err
+		}
+		if serverURL, err = serverURLFromShareURL(fs.Arg(0)); err != nil {
+			return err
+		}
+	}
+
+	// The API key is not sent along, as the server of the share URL may not be the configured one.
+	cl, err := newClient(serverURL, "")
+	if err != nil {
+		return err
+	}
+
+	msg, err := cl.GetSecret(ctx, tr.Token)
+	if err != nil {
+		return err
+	}
+	out := getOutput{MsgResponse: api.MsgResponse{Msg: msg}}
+
+	if tr.FileToken != "" {
+		content, err := cl.GetFile(ctx, tr.FileToken)
+		if err != nil {
+			return err
+		}
+		if out.File, err = writeFile(*outputDir, tr.FileName, content, *force); err != nil {
+			return err
+		}
+	}
+
+	if cf.json {
+		return json.NewEncoder(c.stdout).Encode(out)
+	}
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	if _, err := io.WriteString(c.stdout, msg); err != nil {
+		return err
+	}
+	if out.File != "" {
+		_, _ = fmt.Fprintf(c.stderr, "File saved to %s\n", out.File)
+	}
+	return nil
+}
+
+// newClient creates an API client authenticated with apiKey, if not empty, failing with a
+// helpful message when no server URL is configured.
+func newClient(serverURL, apiKey string) (*client.Client, error) {
+	if serverURL == "" {
+		return nil, fmt.Errorf("no server URL configured: use -url, SUP3R_URL or the configuration file")
+	}
+	opts := []client.Option{client.WithUserAgent("sup3r/" + version), client.WithRetries(client.DefaultMaxRetries, client.DefaultBackoff, 30*time.Second)}
+	if apiKey != "" {
+		opts = append(opts, client.WithAPIKey(apiKey))
+	}
+	return client.New(serverURL, opts...)
+}
+
+// serverURLFromShareURL returns the server base URL of a /getmsg share URL.
+func serverURLFromShareURL(shareURL string) (string, error) {
+	u, err := url.Parse(shareURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid share URL: %w", err)
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/getmsg")
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// writeFile writes content to name inside dir, refusing to overwrite unless force is set.
+// Only the base name is used so that a crafted file name cannot escape dir.
+func writeFile(dir, name string, content []byte, force bool) (string, error) {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == string(filepath.Separator) {
+		name = "secret-file"
+	}
+	path := filepath.Join(dir, name)
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("%s already exists (use -force to overwrite)", path)
+		}
+		return "", err
+	}
+
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/algolia/sup3rS3cretMes5age/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCLI starts a server backed by an in-memory store and returns a cli whose
+// environment points to it, along with its stdout buffer.
+func newTestCLI(t *testing.T, stdin string) (*cli, *bytes.Buffer, string) {
+	t.Helper()
+
+	cnf := internal.DefaultConfig()
+	server := internal.NewServer(cnf, internal.NewSecretHandlers(internal.NewMemoryStore()))
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	// Use an empty configuration file so that the user's configuration is ignored.
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, nil, 0o600))
+	env := map[string]string{
+		URLVarenv:    ts.URL,
+		ConfigVarenv: configPath,
+	}
+	stdout := &bytes.Buffer{}
+	c := &cli{
+		stdin:  strings.NewReader(stdin),
+		stdout: stdout,
+		stderr: io.Discard,
+		getenv: func(k string) string { return env[k] },
+		copy:   func(string) error { return nil },
+	}
+	return c, stdout, ts.URL
+}
+
+func TestSendAndGetStdin(t *testing.T) {
+	c, stdout, serverURL := newTestCLI(t, "my secret\n")
+
+	require.NoError(t, c.run(context.Background(), []string{"send", "-ttl", "1h"}))
+	shareURL := strings.TrimSpace(stdout.String())
+	assert.True(t, strings.HasPrefix(shareURL, serverURL+"/getmsg?token="), shareURL)
+
+	stdout.Reset()
+	require.NoError(t, c.run(context.Background(), []string{"get", shareURL}))
+	assert.Equal(t, "my secret\n", stdout.String())
+
+	err := c.run(context.Background(), []string{"get", shareURL})
+	assert.Error(t, err)
+}
+
+func TestSendJSONAndGetToken(t *testing.T) {
+	c, stdout, _ := newTestCLI(t, "my secret")
+
+	require.NoError(t, c.run(context.Background(), []string{"send", "-json", "-reads", "2"}))
+	var out sendOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &out))
+	assert.NotEmpty(t, out.Token)
+	assert.Contains(t, out.URL, out.Token)
+
+	for i := 0; i < 2; i++ {
+		stdout.Reset()
+		require.NoError(t, c.run(context.Background(), []string{"get", "-json", out.Token}))
+		var got getOutput
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+		assert.Equal(t, "my secret", got.Msg)
+		assert.Empty(t, got.File)
+	}
+}
+
+func TestSendAndGetFile(t *testing.T) {
+	c, stdout, _ := newTestCLI(t, "")
+
+	src := filepath.Join(t.TempDir(), "config.env")
+	require.NoError(t, os.WriteFile(src, []byte("API_KEY=secret"), 0o600))
+
+	require.NoError(t, c.run(context.Background(), []string{"send", "-m", "here you go", src}))
+	shareURL := strings.TrimSpace(stdout.String())
+
+	outDir := t.TempDir()
+	stdout.Reset()
+	require.NoError(t, c.run(context.Background(), []string{"get", "-o", outDir, shareURL}))
+	assert.Equal(t, "here you go\n", stdout.String())
+
+	b, err := os.ReadFile(filepath.Join(outDir, "config.env"))
+	require.NoError(t, err)
+	assert.Equal(t, "API_KEY=secret", string(b))
+}
+
+func TestSendDirectory(t *testing.T) {
+	c, stdout, _ := newTestCLI(t, "")
+
+	dir := filepath.Join(t.TempDir(), "certs")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0o700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.pem"), []byte("a"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "b.pem"), []byte("b"), 0o600))
+
+	require.NoError(t, c.run(context.Background(), []string{"send", "-json", dir}))
+	var out sendOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &out))
+	assert.Equal(t, "certs.tar.gz", out.FileName)
+
+	outDir := t.TempDir()
+	stdout.Reset()
+	require.NoError(t, c.run(context.Background(), []string{"get", "-json", "-o", outDir, out.URL}))
+	var got getOutput
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &got))
+	assert.Equal(t, "certs.tar.gz", got.Msg)
+	assert.Equal(t, filepath.Join(outDir, "certs.tar.gz"), got.File)
+
+	f, err := os.Open(got.File)
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(b)
+	}
+	assert.Equal(t, map[string]string{"certs/": "", "certs/a.pem": "a", "certs/sub/": "", "certs/sub/b.pem": "b"}, files)
+}
+
+func TestGetRefusesToOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	_, err := writeFile(dir, "../../etc/passwd", []byte("x"), false)
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(dir, "passwd"))
+
+	_, err = writeFile(dir, "passwd", []byte("y"), false)
+	assert.Error(t, err)
+
+	_, err = writeFile(dir, "passwd", []byte("y"), true)
+	assert.NoError(t, err)
+}
+
+func TestLoadCLIConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("url: https://file.example.com\nttl: 2h\nreads: 3\ncopy: true\n"), 0o600))
+
+	env := map[string]string{}
+	getenv := func(k string) string { return env[k] }
+
+	cnf, err := loadCLIConfig(path, getenv)
+	require.NoError(t, err)
+	assert.Equal(t, "https://file.example.com", cnf.URL)
+	assert.Equal(t, "2h0m0s", cnf.TTL.String())
+	assert.Equal(t, 3, cnf.Reads)
+	assert.True(t, cnf.Copy)
+
+	// Environment variables take precedence over the file.
+	env[URLVarenv] = "https://env.example.com"
+	env[ReadsVarenv] = "1"
+	env[APIKeyVarenv] = "sup3r_id_secret"
+	cnf, err = loadCLIConfig(path, getenv)
+	require.NoError(t, err)
+	assert.Equal(t, "https://env.example.com", cnf.URL)
+	assert.Equal(t, 1, cnf.Reads)
+	assert.Equal(t, "sup3r_id_secret", cnf.APIKey)
+
+	// An explicit configuration file must exist.
+	_, err = loadCLIConfig(filepath.Join(t.TempDir(), "missing.yaml"), getenv)
+	assert.Error(t, err)
+
+	env[ReadsVarenv] = "many"
+	_, err = loadCLIConfig(path, getenv)
+	assert.Error(t, err)
+}
+
+func TestSendRequiresURL(t *testing.T) {
+	c, _, _ := newTestCLI(t, "my secret")
+	getenv := c.getenv
+	c.getenv = func(k string) string {
+		if k == URLVarenv {
+			return ""
+		}
+		return getenv(k)
+	}
+
+	err := c.run(context.Background(), []string{"send"})
+	assert.ErrorContains(t, err, "no server URL configured")
+}
+
+func TestSendCopiesToClipboard(t *testing.T) {
+	c, stdout, _ := newTestCLI(t, "my secret")
+	var copied string
+	c.copy = func(s string) error {
+		copied = s
+		return nil
+	}
+
+	require.NoError(t, c.run(context.Background(), []string{"send", "-copy"}))
+	assert.Equal(t, strings.TrimSpace(stdout.String()), copied)
+}
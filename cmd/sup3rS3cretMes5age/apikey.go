@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/algolia/sup3rS3cretMes5age/internal"
+)
+
+// apiKeyUsage describes the api-key command.
+const apiKeyUsage = `Usage:
+  sup3rS3cretMes5age api-key mint -label <label> [-rate-limit 100/1m] [-max-ttl 24h] [-max-size 1M] [-file <path>]
+  sup3rS3cretMes5age api-key revoke [-file <path>] <id>
+  sup3rS3cretMes5age api-key list [-file <path>]
+
+The keys file defaults to ` + internal.APIKeysFileVarenv + `. The server reloads it when it changes.
+`
+
+// apiKey runs the api-key command with args, minting, revoking or listing the API keys
+// of the keys file, and returns the exit code.
+func apiKey(args []string, getenv func(string) string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || (args[0] != "mint" && args[0] != "revoke" && args[0] != "list") {
+		_, _ = fmt.Fprint(stderr, apiKeyUsage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("api-key "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", getenv(internal.APIKeysFileVarenv), "API keys file (env "+internal.APIKeysFileVarenv+")")
+	var opts internal.APIKeyOptions
+	if args[0] == "mint" {
+		fs.StringVar(&opts.Label, "label", "", "label of the key, recorded in the audit log (required)")
+		fs.StringVar(&opts.RateLimit, "rate-limit", "", "rate limit of the key (e.g. 100/1m), the route group limits apply per key when empty")
+		fs.StringVar(&opts.MaxTTL, "max-ttl", "", "maximum time-to-live of the secrets created with the key (e.g. 24h)")
+		fs.StringVar(&opts.MaxSize, "max-size", "", "maximum size of the messages and files created with the key (e.g. 1M)")
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *file == "" {
+		_, _ = fmt.Fprintf(stderr, "API keys file required: set -file or %s\n", internal.APIKeysFileVarenv)
+		return 2
+	}
+
+	switch {
+	case args[0] == "mint" && fs.NArg() == 0:
+		key, k, err := internal.MintAPIKey(*file, opts)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "API key error: %v\n", err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(stderr, "Minted API key %s (%s). Store it now: it cannot be shown again.\n", k.ID, k.Label)
+		_, _ = fmt.Fprintln(stdout, key)
+	case args[0] == "revoke" && fs.NArg() == 1:
+		if err := internal.RevokeAPIKey(*file, fs.Arg(0)); err != nil {
+			_, _ = fmt.Fprintf(stderr, "API key error: %v\n", err)
+			return 1
+		}
+		_, _ = fmt.Fprintf(stderr, "Revoked API key %s\n", fs.Arg(0))
+	case args[0] == "list" && fs.NArg() == 0:
+		keys, err := internal.ReadAPIKeys(*file)
+		if err == nil {
+			err = internal.WriteAPIKeys(stdout, keys)
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "API key error: %v\n", err)
+			return 1
+		}
+	default:
+		_, _ = fmt.Fprint(stderr, apiKeyUsage)
+		return 2
+	}
+	return 0
+}
@@ -6,6 +6,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -18,17 +19,57 @@ import (
 var version = ""
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "api-key" {
+		os.Exit(apiKey(os.Args[2:], os.Getenv, os.Stdout, os.Stderr))
+	}
+
 	versionFlag := flag.Bool("version", false, "Print version")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration, print it (secrets redacted) and exit")
+	configFile := flag.String("config", "", "Configuration file (env "+internal.ConfigFileVarenv+")")
+	verifyAuditLog := flag.String("verify-audit-log", "", "Verify the hash chain of an audit log file, keyed with env "+internal.AuditChainKeyVarenv+", and exit")
+	configFlags := internal.RegisterConfigFlags(flag.CommandLine)
 	flag.Parse()
 	if *versionFlag {
 		fmt.Println(version)
 		os.Exit(0)
 	}
-	// Load configuration
-	conf := internal.LoadConfig()
+
+	if *verifyAuditLog != "" {
+		os.Exit(verifyAudit(*verifyAuditLog))
+	}
+
+	// Load configuration: flags > environment > configuration file > defaults
+	conf, err := internal.LoadConfig(*configFile, os.Getenv, configFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+		os.Exit(2)
+	}
+	if *checkConfig {
+		if err := internal.WriteConfig(os.Stdout, conf); err != nil {
+			fmt.Fprintf(os.Stderr, "Configuration error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	slog.SetDefault(internal.NewLogger(os.Stderr, conf))
+	internal.LogConfig(conf)
+
+	shutdownTracing, err := internal.SetupTracing(context.Background(), conf, version)
+	if err != nil {
+		slog.Error("Unable to set up tracing", "error", err)
+		os.Exit(1)
+	}
+
+	audit, err := internal.OpenAuditLog(conf)
+	if err != nil {
+		slog.Error("Unable to open audit log", "error", err)
+		os.Exit(1)
+	}
+	defer func() { _ = audit.Close() }()
 
 	// Create server with handlers
-	handlers := internal.NewSecretHandlers(internal.NewVault("", conf.VaultPrefix, ""))
+	handlers := internal.NewSecretHandlers(internal.NewVault(conf.VaultAddress, conf.VaultPrefix, conf.VaultToken))
+	handlers.SetAuditLog(audit)
 	server := internal.NewServer(conf, handlers)
 
 	// Setup graceful shutdown
@@ -41,26 +82,56 @@ func main() {
 	// Start server in goroutine
 	go func() {
 		if err := server.Start(ctx); err != nil {
-			fmt.Fprintf(os.Stderr, "Server error: %v\n", err)
+			slog.Error("Server error", "error", err)
 			os.Exit(1)
 		}
 	}()
 
 	// Wait for interrupt signal
 	<-sigChan
-	fmt.Println("\nShutting down gracefully...")
-
-	// Cancel context to signal server to stop
-	cancel()
+	slog.Info("Shutting down gracefully")
 
 	// Give server 10 seconds to finish existing requests
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		fmt.Fprintf(os.Stderr, "Shutdown error: %v\n", err)
+	// Shut down before canceling the context, whose cancellation makes Start shut down
+	// the server without a timeout.
+	err = server.Shutdown(shutdownCtx)
+	cancel()
+	if err != nil {
+		slog.Error("Shutdown error", "error", err)
 		os.Exit(1)
 	}
+	// Flush pending spans
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Tracing shutdown error", "error", err)
+	}
 
-	fmt.Println("Server stopped successfully")
+	slog.Info("Server stopped successfully")
+}
+
+// verifyAudit checks the hash chain of the audit log file at path, keyed with the chain key
+// of the environment, and returns the exit code.
+func verifyAudit(path string) int {
+	key := os.Getenv(internal.AuditChainKeyVarenv)
+	if key == "" {
+		fmt.Fprintf(os.Stderr, "Audit log error: %s must be set to the chain key of the log\n", internal.AuditChainKeyVarenv)
+		return 1
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log error: %v\n", err)
+		return 1
+	}
+	defer func() { _ = f.Close() }()
+
+	n, err := internal.VerifyAuditLog(f, []byte(key))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log verification failed after %d valid entries: %v\n", n, err)
+		return 1
+	}
+	fmt.Printf("Audit log OK: %d entries\n", n)
+	return 0
 }
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+)
+
+// maxRecipients bounds the number of recipients and groups of a secret, and the number of
+// networks it can be retrieved from, which are kept in the storage backend alongside it.
+const maxRecipients = 50
+
+// AccessPolicy restricts who can retrieve a secret. A secret without recipients, groups nor
+// networks can be retrieved by anyone holding its token.
+type AccessPolicy struct {
+	// Recipients are the email addresses of the users allowed to retrieve the secret, in lower case.
+	Recipients []string `json:"recipients,omitempty"`
+	// Groups are the groups whose members are allowed to retrieve the secret.
+	Groups []string `json:"groups,omitempty"`
+	// CIDRs are the networks the secret can be retrieved from, whoever the client is.
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+// restricted reports whether p limits who can retrieve a secret.
+func (p AccessPolicy) restricted() bool {
+	return p.hasRecipients() || len(p.CIDRs) > 0
+}
+
+// hasRecipients reports whether p restricts a secret to recipients, who must log in.
+func (p AccessPolicy) hasRecipients() bool {
+	return len(p.Recipients) > 0 || len(p.Groups) > 0
+}
+
+// allows reports whether the client id can retrieve a secret restricted by p. Only users
+// logged in with OpenID Connect can match a policy with recipients, by their verified email
+// address or one of their groups. The networks of p are checked by allowsIP.
+func (p AccessPolicy) allows(id *Identity) bool {
+	if !p.hasRecipients() {
+		return true
+	}
+	if id == nil || id.Method != IdentityOIDC {
+		return false
+	}
+	if id.Email != "" && slices.Contains(p.Recipients, strings.ToLower(id.Email)) {
+		return true
+	}
+	for _, g := range id.Groups {
+		if slices.Contains(p.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIP reports whether a secret restricted by p can be retrieved from the IP address ip.
+func (p AccessPolicy) allowsIP(ip string) bool {
+	if len(p.CIDRs) == 0 {
+		return true
+	}
+	// The networks were validated by parseAccessPolicy.
+	nets, _ := parseNetworks(p.CIDRs)
+	return ipNetworks{allowed: nets}.allows(ip)
+}
+
+// parseAccessPolicy parses the recipients, groups and networks (CIDRs or IP addresses) of a
+// creation request, given as comma or whitespace separated lists.
+func parseAccessPolicy(recipients, groups, cidrs string) (AccessPolicy, error) {
+	p := AccessPolicy{Recipients: splitList(strings.ToLower(recipients)), Groups: splitList(groups)}
+	if len(p.Recipients)+len(p.Groups) > maxRecipients {
+		return AccessPolicy{}, fmt.Errorf("too many recipients, the maximum is %d", maxRecipients)
+	}
+	for _, r := range p.Recipients {
+		if a, err := mail.ParseAddress(r); err != nil || a.Address != r {
+			return AccessPolicy{}, errors.New("invalid recipient email address")
+		}
+	}
+
+	nets, err := parseNetworks(splitList(cidrs))
+	if err != nil {
+		return AccessPolicy{}, fmt.Errorf("invalid allowed networks: %w", err)
+	}
+	if len(nets) > maxRecipients {
+		return AccessPolicy{}, fmt.Errorf("too many allowed networks, the maximum is %d", maxRecipients)
+	}
+	for _, n := range nets {
+		// Keep the canonical form, so that "10.1.2.3/8" is stored as "10.0.0.0/8".
+		if c := n.String(); !slices.Contains(p.CIDRs, c) {
+			p.CIDRs = append(p.CIDRs, c)
+		}
+	}
+	return p, nil
+}
+
+// splitList splits a comma or whitespace separated list, dropping duplicates.
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' || r == '\r' }) {
+		if !slices.Contains(values, v) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// validateAccessPolicy checks that the restrictions of p can be enforced: the storage
+// backend must keep policies, and recipients must log in with OpenID Connect to prove who
+// they are.
+func (s SecretHandlers) validateAccessPolicy(p AccessPolicy) error {
+	if !p.restricted() {
+		return nil
+	}
+	if p.hasRecipients() && s.auth == nil {
+		return errors.New("recipient restrictions require single sign-on")
+	}
+	if _, ok := s.store.(PolicyStorer); !ok {
+		if !p.hasRecipients() {
+			return errors.New("network restrictions not supported")
+		}
+		return errors.New("recipient restrictions not supported")
+	}
+	return nil
+}
+
+// supportsAccessPolicies reports whether secrets can be restricted to recipients.
+func (s SecretHandlers) supportsAccessPolicies() bool {
+	return s.supportsNetworkPolicies() && s.auth != nil
+}
+
+// supportsNetworkPolicies reports whether secrets can be restricted to networks.
+func (s SecretHandlers) supportsNetworkPolicies() bool {
+	_, ok := s.store.(PolicyStorer)
+	return ok
+}
+
+// Errors returned by checkAccess when a client is not allowed to retrieve a secret.
+var (
+	// errLoginRequired is returned to anonymous clients, who should log in.
+	errLoginRequired = errors.New("login required")
+	// errNotRecipient is returned to users who are not among the recipients of the secret.
+	errNotRecipient = errors.New("you are not a recipient of this secret")
+	// errNetworkNotAllowed is returned to the clients outside of the networks of the secret.
+	errNetworkNotAllowed = errors.New("this secret cannot be retrieved from your network")
+)
+
+// checkAccess returns errNetworkNotAllowed, errLoginRequired or errNotRecipient when the
+// client of ctx is not allowed to retrieve the secret identified by token, or the storage
+// error when its policy cannot be read. The secret is never consumed. It returns nil for
+// storage backends without access policies.
+func (s SecretHandlers) checkAccess(ctx context.Context, token string) error {
+	ps, ok := s.store.(PolicyStorer)
+	if !ok {
+		return nil
+	}
+	policy, err := observeStorage(ctx, "policy", func(ctx context.Context) (AccessPolicy, error) {
+		return ps.Policy(ctx, token)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !policy.allowsIP(clientIPFrom(ctx)) {
+		loggerFrom(ctx).Info("Secret retrieval denied", "reason", "network")
+		return errNetworkNotAllowed
+	}
+
+	id := identityFrom(ctx)
+	if policy.allows(id) {
+		return nil
+	}
+	if id == nil {
+		return errLoginRequired
+	}
+	loggerFrom(ctx).Info("Secret retrieval denied", "reason", "recipient", "subject", id.Subject)
+	return errNotRecipient
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseAccessPolicy(t *testing.T) {
+	p, err := parseAccessPolicy(" Bob@Example.com, carol@example.com\nbob@example.com ", "eng ops,eng", "")
+	require.NoError(t, err)
+	assert.Equal(t, AccessPolicy{Recipients: []string{"bob@example.com", "carol@example.com"}, Groups: []string{"eng", "ops"}}, p)
+
+	p, err = parseAccessPolicy("", "", "")
+	require.NoError(t, err)
+	assert.False(t, p.restricted())
+
+	_, err = parseAccessPolicy("bob", "", "")
+	assert.ErrorContains(t, err, "invalid recipient")
+	_, err = parseAccessPolicy("Bob <bob@example.com>", "", "")
+	assert.ErrorContains(t, err, "invalid recipient")
+
+	groups := make([]string, maxRecipients+1)
+	for i := range groups {
+		groups[i] = "group-" + strconv.Itoa(i)
+	}
+	_, err = parseAccessPolicy("", strings.Join(groups, ","), "")
+	assert.ErrorContains(t, err, "too many recipients")
+
+	p, err = parseAccessPolicy("", "", "10.1.2.3/8, 192.0.2.1 10.0.0.0/8 2001:db8::/32")
+	require.NoError(t, err)
+	assert.Equal(t, AccessPolicy{CIDRs: []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32"}}, p)
+	assert.True(t, p.restricted())
+	_, err = parseAccessPolicy("", "", "10.0.0.0/33")
+	assert.ErrorContains(t, err, "invalid allowed networks")
+}
+
+func TestAccessPolicyAllows(t *testing.T) {
+	p := AccessPolicy{Recipients: []string{"bob@example.com"}, Groups: []string{"ops"}}
+
+	assert.True(t, AccessPolicy{}.allows(nil), "unrestricted secrets can be retrieved by anyone")
+	assert.False(t, p.allows(nil))
+	assert.True(t, p.allows(&Identity{Subject: "bob@example.com", Method: IdentityOIDC, Email: "Bob@example.com"}))
+	assert.True(t, p.allows(&Identity{Subject: "dave@example.com", Method: IdentityOIDC, Email: "dave@example.com", Groups: []string{"eng", "ops"}}))
+	assert.False(t, p.allows(&Identity{Subject: "carol@example.com", Method: IdentityOIDC, Email: "carol@example.com", Groups: []string{"eng"}}))
+	assert.False(t, p.allows(&Identity{Subject: "bob@example.com", Method: IdentityOIDC}), "unverified addresses do not match")
+	assert.False(t, p.allows(&Identity{Subject: "bob@example.com", Method: "api-key", Email: "bob@example.com"}),
+		"only users logged in with single sign-on match")
+}
+
+func TestAccessPolicyAllowsIP(t *testing.T) {
+	p := AccessPolicy{CIDRs: []string{"10.0.0.0/8", "2001:db8::/32"}}
+
+	assert.True(t, AccessPolicy{}.allowsIP("203.0.113.7"))
+	assert.True(t, p.allowsIP("10.1.2.3"))
+	assert.True(t, p.allowsIP("2001:db8::1"))
+	assert.False(t, p.allowsIP("203.0.113.7"))
+	assert.False(t, p.allowsIP(""), "unknown addresses are denied")
+	assert.True(t, p.allows(nil), "networks do not require a login")
+}
+
+func TestNetworkRestrictedSecret(t *testing.T) {
+	cnf := conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}
+	server := NewServer(cnf, NewSecretHandlers(NewMemoryStore()))
+
+	var limits api.Limits
+	rec := serve(server, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &limits))
+	assert.True(t, limits.NetworkRestrictions, "networks do not require single sign-on")
+
+	rec = createSecret(t, server, map[string]string{api.FieldAllowedCIDRs: "10.0.0.0/8"})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var tr TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+
+	rec = serve(server, retrieveRequest(server, tr.Token))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "cannot be retrieved from your network")
+	assert.Contains(t, rec.Body.String(), `"code":"`+api.ErrorCodeNetworkNotAllowed+`"`)
+
+	req := retrieveRequest(server, tr.Token)
+	req.RemoteAddr = "10.1.2.3:1234"
+	rec = serve(server, req)
+	assert.Equal(t, http.StatusOK, rec.Code, "denied attempts do not consume the secret")
+	assert.Contains(t, rec.Body.String(), "my secret")
+
+	rec = createSecret(t, server, map[string]string{api.FieldAllowedCIDRs: "10.0.0.0/33"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	server = NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	rec = createSecret(t, server, map[string]string{api.FieldAllowedCIDRs: "10.0.0.0/8"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "network restrictions not supported")
+}
+
+func TestRestrictedSecret(t *testing.T) {
+	p := newMockOIDCProvider(t, nil)
+	store := NewMemoryStore()
+	server := NewServer(oidcTestConfig(p), NewSecretHandlers(store))
+
+	alice := loginAs(t, server, p, map[string]any{"email": "alice@example.com"})
+	bob := loginAs(t, server, p, map[string]any{"email": "bob@example.com"})
+	carol := loginAs(t, server, p, map[string]any{"email": "carol@example.com", "groups": []string{"eng"}})
+	mallory := loginAs(t, server, p, map[string]any{"email": "bob@example.com", "email_verified": false, "sub": "mallory"})
+	trudy := loginAs(t, server, p, map[string]any{"email": "bob@example.com", "email_verified": nil, "sub": "trudy"})
+
+	rec := createSecret(t, server, map[string]string{api.FieldRecipients: "bob@example.com"}, withCookies(alice))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var tr TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+
+	rec = serve(server, retrieveRequest(server, tr.Token))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "anonymous clients must log in")
+	rec = serve(server, retrieveRequest(server, tr.Token), carol)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "not a recipient")
+	assert.Contains(t, rec.Body.String(), `"code":"`+api.ErrorCodeNotRecipient+`"`)
+	rec = serve(server, retrieveRequest(server, tr.Token), mallory)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "unverified addresses do not match")
+	rec = serve(server, retrieveRequest(server, tr.Token), trudy)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "addresses without verification claim do not match")
+
+	rec = serve(server, retrieveRequest(server, tr.Token), bob)
+	assert.Equal(t, http.StatusOK, rec.Code, "denied attempts do not consume the secret")
+	assert.Contains(t, rec.Body.String(), "my secret")
+	rec = serve(server, retrieveRequest(server, tr.Token), bob)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = createSecret(t, server, map[string]string{api.FieldRecipientGroups: "eng"}, withCookies(alice))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+	rec = serve(server, retrieveRequest(server, tr.Token), bob)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = serve(server, retrieveRequest(server, tr.Token), carol)
+	assert.Equal(t, http.StatusOK, rec.Code, "group members are recipients")
+
+	rec = createSecret(t, server, map[string]string{api.FieldRecipients: "not an address"}, withCookies(alice))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestRestrictedSecretRequiresSingleSignOn(t *testing.T) {
+	cnf := conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}
+	server := NewServer(cnf, NewSecretHandlers(NewMemoryStore()))
+	rec := createSecret(t, server, map[string]string{api.FieldRecipients: "bob@example.com"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "require single sign-on")
+
+	var limits api.Limits
+	rec = serve(server, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &limits))
+	assert.False(t, limits.RecipientRestrictions)
+
+	p := newMockOIDCProvider(t, nil)
+	server = NewServer(oidcTestConfig(p), NewSecretHandlers(&FakeSecretMsgStorer{}))
+	alice := loginAs(t, server, p, map[string]any{"email": "alice@example.com"})
+	rec = createSecret(t, server, map[string]string{api.FieldRecipients: "bob@example.com"}, withCookies(alice))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "not supported")
+
+	server = NewServer(oidcTestConfig(p), NewSecretHandlers(NewMemoryStore()))
+	rec = serve(server, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &limits))
+	assert.True(t, limits.RecipientRestrictions)
+}
+
+func TestGRPCRestrictedSecret(t *testing.T) {
+	store := NewMemoryStore()
+	token, err := store.StoreWithPolicy(t.Context(), "secret", "1h", 1, AccessPolicy{Recipients: []string{"bob@example.com"}})
+	require.NoError(t, err)
+
+	client := newTestGRPCClient(t, store)
+	_, err = client.GetSecret(t.Context(), &secretv1.GetSecretRequest{Token: token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	msg, err := store.Get(t.Context(), token)
+	require.NoError(t, err, "denied attempts do not consume the secret")
+	assert.Equal(t, "secret", msg)
+
+	token, err = store.StoreWithPolicy(t.Context(), "secret", "1h", 1, AccessPolicy{CIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	_, err = client.GetSecret(t.Context(), &secretv1.GetSecretRequest{Token: token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "network")
+}
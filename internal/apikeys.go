@@ -0,0 +1,420 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// API key settings.
+const (
+	// apiKeyPrefix starts the API keys, followed by their ID and their secret part, separated
+	// by underscores, e.g. "sup3r_3f9a1c2b7d4e_<secret>".
+	apiKeyPrefix = "sup3r_"
+	// apiKeysReloadInterval is how often the keys file is checked for changes, so that minted
+	// and revoked keys are taken into account without restarting.
+	apiKeysReloadInterval = 5 * time.Second
+)
+
+// APIKey describes an API key, identifying a program such as a CI pipeline. Only the hash
+// of the key is kept: the key itself is shown once, when minted.
+type APIKey struct {
+	// ID identifies the key. It is part of the key, and is not secret.
+	ID string
+	// Hash is the hex encoded SHA-256 of the key.
+	Hash string
+	// Label describes the key, e.g. the name of the pipeline using it. It is recorded in the
+	// audit log.
+	Label string
+	// RateLimit is the rate limit of the requests made with the key. The limits of the route
+	// groups apply, per key instead of per client IP address, when zero.
+	RateLimit RateLimit
+	// MaxTTL caps the time-to-live of the secrets created with the key, when not zero.
+	MaxTTL time.Duration
+	// MaxSize caps the size of the messages and files created with the key, in bytes, when not zero.
+	MaxSize int64
+	// CreatedAt is when the key was minted.
+	CreatedAt time.Time
+}
+
+// apiKeyRecord is an APIKey as written in the keys file.
+type apiKeyRecord struct {
+	ID        string    `yaml:"id"`
+	Hash      string    `yaml:"hash"`
+	Label     string    `yaml:"label"`
+	RateLimit string    `yaml:"rate_limit,omitempty"`
+	MaxTTL    string    `yaml:"max_ttl,omitempty"`
+	MaxSize   string    `yaml:"max_size,omitempty"`
+	CreatedAt time.Time `yaml:"created_at"`
+}
+
+// apiKeysFile is the content of the keys file.
+type apiKeysFile struct {
+	Keys []apiKeyRecord `yaml:"keys"`
+}
+
+// record returns k as written in the keys file.
+func (k APIKey) record() apiKeyRecord {
+	r := apiKeyRecord{ID: k.ID, Hash: k.Hash, Label: k.Label, CreatedAt: k.CreatedAt}
+	if k.RateLimit != (RateLimit{}) {
+		r.RateLimit = k.RateLimit.String()
+	}
+	if k.MaxTTL != 0 {
+		r.MaxTTL = k.MaxTTL.String()
+	}
+	if k.MaxSize != 0 {
+		r.MaxSize = formatSize(k.MaxSize)
+	}
+	return r
+}
+
+// apiKey parses a key of the keys file.
+func (r apiKeyRecord) apiKey() (APIKey, error) {
+	k := APIKey{ID: r.ID, Hash: r.Hash, Label: r.Label, CreatedAt: r.CreatedAt}
+	if r.ID == "" || len(r.Hash) != 2*sha256.Size {
+		return APIKey{}, errors.New("API keys must have an ID and a SHA-256 hash")
+	}
+	var err error
+	if r.RateLimit != "" {
+		if k.RateLimit, err = parseRateLimit(r.RateLimit); err != nil {
+			return APIKey{}, fmt.Errorf("key %s: %w", r.ID, err)
+		}
+	}
+	if r.MaxTTL != "" {
+		if k.MaxTTL, err = time.ParseDuration(r.MaxTTL); err != nil || k.MaxTTL <= 0 {
+			return APIKey{}, fmt.Errorf("key %s: invalid max TTL %q", r.ID, r.MaxTTL)
+		}
+	}
+	if r.MaxSize != "" {
+		if k.MaxSize, err = parseSize(r.MaxSize); err != nil || k.MaxSize == 0 {
+			return APIKey{}, fmt.Errorf("key %s: invalid max size %q", r.ID, r.MaxSize)
+		}
+	}
+	return k, nil
+}
+
+// ReadAPIKeys returns the API keys of the keys file at path. A missing file has no keys.
+func ReadAPIKeys(path string) ([]APIKey, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading API keys file: %w", err)
+	}
+
+	var f apiKeysFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && len(bytes.TrimSpace(b)) > 0 {
+		return nil, fmt.Errorf("parsing API keys file %s: %w", path, err)
+	}
+
+	keys := make([]APIKey, 0, len(f.Keys))
+	for _, r := range f.Keys {
+		k, err := r.apiKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid API keys file %s: %w", path, err)
+		}
+		if slices.ContainsFunc(keys, func(other APIKey) bool { return other.ID == k.ID }) {
+			return nil, fmt.Errorf("invalid API keys file %s: duplicate key %s", path, k.ID)
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// checkAPIKey returns an error when the limits of the API key k cannot be applied within l,
+// e.g. when its max TTL is shorter than the min TTL, so that no secret could be created with it.
+func (l Limits) checkAPIKey(k APIKey) error {
+	if k.MaxTTL != 0 && k.MaxTTL < l.MinTTL {
+		return fmt.Errorf("key %s: max TTL %s shorter than the min TTL %s", k.ID, k.MaxTTL, l.MinTTL)
+	}
+	return nil
+}
+
+// writeAPIKeys replaces the keys file at path, readable by its owner only.
+func writeAPIKeys(path string, keys []APIKey) error {
+	f := apiKeysFile{Keys: make([]apiKeyRecord, len(keys))}
+	for i, k := range keys {
+		f.Keys[i] = k.record()
+	}
+	b, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// Write a temporary file and rename it, so that the server never reads a partial file.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".apikeys-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// APIKeyOptions are the settings of a new API key, in the format of the keys file.
+type APIKeyOptions struct {
+	// Label describes the key (required).
+	Label string
+	// RateLimit is the rate limit of the key in the "<limit>/<period>" format (e.g. "100/1m").
+	RateLimit string
+	// MaxTTL caps the time-to-live of the secrets created with the key (e.g. "24h").
+	MaxTTL string
+	// MaxSize caps the size of the messages and files created with the key (e.g. "1M").
+	MaxSize string
+}
+
+// MintAPIKey generates a new API key with the given options and adds its hash to the keys
+// file at path, created if needed. It returns the key, to give to its user: it cannot be
+// recovered afterwards.
+func MintAPIKey(path string, opts APIKeyOptions) (string, APIKey, error) {
+	if opts.Label == "" {
+		return "", APIKey{}, errors.New("API keys must have a label")
+	}
+	keys, err := ReadAPIKeys(path)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	id := make([]byte, 6)
+	_, _ = rand.Read(id)
+	r := apiKeyRecord{
+		ID:        hex.EncodeToString(id),
+		Label:     opts.Label,
+		RateLimit: opts.RateLimit,
+		MaxTTL:    opts.MaxTTL,
+		MaxSize:   opts.MaxSize,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+	}
+	key := apiKeyPrefix + r.ID + "_" + rand.Text()
+	r.Hash = hashAPIKey(key)
+	k, err := r.apiKey()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	if err := writeAPIKeys(path, append(keys, k)); err != nil {
+		return "", APIKey{}, fmt.Errorf("writing API keys file: %w", err)
+	}
+	return key, k, nil
+}
+
+// RevokeAPIKey removes the API key identified by id from the keys file at path.
+func RevokeAPIKey(path, id string) error {
+	keys, err := ReadAPIKeys(path)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(keys, func(k APIKey) bool { return k.ID == id })
+	if i < 0 {
+		return fmt.Errorf("API key %s not found", id)
+	}
+	if err := writeAPIKeys(path, slices.Delete(keys, i, i+1)); err != nil {
+		return fmt.Errorf("writing API keys file: %w", err)
+	}
+	return nil
+}
+
+// WriteAPIKeys writes a table describing keys to w, without their hashes.
+func WriteAPIKeys(w io.Writer, keys []APIKey) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tLABEL\tCREATED\tRATE LIMIT\tMAX TTL\tMAX SIZE")
+	for _, k := range keys {
+		r := k.record()
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Label, r.CreatedAt.Format(time.RFC3339),
+			orDash(r.RateLimit), orDash(r.MaxTTL), orDash(r.MaxSize))
+	}
+	return tw.Flush()
+}
+
+// orDash returns s, or "-" when it is empty.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// hashAPIKey returns the hex encoded SHA-256 of key. Keys are random, so that a fast hash
+// is enough to protect them.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiKeys authenticates the clients sending an API key, checking them against the keys
+// file, which is reloaded when it changes.
+type apiKeys struct {
+	path string
+	// limits are the limits of the server, which the limits of the keys must fit in.
+	limits Limits
+	now    func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]APIKey
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newAPIKeys returns the API keys of the keys file configured by cnf, or nil when API keys
+// are disabled. An invalid file is logged, and no key is accepted until it is fixed. Keys
+// whose limits do not fit in those of cnf are logged and rejected.
+func newAPIKeys(cnf conf) *apiKeys {
+	if cnf.APIKeysFile == "" {
+		return nil
+	}
+	a := &apiKeys{path: cnf.APIKeysFile, limits: cnf.Limits.orDefault(), now: time.Now}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reload()
+	return a
+}
+
+// reload reads the keys file when it changed since it was last read. The caller must hold a.mu.
+func (a *apiKeys) reload() {
+	a.lastCheck = a.now()
+	info, err := os.Stat(a.path)
+	var modTime time.Time
+	if err == nil {
+		modTime = info.ModTime()
+	}
+	if a.keys != nil && modTime.Equal(a.modTime) {
+		return
+	}
+
+	keys, err := ReadAPIKeys(a.path)
+	if err != nil {
+		slog.Error("Unable to load the API keys, rejecting them", "error", err)
+		keys = nil
+	}
+	a.keys = make(map[string]APIKey, len(keys))
+	for _, k := range keys {
+		if err := a.limits.checkAPIKey(k); err != nil {
+			slog.Error("Invalid API key, rejecting it", "id", k.ID, "label", k.Label, "error", err)
+			continue
+		}
+		a.keys[k.ID] = k
+	}
+	a.modTime = modTime
+	slog.Info("API keys loaded", "keys", len(a.keys))
+}
+
+// authenticate returns the API key matching key, or nil if it is not a valid key.
+func (a *apiKeys) authenticate(key string) *APIKey {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return nil
+	}
+	id, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil
+	}
+
+	a.mu.Lock()
+	if a.now().Sub(a.lastCheck) >= apiKeysReloadInterval {
+		a.reload()
+	}
+	k, ok := a.keys[id]
+	a.mu.Unlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(hashAPIKey(key)), []byte(k.Hash)) != 1 {
+		return nil
+	}
+	return &k
+}
+
+// apiKeyMiddleware authenticates the clients sending an API key as a bearer token in the
+// Authorization header, attaching their identity to the request context. Requests with an
+// invalid key are rejected rather than treated as anonymous. It lets all the requests
+// through when a is nil.
+func apiKeyMiddleware(a *apiKeys) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if a == nil || !ok {
+				return next(c)
+			}
+			k := a.authenticate(strings.TrimSpace(key))
+			if k == nil {
+				loggerFrom(c.Request().Context()).Info("Invalid API key")
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid API key")
+			}
+			c.SetRequest(c.Request().WithContext(withIdentity(c.Request().Context(), apiKeyIdentity(k))))
+			return next(c)
+		}
+	}
+}
+
+// grpcAPIKeyInterceptor authenticates the gRPC clients sending an API key as a bearer token
+// in the authorization metadata, like apiKeyMiddleware: calls with an invalid key get an
+// Unauthenticated error. It lets all the calls through when a is nil.
+func grpcAPIKeyInterceptor(a *apiKeys) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		key, ok := strings.CutPrefix(firstMetadata(md, "authorization"), "Bearer ")
+		if a == nil || !ok {
+			return handler(ctx, req)
+		}
+		k := a.authenticate(strings.TrimSpace(key))
+		if k == nil {
+			loggerFrom(ctx).Info("Invalid API key")
+			return nil, status.Error(codes.Unauthenticated, "invalid API key")
+		}
+		return handler(withIdentity(ctx, apiKeyIdentity(k)), req)
+	}
+}
+
+// apiKeyIdentity returns the identity of the clients authenticated with the API key k.
+func apiKeyIdentity(k *APIKey) *Identity {
+	return &Identity{Subject: "api-key:" + k.ID, Method: IdentityAPIKey, APIKey: k, Label: k.Label}
+}
+
+// forAPIKey returns l capped by the limits of the API key k, if not nil.
+func (l Limits) forAPIKey(k *APIKey) Limits {
+	if k == nil {
+		return l
+	}
+	if k.MaxTTL > 0 && k.MaxTTL < l.MaxTTL {
+		l.MaxTTL = k.MaxTTL
+		l.DefaultTTL = min(l.DefaultTTL, k.MaxTTL)
+	}
+	if k.MaxSize > 0 {
+		l.MaxMessageSize = min(l.MaxMessageSize, k.MaxSize)
+		l.MaxFileSize = min(l.MaxFileSize, k.MaxSize)
+	}
+	return l
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMintAndRevokeAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+
+	keys, err := ReadAPIKeys(path)
+	require.NoError(t, err, "a missing file has no keys")
+	assert.Empty(t, keys)
+
+	_, _, err = MintAPIKey(path, APIKeyOptions{})
+	assert.ErrorContains(t, err, "label")
+	_, _, err = MintAPIKey(path, APIKeyOptions{Label: "ci", RateLimit: "fast"})
+	assert.Error(t, err)
+
+	key, k, err := MintAPIKey(path, APIKeyOptions{Label: "ci", RateLimit: "100/1m", MaxTTL: "24h", MaxSize: "1M"})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix+k.ID+"_"))
+	assert.Equal(t, hashAPIKey(key), k.Hash)
+	_, other, err := MintAPIKey(path, APIKeyOptions{Label: "deploy"})
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), key, "only the hash of the key is kept")
+
+	keys, err = ReadAPIKeys(path)
+	require.NoError(t, err)
+	assert.Equal(t, []APIKey{k, other}, keys)
+	assert.Equal(t, RateLimit{Limit: 100, Period: time.Minute}, keys[0].RateLimit)
+	assert.Equal(t, 24*time.Hour, keys[0].MaxTTL)
+	assert.Equal(t, int64(1<<20), keys[0].MaxSize)
+
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteAPIKeys(out, keys))
+	assert.Contains(t, out.String(), "100/1m")
+	assert.Contains(t, out.String(), "deploy")
+	assert.NotContains(t, out.String(), k.Hash)
+
+	require.NoError(t, RevokeAPIKey(path, k.ID))
+	assert.ErrorContains(t, RevokeAPIKey(path, k.ID), "not found")
+	keys, err = ReadAPIKeys(path)
+	require.NoError(t, err)
+	assert.Equal(t, []APIKey{other}, keys)
+}
+
+func TestReadAPIKeysInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"unknown field", "keys:\n  - id: a\n    secret: b\n", "field secret not found"},
+		{"missing hash", "keys:\n  - id: a\n    label: ci\n", "SHA-256 hash"},
+		{"duplicate", "keys:\n  - id: a\n    hash: " + hashAPIKey("a") + "\n  - id: a\n    hash: " + hashAPIKey("b") + "\n", "duplicate key a"},
+		{"invalid max TTL", "keys:\n  - id: a\n    hash: " + hashAPIKey("a") + "\n    max_ttl: forever\n", "invalid max TTL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "apikeys.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+			_, err := ReadAPIKeys(path)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestAPIKeysReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	key, k, err := MintAPIKey(path, APIKeyOptions{Label: "ci"})
+	require.NoError(t, err)
+
+	a := newAPIKeys(conf{APIKeysFile: path})
+	now := a.lastCheck
+	a.now = func() time.Time { return now }
+
+	got := a.authenticate(key)
+	require.NotNil(t, got)
+	assert.Equal(t, k, *got)
+	assert.Nil(t, a.authenticate(key+"x"))
+	assert.Nil(t, a.authenticate(apiKeyPrefix+"unknown_secret"))
+	assert.Nil(t, a.authenticate("not a key"))
+
+	minted, _, err := MintAPIKey(path, APIKeyOptions{Label: "deploy"})
+	require.NoError(t, err)
+	require.NoError(t, RevokeAPIKey(path, k.ID))
+	// Make sure the modification time changes on file systems with a coarse resolution.
+	require.NoError(t, os.Chtimes(path, now, now.Add(time.Second)))
+	assert.NotNil(t, a.authenticate(key), "the file is checked periodically")
+
+	now = now.Add(apiKeysReloadInterval)
+	assert.Nil(t, a.authenticate(key), "revoked keys are rejected")
+	assert.NotNil(t, a.authenticate(minted), "minted keys are accepted")
+
+	require.NoError(t, os.WriteFile(path, []byte("keys: invalid"), 0o600))
+	now = now.Add(apiKeysReloadInterval)
+	assert.Nil(t, a.authenticate(minted), "all keys are rejected while the file is invalid")
+
+	assert.Nil(t, newAPIKeys(conf{}), "API keys are disabled without file")
+}
+
+func TestAPIKeysOutsideLimits(t *testing.T) {
+	logs := captureLogs(t)
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	short, _, err := MintAPIKey(path, APIKeyOptions{Label: "short", MaxTTL: "30s"})
+	require.NoError(t, err)
+	key, _, err := MintAPIKey(path, APIKeyOptions{Label: "ci", MaxTTL: "1h"})
+	require.NoError(t, err)
+
+	cnf := DefaultConfig()
+	cnf.HttpBindingAddress = ":8080"
+	cnf.APIKeysFile = path
+	assert.ErrorContains(t, cnf.Validate(), "max TTL 30s shorter than the min TTL 1m0s")
+	cnf.Limits.MinTTL = 10 * time.Second
+	assert.NoError(t, cnf.Validate(), "the limits of the keys are checked against the configured limits")
+
+	a := newAPIKeys(conf{APIKeysFile: path})
+	assert.Nil(t, a.authenticate(short), "keys outside of the limits are rejected")
+	assert.Equal(t, "short", logs.record(t, "Invalid API key, rejecting it")["label"])
+	assert.NotNil(t, a.authenticate(key), "the other keys are accepted")
+}
+
+func TestAPIKeyCreation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	key, k, err := MintAPIKey(path, APIKeyOptions{Label: "ci", MaxTTL: "1h", MaxSize: "16"})
+	require.NoError(t, err)
+
+	p := newMockOIDCProvider(t, nil)
+	cnf := oidcTestConfig(p)
+	cnf.APIKeysFile = path
+	cnf.Challenge = api.ChallengeProofOfWork
+	cnf.ChallengeDifficulty = 8
+	buf := &bytes.Buffer{}
+	handlers := NewSecretHandlers(&FakeSecretMsgStorer{})
+	handlers.SetAuditLog(NewAuditLog(buf, []byte("salt"), testAuditChainKey))
+	server := NewServer(cnf, handlers)
+
+	rec := createSecret(t, server, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "anonymous clients must log in")
+	rec = createSecret(t, server, nil, withAPIKey(key+"x"))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid API key")
+
+	rec = createSecret(t, server, nil, withAPIKey(key))
+	require.Equal(t, http.StatusOK, rec.Code, "API keys skip the login and the challenge: %s", rec.Body.String())
+	var entry AuditEntry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "api-key:"+k.ID, entry.Creator)
+	assert.Equal(t, "ci", entry.Label)
+
+	rec = createSecret(t, server, map[string]string{api.FieldTTL: "2h"}, withAPIKey(key))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the TTL is capped by the key")
+	rec = createSecret(t, server, map[string]string{api.FieldMsg: strings.Repeat("x", 17)}, withAPIKey(key))
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the size is capped by the key")
+
+	req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+key)
+	var limits api.Limits
+	require.NoError(t, json.Unmarshal(serve(server, req).Body.Bytes(), &limits))
+	assert.Equal(t, int64(3600), limits.MaxTTL)
+	assert.Equal(t, int64(16), limits.MaxMessageSize)
+	ch := getChallenge(t, server)
+	assert.Equal(t, api.ChallengeProofOfWork, ch.Type, "anonymous clients are still challenged")
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	limited, _, err := MintAPIKey(path, APIKeyOptions{Label: "ci", RateLimit: "2/1m"})
+	require.NoError(t, err)
+	other, _, err := MintAPIKey(path, APIKeyOptions{Label: "deploy"})
+	require.NoError(t, err)
+
+	cnf := conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}, APIKeysFile: path}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	for range 2 {
+		assert.Equal(t, http.StatusOK, createSecret(t, server, nil, withAPIKey(limited)).Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, createSecret(t, server, nil, withAPIKey(limited)).Code)
+	assert.Equal(t, http.StatusOK, createSecret(t, server, nil, withAPIKey(other)).Code, "keys are limited separately")
+	assert.Equal(t, http.StatusOK, createSecret(t, server, nil).Code, "the key does not use the limit of its IP address")
+}
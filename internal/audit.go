@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// Audit events of the secret lifecycle.
+const (
+	AuditCreated = "created"
+	AuditRead    = "read"
+	AuditExpired = "expired"
+	AuditRevoked = "revoked"
+)
+
+// Audit log sinks, besides file paths.
+const (
+	AuditSinkStdout = "stdout"
+	AuditSinkSyslog = "syslog"
+)
+
+// AuditEntry is a line of the audit log. It never holds tokens or content: secrets
+// are identified by a salted hash of their token.
+//
+// Entries are hash-chained: Hash covers the entry and the Hash of the previous one
+// (PrevHash), so that modifying, inserting or deleting entries breaks the chain. The chain is
+// keyed with a secret kept apart from the log, so that it cannot be recomputed by whoever
+// can write the log.
+type AuditEntry struct {
+	// Seq is the position of the entry in the log, starting at 1.
+	Seq uint64 `json:"seq"`
+	// Time is when the event was recorded.
+	Time time.Time `json:"time"`
+	// Event is one of AuditCreated, AuditRead, AuditExpired or AuditRevoked.
+	Event string `json:"event"`
+	// TokenHash is the HMAC-SHA256 of the secret token, keyed with the audit salt.
+	TokenHash string `json:"token_hash"`
+	// Kind is the kind of secret created (message or file).
+	Kind string `json:"kind,omitempty"`
+	// Size is the size of the created secret, in bytes.
+	Size int `json:"size,omitempty"`
+	// TTL is the time-to-live of the created secret.
+	TTL string `json:"ttl,omitempty"`
+	// Reads is the number of reads allowed for the created secret.
+	Reads int `json:"reads,omitempty"`
+	// Restricted reports whether the created secret can only be retrieved by its recipients.
+	Restricted bool `json:"restricted,omitempty"`
+	// Creator is the identity of the authenticated creator of the secret, if any.
+	Creator string `json:"creator,omitempty"`
+	// Reader is the identity of the authenticated client who retrieved the secret, if any.
+	Reader string `json:"reader,omitempty"`
+	// Label is the label of the API key of the client who created or retrieved the secret, if any.
+	Label string `json:"label,omitempty"`
+	// ClientIP is the IP address of the client, if the event is caused by a request.
+	ClientIP string `json:"client_ip,omitempty"`
+	// PrevHash is the Hash of the previous entry, empty for the first one.
+	PrevHash string `json:"prev_hash"`
+	// Hash is the HMAC-SHA256 of the entry, with an empty Hash, chained to PrevHash and
+	// keyed with the audit chain key.
+	Hash string `json:"hash"`
+}
+
+// minAuditChainKeyLength is the minimum length of the audit chain key.
+const minAuditChainKeyLength = 32
+
+// computeHash returns the chained hash of e, keyed with key.
+func (e AuditEntry) computeHash(key []byte) (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(e.PrevHash))
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// AuditLog writes the hash-chained audit log of the secret lifecycle events.
+// A nil *AuditLog discards events, so that auditing can be disabled.
+type AuditLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	closer   io.Closer
+	salt     []byte
+	chainKey []byte
+	seq      uint64
+	prevHash string
+	now      func() time.Time
+}
+
+// NewAuditLog returns an audit log writing one JSON entry per line to w. Token hashes are
+// keyed with salt: it must be kept secret and stable to correlate events across restarts.
+// The hash chain is keyed with chainKey, which is required to verify the log.
+func NewAuditLog(w io.Writer, salt, chainKey []byte) *AuditLog {
+	return &AuditLog{w: w, salt: salt, chainKey: chainKey, now: time.Now}
+}
+
+// OpenAuditLog opens the audit log configured by cnf.AuditLog: AuditSinkStdout,
+// AuditSinkSyslog or a file path, the chain of an existing file being continued.
+// It returns a nil AuditLog when auditing is disabled. Without a configured salt,
+// a random one is used, which prevents correlating events across restarts. The chain key
+// is required, see conf.Validate.
+func OpenAuditLog(cnf conf) (*AuditLog, error) {
+	if cnf.AuditLog == "" {
+		return nil, nil
+	}
+
+	salt := []byte(cnf.AuditSalt)
+	if len(salt) == 0 {
+		slog.Warn("No audit salt configured, using a random one: token hashes cannot be correlated across restarts")
+		salt = make([]byte, 32)
+		_, _ = rand.Read(salt)
+	}
+	chainKey := []byte(cnf.AuditChainKey)
+
+	switch cnf.AuditLog {
+	case AuditSinkStdout:
+		return NewAuditLog(os.Stdout, salt, chainKey), nil
+	case AuditSinkSyslog:
+		w, err := openAuditSyslog()
+		if err != nil {
+			return nil, err
+		}
+		a := NewAuditLog(w, salt, chainKey)
+		a.closer = w
+		return a, nil
+	}
+
+	f, err := os.OpenFile(cnf.AuditLog, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := lastAuditEntry(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("reading audit log %s: %w", cnf.AuditLog, err)
+	}
+
+	a := NewAuditLog(f, salt, chainKey)
+	a.closer = f
+	a.seq, a.prevHash = last.Seq, last.Hash
+	return a, nil
+}
+
+// lastAuditEntry returns the last entry of an audit log, or a zero entry if it is empty.
+func lastAuditEntry(r io.Reader) (AuditEntry, error) {
+	var last AuditEntry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return AuditEntry{}, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return last, scanner.Err()
+}
+
+// Close closes the underlying file or syslog connection, if any.
+func (a *AuditLog) Close() error {
+	if a == nil || a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// hashToken returns the salted hash identifying token in the audit log.
+func (a *AuditLog) hashToken(token string) string {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// record appends an entry for the event on the secret identified by token. The other
+// fields of e, such as the size of a created secret, are recorded as is. Failures are
+// logged: they must not prevent serving secrets.
+func (a *AuditLog) record(ctx context.Context, event, token string, e AuditEntry) {
+	if a == nil {
+		return
+	}
+	a.recordHash(ctx, event, a.hashToken(token), e)
+}
+
+// recordHash is record for a secret identified by the hash of its token, see hashToken.
+func (a *AuditLog) recordHash(ctx context.Context, event, tokenHash string, e AuditEntry) {
+	if a == nil {
+		return
+	}
+	e.Event = event
+	e.TokenHash = tokenHash
+	if e.ClientIP == "" {
+		e.ClientIP = clientIPFrom(ctx)
+	}
+
+	if err := a.append(e); err != nil {
+		loggerFrom(ctx).Error("Failed to write audit log", "event", event, "error", err)
+	}
+}
+
+// append chains e to the previous entry and writes it.
+func (a *AuditLog) append(e AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e.Seq = a.seq + 1
+	e.Time = a.now().UTC()
+	e.PrevHash = a.prevHash
+	hash, err := e.computeHash(a.chainKey)
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	a.seq, a.prevHash = e.Seq, e.Hash
+	return nil
+}
+
+// ErrAuditChainBroken is returned by VerifyAuditLog when entries were modified, inserted or deleted.
+var ErrAuditChainBroken = errors.New("audit log chain broken")
+
+// VerifyAuditLog checks the hash chain of an audit log, keyed with chainKey, and returns its
+// number of entries. The first entry may continue a chain, e.g. in a rotated log file.
+// Deleting entries at the end of the log cannot be detected from the log alone: compare the
+// last Seq and Hash with a copy kept elsewhere.
+func VerifyAuditLog(r io.Reader, chainKey []byte) (int, error) {
+	scanner := bufio.NewScanner(r)
+	var prev *AuditEntry
+	n := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		hash, err := e.computeHash(chainKey)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch {
+		case hash != e.Hash:
+			return n, fmt.Errorf("line %d (seq %d): %w: entry hash mismatch", line, e.Seq, ErrAuditChainBroken)
+		case prev != nil && e.Seq != prev.Seq+1:
+			return n, fmt.Errorf("line %d (seq %d): %w: expected seq %d", line, e.Seq, ErrAuditChainBroken, prev.Seq+1)
+		case prev != nil && e.PrevHash != prev.Hash:
+			return n, fmt.Errorf("line %d (seq %d): %w: previous hash mismatch", line, e.Seq, ErrAuditChainBroken)
+		case prev == nil && e.Seq == 1 && e.PrevHash != "":
+			return n, fmt.Errorf("line %d (seq %d): %w: first entry has a previous hash", line, e.Seq, ErrAuditChainBroken)
+		}
+
+		prev = &e
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// clientIPKey is the context key of the client IP address.
+type clientIPKey struct{}
+
+// withClientIP returns a copy of ctx carrying the client IP address.
+func withClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// clientIPFrom returns the client IP address of an HTTP request context, or the peer
+// address of a gRPC call.
+func clientIPFrom(ctx context.Context) string {
+	if ip, ok := ctx.Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
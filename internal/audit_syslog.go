@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package internal
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openAuditSyslog connects to the local syslog daemon, audit entries being sent
+// with the authpriv facility.
+func openAuditSyslog() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTHPRIV, "sup3rS3cretMes5age")
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package internal
+
+import (
+	"errors"
+	"io"
+)
+
+// openAuditSyslog fails: syslog is not available on this platform.
+func openAuditSyslog() (io.WriteCloser, error) {
+	return nil, errors.New("syslog audit log is not supported on this platform")
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAuditChainKey keys the hash chain of the audit logs of the tests.
+var testAuditChainKey = []byte("0123456789abcdef0123456789abcdef")
+
+// auditEntries decodes the entries of an audit log.
+func auditEntries(t *testing.T, log string) []AuditEntry {
+	t.Helper()
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	for scanner.Scan() {
+		var e AuditEntry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLogChain(t *testing.T) {
+	const token = "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+	buf := &bytes.Buffer{}
+	a := NewAuditLog(buf, []byte("salt"), testAuditChainKey)
+
+	a.record(context.Background(), AuditCreated, token, AuditEntry{Kind: kindMessage, Size: 42, TTL: "1h", Reads: 1})
+	a.record(withClientIP(context.Background(), "10.0.0.1"), AuditRead, token, AuditEntry{})
+	a.record(context.Background(), AuditExpired, "hvs.CABAAAAAAQAAAAAAAAAACCCC", AuditEntry{})
+
+	n, err := VerifyAuditLog(strings.NewReader(buf.String()), testAuditChainKey)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.NotContains(t, buf.String(), token)
+
+	entries := auditEntries(t, buf.String())
+	assert.Equal(t, AuditEntry{
+		Seq: 1, Time: entries[0].Time, Event: AuditCreated, TokenHash: entries[0].TokenHash,
+		Kind: kindMessage, Size: 42, TTL: "1h", Reads: 1, Hash: entries[0].Hash,
+	}, entries[0])
+	assert.Equal(t, entries[0].TokenHash, entries[1].TokenHash, "events of a secret can be correlated")
+	assert.NotEqual(t, entries[1].TokenHash, entries[2].TokenHash)
+	assert.NotEqual(t, NewAuditLog(nil, []byte("other salt"), testAuditChainKey).hashToken(token), entries[0].TokenHash)
+	assert.Equal(t, "10.0.0.1", entries[1].ClientIP)
+	assert.Equal(t, entries[1].Hash, entries[2].PrevHash)
+}
+
+func TestVerifyAuditLogDetectsTampering(t *testing.T) {
+	buf := &bytes.Buffer{}
+	a := NewAuditLog(buf, []byte("salt"), testAuditChainKey)
+	for _, event := range []string{AuditCreated, AuditRead, AuditCreated, AuditRevoked} {
+		a.record(context.Background(), event, "hvs.CABAAAAAAQAAAAAAAAAABBBB", AuditEntry{})
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+
+	tests := []struct {
+		name  string
+		lines []string
+		valid int
+	}{
+		{"modified entry", []string{lines[0], strings.Replace(lines[1], `"read"`, `"created"`, 1), lines[2], lines[3]}, 1},
+		{"deleted entry", []string{lines[0], lines[1], lines[3]}, 2},
+		{"reordered entries", []string{lines[0], lines[2], lines[1], lines[3]}, 1},
+		{"duplicated entry", []string{lines[0], lines[1], lines[1], lines[2]}, 2},
+		// The next entry still references the original hash.
+		{"rehashed entry", []string{lines[0], rehash(t, strings.Replace(lines[1], `"read"`, `"revoked"`, 1)), lines[2], lines[3]}, 2},
+		{"renumbered entry", []string{strings.Replace(lines[0], `"seq":1`, `"seq":0`, 1), lines[1]}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := VerifyAuditLog(strings.NewReader(strings.Join(tt.lines, "")), testAuditChainKey)
+			assert.ErrorIs(t, err, ErrAuditChainBroken)
+			assert.Equal(t, tt.valid, n)
+		})
+	}
+
+	// A log forged without the chain key does not verify, even if its chain is consistent.
+	forged := &bytes.Buffer{}
+	f := NewAuditLog(forged, []byte("salt"), []byte("guessed chain key"))
+	f.record(context.Background(), AuditCreated, "hvs.CABAAAAAAQAAAAAAAAAABBBB", AuditEntry{})
+	n, err := VerifyAuditLog(strings.NewReader(forged.String()), testAuditChainKey)
+	assert.ErrorIs(t, err, ErrAuditChainBroken)
+	assert.Equal(t, 0, n)
+
+	// A log may start in the middle of a chain, e.g. after rotation.
+	n, err = VerifyAuditLog(strings.NewReader(strings.Join(lines[2:], "")), testAuditChainKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
+
+// rehash recomputes the hash of an audit log line, as an attacker holding the chain key would
+// after modifying it.
+func rehash(t *testing.T, line string) string {
+	t.Helper()
+	var e AuditEntry
+	require.NoError(t, json.Unmarshal([]byte(line), &e))
+	hash, err := e.computeHash(testAuditChainKey)
+	require.NoError(t, err)
+	e.Hash = hash
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+	return string(b) + "\n"
+}
+
+func TestOpenAuditLogContinuesChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	cnf := conf{AuditLog: path, AuditSalt: "salt", AuditChainKey: string(testAuditChainKey)}
+
+	for i := 0; i < 2; i++ {
+		a, err := OpenAuditLog(cnf)
+		require.NoError(t, err)
+		a.record(context.Background(), AuditCreated, "hvs.CABAAAAAAQAAAAAAAAAABBBB", AuditEntry{})
+		a.record(context.Background(), AuditRead, "hvs.CABAAAAAAQAAAAAAAAAABBBB", AuditEntry{})
+		require.NoError(t, a.Close())
+	}
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+	n, err := VerifyAuditLog(f, testAuditChainKey)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
+
+func TestOpenAuditLogDisabled(t *testing.T) {
+	a, err := OpenAuditLog(conf{})
+	require.NoError(t, err)
+	assert.Nil(t, a)
+	// A nil audit log discards events.
+	a.record(context.Background(), AuditCreated, "hvs.CABAAAAAAQAAAAAAAAAABBBB", AuditEntry{})
+	assert.NoError(t, a.Close())
+}
+
+func TestAuditSecretLifecycle(t *testing.T) {
+	buf := &syncBuffer{}
+	store := NewMemoryStore()
+	handlers := NewSecretHandlers(store)
+	handlers.SetAuditLog(NewAuditLog(buf, []byte("salt"), testAuditChainKey))
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, handlers)
+
+	create := func() string {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		require.NoError(t, writer.WriteField("msg", "my secret"))
+		require.NoError(t, writer.WriteField("ttl", "1h"))
+		require.NoError(t, writer.Close())
+		req := httptest.NewRequest(http.MethodPost, "/secret", body)
+		req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+		req.RemoteAddr = "10.0.0.50:1234"
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var tr TokenResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+		return tr.Token
+	}
+
+	read := create()
+	req := retrieveRequest(server, read)
+	req.RemoteAddr = "10.0.0.51:1234"
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	revoked := create()
+	_, err := (&grpcSecretServer{handlers: handlers}).RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: revoked})
+	require.NoError(t, err)
+
+	expired := create()
+	store.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	_, err = handlers.getMsg(context.Background(), expired)
+	require.Error(t, err)
+
+	a := handlers.audit
+	var events []string
+	for _, e := range auditEntries(t, buf.String()) {
+		switch e.TokenHash {
+		case a.hashToken(read):
+			events = append(events, "read:"+e.Event+"@"+e.ClientIP)
+		case a.hashToken(revoked):
+			events = append(events, "revoked:"+e.Event)
+		case a.hashToken(expired):
+			events = append(events, "expired:"+e.Event)
+		}
+		if e.Event == AuditCreated {
+			assert.Equal(t, kindMessage, e.Kind)
+			assert.Equal(t, len("my secret"), e.Size)
+			assert.Equal(t, "1h", e.TTL)
+		}
+	}
+	assert.Equal(t, []string{
+		"read:created@10.0.0.50", "read:read@10.0.0.51",
+		"revoked:created", "revoked:revoked",
+		"expired:created", "expired:expired",
+	}, events)
+
+	n, err := VerifyAuditLog(strings.NewReader(buf.String()), testAuditChainKey)
+	require.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.NotContains(t, buf.String(), "my secret")
+	assert.Empty(t, tokenPattern.FindAllString(buf.String(), -1))
+}
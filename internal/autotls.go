@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// defaultAutoTLSCacheDir is the directory caching the auto TLS certificates and ACME account
+// key when none is configured.
+const defaultAutoTLSCacheDir = "/var/www/.cache"
+
+// redisAutocertKeyPrefix prefixes the Redis keys of the auto TLS cache.
+const redisAutocertKeyPrefix = "supersecretmessage:autocert:"
+
+// redisAutocertCache is an autocert.Cache keeping the certificates and ACME account key in
+// Redis, shared by all replicas so that they do not each request certificates.
+type redisAutocertCache struct {
+	client redis.UniversalClient
+}
+
+// Get returns the data cached under key, or autocert.ErrCacheMiss.
+func (r redisAutocertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := r.client.Get(ctx, redisAutocertKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return b, err
+}
+
+// Put caches data under key.
+func (r redisAutocertCache) Put(ctx context.Context, key string, data []byte) error {
+	return r.client.Set(ctx, redisAutocertKeyPrefix+key, data, 0).Err()
+}
+
+// Delete removes the data cached under key.
+func (r redisAutocertCache) Delete(ctx context.Context, key string) error {
+	return r.client.Del(ctx, redisAutocertKeyPrefix+key).Err()
+}
+
+// newAutoTLSManager returns the ACME certificate manager configured by cnf, and a function
+// releasing its cache, or nil when auto TLS is disabled. Only cnf.TLSAutoDomain is served.
+// The settings are checked by conf.Validate: invalid ones are logged and ignored.
+func newAutoTLSManager(cnf conf) (*autocert.Manager, func() error) {
+	if cnf.TLSAutoDomain == "" {
+		return nil, func() error { return nil }
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cnf.TLSAutoDomain),
+		Email:      cnf.TLSACMEEmail,
+		Client:     &acme.Client{DirectoryURL: cnf.TLSACMEDirectoryURL},
+	}
+
+	closeCache := func() error { return nil }
+	if cnf.TLSAutoCacheRedisURL != "" {
+		opts, err := redis.ParseURL(cnf.TLSAutoCacheRedisURL)
+		if err != nil {
+			slog.Error("Invalid auto TLS cache Redis URL, using the cache directory", "error", err)
+		} else {
+			client := redis.NewClient(opts)
+			m.Cache, closeCache = redisAutocertCache{client: client}, client.Close
+		}
+	}
+	if m.Cache == nil {
+		dir := cnf.TLSAutoCacheDir
+		if dir == "" {
+			dir = defaultAutoTLSCacheDir
+		}
+		m.Cache = autocert.DirCache(dir)
+	}
+
+	if cnf.TLSACMEEABKeyID != "" {
+		key, err := base64.RawURLEncoding.DecodeString(cnf.TLSACMEEABHMACKey)
+		if err != nil {
+			slog.Error("Invalid ACME external account binding HMAC key, registering without binding", "error", err)
+		} else {
+			m.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: cnf.TLSACMEEABKeyID, Key: key}
+		}
+	}
+	return m, closeCache
+}
+
+// validateAutoTLS checks the auto TLS settings of cnf.
+func (cnf conf) validateAutoTLS() error {
+	var errs []error
+	if cnf.TLSACMEDirectoryURL != "" {
+		if u, err := url.ParseRequestURI(cnf.TLSACMEDirectoryURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+			errs = append(errs, fmt.Errorf("invalid ACME directory URL (tls_acme_directory_url): %q", cnf.TLSACMEDirectoryURL))
+		}
+	}
+	if (cnf.TLSACMEEABKeyID == "") != (cnf.TLSACMEEABHMACKey == "") {
+		errs = append(errs, errors.New("both ACME external account binding key ID (tls_acme_eab_key_id) and HMAC key (tls_acme_eab_hmac_key) must be set"))
+	} else if _, err := base64.RawURLEncoding.DecodeString(cnf.TLSACMEEABHMACKey); err != nil {
+		errs = append(errs, errors.New("ACME external account binding HMAC key (tls_acme_eab_hmac_key) must be base64url encoded"))
+	}
+	if cnf.TLSAutoCacheRedisURL != "" {
+		if _, err := redis.ParseURL(cnf.TLSAutoCacheRedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid auto TLS cache Redis URL (tls_auto_cache_redis_url): %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/letsencrypt/challtestsrv"
+	"github.com/letsencrypt/pebble/v2/ca"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/letsencrypt/pebble/v2/va"
+	"github.com/letsencrypt/pebble/v2/wfe"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Test external account binding of the Pebble ACME server.
+const (
+	testEABKeyID   = "sup3r"
+	testEABHMACKey = "zWNDZM6eQGHWpSRTPal5eIUYFTu7EajVIoguysqZ9wG44nMEtx3MUAsUDkMTQ12W"
+)
+
+// testACMEDomain is the domain of the certificates issued by the test ACME server: autocert
+// only accepts names with a dot, and the mock DNS server resolves all of them to localhost.
+const testACMEDomain = "secrets.sup3r.test"
+
+// startMockDNS starts a DNS server resolving all the names to 127.0.0.1, and returns its address.
+func startMockDNS(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := pc.LocalAddr().String()
+	require.NoError(t, pc.Close())
+
+	logger := log.New(io.Discard, "", 0)
+	srv, err := challtestsrv.New(challtestsrv.Config{Log: logger, DNSAddrs: []string{addr}})
+	require.NoError(t, err)
+	srv.SetDefaultDNSIPv4("127.0.0.1")
+	srv.SetDefaultDNSIPv6("")
+	go srv.Run()
+	t.Cleanup(srv.Shutdown)
+	return addr
+}
+
+// startPebble starts a Pebble ACME server requiring an external account binding, validating
+// the TLS-ALPN-01 challenges on tlsPort of localhost, and returns its directory URL and HTTP client.
+func startPebble(t *testing.T, tlsPort int) (string, *http.Client) {
+	t.Helper()
+	t.Setenv("PEBBLE_VA_NOSLEEP", "1")
+	t.Setenv("PEBBLE_WFE_NONCEREJECT", "0")
+	logger := log.New(io.Discard, "", 0)
+	store := db.NewMemoryStore()
+	require.NoError(t, store.AddExternalAccountKeyByID(testEABKeyID, testEABHMACKey))
+	authority := ca.New(logger, store, "", "ecdsa", 0, 1, map[string]ca.Profile{"default": {}})
+	validation := va.New(logger, 0, tlsPort, false, startMockDNS(t), store)
+	frontend := wfe.New(logger, store, validation, authority, []string{"pebble.letsencrypt.org"}, false, true, 0, 0)
+
+	// The order returned by the finalization has no Location header, which the ACME client
+	// needs to wait for the certificate: point it to the order.
+	handler := frontend.Handler()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutPrefix(r.URL.Path, "/finalize-order/"); ok {
+			w.Header().Set("Location", "https://"+r.Host+"/my-order/"+id)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL + wfe.DirectoryPath, ts.Client()
+}
+
+func TestAutoTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	directoryURL, client := startPebble(t, port)
+
+	cacheDir := t.TempDir()
+	cnf := conf{
+		HttpsBindingAddress: ":" + strconv.Itoa(port),
+		TLSAutoDomain:       testACMEDomain,
+		TLSAutoCacheDir:     cacheDir,
+		TLSACMEDirectoryURL: directoryURL,
+		TLSACMEEABKeyID:     testEABKeyID,
+		TLSACMEEABHMACKey:   testEABHMACKey,
+	}
+	require.NoError(t, cnf.validateAutoTLS())
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	require.NotNil(t, server.autoTLS)
+	server.autoTLS.Client.HTTPClient = client
+
+	getCertificate, err := server.getCertificate(context.Background())
+	require.NoError(t, err)
+	tlsConfig, err := server.tlsConfig(getCertificate)
+	require.NoError(t, err)
+	httpsServer := &http.Server{Handler: server, TLSConfig: tlsConfig}
+	go func() { _ = httpsServer.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = httpsServer.Close() })
+
+	dial := func(serverName string) (*tls.Conn, error) {
+		return tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", ln.Addr().String(),
+			&tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	}
+
+	conn, err := dial(testACMEDomain)
+	require.NoError(t, err, "the certificate is issued by the ACME server")
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	_ = conn.Close()
+	assert.Equal(t, []string{testACMEDomain}, leaf.DNSNames)
+	assert.Contains(t, leaf.Issuer.CommonName, "Pebble")
+	_, err = os.Stat(filepath.Join(cacheDir, testACMEDomain))
+	assert.NoError(t, err, "the certificate is cached")
+
+	_, err = dial("other.example.com")
+	assert.Error(t, err, "only the configured domain is served")
+
+	opts, err := grpcServerOptions(cnf, getCertificate)
+	require.NoError(t, err)
+	gs := newGRPCServer(server.handlers, opts...)
+	grpcLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = gs.Serve(grpcLn) }()
+	t.Cleanup(gs.Stop)
+	grpcConn, err := tls.Dial("tcp", grpcLn.Addr().String(),
+		&tls.Config{ServerName: testACMEDomain, InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	require.NoError(t, err, "the gRPC listener serves TLS")
+	defer func() { _ = grpcConn.Close() }()
+	assert.Equal(t, leaf.SerialNumber, grpcConn.ConnectionState().PeerCertificates[0].SerialNumber,
+		"the gRPC listener serves the auto TLS certificate")
+}
+
+func TestAutoTLSManager(t *testing.T) {
+	m, closeCache := newAutoTLSManager(conf{})
+	assert.Nil(t, m, "auto TLS is disabled without domain")
+	assert.NoError(t, closeCache())
+
+	m, closeCache = newAutoTLSManager(conf{TLSAutoDomain: "secrets.example.com"})
+	defer func() { _ = closeCache() }()
+	assert.Equal(t, autocert.DirCache(defaultAutoTLSCacheDir), m.Cache)
+	assert.Empty(t, m.Client.DirectoryURL, "Let's Encrypt is used by default")
+	assert.Nil(t, m.ExternalAccountBinding)
+	assert.NoError(t, m.HostPolicy(context.Background(), "secrets.example.com"))
+	assert.Error(t, m.HostPolicy(context.Background(), "other.example.com"))
+
+	key, err := base64.RawURLEncoding.DecodeString(testEABHMACKey)
+	require.NoError(t, err)
+	m, closeCache = newAutoTLSManager(conf{
+		TLSAutoDomain:        "secrets.example.com",
+		TLSAutoCacheRedisURL: "redis://" + miniredis.RunT(t).Addr(),
+		TLSACMEDirectoryURL:  "https://acme.example.com/directory",
+		TLSACMEEmail:         "admin@example.com",
+		TLSACMEEABKeyID:      testEABKeyID,
+		TLSACMEEABHMACKey:    testEABHMACKey,
+	})
+	defer func() { _ = closeCache() }()
+	assert.IsType(t, redisAutocertCache{}, m.Cache)
+	assert.Equal(t, "https://acme.example.com/directory", m.Client.DirectoryURL)
+	assert.Equal(t, "admin@example.com", m.Email)
+	assert.Equal(t, testEABKeyID, m.ExternalAccountBinding.KID)
+	assert.Equal(t, key, m.ExternalAccountBinding.Key)
+}
+
+func TestRedisAutocertCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = client.Close() }()
+	cache := redisAutocertCache{client: client}
+	ctx := context.Background()
+
+	_, err := cache.Get(ctx, "secrets.example.com")
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+
+	require.NoError(t, cache.Put(ctx, "secrets.example.com", []byte("certificate")))
+	b, err := cache.Get(ctx, "secrets.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("certificate"), b)
+	assert.True(t, mr.Exists(redisAutocertKeyPrefix+"secrets.example.com"))
+
+	require.NoError(t, cache.Delete(ctx, "secrets.example.com"))
+	_, err = cache.Get(ctx, "secrets.example.com")
+	assert.ErrorIs(t, err, autocert.ErrCacheMiss)
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloadInterval is how often the manual TLS certificate files are checked for changes.
+const certReloadInterval = 10 * time.Second
+
+// certExpiryWarning is how long before its expiry a loaded certificate is logged as a warning.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// certReloader serves the manual TLS certificate, reloading it when its files change or on
+// SIGHUP, so that renewed certificates (e.g. by cert-manager or certbot) are served without
+// restarting. A new certificate only replaces the current one once validated.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime [2]time.Time
+	// failedModTime are the modification times of the files that failed to load last, so
+	// that they are only retried once changed again or on SIGHUP.
+	failedModTime [2]time.Time
+}
+
+// newCertReloader returns a reloader of the certificate and key files at certPath and
+// keyPath, failing when they cannot be loaded.
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath, interval: certReloadInterval, now: time.Now}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modTimes returns the modification times of the certificate and key files, zero when
+// they cannot be read.
+func (r *certReloader) modTimes() [2]time.Time {
+	var times [2]time.Time
+	for i, path := range []string{r.certPath, r.keyPath} {
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// reload loads the certificate and key files, and serves them if they hold a matching key
+// pair whose certificate is currently valid. Otherwise the current certificate is kept.
+func (r *certReloader) reload() (err error) {
+	modTime := r.modTimes()
+	defer func() {
+		if err != nil {
+			r.mu.Lock()
+			r.failedModTime = modTime
+			r.mu.Unlock()
+		}
+	}()
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	now := r.now()
+	if now.Before(cert.Leaf.NotBefore) {
+		return fmt.Errorf("TLS certificate not valid before %s", cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("TLS certificate expired on %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	level := slog.LevelInfo
+	if cert.Leaf.NotAfter.Sub(now) < certExpiryWarning {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "TLS certificate loaded",
+		"subject", cert.Leaf.Subject.String(), "dns_names", cert.Leaf.DNSNames,
+		"not_before", cert.Leaf.NotBefore, "not_after", cert.Leaf.NotAfter)
+	return nil
+}
+
+// changed reports whether the certificate or key file was modified since they were loaded,
+// or since they last failed to load.
+func (r *certReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	modTime := r.modTimes()
+	return modTime != r.modTime && modTime != r.failedModTime
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return r.cert, nil
+}
+
+// watch reloads the certificate when its files change, checked every r.interval, and on
+// SIGHUP, until ctx is done. Reload errors are logged, and files that failed to load are
+// only retried once they change again or on SIGHUP.
+func (r *certReloader) watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(r.interval)
+
+	go func() {
+		defer signal.Stop(hup)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			case <-ticker.C:
+				if !r.changed() {
+					continue
+				}
+			}
+			if err := r.reload(); err != nil {
+				slog.Error("Unable to reload the TLS certificate, keeping the current one", "error", err)
+			}
+		}
+	}()
+}
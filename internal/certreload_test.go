@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servedSerial returns the serial number of the certificate served by r.
+func servedSerial(t *testing.T, r *certReloader) int64 {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+
+	_, err := newCertReloader(certPath, keyPath)
+	assert.Error(t, err, "missing files")
+	expiredCert, expiredKey := selfSignedPEM(t, 1, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	writeCertFiles(t, certPath, keyPath, expiredCert, expiredKey)
+	_, err = newCertReloader(certPath, keyPath)
+	assert.ErrorContains(t, err, "expired")
+
+	cert, key := selfSignedPEM(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	r, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), servedSerial(t, r))
+	assert.False(t, r.changed())
+
+	renewedCert, renewedKey := selfSignedPEM(t, 3, now.Add(-time.Hour), now.Add(24*time.Hour))
+	writeCertFiles(t, certPath, keyPath, renewedCert, renewedKey)
+	assert.True(t, r.changed())
+	require.NoError(t, r.reload())
+	assert.Equal(t, int64(3), servedSerial(t, r))
+	assert.False(t, r.changed())
+
+	otherCert, _ := selfSignedPEM(t, 4, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, otherCert, renewedKey)
+	assert.Error(t, r.reload(), "the key does not match the certificate")
+	assert.Equal(t, int64(3), servedSerial(t, r), "the current certificate is kept")
+	assert.False(t, r.changed(), "files that failed to load are not retried until they change")
+
+	writeCertFiles(t, certPath, keyPath, expiredCert, expiredKey)
+	assert.True(t, r.changed())
+	assert.ErrorContains(t, r.reload(), "expired")
+	assert.Equal(t, int64(3), servedSerial(t, r))
+
+	futureCert, futureKey := selfSignedPEM(t, 5, now.Add(time.Hour), now.Add(2*time.Hour))
+	writeCertFiles(t, certPath, keyPath, futureCert, futureKey)
+	assert.ErrorContains(t, r.reload(), "not valid before")
+	assert.Equal(t, int64(3), servedSerial(t, r))
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	cert, key := selfSignedPEM(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	r.interval = time.Hour
+	r.watch(ctx)
+	cert, key = selfSignedPEM(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	assert.Eventually(t, func() bool { return servedSerial(t, r) == 2 }, 5*time.Second, 10*time.Millisecond, "SIGHUP reloads the certificate")
+
+	r, err = newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	r.interval = 10 * time.Millisecond
+	r.watch(ctx)
+	cert, key = selfSignedPEM(t, 3, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	assert.Eventually(t, func() bool { return servedSerial(t, r) == 3 }, 5*time.Second, 10*time.Millisecond, "file changes are detected")
+}
+
+func TestCertReloaderHandshake(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	cert, key := selfSignedPEM(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	r, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+
+	server := NewServer(conf{HttpsBindingAddress: ":443", TLSCertFilepath: certPath, TLSCertKeyFilepath: keyPath}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	config, err := server.tlsConfig(r.GetCertificate)
+	require.NoError(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+
+	handshake := func() int64 {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), handshake())
+
+	cert, key = selfSignedPEM(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	require.NoError(t, r.reload())
+	assert.Equal(t, int64(2), handshake(), "new connections get the new certificate")
+}
+
+func TestGRPCCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	cert, key := selfSignedPEM(t, 1, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+
+	server := NewServer(conf{TLSCertFilepath: certPath, TLSCertKeyFilepath: keyPath}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	getCertificate, err := server.getCertificate(t.Context())
+	require.NoError(t, err)
+	r, err := server.manualCertificate(t.Context())
+	require.NoError(t, err)
+	opts, err := grpcServerOptions(server.config, r.GetCertificate)
+	require.NoError(t, err)
+	gs := newGRPCServer(server.handlers, opts...)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = gs.Serve(ln) }()
+	t.Cleanup(gs.Stop)
+
+	handshake := func() int64 {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{ServerName: "localhost", InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), handshake())
+
+	cert, key = selfSignedPEM(t, 2, now.Add(-time.Hour), now.Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+	require.NoError(t, r.reload())
+	assert.Equal(t, int64(2), handshake(), "the gRPC listener serves the reloaded certificate")
+	https, err := getCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), https.Leaf.SerialNumber.Int64(), "the reloader is shared with the HTTPS listener")
+}
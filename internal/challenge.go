@@ -0,0 +1,392 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Proof-of-work settings.
+const (
+	// DefaultChallengeDifficulty is the default number of leading zero bits of the
+	// proof-of-work hash: browsers take a second or two to find a solution.
+	DefaultChallengeDifficulty = 18
+	// maxChallengeDifficulty bounds the configured difficulty, beyond which browsers
+	// would take minutes to find a solution.
+	maxChallengeDifficulty = 32
+	// challengeTTL is how long a proof-of-work challenge can be used.
+	challengeTTL = 10 * time.Minute
+	// maxSolutionLength bounds the length of the solutions, which are decimal numbers.
+	maxSolutionLength = 20
+)
+
+// Challenge proves that secrets are created by humans, or at least makes creating secrets
+// in bulk expensive. Authenticated clients do not need to solve it.
+type Challenge interface {
+	// Issue returns the challenge to solve before creating a secret.
+	Issue() api.Challenge
+	// Verify checks the solution sent with a creation request.
+	Verify(c echo.Context) error
+}
+
+// newChallenge returns the challenge configured by cnf, or nil when disabled. Proof-of-work
+// challenges are signed by s, and recorded once used in the Redis server of the rate limits
+// when store is a Redis store, so that each one can only be used once across replicas.
+func newChallenge(cnf conf, s *signer, store RateLimitStore) Challenge {
+	switch cnf.Challenge {
+	case api.ChallengeProofOfWork:
+		difficulty := cnf.ChallengeDifficulty
+		if difficulty == 0 {
+			difficulty = DefaultChallengeDifficulty
+		}
+		p := newProofOfWork(s, difficulty)
+		if r, ok := store.(redisRateLimitStore); ok {
+			p.redis = r.client
+		}
+		return p
+	case api.ChallengeHCaptcha, api.ChallengeTurnstile:
+		verifyURL := cnf.CaptchaVerifyURL
+		if verifyURL == "" {
+			verifyURL = captchaProviders[cnf.Challenge].verifyURL
+		}
+		return &captchaChallenge{
+			provider: cnf.Challenge,
+			siteKey:  cnf.CaptchaSiteKey,
+			verifier: NewSiteVerifyCaptcha(verifyURL, cnf.CaptchaSecret, nil),
+		}
+	}
+	return nil
+}
+
+// challengeMiddleware requires anonymous clients to solve ch. It lets all the requests
+// through when ch is nil.
+func challengeMiddleware(ch Challenge) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if ch == nil || identityFrom(c.Request().Context()) != nil {
+				return next(c)
+			}
+			err := ch.Verify(c)
+			if errors.Is(err, errCaptchaUnavailable) {
+				loggerFrom(c.Request().Context()).Error("CAPTCHA verification failed", "error", err)
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "CAPTCHA verification unavailable")
+			}
+			if err != nil {
+				loggerFrom(c.Request().Context()).Info("Challenge failed", "error", err)
+				return echo.NewHTTPError(http.StatusForbidden, err.Error())
+			}
+			return next(c)
+		}
+	}
+}
+
+// ChallengeHandler handles GET requests describing the challenge to solve before creating
+// a secret, issuing a new proof-of-work challenge when enabled. Authenticated clients have
+// none to solve.
+func (s SecretHandlers) ChallengeHandler(ctx echo.Context) error {
+	if s.challenge == nil || identityFrom(ctx.Request().Context()) != nil {
+		return ctx.JSON(http.StatusOK, api.Challenge{Type: api.ChallengeNone})
+	}
+	ctx.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return ctx.JSON(http.StatusOK, s.challenge.Issue())
+}
+
+// grpcChallengeInterceptor requires the anonymous gRPC clients creating secrets to solve
+// ch, sending the proof-of-work challenge and its solution in the challenge and solution
+// metadata. CAPTCHAs cannot be solved over gRPC: only authenticated clients can then create
+// secrets. It lets all the calls through when ch is nil.
+func grpcChallengeInterceptor(ch Challenge) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if ch == nil || info.FullMethod != secretv1.SecretService_CreateSecret_FullMethodName || identityFrom(ctx) != nil {
+			return handler(ctx, req)
+		}
+		p, ok := ch.(*proofOfWork)
+		if !ok {
+			return nil, status.Error(codes.PermissionDenied, "CAPTCHA required, authenticate with an API key or a client certificate to create secrets over gRPC")
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		if err := p.verify(ctx, firstMetadata(md, api.FieldChallenge), firstMetadata(md, api.FieldSolution)); err != nil {
+			loggerFrom(ctx).Info("Challenge failed", "error", err)
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return handler(ctx, req)
+	}
+}
+
+// firstMetadata returns the first value of the metadata key in md, or "" if there is none.
+func firstMetadata(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// redisChallengeKeyPrefix prefixes the Redis keys of the used proof-of-work challenges.
+const redisChallengeKeyPrefix = "supersecretmessage:challenge:"
+
+// proofOfWork is a stateless proof-of-work challenge: challenges carry their expiry and
+// difficulty, signed so that any replica sharing the signing key can check them. Each
+// challenge can be used once, across replicas when they share a Redis server, and per
+// replica otherwise.
+type proofOfWork struct {
+	signer     *signer
+	difficulty int
+	// redis records the used challenges, if not nil. They are recorded in spent otherwise,
+	// or when Redis fails.
+	redis redis.UniversalClient
+
+	mu        sync.Mutex
+	spent     map[string]time.Time
+	lastSweep time.Time
+}
+
+// newProofOfWork returns a proof-of-work challenge of the given difficulty, in leading
+// zero bits, signed by s.
+func newProofOfWork(s *signer, difficulty int) *proofOfWork {
+	return &proofOfWork{signer: s, difficulty: difficulty, spent: map[string]time.Time{}}
+}
+
+// Issue implements Challenge. Challenges are formatted as
+// "<expiry>.<difficulty>.<random>.<signature>".
+func (p *proofOfWork) Issue() api.Challenge {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	payload := strconv.FormatInt(p.signer.now().Add(challengeTTL).Unix(), 10) + "." +
+		strconv.Itoa(p.difficulty) + "." + base64.RawURLEncoding.EncodeToString(b)
+	return api.Challenge{
+		Type:       api.ChallengeProofOfWork,
+		Challenge:  payload + "." + p.signer.sign("pow", payload),
+		Difficulty: p.difficulty,
+		ExpiresIn:  int64(challengeTTL.Seconds()),
+	}
+}
+
+// Verify implements Challenge.
+func (p *proofOfWork) Verify(c echo.Context) error {
+	return p.verify(c.Request().Context(), c.FormValue(api.FieldChallenge), c.FormValue(api.FieldSolution))
+}
+
+// verify checks the solution of challenge, which is spent once it is valid.
+func (p *proofOfWork) verify(ctx context.Context, challenge, solution string) error {
+	if challenge == "" {
+		return errors.New("proof-of-work challenge required")
+	}
+
+	i := strings.LastIndexByte(challenge, '.')
+	if i < 0 || !p.signer.verify("pow", challenge[:i], challenge[i+1:]) {
+		return errors.New("invalid proof-of-work challenge")
+	}
+	// The signed payload is "<expiry>.<difficulty>.<random>".
+	parts := strings.Split(challenge[:i], ".")
+	if len(parts) != 3 {
+		return errors.New("invalid proof-of-work challenge")
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return errors.New("invalid proof-of-work challenge")
+	}
+	expiry, _ := strconv.ParseInt(parts[0], 10, 64)
+	if p.signer.expired(parts[0]) {
+		return errors.New("proof-of-work challenge expired")
+	}
+	if len(solution) > maxSolutionLength || proofOfWorkBits(challenge, solution) < difficulty {
+		return errors.New("invalid proof-of-work solution")
+	}
+	if !p.spend(ctx, challenge, time.Unix(expiry, 0)) {
+		return errors.New("proof-of-work challenge already used")
+	}
+	return nil
+}
+
+// spend marks challenge as used until its expiry, and reports whether it was not used yet.
+// When Redis fails, the challenge is only recorded by this replica, so that an unavailable
+// Redis does not prevent creating secrets.
+func (p *proofOfWork) spend(ctx context.Context, challenge string, expiry time.Time) bool {
+	if p.redis != nil {
+		ttl := max(expiry.Sub(p.signer.now()), time.Second)
+		ok, err := p.redis.SetNX(ctx, redisChallengeKeyPrefix+challenge, 1, ttl).Result()
+		if err == nil {
+			return ok
+		}
+		loggerFrom(ctx).Warn("Challenge store failed, recording the challenge locally", "error", err)
+	}
+	return p.spendLocally(challenge, expiry)
+}
+
+// spendLocally marks challenge as used by this replica until its expiry, and reports whether
+// it was not used yet. Expired challenges are forgotten, as they are rejected anyway.
+func (p *proofOfWork) spendLocally(challenge string, expiry time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.signer.now()
+	if now.Sub(p.lastSweep) >= time.Minute {
+		for k, exp := range p.spent {
+			if exp.Before(now) {
+				delete(p.spent, k)
+			}
+		}
+		p.lastSweep = now
+	}
+
+	if _, ok := p.spent[challenge]; ok {
+		return false
+	}
+	p.spent[challenge] = expiry
+	return true
+}
+
+// proofOfWorkBits returns the number of leading zero bits of the SHA-256 of
+// "<challenge>:<solution>".
+func proofOfWorkBits(challenge, solution string) int {
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// captchaProvider describes a CAPTCHA service.
+type captchaProvider struct {
+	// verifyURL is the URL of the siteverify API.
+	verifyURL string
+	// responseField is the form field set by the widget.
+	responseField string
+	// sources are the origins of the widget, allowed by the Content-Security-Policy.
+	sources string
+}
+
+// captchaProviders are the supported CAPTCHA services, by challenge type.
+var captchaProviders = map[string]captchaProvider{
+	api.ChallengeHCaptcha: {
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+		responseField: "h-captcha-response",
+		sources:       "https://hcaptcha.com https://*.hcaptcha.com",
+	},
+	api.ChallengeTurnstile: {
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		responseField: "cf-turnstile-response",
+		sources:       "https://challenges.cloudflare.com",
+	},
+}
+
+// captchaChallenge requires the response of a CAPTCHA widget, checked by verifier.
+type captchaChallenge struct {
+	provider string
+	siteKey  string
+	verifier CaptchaVerifier
+}
+
+// Issue implements Challenge.
+func (ch *captchaChallenge) Issue() api.Challenge {
+	return api.Challenge{Type: ch.provider, SiteKey: ch.siteKey}
+}
+
+// Verify implements Challenge.
+func (ch *captchaChallenge) Verify(c echo.Context) error {
+	response := c.FormValue(api.FieldCaptcha)
+	if response == "" {
+		response = c.FormValue(captchaProviders[ch.provider].responseField)
+	}
+	if response == "" {
+		return errors.New("CAPTCHA required")
+	}
+	return ch.verifier.Verify(c.Request().Context(), response, c.RealIP())
+}
+
+// errCaptchaUnavailable is returned when CAPTCHA responses cannot be verified, as opposed
+// to invalid responses.
+var errCaptchaUnavailable = errors.New("CAPTCHA verification unavailable")
+
+// CaptchaVerifier checks the responses of a CAPTCHA widget.
+type CaptchaVerifier interface {
+	// Verify returns an error when response, sent by the client at remoteIP, is not valid,
+	// or an error wrapping errCaptchaUnavailable when it cannot be verified.
+	Verify(ctx context.Context, response, remoteIP string) error
+}
+
+// siteVerifyCaptcha checks CAPTCHA responses with the siteverify API shared by hCaptcha
+// and Cloudflare Turnstile.
+type siteVerifyCaptcha struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// NewSiteVerifyCaptcha returns a CaptchaVerifier calling the siteverify API at verifyURL
+// with the secret key of the site. A nil client uses a client with a 10 seconds timeout.
+func NewSiteVerifyCaptcha(verifyURL, secret string, client *http.Client) CaptchaVerifier {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return siteVerifyCaptcha{url: verifyURL, secret: secret, client: client}
+}
+
+// Verify implements CaptchaVerifier.
+func (v siteVerifyCaptcha) Verify(ctx context.Context, response, remoteIP string) error {
+	form := url.Values{"secret": {v.secret}, "response": {response}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCaptchaUnavailable, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: unexpected status %d", errCaptchaUnavailable, resp.StatusCode)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%w: %w", errCaptchaUnavailable, err)
+	}
+	if !result.Success {
+		return fmt.Errorf("invalid CAPTCHA: %s", strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// contentSecurityPolicy returns the Content-Security-Policy of the pages, allowing the
+// scripts, styles, frames and API calls of the configured CAPTCHA widget.
+func contentSecurityPolicy(cnf conf) string {
+	p, ok := captchaProviders[cnf.Challenge]
+	if !ok {
+		return "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; font-src 'self'; frame-ancestors 'none'"
+	}
+	return "default-src 'self'; script-src 'self' " + p.sources + "; style-src 'self' 'unsafe-inline' " + p.sources +
+		"; img-src 'self' data:; font-src 'self'; frame-src " + p.sources + "; connect-src 'self' " + p.sources + "; frame-ancestors 'none'"
+}
@@ -0,0 +1,293 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// solveProofOfWork returns a solution of the proof-of-work challenge.
+func solveProofOfWork(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		if solution := strconv.Itoa(i); proofOfWorkBits(challenge, solution) >= difficulty {
+			return solution
+		}
+	}
+}
+
+// challengeContext returns the context of a creation request sending fields as a form.
+func challengeContext(fields map[string]string) echo.Context {
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+// getChallenge returns the challenge served by GET /challenge.
+func getChallenge(t *testing.T, server *Server) api.Challenge {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var ch api.Challenge
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ch))
+	return ch
+}
+
+func TestProofOfWork(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	issuer, replica, other := newSigner(key), newSigner(key), newSigner(nil)
+	for _, s := range []*signer{issuer, replica, other} {
+		s.now = func() time.Time { return now }
+	}
+	pow := newProofOfWork(issuer, 8)
+
+	ch := pow.Issue()
+	assert.Equal(t, api.ChallengeProofOfWork, ch.Type)
+	assert.Equal(t, 8, ch.Difficulty)
+	assert.Equal(t, int64(600), ch.ExpiresIn)
+	solution := solveProofOfWork(ch.Challenge, ch.Difficulty)
+	solved := map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: solution}
+
+	assert.ErrorContains(t, pow.Verify(challengeContext(nil)), "challenge required")
+	assert.ErrorContains(t, newProofOfWork(other, 8).Verify(challengeContext(solved)), "invalid proof-of-work challenge",
+		"challenges are bound to the key")
+	require.NoError(t, pow.Verify(challengeContext(solved)))
+	assert.ErrorContains(t, pow.Verify(challengeContext(solved)), "already used")
+	assert.NoError(t, newProofOfWork(replica, 8).Verify(challengeContext(solved)), "replicas sharing the key accept the solution")
+
+	ch = pow.Issue()
+	wrong := "0"
+	for proofOfWorkBits(ch.Challenge, wrong) >= ch.Difficulty {
+		wrong += "0"
+	}
+	assert.ErrorContains(t, pow.Verify(challengeContext(map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: wrong})),
+		"invalid proof-of-work solution")
+	assert.ErrorContains(t, pow.Verify(challengeContext(map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: strings.Repeat("1", 21)})),
+		"invalid proof-of-work solution")
+
+	// Lowering the difficulty invalidates the signature.
+	expiry, rest, _ := strings.Cut(ch.Challenge, ".")
+	_, rest, _ = strings.Cut(rest, ".")
+	easier := expiry + ".0." + rest
+	assert.ErrorContains(t, pow.Verify(challengeContext(map[string]string{api.FieldChallenge: easier, api.FieldSolution: "0"})),
+		"invalid proof-of-work challenge")
+
+	solution = solveProofOfWork(ch.Challenge, ch.Difficulty)
+	now = now.Add(challengeTTL + time.Second)
+	assert.ErrorContains(t, pow.Verify(challengeContext(map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: solution})),
+		"expired")
+}
+
+func TestProofOfWorkForgetsExpiredChallenges(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newSigner(nil)
+	s.now = func() time.Time { return now }
+	pow := newProofOfWork(s, 1)
+
+	for range 3 {
+		ch := pow.Issue()
+		require.NoError(t, pow.Verify(challengeContext(map[string]string{
+			api.FieldChallenge: ch.Challenge, api.FieldSolution: solveProofOfWork(ch.Challenge, 1),
+		})))
+	}
+	assert.Len(t, pow.spent, 3)
+
+	now = now.Add(challengeTTL + time.Minute)
+	assert.True(t, pow.spendLocally("new", now.Add(challengeTTL)))
+	assert.Len(t, pow.spent, 1)
+}
+
+func TestProofOfWorkSharedAcrossReplicas(t *testing.T) {
+	logs := captureLogs(t)
+	mr := miniredis.RunT(t)
+	cnf := conf{Challenge: api.ChallengeProofOfWork, ChallengeDifficulty: 1, RateLimitRedisURL: "redis://" + mr.Addr()}
+	s := newSigner([]byte("0123456789abcdef0123456789abcdef"))
+	var replicas []Challenge
+	for range 2 {
+		store, closeStore := newRateLimitStore(cnf)
+		t.Cleanup(func() { _ = closeStore() })
+		replicas = append(replicas, newChallenge(cnf, s, store))
+	}
+
+	ch := replicas[0].Issue()
+	solved := map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: solveProofOfWork(ch.Challenge, ch.Difficulty)}
+	require.NoError(t, replicas[0].Verify(challengeContext(solved)))
+	assert.ErrorContains(t, replicas[1].Verify(challengeContext(solved)), "already used", "challenges are spent across replicas")
+	ttl := mr.TTL(redisChallengeKeyPrefix + ch.Challenge)
+	assert.Positive(t, ttl, "spent challenges expire")
+	assert.LessOrEqual(t, ttl, challengeTTL)
+
+	mr.Close()
+	ch = replicas[0].Issue()
+	solved = map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: solveProofOfWork(ch.Challenge, ch.Difficulty)}
+	require.NoError(t, replicas[0].Verify(challengeContext(solved)), "challenges are accepted when Redis is down")
+	assert.Equal(t, "WARN", logs.record(t, "Challenge store failed, recording the challenge locally")["level"])
+	assert.ErrorContains(t, replicas[0].Verify(challengeContext(solved)), "already used", "and spent locally")
+}
+
+func TestChallengeMiddleware(t *testing.T) {
+	pow := newProofOfWork(newSigner(nil), 8)
+	next := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+
+	err := challengeMiddleware(pow)(next)(challengeContext(nil))
+	var he *echo.HTTPError
+	require.ErrorAs(t, err, &he)
+	assert.Equal(t, http.StatusForbidden, he.Code)
+
+	c := challengeContext(nil)
+	c.SetRequest(c.Request().WithContext(withIdentity(c.Request().Context(), &Identity{Subject: "ci", Method: "api-key"})))
+	assert.NoError(t, challengeMiddleware(pow)(next)(c), "authenticated clients are not challenged")
+
+	assert.NoError(t, challengeMiddleware(nil)(next)(challengeContext(nil)), "no challenge when disabled")
+}
+
+func TestProofOfWorkCreation(t *testing.T) {
+	logs := captureLogs(t)
+	server := NewServer(conf{
+		HttpBindingAddress:  ":8080",
+		AllowedOrigins:      []string{"*"},
+		Challenge:           api.ChallengeProofOfWork,
+		ChallengeDifficulty: 8,
+	}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	ch := getChallenge(t, server)
+	require.Equal(t, api.ChallengeProofOfWork, ch.Type)
+	assert.Equal(t, 8, ch.Difficulty)
+
+	rec := createSecret(t, server, nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), "proof-of-work challenge required")
+	logs.record(t, "Challenge failed")
+
+	solved := map[string]string{api.FieldChallenge: ch.Challenge, api.FieldSolution: solveProofOfWork(ch.Challenge, ch.Difficulty)}
+	rec = createSecret(t, server, solved)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "token")
+
+	rec = createSecret(t, server, solved)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "solutions cannot be replayed")
+}
+
+func TestCaptchaCreation(t *testing.T) {
+	down := false
+	siteverify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		assert.Equal(t, "captcha-secret", r.PostFormValue("secret"))
+		assert.Equal(t, "192.0.2.1", r.PostFormValue("remoteip"))
+		if r.PostFormValue("response") == "human" {
+			_, _ = w.Write([]byte(`{"success":true}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"success":false,"error-codes":["invalid-input-response"]}`))
+	}))
+	defer siteverify.Close()
+
+	server := NewServer(conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		Challenge:          api.ChallengeTurnstile,
+		CaptchaSiteKey:     "site-key",
+		CaptchaSecret:      "captcha-secret",
+		CaptchaVerifyURL:   siteverify.URL,
+	}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	assert.Equal(t, api.Challenge{Type: api.ChallengeTurnstile, SiteKey: "site-key"}, getChallenge(t, server))
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		down     bool
+		expected int
+	}{
+		{"no response", nil, false, http.StatusForbidden},
+		{"invalid response", map[string]string{api.FieldCaptcha: "robot"}, false, http.StatusForbidden},
+		{"valid response", map[string]string{api.FieldCaptcha: "human"}, false, http.StatusOK},
+		{"widget field", map[string]string{"cf-turnstile-response": "human"}, false, http.StatusOK},
+		{"provider down", map[string]string{api.FieldCaptcha: "human"}, true, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down = tt.down
+			rec := createSecret(t, server, tt.fields)
+			assert.Equal(t, tt.expected, rec.Code)
+		})
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	assert.Equal(t, api.Challenge{Type: api.ChallengeNone}, getChallenge(t, server))
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/challenge", nil))
+	assert.NotContains(t, rec.Header().Get(echo.HeaderContentSecurityPolicy), "frame-src")
+
+	csp := contentSecurityPolicy(conf{Challenge: api.ChallengeHCaptcha})
+	assert.Contains(t, csp, "script-src 'self' https://hcaptcha.com https://*.hcaptcha.com;")
+	assert.Contains(t, csp, "frame-src https://hcaptcha.com https://*.hcaptcha.com;")
+	assert.Contains(t, csp, "frame-ancestors 'none'")
+}
+
+func TestGRPCChallenge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	key, _, err := MintAPIKey(path, APIKeyOptions{Label: "ci"})
+	require.NoError(t, err)
+	keys := newAPIKeys(conf{APIKeysFile: path})
+	pow := newProofOfWork(newSigner(nil), 8)
+	client := newTestGRPCClient(t, &FakeSecretMsgStorer{msg: "secret"},
+		grpc.ChainUnaryInterceptor(grpcAPIKeyInterceptor(keys), grpcChallengeInterceptor(pow)))
+	req := &secretv1.CreateSecretRequest{Msg: "secret"}
+
+	_, err = client.CreateSecret(t.Context(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.ErrorContains(t, err, "proof-of-work challenge required")
+
+	ch := pow.Issue()
+	ctx := metadata.AppendToOutgoingContext(t.Context(), api.FieldChallenge, ch.Challenge, api.FieldSolution, solveProofOfWork(ch.Challenge, ch.Difficulty))
+	_, err = client.CreateSecret(ctx, req)
+	require.NoError(t, err)
+	_, err = client.CreateSecret(ctx, req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "solutions cannot be replayed")
+
+	_, err = client.CreateSecret(metadata.AppendToOutgoingContext(t.Context(), "authorization", "Bearer "+key), req)
+	assert.NoError(t, err, "authenticated clients are not challenged")
+	_, err = client.CreateSecret(metadata.AppendToOutgoingContext(t.Context(), "authorization", "Bearer "+key+"x"), req)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.GetSecret(t.Context(), &secretv1.GetSecretRequest{Token: "hvs.CABAAAAAAQAAAAAAAAAABBBB"})
+	assert.NoError(t, err, "retrieval is not challenged")
+
+	captcha := &captchaChallenge{provider: api.ChallengeTurnstile, siteKey: "site-key"}
+	client = newTestGRPCClient(t, &FakeSecretMsgStorer{},
+		grpc.ChainUnaryInterceptor(grpcAPIKeyInterceptor(keys), grpcChallengeInterceptor(captcha)))
+	_, err = client.CreateSecret(t.Context(), req)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "CAPTCHAs cannot be solved over gRPC")
+	_, err = client.CreateSecret(metadata.AppendToOutgoingContext(t.Context(), "authorization", "Bearer "+key), req)
+	assert.NoError(t, err)
+}
@@ -3,105 +3,941 @@
 package internal
 
 import (
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
 )
 
-// conf holds the application configuration settings loaded from environment variables.
-// It includes HTTP/HTTPS binding addresses, TLS configuration, and Vault storage prefix.
+// conf holds the application configuration settings.
+// It includes HTTP/HTTPS binding addresses, TLS configuration, and Vault settings.
 type conf struct {
-	// HttpBindingAddress is the HTTP server binding address (e.g., ":8080").
+	// HttpBindingAddress is the HTTP server binding address (e.g., ":8080"). The binding
+	// addresses can also be a Unix domain socket (e.g., "unix:/run/sup3r/http.sock") or a
+	// socket passed by systemd socket activation, by name (e.g., "systemd:http").
 	HttpBindingAddress string
 	// HttpsBindingAddress is the HTTPS server binding address (e.g., ":443").
 	HttpsBindingAddress string
+	// GrpcBindingAddress is the gRPC server binding address (e.g., ":9090"). gRPC is disabled when empty.
+	GrpcBindingAddress string
+	// AdminBindingAddress is the admin server binding address (e.g., ":9100"), serving /metrics.
+	// Metrics are served on the main listeners when empty.
+	AdminBindingAddress string
+	// UnixSocketMode is the octal permissions of the Unix domain sockets of the binding
+	// addresses starting with "unix:" (defaults to 0660).
+	UnixSocketMode string
 	// HttpsRedirectEnabled determines whether HTTP requests should redirect to HTTPS.
 	HttpsRedirectEnabled bool
+	// HttpMode is the mode of the HTTP listener: HTTPModeApp (the default) or HTTPModeRedirect.
+	HttpMode string
+	// HttpsRedirectPort is the public port of the HTTPS listener that HTTPModeRedirect redirects
+	// to (defaults to the port of HttpsBindingAddress), e.g. when a container port is mapped.
+	HttpsRedirectPort int
+	// HTTPTimeouts are the timeouts of the HTTP listener.
+	HTTPTimeouts Timeouts
+	// HTTPSTimeouts are the timeouts of the HTTPS listener.
+	HTTPSTimeouts Timeouts
+	// UploadTimeout is how long reading and answering a request creating a secret can take,
+	// instead of the read and write timeouts of the listener (defaults to DefaultUploadTimeout).
+	UploadTimeout time.Duration
+	// H2CEnabled enables HTTP/2 without TLS (h2c) on the HTTP listener, e.g. behind a service
+	// mesh. HTTP/2 is always enabled on the HTTPS listener.
+	H2CEnabled bool
 	// TLSAutoDomain is the domain for automatic Let's Encrypt TLS certificate generation.
 	TLSAutoDomain string
+	// TLSAutoCacheDir is the directory caching the auto TLS certificates and ACME account key
+	// (defaults to /var/www/.cache).
+	TLSAutoCacheDir string
+	// TLSAutoCacheRedisURL is the URL of the Redis server caching the auto TLS certificates
+	// instead of TLSAutoCacheDir, to share them between replicas.
+	TLSAutoCacheRedisURL string
+	// TLSACMEDirectoryURL is the directory URL of the ACME server issuing the auto TLS
+	// certificates (defaults to Let's Encrypt).
+	TLSACMEDirectoryURL string
+	// TLSACMEEmail is the contact email address of the ACME account.
+	TLSACMEEmail string
+	// TLSACMEEABKeyID is the key ID of the external account binding of the ACME account,
+	// required by some ACME servers.
+	TLSACMEEABKeyID string
+	// TLSACMEEABHMACKey is the base64url encoded HMAC key of the external account binding.
+	TLSACMEEABHMACKey string
 	// TLSCertFilepath is the path to a manual TLS certificate file.
 	TLSCertFilepath string
 	// TLSCertKeyFilepath is the path to a manual TLS certificate key file.
 	TLSCertKeyFilepath string
+	// TLSClientAuth enables client certificate authentication on the HTTPS listener:
+	// ClientAuthRequest or ClientAuthRequire. It is disabled when empty.
+	TLSClientAuth string
+	// TLSClientCAFile is the path to the PEM bundle of the CAs signing client certificates.
+	TLSClientCAFile string
+	// TLSClientSubjects lists the subjects of the client certificates accepted. All the
+	// certificates signed by the CAs are accepted when empty.
+	TLSClientSubjects []string
+	// VaultAddress is the Vault server URL (the Vault client reads VAULT_ADDR when empty).
+	VaultAddress string
+	// VaultToken is the Vault authentication token (the Vault client reads VAULT_TOKEN when empty).
+	VaultToken string
 	// VaultPrefix is the Vault storage path prefix (defaults to "cubbyhole/").
 	VaultPrefix string
 	// AllowedOrigins is the list of allowed CORS origins.
 	AllowedOrigins []string
+	// TrustedProxies lists the CIDRs or IP addresses of the proxies trusted to set the
+	// X-Forwarded-For header and send PROXY protocol headers. None is trusted when empty.
+	TrustedProxies []string
+	// ProxyProtocol enables the PROXY protocol on the HTTP, HTTPS and gRPC listeners, for TrustedProxies.
+	ProxyProtocol bool
+	// IPFilters restricts the client IP addresses allowed, per route group. All are allowed when empty.
+	IPFilters IPFilters
+	// Limits bounds the size and time-to-live of secrets.
+	Limits Limits
+	// RateLimits bounds the request rate of each client IP address, per route group.
+	RateLimits RateLimits
+	// RateLimitRedisURL is the URL of the Redis server storing the rate limits (e.g., "redis://redis:6379/0"),
+	// to share them between replicas. Rate limits are kept in memory when empty.
+	RateLimitRedisURL string
+	// OTLPEndpoint is the base URL of the OTLP/HTTP collector receiving traces (e.g., "http://localhost:4318").
+	// Tracing is disabled when empty.
+	OTLPEndpoint string
+	// LogLevel is the minimum level of the logged records (defaults to info).
+	LogLevel slog.Level
+	// LogFormat is the format of the logs, LogFormatJSON (default) or LogFormatText.
+	LogFormat string
+	// AuditLog is the sink of the audit log: AuditSinkStdout, AuditSinkSyslog or a file path.
+	// Auditing is disabled when empty.
+	AuditLog string
+	// AuditSalt keys the token hashes of the audit log (random when empty).
+	AuditSalt string
+	// AuditChainKey keys the hash chain of the audit log, required when auditing is enabled.
+	AuditChainKey string
+	// SigningKey signs the confirmation nonces of the /getmsg page, the proof-of-work
+	// challenges and the session cookies (random when empty). It must be shared by all the replicas.
+	SigningKey string
+	// Challenge is the challenge anonymous clients solve to create secrets: api.ChallengeProofOfWork,
+	// api.ChallengeHCaptcha or api.ChallengeTurnstile. There is none when empty.
+	Challenge string
+	// ChallengeDifficulty is the number of leading zero bits of the proof-of-work hash
+	// (defaults to DefaultChallengeDifficulty).
+	ChallengeDifficulty int
+	// CaptchaSiteKey is the site key of the CAPTCHA widget.
+	CaptchaSiteKey string
+	// CaptchaSecret is the secret key of the site, to verify CAPTCHA responses.
+	CaptchaSecret string
+	// CaptchaVerifyURL overrides the URL of the siteverify API of the CAPTCHA provider.
+	CaptchaVerifyURL string
+	// OIDCIssuer is the URL of the OpenID Connect provider users log in with to create
+	// secrets (e.g., "https://accounts.google.com"). Login is disabled when empty.
+	OIDCIssuer string
+	// OIDCClientID is the client ID registered with the OpenID Connect provider.
+	OIDCClientID string
+	// OIDCClientSecret is the client secret, empty for public clients.
+	OIDCClientSecret string
+	// OIDCRedirectURL is the URL of the /auth/callback endpoint registered with the provider
+	// (e.g., "https://secrets.example.com/auth/callback").
+	OIDCRedirectURL string
+	// OIDCAllowedGroups are the groups allowed to log in.
+	OIDCAllowedGroups []string
+	// OIDCAllowedDomains are the email domains allowed to log in. All the users of the
+	// provider are allowed when neither groups nor domains are set.
+	OIDCAllowedDomains []string
+	// OIDCSessionTTL is how long users stay logged in (defaults to DefaultSessionTTL).
+	OIDCSessionTTL time.Duration
+	// OIDCRequireForRetrieval also requires users to log in to retrieve secrets.
+	OIDCRequireForRetrieval bool
+	// OIDCTrustUnverifiedEmail trusts the email addresses of the ID tokens without
+	// email_verified claim as verified, for providers that omit it for verified addresses.
+	OIDCTrustUnverifiedEmail bool
+	// APIKeysFile is the path of the file holding the hashed API keys, managed with the
+	// api-key command. API keys are disabled when empty.
+	APIKeysFile string
 }
 
 // Environment variable names for application configuration.
 const (
+	// ConfigFileVarenv is the environment variable for the configuration file path.
+	ConfigFileVarenv = "SUPERSECRETMESSAGE_CONFIG_FILE"
 	// HttpBindingAddressVarenv is the environment variable for HTTP binding address.
 	HttpBindingAddressVarenv = "SUPERSECRETMESSAGE_HTTP_BINDING_ADDRESS"
 	// HttpsBindingAddressVarenv is the environment variable for HTTPS binding address.
 	HttpsBindingAddressVarenv = "SUPERSECRETMESSAGE_HTTPS_BINDING_ADDRESS"
+	// GrpcBindingAddressVarenv is the environment variable for gRPC binding address.
+	GrpcBindingAddressVarenv = "SUPERSECRETMESSAGE_GRPC_BINDING_ADDRESS"
+	// AdminBindingAddressVarenv is the environment variable for admin binding address.
+	AdminBindingAddressVarenv = "SUPERSECRETMESSAGE_ADMIN_BINDING_ADDRESS"
+	// UnixSocketModeVarenv is the environment variable for the permissions of the Unix domain sockets.
+	UnixSocketModeVarenv = "SUPERSECRETMESSAGE_UNIX_SOCKET_MODE"
 	// HttpsRedirectEnabledVarenv is the environment variable to enable HTTPS redirect.
 	HttpsRedirectEnabledVarenv = "SUPERSECRETMESSAGE_HTTPS_REDIRECT_ENABLED"
+	// HttpModeVarenv is the environment variable for the mode of the HTTP listener.
+	HttpModeVarenv = "SUPERSECRETMESSAGE_HTTP_MODE"
+	// HttpsRedirectPortVarenv is the environment variable for the public port of the HTTPS listener.
+	HttpsRedirectPortVarenv = "SUPERSECRETMESSAGE_HTTPS_REDIRECT_PORT"
+	// HTTPReadHeaderTimeoutVarenv is the environment variable for the read header timeout of the HTTP listener.
+	HTTPReadHeaderTimeoutVarenv = "SUPERSECRETMESSAGE_HTTP_READ_HEADER_TIMEOUT"
+	// HTTPReadTimeoutVarenv is the environment variable for the read timeout of the HTTP listener.
+	HTTPReadTimeoutVarenv = "SUPERSECRETMESSAGE_HTTP_READ_TIMEOUT"
+	// HTTPWriteTimeoutVarenv is the environment variable for the write timeout of the HTTP listener.
+	HTTPWriteTimeoutVarenv = "SUPERSECRETMESSAGE_HTTP_WRITE_TIMEOUT"
+	// HTTPIdleTimeoutVarenv is the environment variable for the idle timeout of the HTTP listener.
+	HTTPIdleTimeoutVarenv = "SUPERSECRETMESSAGE_HTTP_IDLE_TIMEOUT"
+	// HTTPSReadHeaderTimeoutVarenv is the environment variable for the read header timeout of the HTTPS listener.
+	HTTPSReadHeaderTimeoutVarenv = "SUPERSECRETMESSAGE_HTTPS_READ_HEADER_TIMEOUT"
+	// HTTPSReadTimeoutVarenv is the environment variable for the read timeout of the HTTPS listener.
+	HTTPSReadTimeoutVarenv = "SUPERSECRETMESSAGE_HTTPS_READ_TIMEOUT"
+	// HTTPSWriteTimeoutVarenv is the environment variable for the write timeout of the HTTPS listener.
+	HTTPSWriteTimeoutVarenv = "SUPERSECRETMESSAGE_HTTPS_WRITE_TIMEOUT"
+	// HTTPSIdleTimeoutVarenv is the environment variable for the idle timeout of the HTTPS listener.
+	HTTPSIdleTimeoutVarenv = "SUPERSECRETMESSAGE_HTTPS_IDLE_TIMEOUT"
+	// UploadTimeoutVarenv is the environment variable for the timeout of the requests creating secrets.
+	UploadTimeoutVarenv = "SUPERSECRETMESSAGE_UPLOAD_TIMEOUT"
+	// H2CEnabledVarenv is the environment variable to enable HTTP/2 without TLS on the HTTP listener.
+	H2CEnabledVarenv = "SUPERSECRETMESSAGE_H2C_ENABLED"
 	// TLSAutoDomainVarenv is the environment variable for automatic TLS domain.
 	TLSAutoDomainVarenv = "SUPERSECRETMESSAGE_TLS_AUTO_DOMAIN"
+	// TLSAutoCacheDirVarenv is the environment variable for the auto TLS cache directory.
+	TLSAutoCacheDirVarenv = "SUPERSECRETMESSAGE_TLS_AUTO_CACHE_DIR"
+	// TLSAutoCacheRedisURLVarenv is the environment variable for the Redis URL of the auto TLS cache.
+	TLSAutoCacheRedisURLVarenv = "SUPERSECRETMESSAGE_TLS_AUTO_CACHE_REDIS_URL"
+	// TLSACMEDirectoryURLVarenv is the environment variable for the ACME directory URL.
+	TLSACMEDirectoryURLVarenv = "SUPERSECRETMESSAGE_TLS_ACME_DIRECTORY_URL"
+	// TLSACMEEmailVarenv is the environment variable for the ACME account email address.
+	TLSACMEEmailVarenv = "SUPERSECRETMESSAGE_TLS_ACME_EMAIL"
+	// TLSACMEEABKeyIDVarenv is the environment variable for the ACME external account binding key ID.
+	TLSACMEEABKeyIDVarenv = "SUPERSECRETMESSAGE_TLS_ACME_EAB_KEY_ID"
+	// TLSACMEEABHMACKeyVarenv is the environment variable for the ACME external account binding HMAC key.
+	TLSACMEEABHMACKeyVarenv = "SUPERSECRETMESSAGE_TLS_ACME_EAB_HMAC_KEY"
 	// TLSCertFilepathVarenv is the environment variable for manual TLS certificate path.
 	TLSCertFilepathVarenv = "SUPERSECRETMESSAGE_TLS_CERT_FILEPATH"
 	// TLSCertKeyFilepathVarenv is the environment variable for manual TLS key path.
 	TLSCertKeyFilepathVarenv = "SUPERSECRETMESSAGE_TLS_CERT_KEY_FILEPATH"
+	// TLSClientAuthVarenv is the environment variable for the client certificate authentication mode.
+	TLSClientAuthVarenv = "SUPERSECRETMESSAGE_TLS_CLIENT_AUTH"
+	// TLSClientCAFileVarenv is the environment variable for the client CA bundle path.
+	TLSClientCAFileVarenv = "SUPERSECRETMESSAGE_TLS_CLIENT_CA_FILE"
+	// TLSClientSubjectsVarenv is the environment variable for the accepted client certificate subjects.
+	TLSClientSubjectsVarenv = "SUPERSECRETMESSAGE_TLS_CLIENT_SUBJECTS"
+	// VaultAddressVarenv is the environment variable for the Vault server URL, shared with the Vault CLI.
+	VaultAddressVarenv = "VAULT_ADDR"
+	// VaultTokenVarenv is the environment variable for the Vault token, shared with the Vault CLI.
+	VaultTokenVarenv = "VAULT_TOKEN"
 	// VaultPrefixenv is the environment variable for Vault storage prefix.
 	VaultPrefixenv = "SUPERSECRETMESSAGE_VAULT_PREFIX"
 	// AllowedOriginsVarenv is the environment variable for allowed CORS origins.
 	AllowedOriginsVarenv = "SUPERSECRETMESSAGE_ALLOWED_ORIGINS"
+	// TrustedProxiesVarenv is the environment variable for the trusted proxy CIDRs.
+	TrustedProxiesVarenv = "SUPERSECRETMESSAGE_TRUSTED_PROXIES"
+	// ProxyProtocolVarenv is the environment variable to enable the PROXY protocol.
+	ProxyProtocolVarenv = "SUPERSECRETMESSAGE_PROXY_PROTOCOL"
+	// AllowedCIDRsVarenv is the environment variable for the networks allowed on all the routes.
+	AllowedCIDRsVarenv = "SUPERSECRETMESSAGE_ALLOWED_CIDRS"
+	// DeniedCIDRsVarenv is the environment variable for the networks denied on all the routes.
+	DeniedCIDRsVarenv = "SUPERSECRETMESSAGE_DENIED_CIDRS"
+	// AllowedCIDRsCreateVarenv is the environment variable for the networks allowed to create secrets.
+	AllowedCIDRsCreateVarenv = "SUPERSECRETMESSAGE_ALLOWED_CIDRS_CREATE"
+	// DeniedCIDRsCreateVarenv is the environment variable for the networks denied to create secrets.
+	DeniedCIDRsCreateVarenv = "SUPERSECRETMESSAGE_DENIED_CIDRS_CREATE"
+	// AllowedCIDRsRetrieveVarenv is the environment variable for the networks allowed to retrieve secrets.
+	AllowedCIDRsRetrieveVarenv = "SUPERSECRETMESSAGE_ALLOWED_CIDRS_RETRIEVE"
+	// DeniedCIDRsRetrieveVarenv is the environment variable for the networks denied to retrieve secrets.
+	DeniedCIDRsRetrieveVarenv = "SUPERSECRETMESSAGE_DENIED_CIDRS_RETRIEVE"
+	// MaxMessageSizeVarenv is the environment variable for the maximum message size.
+	MaxMessageSizeVarenv = "SUPERSECRETMESSAGE_MAX_MESSAGE_SIZE"
+	// MaxFileSizeVarenv is the environment variable for the maximum file size.
+	MaxFileSizeVarenv = "SUPERSECRETMESSAGE_MAX_FILE_SIZE"
+	// BodyLimitVarenv is the environment variable for the maximum request body size.
+	BodyLimitVarenv = "SUPERSECRETMESSAGE_BODY_LIMIT"
+	// MinTTLVarenv is the environment variable for the minimum secret TTL.
+	MinTTLVarenv = "SUPERSECRETMESSAGE_MIN_TTL"
+	// MaxTTLVarenv is the environment variable for the maximum secret TTL.
+	MaxTTLVarenv = "SUPERSECRETMESSAGE_MAX_TTL"
+	// DefaultTTLVarenv is the environment variable for the default secret TTL.
+	DefaultTTLVarenv = "SUPERSECRETMESSAGE_DEFAULT_TTL"
+	// RateLimitVarenv is the environment variable for the default rate limit.
+	RateLimitVarenv = "SUPERSECRETMESSAGE_RATE_LIMIT"
+	// RateLimitCreateVarenv is the environment variable for the rate limit of secret creation.
+	RateLimitCreateVarenv = "SUPERSECRETMESSAGE_RATE_LIMIT_CREATE"
+	// RateLimitRetrieveVarenv is the environment variable for the rate limit of secret retrieval.
+	RateLimitRetrieveVarenv = "SUPERSECRETMESSAGE_RATE_LIMIT_RETRIEVE"
+	// RateLimitRedisURLVarenv is the environment variable for the Redis URL of the rate limits.
+	RateLimitRedisURLVarenv = "SUPERSECRETMESSAGE_RATE_LIMIT_REDIS_URL"
+	// OTLPEndpointVarenv is the environment variable for the OTLP/HTTP trace collector URL.
+	OTLPEndpointVarenv = "SUPERSECRETMESSAGE_OTLP_ENDPOINT"
+	// LogLevelVarenv is the environment variable for the log level.
+	LogLevelVarenv = "SUPERSECRETMESSAGE_LOG_LEVEL"
+	// LogFormatVarenv is the environment variable for the log format.
+	LogFormatVarenv = "SUPERSECRETMESSAGE_LOG_FORMAT"
+	// AuditLogVarenv is the environment variable for the audit log sink.
+	AuditLogVarenv = "SUPERSECRETMESSAGE_AUDIT_LOG"
+	// AuditSaltVarenv is the environment variable for the audit log token hash salt.
+	AuditSaltVarenv = "SUPERSECRETMESSAGE_AUDIT_SALT"
+	// AuditChainKeyVarenv is the environment variable for the audit log hash chain key.
+	AuditChainKeyVarenv = "SUPERSECRETMESSAGE_AUDIT_CHAIN_KEY"
+	// SigningKeyVarenv is the environment variable for the key signing confirmation nonces.
+	SigningKeyVarenv = "SUPERSECRETMESSAGE_SIGNING_KEY"
+	// ChallengeVarenv is the environment variable for the challenge of secret creation.
+	ChallengeVarenv = "SUPERSECRETMESSAGE_CHALLENGE"
+	// ChallengeDifficultyVarenv is the environment variable for the proof-of-work difficulty.
+	ChallengeDifficultyVarenv = "SUPERSECRETMESSAGE_CHALLENGE_DIFFICULTY"
+	// CaptchaSiteKeyVarenv is the environment variable for the CAPTCHA site key.
+	CaptchaSiteKeyVarenv = "SUPERSECRETMESSAGE_CAPTCHA_SITE_KEY"
+	// CaptchaSecretVarenv is the environment variable for the CAPTCHA secret key.
+	CaptchaSecretVarenv = "SUPERSECRETMESSAGE_CAPTCHA_SECRET"
+	// CaptchaVerifyURLVarenv is the environment variable for the CAPTCHA siteverify URL.
+	CaptchaVerifyURLVarenv = "SUPERSECRETMESSAGE_CAPTCHA_VERIFY_URL"
+	// OIDCIssuerVarenv is the environment variable for the OpenID Connect issuer URL.
+	OIDCIssuerVarenv = "SUPERSECRETMESSAGE_OIDC_ISSUER"
+	// OIDCClientIDVarenv is the environment variable for the OpenID Connect client ID.
+	OIDCClientIDVarenv = "SUPERSECRETMESSAGE_OIDC_CLIENT_ID"
+	// OIDCClientSecretVarenv is the environment variable for the OpenID Connect client secret.
+	OIDCClientSecretVarenv = "SUPERSECRETMESSAGE_OIDC_CLIENT_SECRET"
+	// OIDCRedirectURLVarenv is the environment variable for the OpenID Connect redirect URL.
+	OIDCRedirectURLVarenv = "SUPERSECRETMESSAGE_OIDC_REDIRECT_URL"
+	// OIDCAllowedGroupsVarenv is the environment variable for the groups allowed to log in.
+	OIDCAllowedGroupsVarenv = "SUPERSECRETMESSAGE_OIDC_ALLOWED_GROUPS"
+	// OIDCAllowedDomainsVarenv is the environment variable for the email domains allowed to log in.
+	OIDCAllowedDomainsVarenv = "SUPERSECRETMESSAGE_OIDC_ALLOWED_DOMAINS"
+	// OIDCSessionTTLVarenv is the environment variable for the session duration.
+	OIDCSessionTTLVarenv = "SUPERSECRETMESSAGE_OIDC_SESSION_TTL"
+	// OIDCRequireForRetrievalVarenv is the environment variable to require login to retrieve secrets.
+	OIDCRequireForRetrievalVarenv = "SUPERSECRETMESSAGE_OIDC_REQUIRE_FOR_RETRIEVAL"
+	// OIDCTrustUnverifiedEmailVarenv is the environment variable to trust email addresses without email_verified claim.
+	OIDCTrustUnverifiedEmailVarenv = "SUPERSECRETMESSAGE_OIDC_TRUST_UNVERIFIED_EMAIL"
+	// APIKeysFileVarenv is the environment variable for the API keys file path.
+	APIKeysFileVarenv = "SUPERSECRETMESSAGE_API_KEYS_FILE"
 )
 
-// LoadConfig loads and validates application configuration from environment variables.
-// It validates TLS configuration mutual exclusivity, ensures required bindings are set,
-// and sets default values where appropriate. Exits with fatal error on invalid configuration.
-func LoadConfig() conf {
-	var cnf conf
-
-	cnf.HttpBindingAddress = os.Getenv(HttpBindingAddressVarenv)
-	cnf.HttpsBindingAddress = os.Getenv(HttpsBindingAddressVarenv)
-	cnf.HttpsRedirectEnabled = strings.ToLower(os.Getenv(HttpsRedirectEnabledVarenv)) == "true"
-	cnf.TLSAutoDomain = os.Getenv(TLSAutoDomainVarenv)
-	cnf.TLSCertFilepath = os.Getenv(TLSCertFilepathVarenv)
-	cnf.TLSCertKeyFilepath = os.Getenv(TLSCertKeyFilepathVarenv)
-	cnf.VaultPrefix = os.Getenv(VaultPrefixenv)
-	cnf.AllowedOrigins = strings.Split(os.Getenv(AllowedOriginsVarenv), ",")
+// redacted replaces the value of secret settings when the configuration is printed or logged.
+const redacted = "<redacted>"
+
+// setting describes a configuration setting and the names it is read from.
+// A setting is named key in the configuration file, --key (with dashes) on the
+// command line and env in the environment.
+type setting struct {
+	// key is the configuration file key.
+	key string
+	// env is the environment variable name.
+	env string
+	// usage is the description shown in the command-line help.
+	usage string
+	// secret hides the value when the configuration is printed or logged.
+	secret bool
+	// boolean makes the command-line flag usable without a value.
+	boolean bool
+	// set parses value and stores it in cnf.
+	set func(cnf *conf, value string) error
+	// get returns the value stored in cnf, for printing.
+	get func(cnf *conf) any
+}
+
+// flagName returns the command-line flag name of the setting.
+func (s setting) flagName() string {
+	return strings.ReplaceAll(s.key, "_", "-")
+}
+
+// stringSetting returns a setting stored in the string returned by field.
+func stringSetting(key, env, usage string, field func(*conf) *string) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			*field(cnf) = value
+			return nil
+		},
+		get: func(cnf *conf) any { return *field(cnf) },
+	}
+}
+
+// boolSetting returns a setting stored in the bool returned by field.
+func boolSetting(key, env, usage string, field func(*conf) *bool) setting {
+	return setting{
+		key:     key,
+		env:     env,
+		usage:   usage,
+		boolean: true,
+		set: func(cnf *conf, value string) error {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("must be true or false")
+			}
+			*field(cnf) = b
+			return nil
+		},
+		get: func(cnf *conf) any { return *field(cnf) },
+	}
+}
+
+// listSetting returns a setting stored in the slice returned by field. On the command line
+// and in the environment, the items are separated by commas.
+func listSetting(key, env, usage string, field func(*conf) *[]string) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			*field(cnf) = strings.Split(value, ",")
+			return nil
+		},
+		get: func(cnf *conf) any { return *field(cnf) },
+	}
+}
+
+// intSetting returns a setting stored in the integer returned by field.
+func intSetting(key, env, usage string, field func(*conf) *int) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", value)
+			}
+			*field(cnf) = n
+			return nil
+		},
+		get: func(cnf *conf) any { return *field(cnf) },
+	}
+}
+
+// sizeSetting returns a setting stored in the size in bytes returned by field.
+// Sizes accept the K, M and G binary unit suffixes (see parseSize).
+func sizeSetting(key, env, usage string, field func(*conf) *int64) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			n, err := parseSize(value)
+			if err != nil {
+				return err
+			}
+			*field(cnf) = n
+			return nil
+		},
+		get: func(cnf *conf) any { return formatSize(*field(cnf)) },
+	}
+}
+
+// durationSetting returns a setting stored in the duration returned by field.
+func durationSetting(key, env, usage string, field func(*conf) *time.Duration) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", value)
+			}
+			*field(cnf) = d
+			return nil
+		},
+		get: func(cnf *conf) any { return field(cnf).String() },
+	}
+}
+
+// logLevelSetting returns a setting stored in the log level returned by field.
+// Levels are debug, info, warn or error.
+func logLevelSetting(key, env, usage string, field func(*conf) *slog.Level) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			return field(cnf).UnmarshalText([]byte(value))
+		},
+		get: func(cnf *conf) any { return strings.ToLower(field(cnf).String()) },
+	}
+}
+
+// rateLimitSetting returns a setting stored in the rate limit returned by field.
+// Rate limits are formatted as <limit>/<period> (see parseRateLimit).
+func rateLimitSetting(key, env, usage string, field func(*conf) *RateLimit) setting {
+	return setting{
+		key:   key,
+		env:   env,
+		usage: usage,
+		set: func(cnf *conf, value string) error {
+			r, err := parseRateLimit(value)
+			if err != nil {
+				return err
+			}
+			*field(cnf) = r
+			return nil
+		},
+		get: func(cnf *conf) any { return field(cnf).String() },
+	}
+}
+
+// secretSetting marks s as secret.
+func secretSetting(s setting) setting {
+	s.secret = true
+	return s
+}
+
+// settings lists all configuration settings, in the order they are printed.
+var settings = []setting{
+	stringSetting("http_binding_address", HttpBindingAddressVarenv, "HTTP binding address (e.g. :80, unix:/run/sup3r/http.sock or systemd:http)",
+		func(c *conf) *string { return &c.HttpBindingAddress }),
+	stringSetting("https_binding_address", HttpsBindingAddressVarenv, "HTTPS binding address (e.g. :443)",
+		func(c *conf) *string { return &c.HttpsBindingAddress }),
+	stringSetting("grpc_binding_address", GrpcBindingAddressVarenv, "gRPC binding address (e.g. :9090), disabled when empty",
+		func(c *conf) *string { return &c.GrpcBindingAddress }),
+	stringSetting("admin_binding_address", AdminBindingAddressVarenv, "admin binding address serving /metrics (e.g. :9100), metrics are served on the main listeners when empty",
+		func(c *conf) *string { return &c.AdminBindingAddress }),
+	stringSetting("unix_socket_mode", UnixSocketModeVarenv, "octal permissions of the Unix domain sockets of the unix: binding addresses (default 0660)",
+		func(c *conf) *string { return &c.UnixSocketMode }),
+	boolSetting("https_redirect_enabled", HttpsRedirectEnabledVarenv, "redirect HTTP requests to HTTPS",
+		func(c *conf) *bool { return &c.HttpsRedirectEnabled }),
+	stringSetting("http_mode", HttpModeVarenv, "mode of the HTTP listener: app, or redirect to only serve ACME challenges and redirect to HTTPS",
+		func(c *conf) *string { return &c.HttpMode }),
+	intSetting("https_redirect_port", HttpsRedirectPortVarenv, "public port of the HTTPS listener the redirect mode redirects to, the port of the HTTPS binding address when 0",
+		func(c *conf) *int { return &c.HttpsRedirectPort }),
+	durationSetting("http_read_header_timeout", HTTPReadHeaderTimeoutVarenv, "timeout of reading the headers of a request on the HTTP listener (default 10s)",
+		func(c *conf) *time.Duration { return &c.HTTPTimeouts.ReadHeader }),
+	durationSetting("http_read_timeout", HTTPReadTimeoutVarenv, "timeout of reading a request, including its body on the HTTP listener (default 10s)",
+		func(c *conf) *time.Duration { return &c.HTTPTimeouts.Read }),
+	durationSetting("http_write_timeout", HTTPWriteTimeoutVarenv, "timeout of writing a response on the HTTP listener (default 10s)",
+		func(c *conf) *time.Duration { return &c.HTTPTimeouts.Write }),
+	durationSetting("http_idle_timeout", HTTPIdleTimeoutVarenv, "timeout of keeping an idle connection open on the HTTP listener (default 2m)",
+		func(c *conf) *time.Duration { return &c.HTTPTimeouts.Idle }),
+	durationSetting("https_read_header_timeout", HTTPSReadHeaderTimeoutVarenv, "timeout of reading the headers of a request on the HTTPS listener (default 10s)",
+		func(c *conf) *time.Duration { return &c.HTTPSTimeouts.ReadHeader }),
+	durationSetting("https_read_timeout", HTTPSReadTimeoutVarenv, "timeout of reading a request, including its body on the HTTPS listener (default 10s)",
+		func(c *conf) *time.Duration { return &c.HTTPSTimeouts.Read }),
+	durationSetting("https_write_timeout", HTTPSWriteTimeoutVarenv, "timeout of writing a response on the HTTPS listener (default 10s)",
+		func(c *conf) *time.Duration { return &c.HTTPSTimeouts.Write }),
+	durationSetting("https_idle_timeout", HTTPSIdleTimeoutVarenv, "timeout of keeping an idle connection open on the HTTPS listener (default 2m)",
+		func(c *conf) *time.Duration { return &c.HTTPSTimeouts.Idle }),
+	durationSetting("upload_timeout", UploadTimeoutVarenv, "timeout of reading and answering a request creating a secret, instead of the read and write timeouts (default 10m)",
+		func(c *conf) *time.Duration { return &c.UploadTimeout }),
+	boolSetting("h2c_enabled", H2CEnabledVarenv, "enable HTTP/2 without TLS (h2c) on the HTTP listener, e.g. behind a service mesh",
+		func(c *conf) *bool { return &c.H2CEnabled }),
+	stringSetting("tls_auto_domain", TLSAutoDomainVarenv, "domain of the automatic Let's Encrypt certificate",
+		func(c *conf) *string { return &c.TLSAutoDomain }),
+	stringSetting("tls_auto_cache_dir", TLSAutoCacheDirVarenv, "directory caching the auto TLS certificates and ACME account key (default /var/www/.cache)",
+		func(c *conf) *string { return &c.TLSAutoCacheDir }),
+	secretSetting(stringSetting("tls_auto_cache_redis_url", TLSAutoCacheRedisURLVarenv, "URL of the Redis server caching the auto TLS certificates instead of the cache directory (e.g. redis://redis:6379/0)",
+		func(c *conf) *string { return &c.TLSAutoCacheRedisURL })),
+	stringSetting("tls_acme_directory_url", TLSACMEDirectoryURLVarenv, "directory URL of the ACME server issuing the auto TLS certificates, Let's Encrypt when empty",
+		func(c *conf) *string { return &c.TLSACMEDirectoryURL }),
+	stringSetting("tls_acme_email", TLSACMEEmailVarenv, "contact email address of the ACME account",
+		func(c *conf) *string { return &c.TLSACMEEmail }),
+	stringSetting("tls_acme_eab_key_id", TLSACMEEABKeyIDVarenv, "key ID of the external account binding of the ACME account",
+		func(c *conf) *string { return &c.TLSACMEEABKeyID }),
+	secretSetting(stringSetting("tls_acme_eab_hmac_key", TLSACMEEABHMACKeyVarenv, "base64url encoded HMAC key of the external account binding of the ACME account",
+		func(c *conf) *string { return &c.TLSACMEEABHMACKey })),
+	stringSetting("tls_cert_filepath", TLSCertFilepathVarenv, "manual TLS certificate file",
+		func(c *conf) *string { return &c.TLSCertFilepath }),
+	stringSetting("tls_cert_key_filepath", TLSCertKeyFilepathVarenv, "manual TLS certificate key file",
+		func(c *conf) *string { return &c.TLSCertKeyFilepath }),
+	stringSetting("tls_client_auth", TLSClientAuthVarenv, "client certificate authentication on the HTTPS listener: request or require, disabled when empty",
+		func(c *conf) *string { return &c.TLSClientAuth }),
+	stringSetting("tls_client_ca_file", TLSClientCAFileVarenv, "PEM bundle of the CAs signing client certificates",
+		func(c *conf) *string { return &c.TLSClientCAFile }),
+	listSetting("tls_client_subjects", TLSClientSubjectsVarenv, "comma-separated list of the subjects (common name, or first URI, DNS name or email address) of the client certificates accepted, all when empty",
+		func(c *conf) *[]string { return &c.TLSClientSubjects }),
+	stringSetting("vault_addr", VaultAddressVarenv, "Vault server URL",
+		func(c *conf) *string { return &c.VaultAddress }),
+	secretSetting(stringSetting("vault_token", VaultTokenVarenv, "Vault token",
+		func(c *conf) *string { return &c.VaultToken })),
+	stringSetting("vault_prefix", VaultPrefixenv, "Vault storage path prefix",
+		func(c *conf) *string { return &c.VaultPrefix }),
+	listSetting("allowed_origins", AllowedOriginsVarenv, "comma-separated list of allowed CORS origins",
+		func(c *conf) *[]string { return &c.AllowedOrigins }),
+	listSetting("trusted_proxies", TrustedProxiesVarenv, "comma-separated list of CIDRs or IP addresses of the proxies trusted to set X-Forwarded-For (e.g. 10.0.0.0/8)",
+		func(c *conf) *[]string { return &c.TrustedProxies }),
+	boolSetting("proxy_protocol", ProxyProtocolVarenv, "read the PROXY protocol header sent by trusted proxies on the HTTP, HTTPS and gRPC listeners",
+		func(c *conf) *bool { return &c.ProxyProtocol }),
+	listSetting("allowed_cidrs", AllowedCIDRsVarenv, "comma-separated list of CIDRs or IP addresses of the clients allowed on all the routes but health probes, all are allowed when empty",
+		func(c *conf) *[]string { return &c.IPFilters.Default.Allowed }),
+	listSetting("denied_cidrs", DeniedCIDRsVarenv, "comma-separated list of CIDRs or IP addresses of the clients denied on all the routes but health probes",
+		func(c *conf) *[]string { return &c.IPFilters.Default.Denied }),
+	listSetting("allowed_cidrs_create", AllowedCIDRsCreateVarenv, "comma-separated list of CIDRs or IP addresses of the clients allowed to create secrets (e.g. 10.0.0.0/8)",
+		func(c *conf) *[]string { return &c.IPFilters.Create.Allowed }),
+	listSetting("denied_cidrs_create", DeniedCIDRsCreateVarenv, "comma-separated list of CIDRs or IP addresses of the clients denied to create secrets",
+		func(c *conf) *[]string { return &c.IPFilters.Create.Denied }),
+	listSetting("allowed_cidrs_retrieve", AllowedCIDRsRetrieveVarenv, "comma-separated list of CIDRs or IP addresses of the clients allowed to retrieve secrets",
+		func(c *conf) *[]string { return &c.IPFilters.Retrieve.Allowed }),
+	listSetting("denied_cidrs_retrieve", DeniedCIDRsRetrieveVarenv, "comma-separated list of CIDRs or IP addresses of the clients denied to retrieve secrets",
+		func(c *conf) *[]string { return &c.IPFilters.Retrieve.Denied }),
+	sizeSetting("max_message_size", MaxMessageSizeVarenv, "maximum size of a secret message (e.g. 1M)",
+		func(c *conf) *int64 { return &c.Limits.MaxMessageSize }),
+	sizeSetting("max_file_size", MaxFileSizeVarenv, "maximum size of an uploaded file (e.g. 50M)",
+		func(c *conf) *int64 { return &c.Limits.MaxFileSize }),
+	sizeSetting("body_limit", BodyLimitVarenv, "maximum size of a request body (e.g. 52M)",
+		func(c *conf) *int64 { return &c.Limits.BodyLimit }),
+	durationSetting("min_ttl", MinTTLVarenv, "minimum time-to-live of a secret",
+		func(c *conf) *time.Duration { return &c.Limits.MinTTL }),
+	durationSetting("max_ttl", MaxTTLVarenv, "maximum time-to-live of a secret",
+		func(c *conf) *time.Duration { return &c.Limits.MaxTTL }),
+	durationSetting("default_ttl", DefaultTTLVarenv, "time-to-live of a secret created without one",
+		func(c *conf) *time.Duration { return &c.Limits.DefaultTTL }),
+	rateLimitSetting("rate_limit", RateLimitVarenv, "requests allowed per client IP address and period, on routes without a specific limit (e.g. 10/2s)",
+		func(c *conf) *RateLimit { return &c.RateLimits.Default }),
+	rateLimitSetting("rate_limit_create", RateLimitCreateVarenv, "secrets created per client IP address and period (e.g. 20/1m)",
+		func(c *conf) *RateLimit { return &c.RateLimits.Create }),
+	rateLimitSetting("rate_limit_retrieve", RateLimitRetrieveVarenv, "secret retrievals per client IP address and period (e.g. 10/2s)",
+		func(c *conf) *RateLimit { return &c.RateLimits.Retrieve }),
+	secretSetting(stringSetting("rate_limit_redis_url", RateLimitRedisURLVarenv, "URL of the Redis server sharing the rate limits between replicas (e.g. redis://redis:6379/0), rate limits are kept in memory when empty",
+		func(c *conf) *string { return &c.RateLimitRedisURL })),
+	logLevelSetting("log_level", LogLevelVarenv, "minimum level of the logs: debug, info, warn or error",
+		func(c *conf) *slog.Level { return &c.LogLevel }),
+	stringSetting("log_format", LogFormatVarenv, "format of the logs: json or text",
+		func(c *conf) *string { return &c.LogFormat }),
+	stringSetting("audit_log", AuditLogVarenv, "audit log sink: stdout, syslog or a file path, auditing is disabled when empty",
+		func(c *conf) *string { return &c.AuditLog }),
+	secretSetting(stringSetting("audit_salt", AuditSaltVarenv, "secret salt of the token hashes in the audit log",
+		func(c *conf) *string { return &c.AuditSalt })),
+	secretSetting(stringSetting("audit_chain_key", AuditChainKeyVarenv, "secret key of the hash chain of the audit log, kept apart from the log",
+		func(c *conf) *string { return &c.AuditChainKey })),
+	secretSetting(stringSetting("signing_key", SigningKeyVarenv, "secret key signing the confirmation nonces required to retrieve secrets, shared by all the replicas (random when empty)",
+		func(c *conf) *string { return &c.SigningKey })),
+	stringSetting("challenge", ChallengeVarenv, "challenge anonymous clients solve to create secrets: pow, hcaptcha or turnstile, none when empty",
+		func(c *conf) *string { return &c.Challenge }),
+	intSetting("challenge_difficulty", ChallengeDifficultyVarenv, "number of leading zero bits of the proof-of-work hash",
+		func(c *conf) *int { return &c.ChallengeDifficulty }),
+	stringSetting("captcha_site_key", CaptchaSiteKeyVarenv, "site key of the hCaptcha or Turnstile widget",
+		func(c *conf) *string { return &c.CaptchaSiteKey }),
+	secretSetting(stringSetting("captcha_secret", CaptchaSecretVarenv, "secret key verifying the hCaptcha or Turnstile responses",
+		func(c *conf) *string { return &c.CaptchaSecret })),
+	stringSetting("captcha_verify_url", CaptchaVerifyURLVarenv, "URL of the siteverify API of the CAPTCHA provider, to override the default one",
+		func(c *conf) *string { return &c.CaptchaVerifyURL }),
+	stringSetting("oidc_issuer", OIDCIssuerVarenv, "URL of the OpenID Connect provider users log in with to create secrets, login being disabled when empty",
+		func(c *conf) *string { return &c.OIDCIssuer }),
+	stringSetting("oidc_client_id", OIDCClientIDVarenv, "client ID registered with the OpenID Connect provider",
+		func(c *conf) *string { return &c.OIDCClientID }),
+	secretSetting(stringSetting("oidc_client_secret", OIDCClientSecretVarenv, "client secret registered with the OpenID Connect provider, empty for public clients",
+		func(c *conf) *string { return &c.OIDCClientSecret })),
+	stringSetting("oidc_redirect_url", OIDCRedirectURLVarenv, "URL of the /auth/callback endpoint registered with the OpenID Connect provider",
+		func(c *conf) *string { return &c.OIDCRedirectURL }),
+	listSetting("oidc_allowed_groups", OIDCAllowedGroupsVarenv, "comma-separated list of the groups allowed to log in",
+		func(c *conf) *[]string { return &c.OIDCAllowedGroups }),
+	listSetting("oidc_allowed_domains", OIDCAllowedDomainsVarenv, "comma-separated list of the email domains allowed to log in",
+		func(c *conf) *[]string { return &c.OIDCAllowedDomains }),
+	durationSetting("oidc_session_ttl", OIDCSessionTTLVarenv, "how long users stay logged in",
+		func(c *conf) *time.Duration { return &c.OIDCSessionTTL }),
+	boolSetting("oidc_require_for_retrieval", OIDCRequireForRetrievalVarenv, "also require users to log in to retrieve secrets",
+		func(c *conf) *bool { return &c.OIDCRequireForRetrieval }),
+	boolSetting("oidc_trust_unverified_email", OIDCTrustUnverifiedEmailVarenv, "trust the email addresses of the ID tokens without email_verified claim as verified",
+		func(c *conf) *bool { return &c.OIDCTrustUnverifiedEmail }),
+	stringSetting("api_keys_file", APIKeysFileVarenv, "file holding the hashed API keys, managed with the api-key command, API keys are disabled when empty",
+		func(c *conf) *string { return &c.APIKeysFile }),
+	stringSetting("otlp_endpoint", OTLPEndpointVarenv, "OTLP/HTTP collector URL receiving traces (e.g. http://localhost:4318), tracing is disabled when empty",
+		func(c *conf) *string { return &c.OTLPEndpoint }),
+}
+
+// DefaultConfig returns the configuration used when no setting is provided.
+// It is also useful to build a configuration programmatically, e.g. in tests.
+func DefaultConfig() conf {
+	return conf{
+		VaultPrefix: "cubbyhole/",
+		// No origin matches, so cross-origin requests are denied unless origins are configured.
+		AllowedOrigins: []string{""},
+		Limits:         DefaultLimits(),
+		RateLimits:     DefaultRateLimits(),
+		LogLevel:       slog.LevelInfo,
+		LogFormat:      LogFormatJSON,
+	}
+}
+
+// ConfigFlags holds the configuration settings given on the command line, by file key.
+type ConfigFlags map[string]string
+
+// RegisterConfigFlags defines a command-line flag on fs for each configuration setting.
+// The returned ConfigFlags is filled when fs is parsed and must be passed to LoadConfig.
+func RegisterConfigFlags(fs *flag.FlagSet) ConfigFlags {
+	flags := ConfigFlags{}
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		store := func(value string) error {
+			flags[s.key] = value
+			return nil
+		}
+		if s.boolean {
+			fs.BoolFunc(s.flagName(), usage, store)
+		} else {
+			fs.Func(s.flagName(), usage, store)
+		}
+	}
+	return flags
+}
+
+// LoadConfig loads and validates the application configuration. Settings are read from
+// the configuration file, the environment and the command-line flags, each source
+// overriding the previous one, on top of DefaultConfig.
+// The configuration file is path, or the file named by SUPERSECRETMESSAGE_CONFIG_FILE
+// when path is empty; no file is read when both are empty.
+func LoadConfig(path string, getenv func(string) string, flags ConfigFlags) (conf, error) {
+	cnf := DefaultConfig()
+
+	if path == "" {
+		path = getenv(ConfigFileVarenv)
+	}
+	if path != "" {
+		if err := loadConfigFile(&cnf, path); err != nil {
+			return cnf, err
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(&cnf, value); err != nil {
+				return cnf, fmt.Errorf("invalid %s: %w", s.env, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := flags[s.key]; ok {
+			if err := s.set(&cnf, value); err != nil {
+				return cnf, fmt.Errorf("invalid --%s: %w", s.flagName(), err)
+			}
+		}
+	}
+
+	return cnf, cnf.Validate()
+}
+
+// loadConfigFile reads the YAML configuration file at path into cnf. Unknown keys are
+// rejected so that typos do not go unnoticed.
+func loadConfigFile(cnf *conf, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading configuration file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return fmt.Errorf("parsing configuration file %s: %w", path, err)
+	}
+
+	for key := range values {
+		if settingByKey(key) == nil {
+			return fmt.Errorf("unknown setting %q in configuration file %s", key, path)
+		}
+	}
+
+	for _, s := range settings {
+		v, ok := values[s.key]
+		if !ok || v == nil {
+			continue
+		}
+
+		var value string
+		switch v := v.(type) {
+		case []any:
+			// The defaults of lists have no item, or a single empty one.
+			if len(v) == 0 {
+				continue
+			}
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		case map[string]any:
+			return fmt.Errorf("invalid %s in configuration file %s: must not be a mapping", s.key, path)
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		if err := s.set(cnf, value); err != nil {
+			return fmt.Errorf("invalid %s in configuration file %s: %w", s.key, path, err)
+		}
+	}
+	return nil
+}
+
+// settingByKey returns the setting named key, or nil if there is none.
+func settingByKey(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+	return nil
+}
+
+// Validate checks the consistency of the configuration. It validates TLS configuration
+// mutual exclusivity, ensures required bindings are set and checks the limits.
+func (cnf conf) Validate() error {
+	var errs []error
 
 	if cnf.TLSAutoDomain != "" && (cnf.TLSCertFilepath != "" || cnf.TLSCertKeyFilepath != "") {
-		log.Fatalf("Auto TLS (%s) is mutually exclusive with manual TLS (%s and %s)", TLSAutoDomainVarenv,
-			TLSCertFilepathVarenv, TLSCertKeyFilepathVarenv)
+		errs = append(errs, errors.New("auto TLS (tls_auto_domain) is mutually exclusive with manual TLS (tls_cert_filepath and tls_cert_key_filepath)"))
 	}
 
 	if (cnf.TLSCertFilepath != "" && cnf.TLSCertKeyFilepath == "") ||
 		(cnf.TLSCertFilepath == "" && cnf.TLSCertKeyFilepath != "") {
-		log.Fatalf("Both certificate filepath (%s) and certificate key filepath (%s) must be set when using manual TLS",
-			TLSCertFilepathVarenv, TLSCertKeyFilepathVarenv)
+		errs = append(errs, errors.New("both certificate filepath (tls_cert_filepath) and certificate key filepath (tls_cert_key_filepath) must be set when using manual TLS"))
 	}
 
 	if cnf.HttpsBindingAddress == "" && (cnf.TLSAutoDomain != "" || cnf.TLSCertFilepath != "") {
-		log.Fatalf("HTTPS binding address (%s) must be set when using either auto TLS (%s) or manual TLS (%s and %s)",
-			HttpsBindingAddressVarenv, TLSAutoDomainVarenv, TLSCertFilepathVarenv, TLSCertKeyFilepathVarenv)
+		errs = append(errs, errors.New("HTTPS binding address (https_binding_address) must be set when using either auto TLS (tls_auto_domain) or manual TLS (tls_cert_filepath and tls_cert_key_filepath)"))
 	}
 
 	if cnf.HttpBindingAddress == "" && cnf.TLSAutoDomain == "" && cnf.TLSCertFilepath == "" {
-		log.Fatalf("HTTP binding address (%s) must be set if auto TLS (%s) and manual TLS (%s and %s) are both disabled",
-			HttpBindingAddressVarenv, TLSAutoDomainVarenv, TLSCertFilepathVarenv, TLSCertKeyFilepathVarenv)
+		errs = append(errs, errors.New("HTTP binding address (http_binding_address) must be set if auto TLS (tls_auto_domain) and manual TLS (tls_cert_filepath and tls_cert_key_filepath) are both disabled"))
 	}
 
 	if cnf.HttpsBindingAddress != "" && cnf.TLSAutoDomain == "" && cnf.TLSCertFilepath == "" {
-		log.Fatalf("HTTPS binding address (%s) is set but neither auto TLS (%s) nor manual TLS (%s and %s) are enabled",
-			HttpsBindingAddressVarenv, TLSAutoDomainVarenv, TLSCertFilepathVarenv, TLSCertKeyFilepathVarenv)
+		errs = append(errs, errors.New("HTTPS binding address (https_binding_address) is set but neither auto TLS (tls_auto_domain) nor manual TLS (tls_cert_filepath and tls_cert_key_filepath) are enabled"))
+	}
+
+	if err := cnf.validateListeners(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch cnf.HttpMode {
+	case "", HTTPModeApp:
+	case HTTPModeRedirect:
+		if cnf.HttpBindingAddress == "" || cnf.HttpsBindingAddress == "" {
+			errs = append(errs, errors.New("HTTP (http_binding_address) and HTTPS (https_binding_address) binding addresses must be set when the HTTP listener redirects to HTTPS (http_mode)"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("HTTP listener mode (http_mode) must be empty, %q or %q", HTTPModeApp, HTTPModeRedirect))
+	}
+	if cnf.HttpsRedirectPort < 0 || cnf.HttpsRedirectPort > 65535 {
+		errs = append(errs, errors.New("HTTPS redirect port (https_redirect_port) must be between 0 and 65535"))
+	}
+
+	errs = append(errs, cnf.HTTPTimeouts.Validate("http"), cnf.HTTPSTimeouts.Validate("https"))
+	if cnf.UploadTimeout < 0 {
+		errs = append(errs, errors.New("upload timeout (upload_timeout) must not be negative"))
+	}
+
+	if err := cnf.validateAutoTLS(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := cnf.validateClientAuth(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if cnf.LogFormat != LogFormatJSON && cnf.LogFormat != LogFormatText {
+		errs = append(errs, fmt.Errorf("log format (log_format) must be %q or %q", LogFormatJSON, LogFormatText))
+	}
+
+	trustedProxies, err := parseNetworks(cnf.TrustedProxies)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid trusted proxies (trusted_proxies): %w", err))
+	}
+	if cnf.ProxyProtocol && err == nil && len(trustedProxies) == 0 {
+		errs = append(errs, errors.New("trusted proxies (trusted_proxies) must be set when the PROXY protocol (proxy_protocol) is enabled"))
+	}
+
+	if _, err := cnf.IPFilters.parse(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid IP filters (allowed_cidrs and denied_cidrs): %w", err))
+	}
+
+	if cnf.RateLimitRedisURL != "" {
+		if _, err := redis.ParseURL(cnf.RateLimitRedisURL); err != nil {
+			errs = append(errs, fmt.Errorf("invalid rate limit Redis URL (rate_limit_redis_url): %w", err))
+		}
+	}
+
+	if cnf.AuditLog != "" && len(cnf.AuditChainKey) < minAuditChainKeyLength {
+		errs = append(errs, fmt.Errorf("audit chain key (audit_chain_key) of at least %d characters must be set when auditing is enabled (audit_log)", minAuditChainKeyLength))
+	}
+
+	if cnf.SigningKey != "" && len(cnf.SigningKey) < minSigningKeyLength {
+		errs = append(errs, fmt.Errorf("signing key (signing_key) must be at least %d characters long", minSigningKeyLength))
+	}
+
+	switch cnf.Challenge {
+	case "", api.ChallengeProofOfWork:
+	case api.ChallengeHCaptcha, api.ChallengeTurnstile:
+		if cnf.CaptchaSiteKey == "" || cnf.CaptchaSecret == "" {
+			errs = append(errs, fmt.Errorf("CAPTCHA site key (captcha_site_key) and secret (captcha_secret) must be set when the challenge is %s", cnf.Challenge))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("challenge (challenge) must be empty, %q, %q or %q", api.ChallengeProofOfWork, api.ChallengeHCaptcha, api.ChallengeTurnstile))
+	}
+	if cnf.ChallengeDifficulty < 0 || cnf.ChallengeDifficulty > maxChallengeDifficulty {
+		errs = append(errs, fmt.Errorf("challenge difficulty (challenge_difficulty) must be between 1 and %d, or 0 for the default (%d)", maxChallengeDifficulty, DefaultChallengeDifficulty))
 	}
 
-	if cnf.VaultPrefix == "" {
-		cnf.VaultPrefix = "cubbyhole/"
+	if cnf.OIDCIssuer != "" {
+		if _, err := url.ParseRequestURI(cnf.OIDCIssuer); err != nil {
+			errs = append(errs, fmt.Errorf("invalid OpenID Connect issuer (oidc_issuer): %w", err))
+		}
+		if cnf.OIDCClientID == "" || cnf.OIDCRedirectURL == "" {
+			errs = append(errs, errors.New("OpenID Connect client ID (oidc_client_id) and redirect URL (oidc_redirect_url) must be set when login is enabled (oidc_issuer)"))
+		} else if u, err := url.Parse(cnf.OIDCRedirectURL); err != nil || u.Path != callbackPath {
+			errs = append(errs, fmt.Errorf("OpenID Connect redirect URL (oidc_redirect_url) must be the URL of %s", callbackPath))
+		}
+		if cnf.OIDCSessionTTL < 0 {
+			errs = append(errs, errors.New("session TTL (oidc_session_ttl) must not be negative"))
+		}
+	} else if cnf.OIDCRequireForRetrieval {
+		errs = append(errs, errors.New("OpenID Connect issuer (oidc_issuer) must be set when login is required for retrieval (oidc_require_for_retrieval)"))
 	}
 
-	log.Println("[INFO] HTTP Binding Address:", cnf.HttpBindingAddress)
-	log.Println("[INFO] HTTPS Binding Address:", cnf.HttpsBindingAddress)
-	log.Println("[INFO] HTTPS Redirect enabled:", cnf.HttpsRedirectEnabled)
-	log.Println("[INFO] TLS Auto Domain:", cnf.TLSAutoDomain)
-	log.Println("[INFO] TLS Cert Filepath:", cnf.TLSCertFilepath)
-	log.Println("[INFO] TLS Cert Key Filepath:", cnf.TLSCertKeyFilepath)
-	log.Println("[INFO] Vault prefix:", cnf.VaultPrefix)
-	log.Println("[INFO] Allowed Origins:", cnf.AllowedOrigins)
+	if cnf.APIKeysFile != "" {
+		keys, err := ReadAPIKeys(cnf.APIKeysFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid API keys file (api_keys_file): %w", err))
+		}
+		for _, k := range keys {
+			if err := cnf.Limits.orDefault().checkAPIKey(k); err != nil {
+				errs = append(errs, fmt.Errorf("invalid API keys file (api_keys_file): %w", err))
+			}
+		}
+	}
+
+	errs = append(errs, cnf.Limits.Validate())
+
+	return errors.Join(errs...)
+}
+
+// redactedValues returns the value of each setting, in order, with secrets redacted.
+func (cnf conf) redactedValues() []any {
+	values := make([]any, len(settings))
+	for i, s := range settings {
+		values[i] = s.get(&cnf)
+		if s.secret && values[i] != "" {
+			values[i] = redacted
+		}
+	}
+	return values
+}
 
-	return cnf
+// WriteConfig writes cnf to w in the configuration file format, with secrets redacted.
+func WriteConfig(w io.Writer, cnf conf) error {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for i, value := range cnf.redactedValues() {
+		var node yaml.Node
+		if err := node.Encode(value); err != nil {
+			return err
+		}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: settings[i].key}, &node)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// LogConfig logs the effective configuration, with secrets redacted.
+func LogConfig(cnf conf) {
+	values := cnf.redactedValues()
+	attrs := make([]any, len(values))
+	for i, value := range values {
+		attrs[i] = slog.Any(settings[i].key, value)
+	}
+	slog.Info("Configuration", attrs...)
 }
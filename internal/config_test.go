@@ -1,26 +1,437 @@
 package internal
 
 import (
+	"bytes"
+	"flag"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestLoadConfig(t *testing.T) {
-	_ = os.Setenv(HttpBindingAddressVarenv, ":8080")
-	_ = os.Setenv(VaultPrefixenv, "cubbyhole/")
-	_ = os.Setenv(AllowedOriginsVarenv, "http://localhost,https://example.com")
-	defer func() {
-		_ = os.Unsetenv(HttpBindingAddressVarenv)
-		_ = os.Unsetenv(VaultPrefixenv)
-		_ = os.Unsetenv(AllowedOriginsVarenv)
-	}()
+// mapGetenv returns a getenv function reading from env.
+func mapGetenv(env map[string]string) func(string) string {
+	return func(k string) string { return env[k] }
+}
 
-	cnf := LoadConfig()
+// writeConfigFile writes content to a temporary configuration file and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cnf, err := LoadConfig("", mapGetenv(map[string]string{
+		HttpBindingAddressVarenv: ":8080",
+		VaultPrefixenv:           "cubbyhole/",
+		AllowedOriginsVarenv:     "http://localhost,https://example.com",
+	}), nil)
+	require.NoError(t, err)
 
 	assert.Equal(t, ":8080", cnf.HttpBindingAddress)
 	assert.Equal(t, "cubbyhole/", cnf.VaultPrefix)
 	assert.False(t, cnf.HttpsRedirectEnabled)
 	assert.Equal(t, []string{"http://localhost", "https://example.com"}, cnf.AllowedOrigins)
 }
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cnf, err := LoadConfig("", mapGetenv(map[string]string{HttpBindingAddressVarenv: ":8080"}), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "cubbyhole/", cnf.VaultPrefix)
+	assert.Equal(t, []string{""}, cnf.AllowedOrigins)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+http_binding_address: ":1000"
+https_redirect_enabled: true
+vault_prefix: file/
+vault_addr: http://file:8200
+allowed_origins:
+  - https://a.example.com
+  - https://b.example.com
+`)
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		args     []string
+		expected conf
+	}{
+		{
+			name: "file only",
+			expected: conf{
+				HttpBindingAddress:   ":1000",
+				HttpsRedirectEnabled: true,
+				VaultAddress:         "http://file:8200",
+				VaultPrefix:          "file/",
+				AllowedOrigins:       []string{"https://a.example.com", "https://b.example.com"},
+				Limits:               DefaultLimits(),
+				RateLimits:           DefaultRateLimits(),
+				LogFormat:            LogFormatJSON,
+			},
+		},
+		{
+			name: "env overrides file",
+			env: map[string]string{
+				HttpBindingAddressVarenv:   ":2000",
+				HttpsRedirectEnabledVarenv: "false",
+				AllowedOriginsVarenv:       "https://env.example.com",
+			},
+			expected: conf{
+				HttpBindingAddress: ":2000",
+				VaultAddress:       "http://file:8200",
+				VaultPrefix:        "file/",
+				AllowedOrigins:     []string{"https://env.example.com"},
+				Limits:             DefaultLimits(),
+				RateLimits:         DefaultRateLimits(),
+				LogFormat:          LogFormatJSON,
+			},
+		},
+		{
+			name: "flags override env",
+			env: map[string]string{
+				HttpBindingAddressVarenv: ":2000",
+				VaultPrefixenv:           "env/",
+			},
+			args: []string{"--http-binding-address", ":3000", "--https-redirect-enabled=false", "--vault-token", "flag-token"},
+			expected: conf{
+				HttpBindingAddress: ":3000",
+				VaultAddress:       "http://file:8200",
+				VaultToken:         "flag-token",
+				VaultPrefix:        "env/",
+				AllowedOrigins:     []string{"https://a.example.com", "https://b.example.com"},
+				Limits:             DefaultLimits(),
+				RateLimits:         DefaultRateLimits(),
+				LogFormat:          LogFormatJSON,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags := RegisterConfigFlags(fs)
+			require.NoError(t, fs.Parse(tt.args))
+
+			cnf, err := LoadConfig(path, mapGetenv(tt.env), flags)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, cnf)
+		})
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	path := writeConfigFile(t, "http_binding_address: \":1000\"\n")
+
+	cnf, err := LoadConfig("", mapGetenv(map[string]string{ConfigFileVarenv: path}), nil)
+	require.NoError(t, err)
+	assert.Equal(t, ":1000", cnf.HttpBindingAddress)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		expected string
+	}{
+		{
+			name:     "unknown file key",
+			file:     "http_bind_address: \":80\"\n",
+			expected: `unknown setting "http_bind_address"`,
+		},
+		{
+			name:     "invalid yaml",
+			file:     "http_binding_address: [\n",
+			expected: "parsing configuration file",
+		},
+		{
+			name:     "invalid bool in file",
+			file:     "http_binding_address: \":80\"\nhttps_redirect_enabled: maybe\n",
+			expected: "invalid https_redirect_enabled",
+		},
+		{
+			name:     "invalid bool in env",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", HttpsRedirectEnabledVarenv: "yes please"},
+			expected: "invalid " + HttpsRedirectEnabledVarenv,
+		},
+		{
+			name:     "no binding",
+			expected: "HTTP binding address (http_binding_address) must be set",
+		},
+		{
+			name: "auto and manual TLS",
+			env: map[string]string{
+				HttpsBindingAddressVarenv: ":443",
+				TLSAutoDomainVarenv:       "secrets.example.com",
+				TLSCertFilepathVarenv:     "cert.pem",
+				TLSCertKeyFilepathVarenv:  "key.pem",
+			},
+			expected: "mutually exclusive",
+		},
+		{
+			name: "manual TLS without key",
+			env: map[string]string{
+				HttpsBindingAddressVarenv: ":443",
+				TLSCertFilepathVarenv:     "cert.pem",
+			},
+			expected: "must be set when using manual TLS",
+		},
+		{
+			name:     "TLS without HTTPS binding",
+			env:      map[string]string{TLSAutoDomainVarenv: "secrets.example.com"},
+			expected: "HTTPS binding address (https_binding_address) must be set",
+		},
+		{
+			name:     "invalid log level",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", LogLevelVarenv: "verbose"},
+			expected: "invalid " + LogLevelVarenv,
+		},
+		{
+			name:     "invalid log format",
+			file:     "http_binding_address: \":80\"\nlog_format: xml\n",
+			expected: "log format (log_format) must be",
+		},
+		{
+			name:     "invalid trusted proxy",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", TrustedProxiesVarenv: "10.0.0.0/8,lb.example.com"},
+			expected: "trusted_proxies",
+		},
+		{
+			name:     "PROXY protocol without trusted proxies",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", ProxyProtocolVarenv: "true"},
+			expected: "trusted proxies (trusted_proxies) must be set",
+		},
+		{
+			name:     "invalid rate limit",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", RateLimitCreateVarenv: "20 per minute"},
+			expected: "invalid " + RateLimitCreateVarenv,
+		},
+		{
+			name:     "invalid rate limit Redis URL",
+			file:     "http_binding_address: \":80\"\nrate_limit_redis_url: http://redis:6379\n",
+			expected: "rate_limit_redis_url",
+		},
+		{
+			name:     "audit log without chain key",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", AuditLogVarenv: "stdout", AuditChainKeyVarenv: "secret"},
+			expected: "audit chain key (audit_chain_key) of at least 32 characters must be set",
+		},
+		{
+			name:     "short signing key",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", SigningKeyVarenv: "secret"},
+			expected: "signing key (signing_key) must be at least 32 characters long",
+		},
+		{
+			name:     "unknown challenge",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", ChallengeVarenv: "recaptcha"},
+			expected: "challenge (challenge) must be",
+		},
+		{
+			name:     "invalid challenge difficulty",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", ChallengeVarenv: "pow", ChallengeDifficultyVarenv: "hard"},
+			expected: "invalid " + ChallengeDifficultyVarenv,
+		},
+		{
+			name:     "challenge difficulty too high",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", ChallengeVarenv: "pow", ChallengeDifficultyVarenv: "64"},
+			expected: "challenge difficulty (challenge_difficulty) must be between 1 and 32, or 0 for the default (18)",
+		},
+		{
+			name:     "CAPTCHA without secret",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", ChallengeVarenv: "turnstile", CaptchaSiteKeyVarenv: "site-key"},
+			expected: "captcha_secret",
+		},
+		{
+			name:     "OpenID Connect without client",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", OIDCIssuerVarenv: "https://idp.example.com"},
+			expected: "OpenID Connect client ID (oidc_client_id) and redirect URL (oidc_redirect_url) must be set",
+		},
+		{
+			name: "OpenID Connect redirect URL not to the callback",
+			env: map[string]string{
+				HttpBindingAddressVarenv: ":80",
+				OIDCIssuerVarenv:         "https://idp.example.com",
+				OIDCClientIDVarenv:       "sup3r",
+				OIDCRedirectURLVarenv:    "https://secrets.example.com/callback",
+			},
+			expected: "must be the URL of /auth/callback",
+		},
+		{
+			name:     "negative session TTL",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", OIDCIssuerVarenv: "https://idp.example.com", OIDCSessionTTLVarenv: "-1h"},
+			expected: "session TTL (oidc_session_ttl) must not be negative",
+		},
+		{
+			name:     "login for retrieval without OpenID Connect",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", OIDCRequireForRetrievalVarenv: "true"},
+			expected: "OpenID Connect issuer (oidc_issuer) must be set",
+		},
+		{
+			name:     "HTTPS binding without TLS",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", HttpsBindingAddressVarenv: ":443"},
+			expected: "neither auto TLS",
+		},
+		{
+			name:     "invalid CIDR",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", AllowedCIDRsCreateVarenv: "10.0.0.0/8,10.0.0.0/33"},
+			expected: "create routes: allowed networks: invalid IP address or CIDR \"10.0.0.0/33\"",
+		},
+		{
+			name:     "unreadable API keys file",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", APIKeysFileVarenv: "/"},
+			expected: "invalid API keys file (api_keys_file)",
+		},
+		{
+			name:     "invalid HTTP mode",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", HttpModeVarenv: "proxy"},
+			expected: "HTTP listener mode (http_mode) must be empty",
+		},
+		{
+			name:     "redirect mode without HTTPS",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", HttpModeVarenv: "redirect"},
+			expected: "binding addresses must be set when the HTTP listener redirects to HTTPS",
+		},
+		{
+			name:     "Unix domain socket without path",
+			env:      map[string]string{HttpBindingAddressVarenv: "unix:"},
+			expected: "binding address (http_binding_address) of a Unix domain socket must have a path",
+		},
+		{
+			name:     "systemd socket without name",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", GrpcBindingAddressVarenv: "systemd:"},
+			expected: "binding address (grpc_binding_address) of a systemd socket must have a name",
+		},
+		{
+			name:     "invalid Unix domain socket permissions",
+			env:      map[string]string{HttpBindingAddressVarenv: "unix:/run/sup3r/http.sock", UnixSocketModeVarenv: "660x"},
+			expected: "permissions of the Unix domain sockets (unix_socket_mode)",
+		},
+		{
+			name:     "negative HTTPS timeout",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", HTTPSWriteTimeoutVarenv: "-1s"},
+			expected: "HTTPS write timeout (https_write_timeout) must not be negative",
+		},
+		{
+			name:     "negative upload timeout",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", UploadTimeoutVarenv: "-1m"},
+			expected: "upload timeout (upload_timeout) must not be negative",
+		},
+		{
+			name:     "invalid ACME directory URL",
+			env:      map[string]string{HttpsBindingAddressVarenv: ":443", TLSAutoDomainVarenv: "example.com", TLSACMEDirectoryURLVarenv: "acme.example.com"},
+			expected: "invalid ACME directory URL (tls_acme_directory_url)",
+		},
+		{
+			name:     "ACME external account binding without HMAC key",
+			env:      map[string]string{HttpsBindingAddressVarenv: ":443", TLSAutoDomainVarenv: "example.com", TLSACMEEABKeyIDVarenv: "kid"},
+			expected: "both ACME external account binding key ID (tls_acme_eab_key_id) and HMAC key (tls_acme_eab_hmac_key) must be set",
+		},
+		{
+			name:     "invalid client certificate authentication",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", TLSClientAuthVarenv: "optional"},
+			expected: "client certificate authentication (tls_client_auth) must be empty",
+		},
+		{
+			name:     "client certificate authentication without CA bundle",
+			env:      map[string]string{HttpsBindingAddressVarenv: ":443", TLSAutoDomainVarenv: "example.com", TLSClientAuthVarenv: "require"},
+			expected: "client CA bundle (tls_client_ca_file) must be set",
+		},
+		{
+			name:     "client certificate subjects without authentication",
+			env:      map[string]string{HttpBindingAddressVarenv: ":80", TLSClientSubjectsVarenv: "ci"},
+			expected: "client certificate authentication (tls_client_auth) must be set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = writeConfigFile(t, tt.file)
+			}
+			_, err := LoadConfig(path, mapGetenv(tt.env), nil)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	path := writeConfigFile(t, `
+http_binding_address: ":80"
+max_file_size: 100M
+body_limit: 102MB
+max_ttl: 720h
+`)
+
+	cnf, err := LoadConfig(path, mapGetenv(map[string]string{
+		MaxMessageSizeVarenv: "64K",
+		DefaultTTLVarenv:     "1h",
+	}), ConfigFlags{"min_ttl": "5m"})
+	require.NoError(t, err)
+
+	assert.Equal(t, Limits{
+		MaxMessageSize: 64 * 1024,
+		MaxFileSize:    100 * 1024 * 1024,
+		BodyLimit:      102 * 1024 * 1024,
+		MinTTL:         5 * time.Minute,
+		MaxTTL:         720 * time.Hour,
+		DefaultTTL:     time.Hour,
+	}, cnf.Limits)
+
+	_, err = LoadConfig(path, mapGetenv(map[string]string{MaxFileSizeVarenv: "200M"}), nil)
+	assert.ErrorContains(t, err, "body_limit")
+
+	_, err = LoadConfig(path, mapGetenv(map[string]string{MaxMessageSizeVarenv: "lots"}), nil)
+	assert.ErrorContains(t, err, "invalid "+MaxMessageSizeVarenv)
+}
+
+func TestLoadConfigTimeouts(t *testing.T) {
+	path := writeConfigFile(t, `
+http_binding_address: ":80"
+http_read_timeout: 30s
+https_idle_timeout: 5m
+upload_timeout: 1h
+`)
+
+	cnf, err := LoadConfig(path, mapGetenv(map[string]string{
+		HTTPWriteTimeoutVarenv: "1m",
+		H2CEnabledVarenv:       "true",
+	}), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, Timeouts{Read: 30 * time.Second, Write: time.Minute}, cnf.HTTPTimeouts)
+	assert.Equal(t, Timeouts{Idle: 5 * time.Minute}, cnf.HTTPSTimeouts)
+	assert.Equal(t, time.Hour, cnf.UploadTimeout)
+	assert.True(t, cnf.H2CEnabled)
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	_, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"), mapGetenv(nil), nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWriteConfigRedactsSecrets(t *testing.T) {
+	cnf := DefaultConfig()
+	cnf.HttpBindingAddress = ":8080"
+	cnf.VaultToken = "hvs.supersecrettoken"
+	cnf.AllowedOrigins = []string{"https://example.com"}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteConfig(buf, cnf))
+	assert.NotContains(t, buf.String(), "supersecrettoken")
+	assert.Contains(t, buf.String(), "vault_token: <redacted>")
+
+	// The printed configuration can be loaded back, except for redacted secrets.
+	loaded, err := LoadConfig(writeConfigFile(t, buf.String()), mapGetenv(nil), nil)
+	require.NoError(t, err)
+	cnf.VaultToken = redacted
+	assert.Equal(t, cnf, loaded)
+}
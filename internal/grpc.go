@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// grpcSecretServer implements the gRPC SecretService on top of the same
+// SecretMsgStorer and validation rules as the HTTP handlers.
+type grpcSecretServer struct {
+	secretv1.UnimplementedSecretServiceServer
+	handlers *SecretHandlers
+}
+
+// newGRPCServer creates a gRPC server exposing SecretService backed by the provided handlers.
+// Incoming messages are bounded by the request body limit, which leaves room for the largest
+// allowed file and message plus framing overhead.
+// Additional server options (e.g. transport credentials) can be passed through opts.
+func newGRPCServer(handlers *SecretHandlers, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append([]grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(handlers.limits.BodyLimit)),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.UnaryInterceptor(grpcLoggingInterceptor),
+	}, opts...)
+	gs := grpc.NewServer(opts...)
+	secretv1.RegisterSecretServiceServer(gs, &grpcSecretServer{handlers: handlers})
+	return gs
+}
+
+// grpcServerOptions returns the gRPC server options derived from the configuration.
+// When TLS is configured, the gRPC listener serves the certificates of getCertificate,
+// shared with the HTTPS listener so that renewed certificates are served by both, and
+// verifies the client certificates like the HTTPS listener. The listener is plaintext when
+// getCertificate is nil.
+func grpcServerOptions(cnf conf, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) ([]grpc.ServerOption, error) {
+	if getCertificate == nil {
+		return nil, nil
+	}
+
+	config := &tls.Config{GetCertificate: getCertificate, MinVersion: tls.VersionTLS12}
+	if err := withClientAuth(config, cnf); err != nil {
+		return nil, fmt.Errorf("client certificate authentication: %w", err)
+	}
+	return []grpc.ServerOption{grpc.Creds(credentials.NewTLS(config))}, nil
+}
+
+// CreateSecret validates and stores a message and optional file, returning one-time tokens.
+func (g *grpcSecretServer) CreateSecret(ctx context.Context, req *secretv1.CreateSecretRequest) (*secretv1.CreateSecretResponse, error) {
+	if err := g.handlers.validateMsg(req.GetMsg()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	ttl, err := g.handlers.resolveTTL(req.GetTtl())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	reads := int(req.GetReads())
+	if reads == 0 {
+		reads = 1
+	}
+	if err := g.handlers.validateReads(reads); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	policy, err := parseAccessPolicy(strings.Join(req.GetRecipients(), ","), strings.Join(req.GetRecipientGroups(), ","), strings.Join(req.GetAllowedCidrs(), ","))
+	if err == nil {
+		err = g.handlers.validateAccessPolicy(policy)
+	}
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp := &secretv1.CreateSecretResponse{}
+	if f := req.GetFile(); f != nil && len(f.GetContent()) > 0 {
+		if int64(len(f.GetContent())) > g.handlers.limits.MaxFileSize {
+			return nil, status.Error(codes.InvalidArgument, "file too large")
+		}
+		if err := validateFilename(f.GetName()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		fileToken, err := g.handlers.storeFile(ctx, f.GetContent(), ttl, reads, policy)
+		if err != nil {
+			loggerFrom(ctx).Error("Failed to store file", "error", err)
+			return nil, status.Error(codes.Internal, "failed to store file")
+		}
+		resp.FileToken = fileToken
+		resp.FileName = f.GetName()
+	}
+
+	token, err := g.handlers.storeMsg(ctx, req.GetMsg(), ttl, reads, policy)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to store secret", "error", err)
+		return nil, status.Error(codes.Internal, "failed to store secret")
+	}
+	resp.Token = token
+
+	return resp, nil
+}
+
+// GetSecret retrieves a secret by token. The secret is destroyed once read. Secrets
+// restricted to recipients cannot be retrieved, as gRPC clients do not log in, and those
+// restricted to networks only from these networks.
+func (g *grpcSecretServer) GetSecret(ctx context.Context, req *secretv1.GetSecretRequest) (*secretv1.GetSecretResponse, error) {
+	if err := validateVaultToken(req.GetToken()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := g.handlers.checkAccess(ctx, req.GetToken()); err != nil {
+		return nil, grpcAccessError(ctx, err, "Failed to retrieve secret")
+	}
+
+	msg, err := g.handlers.getMsg(ctx, req.GetToken())
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to retrieve secret", "error", err)
+		return nil, status.Error(codes.NotFound, "secret not found or already consumed")
+	}
+
+	return &secretv1.GetSecretResponse{Msg: msg}, nil
+}
+
+// RevokeSecret destroys a secret without reading it, with the same access restrictions as
+// GetSecret. Returns Unimplemented when the storage backend does not implement SecretMsgRevoker.
+func (g *grpcSecretServer) RevokeSecret(ctx context.Context, req *secretv1.RevokeSecretRequest) (*secretv1.RevokeSecretResponse, error) {
+	if _, ok := g.handlers.store.(SecretMsgRevoker); !ok {
+		return nil, status.Error(codes.Unimplemented, "storage backend does not support revocation")
+	}
+
+	if err := validateVaultToken(req.GetToken()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := g.handlers.checkAccess(ctx, req.GetToken()); err != nil {
+		return nil, grpcAccessError(ctx, err, "Failed to revoke secret")
+	}
+
+	if err := g.handlers.revokeMsg(ctx, req.GetToken()); err != nil {
+		loggerFrom(ctx).Error("Failed to revoke secret", "error", err)
+		return nil, status.Error(codes.NotFound, "secret not found or already consumed")
+	}
+
+	return &secretv1.RevokeSecretResponse{}, nil
+}
+
+// grpcAccessError maps an error of checkAccess to the status of a call on the secret. Storage
+// errors are logged with msg, and reported as a missing secret.
+func grpcAccessError(ctx context.Context, err error, msg string) error {
+	if errors.Is(err, errNetworkNotAllowed) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if errors.Is(err, errLoginRequired) || errors.Is(err, errNotRecipient) {
+		return status.Error(codes.PermissionDenied, "secret restricted to recipients")
+	}
+	loggerFrom(ctx).Error(msg, "error", err)
+	return status.Error(codes.NotFound, "secret not found or already consumed")
+}
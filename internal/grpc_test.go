@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+type FakeSecretMsgRevoker struct {
+	FakeSecretMsgStorer
+	revokedToken string
+}
+
+func (f *FakeSecretMsgRevoker) Revoke(_ context.Context, token string) error {
+	f.revokedToken = token
+	return f.err
+}
+
+// newTestGRPCClient serves SecretService over an in-process bufconn listener, with the
+// given server options, and returns a client connected to it.
+func newTestGRPCClient(t *testing.T, store SecretMsgStorer, opts ...grpc.ServerOption) secretv1.SecretServiceClient {
+	t.Helper()
+
+	ln := bufconn.Listen(1024 * 1024)
+	gs := newGRPCServer(NewSecretHandlers(store), opts...)
+	go func() { _ = gs.Serve(ln) }()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(int(DefaultLimits().BodyLimit))),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return secretv1.NewSecretServiceClient(conn)
+}
+
+func TestGRPCCreateSecret(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      *secretv1.CreateSecretRequest
+		wantCode codes.Code
+		wantFile bool
+	}{
+		{"valid message", &secretv1.CreateSecretRequest{Msg: "secret", Ttl: "1h"}, codes.OK, false},
+		{"valid message, no ttl", &secretv1.CreateSecretRequest{Msg: "secret"}, codes.OK, false},
+		{"valid message with file", &secretv1.CreateSecretRequest{
+			Msg:  "secret",
+			File: &secretv1.File{Name: "test.txt", Content: []byte("file content")},
+		}, codes.OK, true},
+		{"empty file is ignored", &secretv1.CreateSecretRequest{
+			Msg:  "secret",
+			File: &secretv1.File{Name: "empty.txt"},
+		}, codes.OK, false},
+		{"empty message", &secretv1.CreateSecretRequest{Msg: ""}, codes.InvalidArgument, false},
+		{"message too large", &secretv1.CreateSecretRequest{Msg: strings.Repeat("a", int(DefaultLimits().MaxMessageSize)+1)}, codes.InvalidArgument, false},
+		{"invalid ttl", &secretv1.CreateSecretRequest{Msg: "secret", Ttl: "30s"}, codes.InvalidArgument, false},
+		{"file with path traversal", &secretv1.CreateSecretRequest{
+			Msg:  "secret",
+			File: &secretv1.File{Name: "../etc/passwd", Content: []byte("malicious")},
+		}, codes.InvalidArgument, false},
+		{"file too big", &secretv1.CreateSecretRequest{
+			Msg:  "secret",
+			File: &secretv1.File{Name: "bigfile.txt", Content: make([]byte, DefaultLimits().MaxFileSize+1)},
+		}, codes.InvalidArgument, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &FakeSecretMsgStorer{token: "msg-token-123"}
+			client := newTestGRPCClient(t, store)
+
+			resp, err := client.CreateSecret(context.Background(), tt.req)
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			if tt.wantCode != codes.OK {
+				return
+			}
+
+			assert.Equal(t, "msg-token-123", resp.GetToken())
+			assert.Equal(t, tt.req.GetMsg(), store.lastMsg)
+			if tt.wantFile {
+				assert.NotEmpty(t, resp.GetFileToken())
+				assert.Equal(t, tt.req.GetFile().GetName(), resp.GetFileName())
+			} else {
+				assert.Empty(t, resp.GetFileToken())
+				assert.Empty(t, resp.GetFileName())
+			}
+		})
+	}
+}
+
+func TestGRPCCreateSecretStoreError(t *testing.T) {
+	client := newTestGRPCClient(t, &FakeSecretMsgStorer{err: errors.New("vault down")})
+
+	_, err := client.CreateSecret(context.Background(), &secretv1.CreateSecretRequest{Msg: "secret"})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestGRPCCreateRestrictedSecret(t *testing.T) {
+	clientIP := "192.0.2.1"
+	client := newTestGRPCClient(t, NewMemoryStore(), grpc.ChainUnaryInterceptor(
+		func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			return handler(withClientIP(ctx, clientIP), req)
+		}))
+
+	resp, err := client.CreateSecret(context.Background(), &secretv1.CreateSecretRequest{Msg: "secret", AllowedCidrs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+
+	_, err = client.GetSecret(context.Background(), &secretv1.GetSecretRequest{Token: resp.GetToken()})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	clientIP = "10.1.2.3"
+	got, err := client.GetSecret(context.Background(), &secretv1.GetSecretRequest{Token: resp.GetToken()})
+	require.NoError(t, err, "denied attempts do not consume the secret")
+	assert.Equal(t, "secret", got.GetMsg())
+
+	_, err = client.CreateSecret(context.Background(), &secretv1.CreateSecretRequest{Msg: "secret", AllowedCidrs: []string{"10.0.0.0/33"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateSecret(context.Background(), &secretv1.CreateSecretRequest{Msg: "secret", Recipients: []string{"alice@example.com"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "recipient restrictions require single sign-on")
+
+	client = newTestGRPCClient(t, &FakeSecretMsgStorer{})
+	_, err = client.CreateSecret(context.Background(), &secretv1.CreateSecretRequest{Msg: "secret", AllowedCidrs: []string{"10.0.0.0/8"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "the store does not support access policies")
+}
+
+func TestGRPCRevokeRestrictedSecret(t *testing.T) {
+	store := NewMemoryStore()
+	clientIP := "192.0.2.1"
+	client := newTestGRPCClient(t, store, grpc.ChainUnaryInterceptor(
+		func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			return handler(withClientIP(ctx, clientIP), req)
+		}))
+	token, err := store.StoreWithPolicy(context.Background(), "secret", "1h", 1, AccessPolicy{CIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+
+	_, err = client.RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: token})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, status.Convert(err).Message(), "network")
+
+	clientIP = "10.1.2.3"
+	_, err = client.RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: token})
+	require.NoError(t, err, "denied attempts do not destroy the secret")
+	_, err = store.Get(context.Background(), token)
+	assert.Error(t, err)
+}
+
+func TestGRPCGetSecret(t *testing.T) {
+	validToken := "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+
+	tests := []struct {
+		name     string
+		token    string
+		storeErr error
+		wantCode codes.Code
+	}{
+		{"successful retrieval", validToken, nil, codes.OK},
+		{"retrieval with error", validToken, errors.New("expired"), codes.NotFound},
+		{"invalid token format", "invalid-token-123", nil, codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &FakeSecretMsgStorer{msg: "secret", err: tt.storeErr}
+			client := newTestGRPCClient(t, store)
+
+			resp, err := client.GetSecret(context.Background(), &secretv1.GetSecretRequest{Token: tt.token})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			if tt.wantCode == codes.OK {
+				assert.Equal(t, "secret", resp.GetMsg())
+				assert.Equal(t, tt.token, store.lastUsedToken)
+			}
+		})
+	}
+}
+
+func TestGRPCRevokeSecret(t *testing.T) {
+	validToken := "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+
+	t.Run("unsupported by storage backend", func(t *testing.T) {
+		client := newTestGRPCClient(t, &FakeSecretMsgStorer{})
+
+		_, err := client.RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: validToken})
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+
+	t.Run("successful revocation", func(t *testing.T) {
+		store := &FakeSecretMsgRevoker{}
+		client := newTestGRPCClient(t, store)
+
+		_, err := client.RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: validToken})
+		assert.NoError(t, err)
+		assert.Equal(t, validToken, store.revokedToken)
+	})
+
+	t.Run("invalid token format", func(t *testing.T) {
+		store := &FakeSecretMsgRevoker{}
+		client := newTestGRPCClient(t, store)
+
+		_, err := client.RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: "invalid"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Empty(t, store.revokedToken)
+	})
+
+	t.Run("revocation failure", func(t *testing.T) {
+		store := &FakeSecretMsgRevoker{FakeSecretMsgStorer: FakeSecretMsgStorer{err: errors.New("gone")}}
+		client := newTestGRPCClient(t, store)
+
+		_, err := client.RevokeSecret(context.Background(), &secretv1.RevokeSecretRequest{Token: validToken})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+	})
+}
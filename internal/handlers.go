@@ -1,82 +1,127 @@
 package internal
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
-	"time"
 
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // tokenRegex matches valid Vault token formats for hv.sb and legacy tokens.
 var tokenRegex = regexp.MustCompile(`^hv[sb]\.(?:[A-Za-z0-9]{24}|[A-Za-z0-9_-]{91,})$`)
 
+// LimitsResponse represents the API response describing the server limits.
+// It is an alias of the public api.Limits shared with the client SDK.
+type LimitsResponse = api.Limits
+
 // TokenResponse represents the API response when creating a new secret message.
-// It includes a token for retrieving the message, and optional file token and name
-// if a file was uploaded alongside the message.
-type TokenResponse struct {
-	// Token is the unique identifier for retrieving the secret message.
-	Token string `json:"token"`
-	// FileToken is the unique identifier for retrieving an uploaded file (optional).
-	FileToken string `json:"filetoken,omitempty"`
-	// FileName is the original name of the uploaded file (optional).
-	FileName string `json:"filename,omitempty"`
-}
+// It is an alias of the public api.TokenResponse shared with the client SDK.
+type TokenResponse = api.TokenResponse
 
 // MsgResponse represents the API response when retrieving a secret message.
-type MsgResponse struct {
-	// Msg is the secret message content retrieved from Vault.
-	Msg string `json:"msg"`
-}
+// It is an alias of the public api.MsgResponse shared with the client SDK.
+type MsgResponse = api.MsgResponse
 
 // SecretHandlers provides HTTP handler methods for creating and retrieving secret messages.
 type SecretHandlers struct {
 	// store is the backend storage implementation (Vault) for secret messages.
 	store SecretMsgStorer
+	// limits bounds the size and time-to-live of created secrets.
+	limits Limits
+	// audit records the lifecycle events of secrets, when enabled.
+	audit *AuditLog
+	// readiness checks the health of store, for the readiness endpoint.
+	readiness *readinessCheck
+	// signer issues the confirmation nonces required to retrieve secrets.
+	signer *signer
+	// challenge must be solved by anonymous clients to create secrets, when enabled.
+	challenge Challenge
+	// auth logs users in with OpenID Connect, when enabled.
+	auth *oidcAuth
+	// getMsgPage is the template of the /getmsg page, loaded by NewServer.
+	getMsgPage *template.Template
 }
 
 // NewSecretHandlers creates a new SecretHandlers instance with the provided storage backend.
+// DefaultLimits and a random signing key apply until the handlers are passed to NewServer,
+// which applies the configured ones.
 func NewSecretHandlers(s SecretMsgStorer) *SecretHandlers {
-	return &SecretHandlers{s}
+	return &SecretHandlers{store: s, limits: DefaultLimits(), readiness: newReadinessCheck(s), signer: newSigner(nil)}
+}
+
+// SetAuditLog records the lifecycle events of secrets in a. Expiry is only recorded for
+// storage backends that report it, by implementing ExpiryNotifier.
+func (s *SecretHandlers) SetAuditLog(a *AuditLog) {
+	s.audit = a
+	if n, ok := s.store.(ExpiryNotifier); ok && a != nil {
+		n.NotifyExpired(a.hashToken, func(tokenHash string) {
+			a.recordHash(context.Background(), AuditExpired, tokenHash, AuditEntry{})
+		})
+	}
 }
 
 // validateMsg checks if the provided message is non-empty and within size limits.
-func validateMsg(msg string) error {
+func (s SecretHandlers) validateMsg(msg string) error {
 	if msg == "" {
 		return fmt.Errorf("message is required")
 	}
 
-	// 1MB limit for text
-	if len(msg) > 1*1024*1024 {
+	if int64(len(msg)) > s.limits.MaxMessageSize {
 		return fmt.Errorf("message too large")
 	}
 
 	return nil
 }
 
-// isValidTTL checks if the provided TTL string is a valid duration between 1 minute and 7 days.
-func isValidTTL(ttl string) bool {
-	// Verify duration
-	d, err := time.ParseDuration(ttl)
+// resolveTTL validates the requested TTL, returning the default TTL when it is empty.
+func (s SecretHandlers) resolveTTL(ttl string) (string, error) {
+	if ttl == "" {
+		return s.limits.DefaultTTL.String(), nil
+	}
+	if !s.limits.isValidTTL(ttl) {
+		return "", fmt.Errorf("invalid TTL format")
+	}
+	return ttl, nil
+}
+
+// parseReads parses the number of times a secret can be retrieved, defaulting to 1 when empty.
+func parseReads(v string) (int, error) {
+	if v == "" {
+		return 1, nil
+	}
+	reads, err := strconv.Atoi(v)
 	if err != nil {
-		return false
+		return 0, fmt.Errorf("invalid reads")
 	}
+	return reads, nil
+}
 
-	// validate duration length (between 1 minute and 7 days)
-	if d < 1*time.Minute || d > 168*time.Hour {
-		return false
+// validateReads checks that reads is within bounds and supported by the storage backend.
+func (s SecretHandlers) validateReads(reads int) error {
+	if reads < 1 || reads > maxReads {
+		return fmt.Errorf("invalid reads")
 	}
-	return true
+	if _, ok := s.store.(MultiReadStorer); reads > 1 && !ok {
+		return fmt.Errorf("multiple reads not supported")
+	}
+	return nil
 }
 
 // validateFileUpload checks the uploaded file for size and filename validity.
-func validateFileUpload(file *multipart.FileHeader) error {
+func (s SecretHandlers) validateFileUpload(file *multipart.FileHeader) error {
 	// Parse Content-Disposition to extract filename
 	mediatype, params, err := mime.ParseMediaType(file.Header.Get("Content-Disposition"))
 	if mediatype != "form-data" || err != nil {
@@ -84,20 +129,23 @@ func validateFileUpload(file *multipart.FileHeader) error {
 	}
 
 	// Check file size
-	if file.Size > 50*1024*1024 {
+	if file.Size > s.limits.MaxFileSize {
 		return fmt.Errorf("file too large")
 	}
 
-	// Check filename for path traversal
-	if strings.Contains(params["filename"], "..") ||
-		strings.Contains(params["filename"], "/") ||
-		strings.Contains(params["filename"], "\\") ||
-		strings.Contains(file.Filename, "..") ||
-		strings.Contains(file.Filename, "/") ||
-		strings.Contains(file.Filename, "\\") {
-		return fmt.Errorf("invalid filename")
+	if err := validateFilename(params["filename"]); err != nil {
+		return err
 	}
+	return validateFilename(file.Filename)
+}
 
+// validateFilename rejects file names that could be used for path traversal.
+func validateFilename(name string) error {
+	if strings.Contains(name, "..") ||
+		strings.Contains(name, "/") ||
+		strings.Contains(name, "\\") {
+		return fmt.Errorf("invalid filename")
+	}
 	return nil
 }
 
@@ -105,33 +153,62 @@ func validateFileUpload(file *multipart.FileHeader) error {
 func validateVaultToken(token string) error {
 	// Check token format
 	if !tokenRegex.MatchString(token) {
-		return fmt.Errorf("invalid token format: %s", token)
+		// The token is not included: invalid tokens can be typos of valid ones.
+		return fmt.Errorf("invalid token format")
 	}
 	return nil
 }
 
 // CreateMsgHandler handles POST requests to create a new self-destructing secret message.
-// It accepts form data with 'msg' (required), 'ttl' (optional time-to-live), and 'file' (optional file upload).
-// Files are base64 encoded before storage. Maximum file size is 50MB (enforced by middleware).
+// It accepts form data with 'msg' (required), 'ttl' (optional time-to-live), 'reads' (optional
+// number of allowed retrievals, default 1), 'recipients' and 'recipient_groups' (optional
+// lists of the users allowed to retrieve the secret) and 'file' (optional file upload).
+// Files are base64 encoded before storage. Sizes and TTL are bounded by the configured Limits.
 // Returns a JSON response with token(s) for retrieving the message and/or file.
 func (s SecretHandlers) CreateMsgHandler(ctx echo.Context) error {
+	rctx, span := startHandlerSpan(ctx.Request().Context(), "CreateMsgHandler")
+	defer span.End()
+	// s is a copy: the limits of the API key, if any, only apply to this request.
+	s.limits = s.limits.forAPIKey(apiKeyFrom(rctx))
 
-	msg := ctx.FormValue("msg")
-	if err := validateMsg(msg); err != nil {
+	msg := ctx.FormValue(api.FieldMsg)
+	if err := s.validateMsg(msg); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// Get TTL (if any)
-	ttl := ctx.FormValue("ttl")
-	if ttl != "" && !isValidTTL(ttl) {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid TTL format")
+	ttl, err := s.resolveTTL(ctx.FormValue(api.FieldTTL))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	reads, err := parseReads(ctx.FormValue(api.FieldReads))
+	if err == nil {
+		err = s.validateReads(reads)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	policy, err := parseAccessPolicy(ctx.FormValue(api.FieldRecipients), ctx.FormValue(api.FieldRecipientGroups), ctx.FormValue(api.FieldAllowedCIDRs))
+	if err == nil {
+		err = s.validateAccessPolicy(policy)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	span.SetAttributes(
+		attribute.Int("secret.message.size", len(msg)),
+		attribute.String("secret.ttl", ttl),
+		attribute.Int("secret.reads", reads),
+		attribute.Bool("secret.restricted", policy.restricted()),
+	)
+
 	var tr TokenResponse
 	// Upload file if any
-	file, err := ctx.FormFile("file")
+	file, err := ctx.FormFile(api.FieldFile)
 	if err == nil {
-		if err := validateFileUpload(file); err != nil {
+		if err := s.validateFileUpload(file); err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
 
@@ -148,9 +225,9 @@ func (s SecretHandlers) CreateMsgHandler(ctx echo.Context) error {
 
 		if len(b) > 0 {
 			tr.FileName = file.Filename
-			encodedFile := base64.StdEncoding.EncodeToString(b)
+			span.SetAttributes(attribute.Int("secret.file.size", len(b)))
 
-			filetoken, err := s.store.Store(encodedFile, ttl)
+			filetoken, err := s.storeFile(rctx, b, ttl, reads, policy)
 			if err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, err)
 			}
@@ -159,27 +236,116 @@ func (s SecretHandlers) CreateMsgHandler(ctx echo.Context) error {
 	}
 
 	// Handle the secret message
-	tr.Token, err = s.store.Store(msg, ttl)
+	tr.Token, err = s.storeMsg(rctx, msg, ttl, reads, policy)
 	if err != nil {
-		ctx.Logger().Errorf("Failed to store secret: %v", err)
+		loggerFrom(rctx).Error("Failed to store secret", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to store secret")
 	}
 
 	return ctx.JSON(http.StatusOK, tr)
 }
 
-// GetMsgHandler handles GET requests to retrieve a self-destructing secret message.
-// Accepts a 'token' query parameter. The message is deleted from Vault after retrieval,
-// making it accessible only once. Returns a JSON response with the message content.
+// storeMsg stores a message, using MultiReadStorer when it can be read more than once and
+// PolicyStorer when it is restricted to recipients. reads and policy must have been checked
+// with validateReads and validateAccessPolicy.
+func (s SecretHandlers) storeMsg(ctx context.Context, msg string, ttl string, reads int, policy AccessPolicy) (string, error) {
+	return s.storeSecret(ctx, kindMessage, msg, len(msg), ttl, reads, policy)
+}
+
+// storeFile base64 encodes the file content and stores it as a separate secret.
+func (s SecretHandlers) storeFile(ctx context.Context, content []byte, ttl string, reads int, policy AccessPolicy) (string, error) {
+	return s.storeSecret(ctx, kindFile, base64.StdEncoding.EncodeToString(content), len(content), ttl, reads, policy)
+}
+
+// storeSecret stores value and records the creation metrics of a secret of the given kind and size.
+func (s SecretHandlers) storeSecret(ctx context.Context, kind, value string, size int, ttl string, reads int, policy AccessPolicy) (string, error) {
+	token, err := observeStorage(ctx, "store", func(ctx context.Context) (string, error) {
+		if policy.restricted() {
+			return s.store.(PolicyStorer).StoreWithPolicy(ctx, value, ttl, reads, policy)
+		}
+		if reads > 1 {
+			return s.store.(MultiReadStorer).StoreWithReads(ctx, value, ttl, reads)
+		}
+		return s.store.Store(ctx, value, ttl)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	secretsCreatedTotal.WithLabelValues(kind).Inc()
+	secretPayloadSize.WithLabelValues(kind).Observe(float64(size))
+	s.audit.record(ctx, AuditCreated, token, AuditEntry{
+		Kind: kind, Size: size, TTL: ttl, Reads: reads, Restricted: policy.restricted(), Creator: subjectFrom(ctx), Label: labelFrom(ctx),
+	})
+	return token, nil
+}
+
+// getMsg retrieves a secret from the storage backend, consuming one of its reads.
+func (s SecretHandlers) getMsg(ctx context.Context, token string) (string, error) {
+	msg, err := observeStorage(ctx, "get", func(ctx context.Context) (string, error) {
+		return s.store.Get(ctx, token)
+	})
+	if err == nil {
+		secretsReadTotal.Inc()
+		s.audit.record(ctx, AuditRead, token, AuditEntry{Reader: subjectFrom(ctx), Label: labelFrom(ctx)})
+	}
+	return msg, err
+}
+
+// revokeMsg destroys a secret without reading it. The storage backend must implement SecretMsgRevoker.
+func (s SecretHandlers) revokeMsg(ctx context.Context, token string) error {
+	_, err := observeStorage(ctx, "revoke", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.store.(SecretMsgRevoker).Revoke(ctx, token)
+	})
+	if err == nil {
+		secretsRevokedTotal.Inc()
+		s.audit.record(ctx, AuditRevoked, token, AuditEntry{})
+	}
+	return err
+}
+
+// GetMsgHandler handles POST requests to retrieve a self-destructing secret message.
+// Accepts 'token' and 'nonce' form fields, the nonce being issued by the /getmsg page, so
+// that fetching a link (e.g. to show its preview in a chat app) cannot consume a secret.
+// Known link preview bots are rejected, and so are the clients who are not among the
+// recipients of restricted secrets or outside of their networks, without consuming them.
+// The message is deleted from Vault after retrieval, making it accessible only once.
+// Returns a JSON response with the message content.
 func (s SecretHandlers) GetMsgHandler(ctx echo.Context) error {
-	token := ctx.QueryParam("token")
+	rctx, span := startHandlerSpan(ctx.Request().Context(), "GetMsgHandler")
+	defer span.End()
+
+	if isLinkPreviewAgent(ctx.Request().UserAgent()) {
+		return retrievalForbidden(api.ErrorCodeLinkPreview, errors.New("link previews cannot retrieve secrets"))
+	}
+
+	// Only read the body, as tokens in URLs end up in logs and browser histories.
+	token := ctx.Request().PostFormValue(api.FieldToken)
 	if err := validateVaultToken(token); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	if err := s.signer.checkNonce(ctx.Request().PostFormValue(api.FieldNonce), token); err != nil {
+		return retrievalForbidden(api.ErrorCodeInvalidNonce, err)
+	}
 
-	m, err := s.store.Get(token)
+	if err := s.checkAccess(rctx, token); err != nil {
+		switch {
+		case errors.Is(err, errLoginRequired):
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		case errors.Is(err, errNotRecipient):
+			return retrievalForbidden(api.ErrorCodeNotRecipient, err)
+		case errors.Is(err, errNetworkNotAllowed):
+			return retrievalForbidden(api.ErrorCodeNetworkNotAllowed, err)
+		}
+		span.SetStatus(codes.Error, "secret not found")
+		loggerFrom(rctx).Error("Failed to retrieve secret", "error", err)
+		return echo.NewHTTPError(http.StatusNotFound, "secret not found or already consumed")
+	}
+
+	m, err := s.getMsg(rctx, token)
 	if err != nil {
-		ctx.Logger().Errorf("Failed to retrieve secret: %v", err)
+		span.SetStatus(codes.Error, "secret not found")
+		loggerFrom(rctx).Error("Failed to retrieve secret", "error", err)
 		return echo.NewHTTPError(http.StatusNotFound, "secret not found or already consumed")
 	}
 	r := &MsgResponse{
@@ -188,8 +354,20 @@ func (s SecretHandlers) GetMsgHandler(ctx echo.Context) error {
 	return ctx.JSON(http.StatusOK, r)
 }
 
-// healthHandler provides a simple health check endpoint.
-// Returns HTTP 200 OK when the application is running.
+// LimitsHandler handles GET requests describing the limits enforced when creating secrets,
+// so that clients such as the web UI can validate input and show the real bounds, and
+// whether secrets can be restricted to recipients or networks. Clients with an API key get its limits.
+func (s SecretHandlers) LimitsHandler(ctx echo.Context) error {
+	l := s.limits.forAPIKey(apiKeyFrom(ctx.Request().Context())).apiLimits()
+	l.RecipientRestrictions = s.supportsAccessPolicies()
+	l.NetworkRestrictions = s.supportsNetworkPolicies()
+	return ctx.JSON(http.StatusOK, l)
+}
+
+// healthHandler provides a simple health check endpoint, used for liveness.
+// Returns HTTP 200 OK when the application is running, without checking its dependencies,
+// so that an unavailable storage backend does not get the application restarted.
+// Readiness is reported by ReadinessHandler.
 func healthHandler(ctx echo.Context) error {
 	return ctx.String(http.StatusOK, http.StatusText(http.StatusOK))
 }
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"mime/multipart"
@@ -11,8 +12,10 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type FakeSecretMsgStorer struct {
@@ -21,18 +24,77 @@ type FakeSecretMsgStorer struct {
 	err           error
 	lastUsedToken string
 	lastMsg       string
+	lastTTL       string
 }
 
-func (f *FakeSecretMsgStorer) Get(token string) (msg string, err error) {
+func (f *FakeSecretMsgStorer) Get(_ context.Context, token string) (msg string, err error) {
 	f.lastUsedToken = token
 	return f.msg, f.err
 }
 
-func (f *FakeSecretMsgStorer) Store(msg string, ttl string) (token string, err error) {
+func (f *FakeSecretMsgStorer) Store(_ context.Context, msg string, ttl string) (token string, err error) {
 	f.lastMsg = msg
+	f.lastTTL = ttl
 	return f.token, f.err
 }
 
+// createOption customizes the secret creation requests of the tests.
+type createOption func(*http.Request)
+
+// fromIP sends the request from the client IP address ip.
+func fromIP(ip string) createOption {
+	return func(r *http.Request) { r.RemoteAddr = ip + ":1234" }
+}
+
+// withAPIKey authenticates the request with the API key key.
+func withAPIKey(key string) createOption {
+	return func(r *http.Request) { r.Header.Set(echo.HeaderAuthorization, "Bearer "+key) }
+}
+
+// withCookies sends cookies with the request, e.g. a session.
+func withCookies(cookies ...*http.Cookie) createOption {
+	return func(r *http.Request) {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// sentTo addresses the request to the HTTPS test server ts, to be sent with an HTTP client.
+func sentTo(ts *httptest.Server) createOption {
+	return func(r *http.Request) {
+		r.RequestURI = ""
+		r.URL.Scheme, r.URL.Host = "https", ts.Listener.Addr().String()
+	}
+}
+
+// newCreateRequest returns a POST /secret request with the msg field, unless fields has one,
+// and the given fields.
+func newCreateRequest(t *testing.T, fields map[string]string, opts ...createOption) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if _, ok := fields[api.FieldMsg]; !ok {
+		require.NoError(t, writer.WriteField(api.FieldMsg, "my secret"))
+	}
+	for k, v := range fields {
+		require.NoError(t, writer.WriteField(k, v))
+	}
+	require.NoError(t, writer.Close())
+	req := httptest.NewRequest(http.MethodPost, "/secret", body)
+	req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+	for _, opt := range opts {
+		opt(req)
+	}
+	return req
+}
+
+// createSecret sends the request of newCreateRequest to server.
+func createSecret(t *testing.T, server *Server, fields map[string]string, opts ...createOption) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(server, newCreateRequest(t, fields, opts...))
+}
+
 func TestGetMsgHandler(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -74,13 +136,16 @@ func TestGetMsgHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			s := &FakeSecretMsgStorer{msg: tt.storedMsg, err: tt.storeErr}
+			h := NewSecretHandlers(s)
+
 			e := echo.New()
-			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.token, nil)
+			form := url.Values{"token": {tt.token}, "nonce": {h.signer.issueNonce(tt.token)}}
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
 			rec := httptest.NewRecorder()
 			c := e.NewContext(req, rec)
 
-			s := &FakeSecretMsgStorer{msg: tt.storedMsg, err: tt.storeErr}
-			h := NewSecretHandlers(s)
 			err := h.GetMsgHandler(c)
 
 			if tt.expectError {
@@ -144,7 +209,7 @@ func TestIsValidTTL(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		result := isValidTTL(tt.ttl)
+		result := DefaultLimits().isValidTTL(tt.ttl)
 		assert.Equal(t, result, tt.valid)
 	}
 }
@@ -162,7 +227,7 @@ func TestValidateMsg(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := validateMsg(tt.msg)
+			err := NewSecretHandlers(&FakeSecretMsgStorer{}).validateMsg(tt.msg)
 			if tt.wantErr {
 				assert.Error(t, err)
 			} else {
@@ -360,3 +425,50 @@ func TestCreateMsgHandlerWithFile(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateMsgHandlerReads(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      SecretMsgStorer
+		reads      string
+		errMessage string
+	}{
+		{"default single read", &FakeSecretMsgStorer{token: "testtoken"}, "", ""},
+		{"explicit single read", &FakeSecretMsgStorer{token: "testtoken"}, "1", ""},
+		{"multiple reads", NewMemoryStore(), "3", ""},
+		{"maximum reads", NewMemoryStore(), "10", ""},
+		{"multiple reads unsupported", &FakeSecretMsgStorer{token: "testtoken"}, "2", "multiple reads not supported"},
+		{"too many reads", NewMemoryStore(), "11", "invalid reads"},
+		{"zero reads", NewMemoryStore(), "0", "invalid reads"},
+		{"non numeric reads", NewMemoryStore(), "many", "invalid reads"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			form := make(url.Values)
+			form.Set("msg", "hello world")
+			form.Set("reads", tt.reads)
+
+			req := httptest.NewRequest(http.MethodPost, "/secret", strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err := NewSecretHandlers(tt.store).CreateMsgHandler(c)
+
+			if tt.errMessage != "" {
+				if assert.Error(t, err) {
+					httpErr, ok := err.(*echo.HTTPError)
+					if assert.True(t, ok) {
+						assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+						assert.Equal(t, tt.errMessage, httpErr.Message)
+					}
+				}
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, http.StatusOK, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// readinessCacheTTL is how long the result of a readiness check is reused, so that
+	// frequent probes from several sources do not hammer the storage backend.
+	readinessCacheTTL = 5 * time.Second
+	// readinessTimeout bounds the duration of a readiness check.
+	readinessTimeout = 3 * time.Second
+)
+
+// readinessCheck checks the storage backend health, caching the result for readinessCacheTTL.
+type readinessCheck struct {
+	mu        sync.Mutex
+	check     func(ctx context.Context) error
+	checkedAt time.Time
+	err       error
+	now       func() time.Time
+}
+
+// newReadinessCheck returns the readiness check of store. Stores that do not implement
+// HealthChecker are always ready.
+func newReadinessCheck(store SecretMsgStorer) *readinessCheck {
+	check := func(context.Context) error { return nil }
+	if hc, ok := store.(HealthChecker); ok {
+		check = hc.CheckHealth
+	}
+	return &readinessCheck{check: check, now: time.Now}
+}
+
+// ready returns the result of the last check if it is recent enough, or checks the backend.
+// Concurrent callers wait for the running check instead of starting their own.
+func (r *readinessCheck) ready(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.checkedAt.IsZero() && r.now().Sub(r.checkedAt) < readinessCacheTTL {
+		return r.err
+	}
+
+	// The result is shared with other callers: it must not depend on this request being canceled.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessTimeout)
+	defer cancel()
+	r.err = r.check(ctx)
+	r.checkedAt = r.now()
+	return r.err
+}
+
+// ReadinessHandler reports whether the storage backend can serve requests, returning
+// 503 Service Unavailable otherwise. The cause is logged but not returned, as it may
+// disclose details of the infrastructure.
+func (s SecretHandlers) ReadinessHandler(ctx echo.Context) error {
+	rctx := ctx.Request().Context()
+	if err := s.readiness.ready(rctx); err != nil {
+		loggerFrom(rctx).Warn("Storage backend not ready", "error", err)
+		return ctx.String(http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+	}
+	return ctx.String(http.StatusOK, http.StatusText(http.StatusOK))
+}
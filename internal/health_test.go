@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// FakeHealthCheckedStorer is a storage backend whose health is controlled by the test.
+type FakeHealthCheckedStorer struct {
+	FakeSecretMsgStorer
+	healthErr error
+	checks    int
+}
+
+func (f *FakeHealthCheckedStorer) CheckHealth(context.Context) error {
+	f.checks++
+	return f.healthErr
+}
+
+func probe(t *testing.T, handlers *SecretHandlers, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, handlers)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestLivenessDoesNotCheckStorage(t *testing.T) {
+	store := &FakeHealthCheckedStorer{healthErr: errors.New("vault is sealed")}
+	handlers := NewSecretHandlers(store)
+
+	for _, target := range []string{"/health", "/health/live"} {
+		rec := probe(t, handlers, target)
+		assert.Equal(t, http.StatusOK, rec.Code, target)
+		assert.Equal(t, "OK", rec.Body.String(), target)
+	}
+	assert.Zero(t, store.checks)
+}
+
+func TestReadiness(t *testing.T) {
+	logs := captureLogs(t)
+	store := &FakeHealthCheckedStorer{}
+	handlers := NewSecretHandlers(store)
+
+	rec := probe(t, handlers, "/health/ready")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, store.checks)
+
+	store.healthErr = errors.New("vault is sealed")
+	handlers.readiness.checkedAt = time.Time{}
+	rec = probe(t, handlers, "/health/ready")
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "sealed")
+	assert.Equal(t, "vault is sealed", logs.record(t, "Storage backend not ready")["error"])
+}
+
+func TestReadinessCache(t *testing.T) {
+	store := &FakeHealthCheckedStorer{}
+	handlers := NewSecretHandlers(store)
+	now := time.Now()
+	handlers.readiness.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, probe(t, handlers, "/health/ready").Code)
+	}
+	assert.Equal(t, 1, store.checks, "results are cached")
+
+	store.healthErr = errors.New("vault is sealed")
+	now = now.Add(readinessCacheTTL)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, handlers, "/health/ready").Code)
+	assert.Equal(t, 2, store.checks)
+}
+
+func TestReadinessWithoutHealthChecker(t *testing.T) {
+	assert.Equal(t, http.StatusOK, probe(t, NewSecretHandlers(&FakeSecretMsgStorer{}), "/health/ready").Code)
+}
+
+func TestVaultCheckHealth(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	assert.NoError(t, NewVault(c.Address(), "cubbyhole/", c.Token()).CheckHealth(context.Background()))
+
+	err := NewVault(c.Address(), "cubbyhole/", "hvs.invalid").CheckHealth(context.Background())
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "hvs.invalid")
+
+	require.NoError(t, c.Sys().PutPolicy("no-lookup", `path "auth/token/create" { capabilities = ["update"] }`))
+	limited, err := c.Auth().Token().Create(&api.TokenCreateRequest{Policies: []string{"no-lookup"}})
+	require.NoError(t, err)
+	err = NewVault(c.Address(), "cubbyhole/", limited.Auth.ClientToken).CheckHealth(context.Background())
+	assert.ErrorContains(t, err, "auth/token/lookup", "the access policies of secrets cannot be read")
+
+	require.NoError(t, c.Sys().Seal())
+	assert.Error(t, NewVault(c.Address(), "cubbyhole/", c.Token()).CheckHealth(context.Background()))
+}
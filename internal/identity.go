@@ -0,0 +1,78 @@
+package internal
+
+import "context"
+
+// Identity is the authenticated client of a request.
+type Identity struct {
+	// Subject identifies the client, e.g. the email address of a user.
+	Subject string
+	// Method is how the client authenticated, e.g. IdentityOIDC.
+	Method string
+	// Email is the verified email address of the client, if any.
+	Email string
+	// Groups are the groups of the client, as reported by the identity provider.
+	Groups []string
+	// APIKey is the API key of the client, for IdentityAPIKey.
+	APIKey *APIKey
+	// Label describes the client in the audit log, e.g. the label of its API key or the
+	// distinguished name of its certificate.
+	Label string
+}
+
+// Authentication methods of identities.
+const (
+	// IdentityOIDC identifies users logged in with OpenID Connect.
+	IdentityOIDC = "oidc"
+	// IdentityAPIKey identifies programs authenticated with an API key.
+	IdentityAPIKey = "api-key"
+	// IdentityCertificate identifies programs authenticated with a TLS client certificate.
+	IdentityCertificate = "certificate"
+)
+
+// identityKey is the context key of the authenticated client.
+type identityKey struct{}
+
+// withIdentity returns a copy of ctx carrying the authenticated client id.
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the authenticated client of a request context, or nil for
+// anonymous requests.
+func identityFrom(ctx context.Context) *Identity {
+	id, _ := ctx.Value(identityKey{}).(*Identity)
+	return id
+}
+
+// apiKeyFrom returns the API key of the authenticated client of a request context, or nil
+// for clients without one.
+func apiKeyFrom(ctx context.Context) *APIKey {
+	if id := identityFrom(ctx); id != nil {
+		return id.APIKey
+	}
+	return nil
+}
+
+// labelFrom returns the label of the authenticated client of a request context, or an
+// empty string for clients without one.
+func labelFrom(ctx context.Context) string {
+	if id := identityFrom(ctx); id != nil {
+		return id.Label
+	}
+	return ""
+}
+
+// isProgram reports whether id identifies a program, authenticated with an API key or a
+// client certificate, rather than a user. Programs have their own rate limits.
+func (id *Identity) isProgram() bool {
+	return id != nil && (id.Method == IdentityAPIKey || id.Method == IdentityCertificate)
+}
+
+// subjectFrom returns the subject of the authenticated client of a request context, or an
+// empty string for anonymous requests.
+func subjectFrom(ctx context.Context) string {
+	if id := identityFrom(ctx); id != nil {
+		return id.Subject
+	}
+	return ""
+}
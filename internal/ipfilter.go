@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IPFilter restricts the client IP addresses allowed on a route group, by CIDRs (e.g.
+// "10.0.0.0/8") or single IP addresses.
+type IPFilter struct {
+	// Allowed lists the networks allowed. All the networks are allowed when empty.
+	Allowed []string
+	// Denied lists the networks denied, even when they are in Allowed.
+	Denied []string
+}
+
+// IPFilters holds the IP filters of the route groups. The Default filter applies to all
+// the routes but health probes, and the filters of the other groups apply in addition to
+// it, e.g. to restrict secret creation to corporate networks while leaving retrieval open.
+type IPFilters struct {
+	// Default applies to all the routes.
+	Default IPFilter
+	// Create applies to the creation of secrets (POST /secret).
+	Create IPFilter
+	// Retrieve applies to the retrieval of secrets (POST /secret/retrieve).
+	Retrieve IPFilter
+}
+
+// ipNetworks is a parsed IPFilter.
+type ipNetworks struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+// parse parses the networks of f, reporting the invalid ones.
+func (f IPFilter) parse() (ipNetworks, error) {
+	allowed, err := parseNetworks(f.Allowed)
+	if err != nil {
+		return ipNetworks{}, fmt.Errorf("allowed networks: %w", err)
+	}
+	denied, err := parseNetworks(f.Denied)
+	if err != nil {
+		return ipNetworks{}, fmt.Errorf("denied networks: %w", err)
+	}
+	return ipNetworks{allowed: allowed, denied: denied}, nil
+}
+
+// empty reports whether n lets all the addresses through.
+func (n ipNetworks) empty() bool {
+	return len(n.allowed) == 0 && len(n.denied) == 0
+}
+
+// allows reports whether the IP address ip is allowed. Invalid addresses are only allowed
+// when there is no filter.
+func (n ipNetworks) allows(ip string) bool {
+	if n.empty() {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil || containsIP(n.denied, parsed) {
+		return false
+	}
+	return len(n.allowed) == 0 || containsIP(n.allowed, parsed)
+}
+
+// group returns the filter of the given route group.
+func (f IPFilters) group(group string) IPFilter {
+	switch group {
+	case routeGroupCreate:
+		return f.Create
+	case routeGroupRetrieve:
+		return f.Retrieve
+	}
+	return f.Default
+}
+
+// denyAll denies all the IP addresses.
+var denyAll = ipNetworks{denied: []*net.IPNet{
+	{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)},
+	{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)},
+}}
+
+// parse parses the filters of each route group, keyed by route group. The route groups
+// with an invalid filter deny all the addresses, so that a typo does not open them.
+func (f IPFilters) parse() (map[string]ipNetworks, error) {
+	nets := make(map[string]ipNetworks, 3)
+	var errs []error
+	for _, group := range []string{routeGroupDefault, routeGroupCreate, routeGroupRetrieve} {
+		n, err := f.group(group).parse()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s routes: %w", group, err))
+			n = denyAll
+		}
+		nets[group] = n
+	}
+	return nets, errors.Join(errs...)
+}
+
+// ipFilterMiddleware rejects the requests from the client IP addresses that are not allowed
+// on all the routes, or on the route group of the request, with a 403 response. Health
+// probes are not filtered. It lets all the requests through when no filter is configured.
+func ipFilterMiddleware(filters map[string]ipNetworks) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			group := routeGroup(c)
+			if group == "" {
+				return next(c)
+			}
+			if !allowsIP(filters, group, c.RealIP()) {
+				loggerFrom(c.Request().Context()).Info("Request denied by IP filter", "group", group)
+				return echo.NewHTTPError(http.StatusForbidden, "access denied from your network")
+			}
+			return next(c)
+		}
+	}
+}
+
+// grpcIPFilterInterceptor applies the IP filters to gRPC calls like ipFilterMiddleware, the
+// creation and retrieval of secrets being filtered by their route group. The calls from
+// addresses that are not allowed are rejected with PermissionDenied.
+func grpcIPFilterInterceptor(filters map[string]ipNetworks) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		group := grpcRouteGroup(info.FullMethod)
+		if !allowsIP(filters, group, clientIPFrom(ctx)) {
+			loggerFrom(ctx).Info("Request denied by IP filter", "group", group)
+			return nil, status.Error(codes.PermissionDenied, "access denied from your network")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// allowsIP reports whether the IP address ip is allowed on all the routes and on the route
+// group.
+func allowsIP(filters map[string]ipNetworks, group, ip string) bool {
+	return filters[routeGroupDefault].allows(ip) && (group == routeGroupDefault || filters[group].allows(ip))
+}
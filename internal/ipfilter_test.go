@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIPNetworksAllows(t *testing.T) {
+	nets, err := IPFilter{Allowed: []string{"10.0.0.0/8"}, Denied: []string{"10.0.0.1"}}.parse()
+	require.NoError(t, err)
+
+	assert.True(t, nets.allows("10.1.2.3"))
+	assert.False(t, nets.allows("10.0.0.1"), "denied networks take precedence")
+	assert.False(t, nets.allows("192.0.2.1"))
+	assert.False(t, nets.allows("not an address"))
+
+	nets, err = IPFilter{Denied: []string{"192.0.2.0/24"}}.parse()
+	require.NoError(t, err)
+	assert.False(t, nets.allows("192.0.2.1"))
+	assert.True(t, nets.allows("203.0.113.7"), "all the other networks are allowed without allowed networks")
+
+	assert.True(t, ipNetworks{}.allows(""), "no filter")
+}
+
+func TestIPFiltersParse(t *testing.T) {
+	nets, err := IPFilters{Create: IPFilter{Allowed: []string{"10.0.0.0/8"}}, Retrieve: IPFilter{Denied: []string{"not a network"}}}.parse()
+	assert.ErrorContains(t, err, "retrieve routes: denied networks")
+	assert.True(t, nets[routeGroupDefault].empty())
+	assert.True(t, nets[routeGroupCreate].allows("10.1.2.3"))
+	assert.False(t, nets[routeGroupRetrieve].allows("10.1.2.3"), "invalid filters deny all the addresses")
+	assert.False(t, nets[routeGroupRetrieve].allows("2001:db8::1"))
+}
+
+func TestIPFilterMiddleware(t *testing.T) {
+	cnf := conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		IPFilters: IPFilters{
+			Default: IPFilter{Denied: []string{"203.0.113.0/24"}},
+			Create:  IPFilter{Allowed: []string{"10.0.0.0/8"}},
+		},
+	}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	tests := []struct {
+		name     string
+		remote   string
+		method   string
+		path     string
+		expected int
+	}{
+		{"creation from the allowed network", "10.1.2.3:1234", http.MethodPost, "/secret", http.StatusOK},
+		{"creation from another network", "192.0.2.1:1234", http.MethodPost, "/secret", http.StatusForbidden},
+		{"other routes from another network", "192.0.2.1:1234", http.MethodGet, "/limits", http.StatusOK},
+		{"denied network", "203.0.113.7:1234", http.MethodGet, "/limits", http.StatusForbidden},
+		{"health probes are not filtered", "203.0.113.7:1234", http.MethodGet, "/health", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req *http.Request
+			if tt.path == "/secret" {
+				req = newCreateRequest(t, nil)
+			} else {
+				req = httptest.NewRequest(tt.method, tt.path, nil)
+			}
+			req.RemoteAddr = tt.remote
+			rec := serve(server, req)
+			assert.Equal(t, tt.expected, rec.Code)
+			if tt.expected == http.StatusForbidden {
+				assert.Contains(t, rec.Body.String(), "access denied from your network")
+			}
+		})
+	}
+}
+
+func TestGRPCIPFilterInterceptor(t *testing.T) {
+	filters, err := IPFilters{
+		Default: IPFilter{Denied: []string{"203.0.113.0/24"}},
+		Create:  IPFilter{Allowed: []string{"10.0.0.0/8"}},
+	}.parse()
+	require.NoError(t, err)
+	interceptor := grpcIPFilterInterceptor(filters)
+
+	tests := []struct {
+		name     string
+		ip       string
+		method   string
+		expected codes.Code
+	}{
+		{"creation from the allowed network", "10.1.2.3", secretv1.SecretService_CreateSecret_FullMethodName, codes.OK},
+		{"creation from another network", "192.0.2.1", secretv1.SecretService_CreateSecret_FullMethodName, codes.PermissionDenied},
+		{"retrieval from another network", "192.0.2.1", secretv1.SecretService_GetSecret_FullMethodName, codes.OK},
+		{"denied network", "203.0.113.7", secretv1.SecretService_GetSecret_FullMethodName, codes.PermissionDenied},
+		{"denied network on other methods", "203.0.113.7", secretv1.SecretService_RevokeSecret_FullMethodName, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := interceptor(withClientIP(context.Background(), tt.ip), nil, &grpc.UnaryServerInfo{FullMethod: tt.method},
+				func(context.Context, any) (any, error) { return nil, nil })
+			assert.Equal(t, tt.expected, status.Code(err))
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+)
+
+const (
+	// maxReads is the maximum number of times a secret can be retrieved.
+	maxReads = 10
+	// multipartOverhead is the room left in the request body limit for multipart
+	// boundaries, part headers and the other form fields.
+	multipartOverhead = 1 * 1024 * 1024
+)
+
+// Limits holds the size and time-to-live bounds applied to secrets.
+// Zero fields are replaced by their DefaultLimits value.
+type Limits struct {
+	// MaxMessageSize is the maximum size of a secret text message, in bytes.
+	MaxMessageSize int64
+	// MaxFileSize is the maximum size of an uploaded file, in bytes.
+	MaxFileSize int64
+	// BodyLimit is the maximum size of a request body, in bytes. It must leave room
+	// for the largest file and message plus multipart overhead.
+	BodyLimit int64
+	// MinTTL is the shortest time-to-live a secret can be created with.
+	MinTTL time.Duration
+	// MaxTTL is the longest time-to-live a secret can be created with.
+	MaxTTL time.Duration
+	// DefaultTTL is the time-to-live of secrets created without one.
+	DefaultTTL time.Duration
+}
+
+// DefaultLimits returns the limits used when none is configured:
+// 1MB messages, 50MB files, and a TTL between 1 minute and 7 days, 48 hours by default.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxMessageSize: 1 * 1024 * 1024,
+		MaxFileSize:    50 * 1024 * 1024,
+		BodyLimit:      52 * 1024 * 1024,
+		MinTTL:         1 * time.Minute,
+		MaxTTL:         168 * time.Hour,
+		DefaultTTL:     48 * time.Hour,
+	}
+}
+
+// orDefault returns l with its zero fields replaced by their default value.
+func (l Limits) orDefault() Limits {
+	d := DefaultLimits()
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = d.MaxMessageSize
+	}
+	if l.MaxFileSize == 0 {
+		l.MaxFileSize = d.MaxFileSize
+	}
+	if l.BodyLimit == 0 {
+		l.BodyLimit = d.BodyLimit
+	}
+	if l.MinTTL == 0 {
+		l.MinTTL = d.MinTTL
+	}
+	if l.MaxTTL == 0 {
+		l.MaxTTL = d.MaxTTL
+	}
+	if l.DefaultTTL == 0 {
+		l.DefaultTTL = d.DefaultTTL
+	}
+	return l
+}
+
+// Validate checks that the limits are positive and consistent with each other.
+func (l Limits) Validate() error {
+	var errs []error
+
+	if l.MaxMessageSize <= 0 {
+		errs = append(errs, errors.New("maximum message size (max_message_size) must be positive"))
+	}
+	if l.MaxFileSize <= 0 {
+		errs = append(errs, errors.New("maximum file size (max_file_size) must be positive"))
+	}
+	if minBody := l.MaxFileSize + l.MaxMessageSize + multipartOverhead; l.BodyLimit < minBody {
+		errs = append(errs, fmt.Errorf("body limit (body_limit) must be at least max_file_size + max_message_size + %s of multipart overhead (%s)",
+			formatSize(multipartOverhead), formatSize(minBody)))
+	}
+
+	if l.MinTTL <= 0 {
+		errs = append(errs, errors.New("minimum TTL (min_ttl) must be positive"))
+	}
+	if l.MaxTTL < l.MinTTL {
+		errs = append(errs, errors.New("maximum TTL (max_ttl) must not be lower than min_ttl"))
+	}
+	if l.DefaultTTL < l.MinTTL || l.DefaultTTL > l.MaxTTL {
+		errs = append(errs, errors.New("default TTL (default_ttl) must be between min_ttl and max_ttl"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// isValidTTL checks if the provided TTL string is a valid duration between MinTTL and MaxTTL.
+func (l Limits) isValidTTL(ttl string) bool {
+	// Verify duration
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return false
+	}
+
+	// validate duration length
+	return d >= l.MinTTL && d <= l.MaxTTL
+}
+
+// apiLimits returns the limits in their public wire format.
+func (l Limits) apiLimits() api.Limits {
+	return api.Limits{
+		MaxMessageSize: l.MaxMessageSize,
+		MaxFileSize:    l.MaxFileSize,
+		MinTTL:         int64(l.MinTTL / time.Second),
+		MaxTTL:         int64(l.MaxTTL / time.Second),
+		DefaultTTL:     int64(l.DefaultTTL / time.Second),
+		MaxReads:       maxReads,
+	}
+}
+
+// sizeUnits lists the binary size suffixes, from the largest.
+var sizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseSize parses a size in bytes with an optional binary unit suffix: K, M or G,
+// optionally followed by B or iB (e.g. "50M", "50MB" and "50MiB" are all 50*1024*1024).
+func parseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, multiplier = strings.TrimSuffix(v, u.suffix), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatSize formats a size in bytes with the largest unit that divides it exactly.
+func formatSize(n int64) string {
+	for _, u := range sizeUnits {
+		if n != 0 && n%u.size == 0 {
+			return strconv.FormatInt(n/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(l *Limits)
+		expected string
+	}{
+		{"defaults", func(l *Limits) {}, ""},
+		{"zero message size", func(l *Limits) { l.MaxMessageSize = 0 }, "max_message_size"},
+		{"negative file size", func(l *Limits) { l.MaxFileSize = -1 }, "max_file_size"},
+		{"body limit below file size", func(l *Limits) { l.BodyLimit = 50 * 1024 * 1024 }, "body_limit"},
+		{"body limit without overhead", func(l *Limits) { l.BodyLimit = 51 * 1024 * 1024 }, "body_limit"},
+		{"body limit raised with file size", func(l *Limits) {
+			l.MaxFileSize = 100 * 1024 * 1024
+			l.BodyLimit = 102 * 1024 * 1024
+		}, ""},
+		{"zero min TTL", func(l *Limits) { l.MinTTL = 0 }, "min_ttl"},
+		{"max TTL below min TTL", func(l *Limits) { l.MaxTTL = 30 * time.Second }, "max_ttl"},
+		{"default TTL above max TTL", func(l *Limits) { l.DefaultTTL = 200 * time.Hour }, "default_ttl"},
+		{"default TTL below min TTL", func(l *Limits) { l.DefaultTTL = time.Second }, "default_ttl"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := DefaultLimits()
+			tt.modify(&l)
+
+			err := l.Validate()
+			if tt.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLimitsIsValidTTL(t *testing.T) {
+	l := Limits{MinTTL: time.Hour, MaxTTL: 24 * time.Hour}
+
+	tests := []struct {
+		ttl   string
+		valid bool
+	}{
+		{"1h", true},
+		{"24h", true},
+		{"59m", false},
+		{"25h", false},
+		{"", false},
+		{"invalid", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.valid, l.isValidTTL(tt.ttl), tt.ttl)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected int64
+		wantErr  bool
+	}{
+		{"1024", 1024, false},
+		{"512B", 512, false},
+		{"1K", 1024, false},
+		{"1kb", 1024, false},
+		{"50M", 50 * 1024 * 1024, false},
+		{"50MB", 50 * 1024 * 1024, false},
+		{"50MiB", 50 * 1024 * 1024, false},
+		{"2G", 2 * 1024 * 1024 * 1024, false},
+		{" 10 M ", 10 * 1024 * 1024, false},
+		{"", 0, true},
+		{"M", 0, true},
+		{"1.5M", 0, true},
+		{"-1M", 0, true},
+		{"10X", 0, true},
+	}
+
+	for _, tt := range tests {
+		n, err := parseSize(tt.size)
+		if tt.wantErr {
+			assert.Error(t, err, tt.size)
+			continue
+		}
+		assert.NoError(t, err, tt.size)
+		assert.Equal(t, tt.expected, n, tt.size)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{1024, "1K"},
+		{1536, "1536"},
+		{52 * 1024 * 1024, "52M"},
+		{1024 * 1024 * 1024, "1G"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, formatSize(tt.size))
+		n, err := parseSize(tt.expected)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.size, n)
+	}
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Binding address prefixes of the listeners that are not TCP addresses.
+const (
+	// unixAddressPrefix prefixes the path of a Unix domain socket, e.g. "unix:/run/sup3r/http.sock".
+	unixAddressPrefix = "unix:"
+	// systemdAddressPrefix prefixes the name of a socket passed by systemd socket activation,
+	// e.g. "systemd:http" for a socket unit with FileDescriptorName=http.
+	systemdAddressPrefix = "systemd:"
+)
+
+// defaultUnixSocketMode is the permissions of the Unix domain sockets when none is configured.
+const defaultUnixSocketMode os.FileMode = 0o660
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// unixSocketMode parses the permissions of the Unix domain sockets, in octal (e.g. "0660").
+func (cnf conf) unixSocketMode() (os.FileMode, error) {
+	if cnf.UnixSocketMode == "" {
+		return defaultUnixSocketMode, nil
+	}
+	mode, err := strconv.ParseUint(cnf.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid permissions %q", cnf.UnixSocketMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validateListeners checks the binding addresses and the Unix domain socket settings of cnf.
+func (cnf conf) validateListeners() error {
+	var errs []error
+	for _, a := range []struct{ key, addr string }{
+		{"http_binding_address", cnf.HttpBindingAddress},
+		{"https_binding_address", cnf.HttpsBindingAddress},
+		{"grpc_binding_address", cnf.GrpcBindingAddress},
+		{"admin_binding_address", cnf.AdminBindingAddress},
+	} {
+		if path, ok := strings.CutPrefix(a.addr, unixAddressPrefix); ok && path == "" {
+			errs = append(errs, fmt.Errorf("binding address (%s) of a Unix domain socket must have a path", a.key))
+		}
+		if name, ok := strings.CutPrefix(a.addr, systemdAddressPrefix); ok && name == "" {
+			errs = append(errs, fmt.Errorf("binding address (%s) of a systemd socket must have a name", a.key))
+		}
+	}
+	if _, err := cnf.unixSocketMode(); err != nil {
+		errs = append(errs, fmt.Errorf("permissions of the Unix domain sockets (unix_socket_mode): %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// listenUnix listens on the Unix domain socket at path with the given permissions, removing
+// the socket left by a previous process if any. The socket is removed when the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return localListener{ln}, nil
+}
+
+// localListener is a listener of Unix domain sockets, whose connections come from the local
+// host: their address is the loopback address, so that rate limits, IP filters, trusted
+// proxies and the PROXY protocol apply to them as to local TCP connections.
+type localListener struct {
+	net.Listener
+}
+
+// Accept waits for and returns the next connection, with the loopback address as remote address.
+func (l localListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return localConn{conn}, nil
+}
+
+// localConn is a connection of a Unix domain socket, from the local host.
+type localConn struct {
+	net.Conn
+}
+
+// RemoteAddr returns the loopback address.
+func (localConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// socketActivation holds the sockets passed by systemd socket activation, by name.
+type socketActivation struct {
+	// firstFD is the first file descriptor passed, listenFDsStart except in tests.
+	firstFD   int
+	once      sync.Once
+	mu        sync.Mutex
+	listeners map[string][]net.Listener
+	err       error
+}
+
+// systemdSockets holds the sockets passed to the process by systemd.
+var systemdSockets = &socketActivation{firstFD: listenFDsStart}
+
+// load reads the sockets passed in the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment
+// variables, which are then unset so that child processes do not inherit them.
+func (a *socketActivation) load() {
+	a.listeners = map[string][]net.Listener{}
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(key)
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		a.err = fmt.Errorf("invalid LISTEN_FDS %q", fds)
+		return
+	}
+	for i := range n {
+		// systemd names the sockets of units without FileDescriptorName "unknown".
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(a.firstFD+i), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			a.err = errors.Join(a.err, fmt.Errorf("socket %q: %w", name, err))
+			continue
+		}
+		if _, ok := ln.(*net.UnixListener); ok {
+			ln = localListener{ln}
+		}
+		a.listeners[name] = append(a.listeners[name], ln)
+	}
+}
+
+// listener returns the socket named name passed by systemd. Each socket can only be used once.
+func (a *socketActivation) listener(name string) (net.Listener, error) {
+	a.once.Do(a.load)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return nil, fmt.Errorf("systemd socket activation: %w", a.err)
+	}
+	lns := a.listeners[name]
+	if len(lns) == 0 {
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	a.listeners[name] = lns[1:]
+	return lns[0], nil
+}
+
+// openListener opens the listener of the binding address addr: a TCP address, a Unix domain
+// socket ("unix:" and its path) or a socket passed by systemd ("systemd:" and its name).
+// The listener is closed by Shutdown if it is still open.
+func (s *Server) openListener(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(addr, unixAddressPrefix); ok {
+		var mode os.FileMode
+		if mode, err = s.config.unixSocketMode(); err == nil {
+			ln, err = listenUnix(path, mode)
+		}
+	} else if name, ok := strings.CutPrefix(addr, systemdAddressPrefix); ok {
+		ln, err = systemdSockets.listener(name)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, ln)
+	return ln, nil
+}
+
+// closeListeners closes the listeners that are still open, e.g. those opened while shutting
+// down, removing their Unix domain sockets.
+func (s *Server) closeListeners() {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	for _, ln := range s.listeners {
+		if err := ln.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("Listener close error", "address", ln.Addr().String(), "error", err)
+		}
+	}
+	s.listeners = nil
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// unixClient returns an HTTP client connecting to the Unix domain socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	// A socket left by a previous process is replaced.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	cnf := conf{HttpBindingAddress: unixAddressPrefix + path, UnixSocketMode: "0600"}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+
+	client := unixClient(path)
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = client.Get("http://localhost/limits")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	cancel()
+	require.NoError(t, <-done)
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist, "the socket is removed on shutdown")
+}
+
+func TestLocalListener(t *testing.T) {
+	ln, err := listenUnix(filepath.Join(t.TempDir(), "http.sock"), defaultUnixSocketMode)
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+
+	go func() {
+		conn, err := net.Dial("unix", ln.Addr().String())
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, "127.0.0.1:0", conn.RemoteAddr().String(), "connections come from the local host")
+}
+
+func TestSocketActivation(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	f, err := ln.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer func() { _ = f.Close() }()
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+	a := &socketActivation{firstFD: int(f.Fd())}
+	activated, err := a.listener("http")
+	require.NoError(t, err)
+	defer func() { _ = activated.Close() }()
+	assert.Equal(t, ln.Addr().String(), activated.Addr().String())
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok, "the environment variables are unset")
+
+	_, err = a.listener("http")
+	assert.ErrorContains(t, err, `no socket named "http"`, "each socket is used once")
+	_, err = a.listener("grpc")
+	assert.Error(t, err)
+
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	a = &socketActivation{firstFD: int(f.Fd())}
+	_, err = a.listener("http")
+	assert.Error(t, err, "the sockets of other processes are ignored")
+}
+
+func TestUnixSocketMode(t *testing.T) {
+	mode, err := conf{}.unixSocketMode()
+	require.NoError(t, err)
+	assert.Equal(t, defaultUnixSocketMode, mode)
+
+	mode, err = conf{UnixSocketMode: "0666"}.unixSocketMode()
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o666), mode)
+
+	for _, invalid := range []string{"rw-rw----", "0999", "01777"} {
+		_, err := conf{UnixSocketMode: invalid}.unixSocketMode()
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Log formats.
+const (
+	// LogFormatJSON writes one JSON object per line.
+	LogFormatJSON = "json"
+	// LogFormatText writes key=value pairs, easier to read in a terminal.
+	LogFormatText = "text"
+)
+
+// NewLogger returns a logger writing to w in the configured format (JSON by default) and
+// at the configured level. It is meant to be installed with slog.SetDefault, which also
+// routes the standard log package, used by dependencies, through it.
+func NewLogger(w io.Writer, cnf conf) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cnf.LogLevel}
+	if cnf.LogFormat == LogFormatText {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// loggerKey is the context key of the request-scoped logger.
+type loggerKey struct{}
+
+// withLogger returns a copy of ctx carrying logger.
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// loggerFrom returns the request-scoped logger of ctx, which adds the request ID to the
+// log records, or the default logger outside of requests.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// requestLogger returns the default logger with the request ID and, when the request
+// is traced, the trace ID.
+func requestLogger(ctx context.Context, requestID string) *slog.Logger {
+	logger := slog.Default().With("request_id", requestID)
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	return logger
+}
+
+// requestContextMiddleware sets the X-Request-ID response header, reusing the one of the
+// request if any, and attaches a logger recording it and the client IP to the request context.
+func requestContextMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: func(c echo.Context, id string) {
+			req := c.Request()
+			ctx := withLogger(req.Context(), requestLogger(req.Context(), id))
+			c.SetRequest(req.WithContext(withClientIP(ctx, c.RealIP())))
+		},
+	})
+}
+
+// accessLogMiddleware logs one record per request. Server errors are logged at the error
+// level. Tokens are redacted from the URI and errors, as they allow reading secrets.
+func accessLogMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
+		// Skip the health probes of orchestrators and load balancers.
+		Skipper: func(c echo.Context) bool {
+			return strings.HasPrefix(c.Path(), "/health")
+		},
+		LogRemoteIP:      true,
+		LogHost:          true,
+		LogMethod:        true,
+		LogURI:           true,
+		LogUserAgent:     true,
+		LogStatus:        true,
+		LogError:         true,
+		LogLatency:       true,
+		LogContentLength: true,
+		LogResponseSize:  true,
+		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
+			attrs := []slog.Attr{
+				slog.String("remote_ip", v.RemoteIP),
+				slog.String("host", v.Host),
+				slog.String("method", v.Method),
+				slog.String("uri", redactURI(v.URI)),
+				slog.String("route", metricsRoute(c)),
+				slog.String("user_agent", v.UserAgent),
+				slog.Int("status", v.Status),
+				slog.Duration("latency", v.Latency),
+				slog.String("bytes_in", v.ContentLength),
+				slog.Int64("bytes_out", v.ResponseSize),
+			}
+
+			level := slog.LevelInfo
+			if v.Error != nil {
+				attrs = append(attrs, slog.String("error", redactTokens(v.Error.Error())))
+			}
+			if v.Status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+
+			ctx := c.Request().Context()
+			loggerFrom(ctx).LogAttrs(ctx, level, "Request", attrs...)
+			return nil
+		},
+	})
+}
+
+// grpcLoggingInterceptor attaches a request-scoped logger to the context of gRPC calls,
+// reusing the x-request-id metadata if any, and logs one record per call.
+func grpcLoggingInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get("x-request-id"); len(ids) > 0 {
+			requestID = ids[0]
+		}
+	}
+	if requestID == "" {
+		requestID = newRequestID()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+
+	logger := requestLogger(ctx, requestID)
+	start := time.Now()
+	resp, err := handler(withLogger(ctx, logger), req)
+
+	level := slog.LevelInfo
+	code := status.Code(err)
+	switch code {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss:
+		level = slog.LevelError
+	}
+	logger.LogAttrs(ctx, level, "RPC",
+		slog.String("method", info.FullMethod),
+		slog.String("code", code.String()),
+		slog.Duration("latency", time.Since(start)),
+	)
+	return resp, err
+}
+
+// newRequestID returns a random request ID, for calls without one.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// serverErrorLog returns a standard logger for the errors of the given http.Server
+// (e.g. TLS handshake failures), going through the default slog logger.
+func serverErrorLog(server string) *log.Logger {
+	return slog.NewLogLogger(slog.Default().Handler().WithAttrs([]slog.Attr{slog.String("server", server)}), slog.LevelError)
+}
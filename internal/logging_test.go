@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, as background goroutines may log.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// records decodes the JSON log records.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	scanner := bufio.NewScanner(strings.NewReader(b.String()))
+	for scanner.Scan() {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), scanner.Text())
+		records = append(records, record)
+	}
+	return records
+}
+
+// record returns the first log record with the given message.
+func (b *syncBuffer) record(t *testing.T, msg string) map[string]any {
+	t.Helper()
+	for _, r := range b.records(t) {
+		if r[slog.MessageKey] == msg {
+			return r
+		}
+	}
+	require.Failf(t, "log record not found", "no record %q in:\n%s", msg, b.String())
+	return nil
+}
+
+// captureLogs makes the default logger write JSON records at the debug level to the
+// returned buffer, until the end of the test.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	logs := &syncBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(NewLogger(logs, conf{LogLevel: slog.LevelDebug, LogFormat: LogFormatJSON}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name     string
+		cnf      conf
+		expected string
+	}{
+		{"json", conf{LogFormat: LogFormatJSON}, `"msg":"shown","key":"value"}`},
+		{"default format", conf{}, `"msg":"shown","key":"value"}`},
+		{"text", conf{LogFormat: LogFormatText}, `level=INFO msg=shown key=value`},
+		{"warn level", conf{LogLevel: slog.LevelWarn, LogFormat: LogFormatText}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			logger := NewLogger(buf, tt.cnf)
+			logger.Debug("hidden")
+			logger.Info("shown", "key", "value")
+
+			assert.NotContains(t, buf.String(), "hidden")
+			if tt.expected == "" {
+				assert.Empty(t, buf.String())
+			} else {
+				assert.Contains(t, buf.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestRequestLogsCorrelation(t *testing.T) {
+	logs := captureLogs(t)
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}},
+		NewSecretHandlers(&FakeSecretMsgStorer{err: errors.New("expired")}))
+
+	req := retrieveRequest(server, "hvs.CABAAAAAAQAAAAAAAAAABBBB")
+	req.RemoteAddr = "10.0.0.40:1234"
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	requestID := rec.Header().Get(echo.HeaderXRequestID)
+	require.NotEmpty(t, requestID)
+
+	handlerRecord := logs.record(t, "Failed to retrieve secret")
+	assert.Equal(t, "ERROR", handlerRecord[slog.LevelKey])
+	assert.Equal(t, requestID, handlerRecord["request_id"])
+	assert.Equal(t, "expired", handlerRecord["error"])
+
+	accessRecord := logs.record(t, "Request")
+	assert.Equal(t, "INFO", accessRecord[slog.LevelKey])
+	assert.Equal(t, requestID, accessRecord["request_id"])
+	assert.Equal(t, http.MethodPost, accessRecord["method"])
+	assert.Equal(t, "/secret/retrieve", accessRecord["route"])
+	assert.Equal(t, float64(http.StatusNotFound), accessRecord["status"])
+	assert.Equal(t, "/secret/retrieve", accessRecord["uri"])
+}
+
+func TestRequestLogsReuseRequestID(t *testing.T) {
+	logs := captureLogs(t)
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+	req.RemoteAddr = "10.0.0.41:1234"
+	req.Header.Set(echo.HeaderXRequestID, "from-proxy")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+
+	assert.Equal(t, "from-proxy", rec.Header().Get(echo.HeaderXRequestID))
+	assert.Equal(t, "from-proxy", logs.record(t, "Request")["request_id"])
+}
+
+func TestGRPCLoggingInterceptor(t *testing.T) {
+	logs := captureLogs(t)
+	g := &grpcSecretServer{handlers: NewSecretHandlers(&FakeSecretMsgStorer{err: errors.New("expired")})}
+	info := &grpc.UnaryServerInfo{FullMethod: "/secret.v1.SecretService/GetSecret"}
+	handler := func(ctx context.Context, req any) (any, error) {
+		return g.GetSecret(ctx, req.(*secretv1.GetSecretRequest))
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "grpc-call"))
+	_, err := grpcLoggingInterceptor(ctx, &secretv1.GetSecretRequest{Token: "hvs.CABAAAAAAQAAAAAAAAAABBBB"}, info, handler)
+	require.Error(t, err)
+
+	assert.Equal(t, "grpc-call", logs.record(t, "Failed to retrieve secret")["request_id"])
+	rpcRecord := logs.record(t, "RPC")
+	assert.Equal(t, "grpc-call", rpcRecord["request_id"])
+	assert.Equal(t, info.FullMethod, rpcRecord["method"])
+	assert.Equal(t, "NotFound", rpcRecord["code"])
+	assert.Equal(t, "INFO", rpcRecord[slog.LevelKey])
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// memoryEntry is a message held by memoryStore until it is read or expires.
+type memoryEntry struct {
+	msg       string
+	reads     int
+	expiresAt time.Time
+	policy    AccessPolicy
+}
+
+// memoryStore implements SecretMsgStorer, SecretMsgRevoker, MultiReadStorer, PolicyStorer,
+// ExpiryNotifier and HealthChecker in process memory.
+// It is intended for tests and local development: messages are lost on restart
+// and are not shared between replicas.
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	now     func() time.Time
+	// onExpire is called with the token of each expired message, if set.
+	onExpire func(token string)
+}
+
+// NewMemoryStore creates an in-memory storage backend.
+// Tokens mimic the Vault service token format so that they pass the same validation.
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[string]memoryEntry),
+		now:     time.Now,
+	}
+}
+
+// Store saves a message with the specified TTL, which is required, and returns a one-time token.
+func (m *memoryStore) Store(ctx context.Context, msg string, ttl string) (token string, err error) {
+	return m.StoreWithReads(ctx, msg, ttl, 1)
+}
+
+// StoreWithReads saves a message that can be retrieved up to reads times.
+func (m *memoryStore) StoreWithReads(ctx context.Context, msg string, ttl string, reads int) (token string, err error) {
+	return m.StoreWithPolicy(ctx, msg, ttl, reads, AccessPolicy{})
+}
+
+// StoreWithPolicy saves a message that can be retrieved up to reads times by the clients
+// allowed by policy.
+func (m *memoryStore) StoreWithPolicy(ctx context.Context, msg string, ttl string, reads int, policy AccessPolicy) (token string, err error) {
+	if ttl == "" {
+		return "", errMissingTTL
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return "", err
+	}
+
+	token = newMemoryToken()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.purgeExpired()
+	m.entries[token] = memoryEntry{msg: msg, reads: reads, expiresAt: m.now().Add(d), policy: policy}
+	return token, nil
+}
+
+// Get retrieves a message and deletes it once all its reads are used.
+// Expired messages are reported as not found.
+func (m *memoryStore) Get(ctx context.Context, token string) (msg string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[token]
+	if !ok {
+		return "", fmt.Errorf("secret not found")
+	}
+	if !m.now().Before(e.expiresAt) {
+		m.expire(token)
+		return "", fmt.Errorf("secret not found")
+	}
+
+	e.reads--
+	if e.reads <= 0 {
+		delete(m.entries, token)
+	} else {
+		m.entries[token] = e
+	}
+	return e.msg, nil
+}
+
+// Policy returns the access policy of a message without consuming it.
+func (m *memoryStore) Policy(ctx context.Context, token string) (AccessPolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[token]
+	if !ok || !m.now().Before(e.expiresAt) {
+		return AccessPolicy{}, fmt.Errorf("secret not found")
+	}
+	return e.policy, nil
+}
+
+// Revoke deletes a message without returning it.
+func (m *memoryStore) Revoke(ctx context.Context, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.entries[token]; !ok {
+		return fmt.Errorf("secret not found")
+	}
+	delete(m.entries, token)
+	return nil
+}
+
+// purgeExpired removes expired messages, counting them as expired. The caller must hold m.mu.
+func (m *memoryStore) purgeExpired() {
+	now := m.now()
+	for token, e := range m.entries {
+		if !now.Before(e.expiresAt) {
+			m.expire(token)
+		}
+	}
+}
+
+// expire removes an expired message, counting it as expired. The caller must hold m.mu.
+func (m *memoryStore) expire(token string) {
+	delete(m.entries, token)
+	secretsExpiredTotal.Inc()
+	if m.onExpire != nil {
+		m.onExpire(token)
+	}
+}
+
+// NotifyExpired registers fn to be called with the ID of each expired message.
+// Expiry is detected lazily, when the store is next written to or the message is read.
+func (m *memoryStore) NotifyExpired(id func(token string) string, fn func(id string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onExpire = func(token string) { fn(id(token)) }
+}
+
+// CheckHealth always succeeds: the in-memory store is available as long as the process is.
+func (m *memoryStore) CheckHealth(ctx context.Context) error {
+	return nil
+}
+
+// newMemoryToken generates a random token in the Vault service token format ("hvs." + 24 characters).
+func newMemoryToken() string {
+	return "hvs." + rand.Text()[:24]
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreAndGet(t *testing.T) {
+	m := NewMemoryStore()
+
+	token, err := m.Store(context.Background(), "my secret", "1h")
+	if assert.NoError(t, err) {
+		assert.NoError(t, validateVaultToken(token))
+
+		msg, err := m.Get(context.Background(), token)
+		assert.NoError(t, err)
+		assert.Equal(t, "my secret", msg)
+
+		_, err = m.Get(context.Background(), token)
+		assert.Error(t, err)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	m := NewMemoryStore()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	token, err := m.Store(context.Background(), "my secret", "1h")
+	if assert.NoError(t, err) {
+		now = now.Add(time.Hour)
+		_, err = m.Get(context.Background(), token)
+		assert.Error(t, err)
+	}
+}
+
+func TestMemoryStoreInvalidTTL(t *testing.T) {
+	_, err := NewMemoryStore().Store(context.Background(), "my secret", "")
+	assert.ErrorIs(t, err, errMissingTTL, "the default TTL is resolved by the handlers")
+
+	_, err = NewMemoryStore().Store(context.Background(), "my secret", "invalid")
+	assert.Error(t, err)
+}
+
+func TestMemoryRevoke(t *testing.T) {
+	m := NewMemoryStore()
+
+	token, err := m.Store(context.Background(), "my secret", "1h")
+	if assert.NoError(t, err) {
+		assert.NoError(t, m.Revoke(context.Background(), token))
+
+		_, err = m.Get(context.Background(), token)
+		assert.Error(t, err)
+		assert.Error(t, m.Revoke(context.Background(), token))
+	}
+}
+
+func TestMemoryStoreWithReads(t *testing.T) {
+	m := NewMemoryStore()
+
+	token, err := m.StoreWithReads(context.Background(), "my secret", "1h", 2)
+	if assert.NoError(t, err) {
+		for i := 0; i < 2; i++ {
+			msg, err := m.Get(context.Background(), token)
+			assert.NoError(t, err)
+			assert.Equal(t, "my secret", msg)
+		}
+
+		_, err = m.Get(context.Background(), token)
+		assert.Error(t, err)
+	}
+}
+
+func TestMemoryStoreWithPolicy(t *testing.T) {
+	m := NewMemoryStore()
+	policy := AccessPolicy{Recipients: []string{"bob@example.com"}}
+
+	token, err := m.StoreWithPolicy(context.Background(), "my secret", "1h", 1, policy)
+	if assert.NoError(t, err) {
+		for i := 0; i < 2; i++ {
+			p, err := m.Policy(context.Background(), token)
+			assert.NoError(t, err)
+			assert.Equal(t, policy, p)
+		}
+
+		msg, err := m.Get(context.Background(), token)
+		assert.NoError(t, err, "reading the policy does not consume the message")
+		assert.Equal(t, "my secret", msg)
+
+		_, err = m.Policy(context.Background(), token)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes all the application metric names.
+const metricsNamespace = "supersecretmessage"
+
+// Kinds of secret payload, used as the "kind" label.
+const (
+	kindMessage = "message"
+	kindFile    = "file"
+)
+
+// metricsRegistry holds the application metrics, along with the Go runtime and process collectors.
+// It is shared by all servers in the process, like the storage backends it observes.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by method, route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	rateLimitRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Number of requests rejected by the rate limiter, by route.",
+	}, []string{"route"})
+
+	secretsCreatedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_created_total",
+		Help:      "Number of secrets created, by kind (message or file).",
+	}, []string{"kind"})
+
+	secretsReadTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_read_total",
+		Help:      "Number of successful secret reads.",
+	})
+
+	secretsRevokedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_revoked_total",
+		Help:      "Number of secrets revoked without being read.",
+	})
+
+	secretsExpiredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_expired_total",
+		Help:      "Number of secrets that expired before being read, for storage backends that track expiry.",
+	})
+
+	secretPayloadSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_payload_size_bytes",
+		Help:      "Size of created secrets before encoding, by kind (message or file).",
+		// 64B to 64MB
+		Buckets: prometheus.ExponentialBuckets(64, 4, 11),
+	}, []string{"kind"})
+
+	storageOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_operation_duration_seconds",
+		Help:      "Storage backend latency, by operation (store, get or revoke).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	storageErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "storage_errors_total",
+		Help:      "Number of failed storage backend operations, by operation. Reads of missing or consumed secrets are included.",
+	}, []string{"operation"})
+
+	vaultTokenRenewalsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_token_renewals_total",
+		Help:      "Number of Vault token renewals, by result (success or failure).",
+	}, []string{"result"})
+
+	vaultTokenLeaseDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_token_lease_duration_seconds",
+		Help:      "Remaining lease duration of the Vault token after its last renewal.",
+	})
+
+	vaultTokenLastRenewal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_token_last_renewal_timestamp_seconds",
+		Help:      "Unix time of the last successful Vault token renewal.",
+	})
+
+	vaultTokenRenewing = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_token_renewing",
+		Help:      "Whether the Vault token is being renewed (1) or renewal stopped (0).",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		rateLimitRejectionsTotal,
+		secretsCreatedTotal,
+		secretsReadTotal,
+		secretsRevokedTotal,
+		secretsExpiredTotal,
+		secretPayloadSize,
+		storageOperationDuration,
+		storageErrorsTotal,
+		vaultTokenRenewalsTotal,
+		vaultTokenLeaseDuration,
+		vaultTokenLastRenewal,
+		vaultTokenRenewing,
+	)
+}
+
+// metricsHandler serves the application metrics in the Prometheus exposition format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// metricsMiddleware records the count and latency of requests by method, route and status.
+// Routes are labelled with their registered path (e.g. "/static*") to bound cardinality.
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		labels := prometheus.Labels{"method": c.Request().Method, "route": metricsRoute(c), "status": strconv.Itoa(responseStatus(c, err))}
+		httpRequestsTotal.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// responseStatus returns the status code of the response to c, taking into account
+// the error returned by the handler, which is only written by Echo's error handler.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// metricsRoute returns the registered route of the request, or "unmatched" for unknown paths.
+func metricsRoute(c echo.Context) string {
+	if route := c.Path(); route != "" {
+		return route
+	}
+	return "unmatched"
+}
+
+// observeStorage times a storage backend operation in a "storage.<operation>" span
+// and counts its failures. Tokens are redacted from the returned error, whatever the backend.
+func observeStorage[T any](ctx context.Context, operation string, fn func(ctx context.Context) (T, error)) (T, error) {
+	ctx, span := tracer().Start(ctx, "storage."+operation)
+	start := time.Now()
+	v, err := fn(ctx)
+	storageOperationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		storageErrorsTotal.WithLabelValues(operation).Inc()
+	}
+	endSpan(span, err)
+	return v, redactError(err)
+}
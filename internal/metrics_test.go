@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMetricsTestServer(store SecretMsgStorer) *Server {
+	return NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(store))
+}
+
+func TestMetricsHTTPRequests(t *testing.T) {
+	server := newMetricsTestServer(&FakeSecretMsgStorer{msg: "secret"})
+
+	ok := httpRequestsTotal.WithLabelValues(http.MethodPost, "/secret/retrieve", "200")
+	badRequest := httpRequestsTotal.WithLabelValues(http.MethodPost, "/secret/retrieve", "400")
+	unmatched := httpRequestsTotal.WithLabelValues(http.MethodGet, "unmatched", "404")
+	okBefore, badBefore, unmatchedBefore := testutil.ToFloat64(ok), testutil.ToFloat64(badRequest), testutil.ToFloat64(unmatched)
+
+	for _, req := range []*http.Request{
+		retrieveRequest(server, "hvs.CABAAAAAAQAAAAAAAAAABBBB"),
+		retrieveRequest(server, "invalid"),
+		httptest.NewRequest(http.MethodGet, "/does-not-exist/hvs.CABAAAAAAQAAAAAAAAAABBBB", nil),
+	} {
+		req.RemoteAddr = "10.0.0.1:1234"
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, okBefore+1, testutil.ToFloat64(ok))
+	assert.Equal(t, badBefore+1, testutil.ToFloat64(badRequest))
+	// Unknown paths share a single label value, so that they cannot blow up cardinality.
+	assert.Equal(t, unmatchedBefore+1, testutil.ToFloat64(unmatched))
+}
+
+func TestMetricsRateLimitRejections(t *testing.T) {
+	server := newMetricsTestServer(&FakeSecretMsgStorer{})
+	rejections := rateLimitRejectionsTotal.WithLabelValues("/limits")
+	before := testutil.ToFloat64(rejections)
+
+	rejected := 0
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+		req.RemoteAddr = "10.0.0.2:1234"
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+
+	assert.Greater(t, rejected, 0)
+	assert.Equal(t, before+float64(rejected), testutil.ToFloat64(rejections))
+	assert.GreaterOrEqual(t, testutil.ToFloat64(httpRequestsTotal.WithLabelValues(http.MethodGet, "/limits", "429")), float64(rejected))
+}
+
+func TestMetricsSecretLifecycle(t *testing.T) {
+	store := NewMemoryStore()
+	server := newMetricsTestServer(store)
+
+	messages := secretsCreatedTotal.WithLabelValues(kindMessage)
+	files := secretsCreatedTotal.WithLabelValues(kindFile)
+	createdBefore, filesBefore := testutil.ToFloat64(messages), testutil.ToFloat64(files)
+	readBefore := testutil.ToFloat64(secretsReadTotal)
+	policyErrorsBefore := testutil.ToFloat64(storageErrorsTotal.WithLabelValues("policy"))
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	_ = w.WriteField("msg", "secret")
+	fw, _ := w.CreateFormFile("file", "secret.txt")
+	_, _ = fw.Write([]byte("file content"))
+	_ = w.Close()
+	req := httptest.NewRequest(http.MethodPost, "/secret", body)
+	req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+	req.RemoteAddr = "10.0.0.3:1234"
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, createdBefore+1, testutil.ToFloat64(messages))
+	assert.Equal(t, filesBefore+1, testutil.ToFloat64(files))
+
+	var tr TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+	for i := 0; i < 2; i++ {
+		req := retrieveRequest(server, tr.Token)
+		req.RemoteAddr = "10.0.0.3:1234"
+		server.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, readBefore+1, testutil.ToFloat64(secretsReadTotal))
+	// The access policy of consumed secrets cannot be looked up, before they are read.
+	assert.Equal(t, policyErrorsBefore+1, testutil.ToFloat64(storageErrorsTotal.WithLabelValues("policy")))
+
+	metrics := scrapeMetrics(t, server)
+	assert.Contains(t, metrics, `supersecretmessage_secret_payload_size_bytes_bucket{kind="file",le="64"}`)
+	assert.Contains(t, metrics, `supersecretmessage_storage_operation_duration_seconds_count{operation="store"}`)
+}
+
+func TestMetricsSecretsExpired(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	before := testutil.ToFloat64(secretsExpiredTotal)
+
+	token, err := store.Store(context.Background(), "secret", "1m")
+	require.NoError(t, err)
+	_, err = store.Store(context.Background(), "secret", "1m")
+	require.NoError(t, err)
+
+	now = now.Add(2 * time.Minute)
+	_, err = store.Get(context.Background(), token)
+	assert.Error(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(secretsExpiredTotal))
+
+	// The other secret is purged when the next one is stored.
+	_, err = store.Store(context.Background(), "secret", "1m")
+	require.NoError(t, err)
+	assert.Equal(t, before+2, testutil.ToFloat64(secretsExpiredTotal))
+}
+
+func TestObserveStorageErrors(t *testing.T) {
+	errorsBefore := testutil.ToFloat64(storageErrorsTotal.WithLabelValues("revoke"))
+
+	_, err := observeStorage(context.Background(), "revoke", func(context.Context) (struct{}, error) { return struct{}{}, errors.New("failed") })
+	assert.Error(t, err)
+	_, err = observeStorage(context.Background(), "revoke", func(context.Context) (struct{}, error) { return struct{}{}, nil })
+	assert.NoError(t, err)
+
+	assert.Equal(t, errorsBefore+1, testutil.ToFloat64(storageErrorsTotal.WithLabelValues("revoke")))
+}
+
+func TestMetricsAdminListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	cnf := conf{HttpBindingAddress: "127.0.0.1:0", AdminBindingAddress: addr, AllowedOrigins: []string{"*"}}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	// Metrics are not exposed on the main listener when an admin listener is configured.
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Get(fmt.Sprintf("http://%s/metrics", addr))
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(b), "supersecretmessage_http_requests_total")
+	assert.Contains(t, string(b), "go_goroutines")
+}
+
+// scrapeMetrics returns the body of GET /metrics on the main listener.
+func scrapeMetrics(t *testing.T, server *Server) string {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.RemoteAddr = "10.0.0.4:1234"
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	return rec.Body.String()
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/acme"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Client certificate authentication modes of the HTTPS listener.
+const (
+	// ClientAuthRequest verifies the client certificates sent, and serves clients without one
+	// anonymously.
+	ClientAuthRequest = "request"
+	// ClientAuthRequire rejects the TLS connections of clients without a valid certificate.
+	ClientAuthRequire = "require"
+)
+
+// clientCertSubjectPrefix starts the subject of the identities of clients authenticated
+// with a certificate, e.g. "cert:ci.example.com".
+const clientCertSubjectPrefix = "cert:"
+
+// loadClientCAs returns the pool of the CA certificates of the PEM bundle at path, which
+// sign the accepted client certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// clientAuthType returns the TLS client authentication policy of the given mode.
+func clientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+// withClientAuth configures config to verify client certificates against the CA bundle
+// configured by cnf, if any. With auto TLS, the TLS-ALPN-01 challenges of the ACME server,
+// which has no client certificate, are still answered: clientCertMiddleware rejects the
+// requests sent over these connections.
+func withClientAuth(config *tls.Config, cnf conf) error {
+	if cnf.TLSClientAuth == "" {
+		return nil
+	}
+	pool, err := loadClientCAs(cnf.TLSClientCAFile)
+	if err != nil {
+		return err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = clientAuthType(cnf.TLSClientAuth)
+
+	if cnf.TLSAutoDomain != "" {
+		acmeConfig := config.Clone()
+		acmeConfig.ClientAuth = tls.NoClientCert
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto {
+				return acmeConfig, nil
+			}
+			return nil, nil
+		}
+	}
+	return nil
+}
+
+// certificateSubject returns the name of the client of cert: its common name, or its first
+// URI (e.g. a SPIFFE ID), DNS name or email address.
+func certificateSubject(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// clientCertMiddleware authenticates the clients presenting a certificate verified by the
+// TLS handshake, attaching their identity to the request context. When allowed is not
+// empty, only the certificates whose subject is listed are accepted: the other ones get a
+// 403 response. Requests without a certificate are let through.
+func clientCertMiddleware(allowed []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			state := c.Request().TLS
+			if state != nil && state.NegotiatedProtocol == acme.ALPNProto {
+				return echo.NewHTTPError(http.StatusMisdirectedRequest, "ACME challenge connection")
+			}
+			if state == nil || len(state.VerifiedChains) == 0 {
+				return next(c)
+			}
+			id := certificateIdentity(c.Request().Context(), state.VerifiedChains[0][0], allowed)
+			if id == nil {
+				return echo.NewHTTPError(http.StatusForbidden, "client certificate not allowed")
+			}
+			c.SetRequest(c.Request().WithContext(withIdentity(c.Request().Context(), id)))
+			return next(c)
+		}
+	}
+}
+
+// grpcClientCertInterceptor authenticates the gRPC clients presenting a certificate verified
+// by the TLS handshake, like clientCertMiddleware: calls with a certificate not allowed get a
+// PermissionDenied error.
+func grpcClientCertInterceptor(allowed []string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		p, _ := peer.FromContext(ctx)
+		var info credentials.TLSInfo
+		if p != nil {
+			info, _ = p.AuthInfo.(credentials.TLSInfo)
+		}
+		if len(info.State.VerifiedChains) == 0 {
+			return handler(ctx, req)
+		}
+		id := certificateIdentity(ctx, info.State.VerifiedChains[0][0], allowed)
+		if id == nil {
+			return nil, status.Error(codes.PermissionDenied, "client certificate not allowed")
+		}
+		return handler(withIdentity(ctx, id), req)
+	}
+}
+
+// certificateIdentity returns the identity of the client of the verified certificate cert,
+// or nil when its subject is not allowed.
+func certificateIdentity(ctx context.Context, cert *x509.Certificate, allowed []string) *Identity {
+	subject := certificateSubject(cert)
+	if subject == "" || (len(allowed) > 0 && !slices.Contains(allowed, subject)) {
+		loggerFrom(ctx).Info("Client certificate not allowed", "subject", cert.Subject.String())
+		return nil
+	}
+	return &Identity{Subject: clientCertSubjectPrefix + subject, Method: IdentityCertificate, Label: cert.Subject.String()}
+}
+
+// validateClientAuth checks the client certificate authentication settings of cnf.
+func (cnf conf) validateClientAuth() error {
+	switch cnf.TLSClientAuth {
+	case "":
+		if cnf.TLSClientCAFile != "" || len(cnf.TLSClientSubjects) > 0 {
+			return errors.New("client certificate authentication (tls_client_auth) must be set with a client CA bundle (tls_client_ca_file) or subjects (tls_client_subjects)")
+		}
+		return nil
+	case ClientAuthRequest, ClientAuthRequire:
+	default:
+		return fmt.Errorf("client certificate authentication (tls_client_auth) must be empty, %q or %q", ClientAuthRequest, ClientAuthRequire)
+	}
+
+	var errs []error
+	if cnf.HttpsBindingAddress == "" {
+		errs = append(errs, errors.New("HTTPS binding address (https_binding_address) must be set when client certificate authentication (tls_client_auth) is enabled"))
+	}
+	if cnf.TLSClientCAFile == "" {
+		errs = append(errs, errors.New("client CA bundle (tls_client_ca_file) must be set when client certificate authentication (tls_client_auth) is enabled"))
+	} else if _, err := loadClientCAs(cnf.TLSClientCAFile); err != nil {
+		errs = append(errs, fmt.Errorf("invalid client CA bundle (tls_client_ca_file): %w", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA returns a new self-signed certificate authority.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// writePEM writes the certificate of the CA to a PEM file and returns its path.
+func (ca *testCA) writePEM(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600))
+	return path
+}
+
+// issueClient returns a client certificate with the given subject, signed by the CA.
+func (ca *testCA) issueClient(t *testing.T, subject pkix.Name) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// selfSignedPEM returns the PEM encoded certificate and key of a self-signed certificate
+// for localhost with the given serial number, valid from notBefore to notAfter.
+func selfSignedPEM(t *testing.T, serial int64, notBefore, notAfter time.Time) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// certFilesWrites counts the writes of writeCertFiles, to give each one a distinct
+// modification time.
+var certFilesWrites int
+
+// writeCertFiles writes the certificate and key to the files at certPath and keyPath, with
+// a modification time in the future so that the change is detected on file systems with a
+// coarse resolution.
+func writeCertFiles(t *testing.T, certPath, keyPath string, certPEM, keyPEM []byte) {
+	t.Helper()
+	certFilesWrites++
+	modTime := time.Now().Add(time.Duration(certFilesWrites) * time.Second)
+	require.NoError(t, os.WriteFile(certPath, certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0o600))
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+}
+
+// startTLSServer starts server on a test HTTPS listener with its TLS configuration.
+func startTLSServer(t *testing.T, server *Server) *httptest.Server {
+	t.Helper()
+	config, err := server.tlsConfig(nil)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(server)
+	ts.TLS = config
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// tlsClient returns a client of ts presenting the given certificates.
+func tlsClient(ts *httptest.Server, certs ...tls.Certificate) *http.Client {
+	client := ts.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certs
+	client.Transport = transport
+	return client
+}
+
+// send sends req with client, closing the body of the response.
+func send(client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestClientCertificateRequest(t *testing.T) {
+	ca := newTestCA(t)
+	cnf := conf{
+		HttpsBindingAddress: ":443",
+		AllowedOrigins:      []string{"*"},
+		TLSClientAuth:       ClientAuthRequest,
+		TLSClientCAFile:     ca.writePEM(t),
+		Challenge:           api.ChallengeProofOfWork,
+		ChallengeDifficulty: 8,
+	}
+	buf := &bytes.Buffer{}
+	handlers := NewSecretHandlers(&FakeSecretMsgStorer{})
+	handlers.SetAuditLog(NewAuditLog(buf, []byte("salt"), testAuditChainKey))
+	ts := startTLSServer(t, NewServer(cnf, handlers))
+
+	resp, err := send(tlsClient(ts), newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "clients without certificate are anonymous and challenged")
+
+	cert := ca.issueClient(t, pkix.Name{CommonName: "ci.example.com", Organization: []string{"Example"}})
+	resp, err = send(tlsClient(ts, cert), newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "clients with a certificate skip the challenge")
+	var entry AuditEntry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "cert:ci.example.com", entry.Creator)
+	assert.Equal(t, "CN=ci.example.com,O=Example", entry.Label)
+
+	other := newTestCA(t).issueClient(t, pkix.Name{CommonName: "ci.example.com"})
+	_, err = send(tlsClient(ts, other), newCreateRequest(t, nil, sentTo(ts)))
+	assert.Error(t, err, "certificates from other CAs are rejected")
+}
+
+func TestClientCertificateRequire(t *testing.T) {
+	ca := newTestCA(t)
+	cnf := conf{
+		HttpsBindingAddress: ":443",
+		AllowedOrigins:      []string{"*"},
+		TLSClientAuth:       ClientAuthRequire,
+		TLSClientCAFile:     ca.writePEM(t),
+		TLSClientSubjects:   []string{"ci.example.com"},
+	}
+	ts := startTLSServer(t, NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{})))
+
+	_, err := send(tlsClient(ts), newCreateRequest(t, nil, sentTo(ts)))
+	assert.Error(t, err, "clients without certificate are rejected")
+
+	resp, err := send(tlsClient(ts, ca.issueClient(t, pkix.Name{CommonName: "ci.example.com"})), newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = send(tlsClient(ts, ca.issueClient(t, pkix.Name{CommonName: "intruder"})), newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "subjects not listed are rejected")
+}
+
+func TestClientCertificateRateLimit(t *testing.T) {
+	ca := newTestCA(t)
+	cnf := conf{
+		HttpsBindingAddress: ":443",
+		AllowedOrigins:      []string{"*"},
+		TLSClientAuth:       ClientAuthRequest,
+		TLSClientCAFile:     ca.writePEM(t),
+		RateLimits:          RateLimits{Create: RateLimit{Limit: 2, Period: time.Minute}},
+	}
+	ts := startTLSServer(t, NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{})))
+	ci := tlsClient(ts, ca.issueClient(t, pkix.Name{CommonName: "ci"}))
+
+	for range 2 {
+		resp, err := send(ci, newCreateRequest(t, nil, sentTo(ts)))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp, err := send(ci, newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	resp, err = send(tlsClient(ts, ca.issueClient(t, pkix.Name{CommonName: "deploy"})), newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "certificates are limited separately")
+	resp, err = send(tlsClient(ts), newCreateRequest(t, nil, sentTo(ts)))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the certificate does not use the limit of its IP address")
+}
+
+func TestCertificateSubject(t *testing.T) {
+	assert.Equal(t, "ci", certificateSubject(&x509.Certificate{Subject: pkix.Name{CommonName: "ci"}, DNSNames: []string{"ci.example.com"}}))
+	assert.Equal(t, "ci.example.com", certificateSubject(&x509.Certificate{DNSNames: []string{"ci.example.com"}}))
+	assert.Equal(t, "ci@example.com", certificateSubject(&x509.Certificate{EmailAddresses: []string{"ci@example.com"}}))
+	assert.Empty(t, certificateSubject(&x509.Certificate{}))
+}
+
+func TestGRPCClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM, keyPEM := selfSignedPEM(t, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, certPEM, keyPEM)
+	cnf := conf{
+		TLSCertFilepath:    certPath,
+		TLSCertKeyFilepath: keyPath,
+		TLSClientAuth:      ClientAuthRequest,
+		TLSClientCAFile:    ca.writePEM(t),
+		TLSClientSubjects:  []string{"ci.example.com"},
+	}
+	certs, err := newCertReloader(certPath, keyPath)
+	require.NoError(t, err)
+	opts, err := grpcServerOptions(cnf, certs.GetCertificate)
+	require.NoError(t, err)
+	opts = append(opts, grpc.ChainUnaryInterceptor(grpcClientCertInterceptor(cnf.TLSClientSubjects), (&oidcAuth{}).grpcRequireLogin()))
+	gs := newGRPCServer(NewSecretHandlers(&FakeSecretMsgStorer{}), opts...)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = gs.Serve(ln) }()
+	t.Cleanup(gs.Stop)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(certPEM))
+	create := func(certs ...tls.Certificate) error {
+		conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certs,
+		})))
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = secretv1.NewSecretServiceClient(conn).CreateSecret(t.Context(), &secretv1.CreateSecretRequest{Msg: "secret"})
+		return err
+	}
+
+	assert.Equal(t, codes.Unauthenticated, status.Code(create()), "clients without certificate are anonymous")
+	assert.NoError(t, create(ca.issueClient(t, pkix.Name{CommonName: "ci.example.com"})), "clients with a certificate are authenticated")
+	assert.Equal(t, codes.PermissionDenied, status.Code(create(ca.issueClient(t, pkix.Name{CommonName: "intruder"}))),
+		"subjects not listed are rejected")
+}
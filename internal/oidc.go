@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OpenID Connect settings.
+const (
+	// DefaultSessionTTL is how long users stay logged in by default.
+	DefaultSessionTTL = 8 * time.Hour
+	// sessionCookie holds the session of logged in users.
+	sessionCookie = "sup3r_session"
+	// loginCookie holds the state of a login in progress, until the identity provider
+	// redirects the user back.
+	loginCookie = "sup3r_login"
+	// loginTTL is how long users have to log in with the identity provider.
+	loginTTL = 10 * time.Minute
+	// loginPath starts the login, and callbackPath ends it. They are under authPath, the
+	// path of the login cookie.
+	authPath     = "/auth"
+	loginPath    = authPath + "/login"
+	callbackPath = authPath + "/callback"
+	logoutPath   = authPath + "/logout"
+)
+
+// session is the content of the session cookie.
+type session struct {
+	// Subject is the email address of the user, or their subject identifier when the
+	// identity provider does not share it.
+	Subject string `json:"sub"`
+	// Email is the verified email address of the user, if any.
+	Email string `json:"email,omitempty"`
+	// Groups are the groups of the user.
+	Groups []string `json:"groups,omitempty"`
+	// Expiry is when the session ends, in seconds since the epoch.
+	Expiry int64 `json:"exp"`
+}
+
+// loginState is the content of the login cookie.
+type loginState struct {
+	// State binds the callback to the browser that started the login.
+	State string `json:"state"`
+	// Nonce binds the ID token to the login.
+	Nonce string `json:"nonce"`
+	// Verifier is the PKCE code verifier.
+	Verifier string `json:"verifier"`
+	// Next is the local path to go back to once logged in.
+	Next string `json:"next"`
+	// Expiry is when the login expires, in seconds since the epoch.
+	Expiry int64 `json:"exp"`
+}
+
+// oidcAuth logs users in with an OpenID Connect identity provider, with the authorization
+// code flow and PKCE. Sessions are kept in cookies signed by signer, so that any replica
+// sharing the signing key can check them.
+type oidcAuth struct {
+	issuer         string
+	clientID       string
+	clientSecret   string
+	redirectURL    string
+	allowedGroups  []string
+	allowedDomains []string
+	sessionTTL     time.Duration
+	// requireForRetrieval also requires users to log in to retrieve secrets.
+	requireForRetrieval bool
+	// trustUnverifiedEmail trusts the email addresses of the ID tokens without email_verified
+	// claim as verified.
+	trustUnverifiedEmail bool
+	signer               *signer
+	// secure marks the cookies Secure, when served over HTTPS.
+	secure bool
+
+	// provider is discovered on the first login, so that the server starts while the
+	// identity provider is unavailable.
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+// newOIDCAuth returns the OpenID Connect login configured by cnf, or nil when disabled.
+// Sessions are signed by s.
+func newOIDCAuth(cnf conf, s *signer) *oidcAuth {
+	if cnf.OIDCIssuer == "" {
+		return nil
+	}
+	ttl := cnf.OIDCSessionTTL
+	if ttl == 0 {
+		ttl = DefaultSessionTTL
+	}
+	return &oidcAuth{
+		issuer:               cnf.OIDCIssuer,
+		clientID:             cnf.OIDCClientID,
+		clientSecret:         cnf.OIDCClientSecret,
+		redirectURL:          cnf.OIDCRedirectURL,
+		allowedGroups:        cnf.OIDCAllowedGroups,
+		allowedDomains:       lowerAll(cnf.OIDCAllowedDomains),
+		sessionTTL:           ttl,
+		requireForRetrieval:  cnf.OIDCRequireForRetrieval,
+		trustUnverifiedEmail: cnf.OIDCTrustUnverifiedEmail,
+		signer:               s,
+		secure:               strings.HasPrefix(cnf.OIDCRedirectURL, "https://"),
+	}
+}
+
+// oauth2Config discovers the identity provider, if not done yet, and returns its OAuth2
+// configuration.
+func (a *oidcAuth) oauth2Config(ctx context.Context) (*oauth2.Config, *oidc.Provider, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.provider == nil {
+		// The provider keeps the context to fetch its keys, so it must outlive the request.
+		p, err := oidc.NewProvider(context.WithoutCancel(ctx), a.issuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discovering OpenID Connect provider %s: %w", a.issuer, err)
+		}
+		a.provider = p
+	}
+
+	scopes := []string{oidc.ScopeOpenID, "email", "profile"}
+	if len(a.allowedGroups) > 0 {
+		scopes = append(scopes, "groups")
+	}
+	return &oauth2.Config{
+		ClientID:     a.clientID,
+		ClientSecret: a.clientSecret,
+		Endpoint:     a.provider.Endpoint(),
+		RedirectURL:  a.redirectURL,
+		Scopes:       scopes,
+	}, a.provider, nil
+}
+
+// identity returns the identity of the session of a request, or nil when the user is not
+// logged in.
+func (a *oidcAuth) identity(r *http.Request) *Identity {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var sess session
+	if err := a.signer.open(sessionCookie, cookie.Value, &sess); err != nil || a.signer.now().Unix() >= sess.Expiry {
+		return nil
+	}
+	return &Identity{Subject: sess.Subject, Method: IdentityOIDC, Email: sess.Email, Groups: sess.Groups}
+}
+
+// authorize returns an error when a user is not allowed to log in. Users must be in one
+// of the allowed groups or have a verified email address in one of the allowed domains,
+// when either is configured.
+func (a *oidcAuth) authorize(email string, emailVerified bool, groups []string) error {
+	if len(a.allowedGroups) == 0 && len(a.allowedDomains) == 0 {
+		return nil
+	}
+	for _, g := range groups {
+		if slices.Contains(a.allowedGroups, g) {
+			return nil
+		}
+	}
+	if _, domain, ok := strings.Cut(email, "@"); ok && emailVerified && slices.Contains(a.allowedDomains, strings.ToLower(domain)) {
+		return nil
+	}
+	return errors.New("user not allowed")
+}
+
+// setCookie sets a cookie, or deletes it when value is empty.
+func (a *oidcAuth) setCookie(c echo.Context, name, value, path string, expiry time.Time) {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expiry,
+		Secure:   a.secure,
+		HttpOnly: true,
+		// Lax, as the identity provider redirects to the callback from another site.
+		SameSite: http.SameSiteLaxMode,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	c.SetCookie(cookie)
+}
+
+// LoginHandler handles GET requests starting a login: the user is redirected to the
+// identity provider, which redirects them back to CallbackHandler.
+func (a *oidcAuth) LoginHandler(c echo.Context) error {
+	cfg, _, err := a.oauth2Config(c.Request().Context())
+	if err != nil {
+		loggerFrom(c.Request().Context()).Error("Failed to start login", "error", err)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "identity provider unavailable")
+	}
+
+	expiry := a.signer.now().Add(loginTTL)
+	login := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: oauth2.GenerateVerifier(),
+		Next:     localPath(c.QueryParam("next")),
+		Expiry:   expiry.Unix(),
+	}
+	sealed, err := a.signer.seal(loginCookie, login)
+	if err != nil {
+		return err
+	}
+	a.setCookie(c, loginCookie, sealed, authPath, expiry)
+	return c.Redirect(http.StatusFound, cfg.AuthCodeURL(login.State, oauth2.S256ChallengeOption(login.Verifier), oidc.Nonce(login.Nonce)))
+}
+
+// CallbackHandler handles the redirection from the identity provider ending a login: the
+// authorization code is exchanged for an ID token, and allowed users get a session.
+func (a *oidcAuth) CallbackHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	cookie, err := c.Cookie(loginCookie)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "no login in progress")
+	}
+	a.setCookie(c, loginCookie, "", authPath, time.Time{})
+	var login loginState
+	if err := a.signer.open(loginCookie, cookie.Value, &login); err != nil || c.QueryParam("state") != login.State {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid login state")
+	}
+	if a.signer.now().Unix() >= login.Expiry {
+		return echo.NewHTTPError(http.StatusBadRequest, "login expired, try again")
+	}
+	if e := c.QueryParam("error"); e != "" {
+		loggerFrom(ctx).Info("Login failed", "error", e, "description", c.QueryParam("error_description"))
+		return echo.NewHTTPError(http.StatusForbidden, "login failed: "+e)
+	}
+
+	cfg, provider, err := a.oauth2Config(ctx)
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to end login", "error", err)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "identity provider unavailable")
+	}
+	token, err := cfg.Exchange(ctx, c.QueryParam("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		loggerFrom(ctx).Error("Failed to exchange authorization code", "error", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "login failed")
+	}
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: a.clientID, Now: a.signer.now}).Verify(ctx, rawIDToken)
+	if err != nil || idToken.Nonce != login.Nonce {
+		loggerFrom(ctx).Error("Invalid ID token", "error", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "login failed")
+	}
+
+	var claims struct {
+		Email         string   `json:"email"`
+		EmailVerified *bool    `json:"email_verified"`
+		Groups        []string `json:"groups"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		loggerFrom(ctx).Error("Invalid ID token claims", "error", err)
+		return echo.NewHTTPError(http.StatusBadGateway, "login failed")
+	}
+	// Some providers omit the claim for addresses users can edit: they are only trusted when
+	// configured so, for providers that only share verified addresses.
+	emailVerified := a.trustUnverifiedEmail
+	if claims.EmailVerified != nil {
+		emailVerified = *claims.EmailVerified
+	}
+	if err := a.authorize(claims.Email, emailVerified, claims.Groups); err != nil {
+		loggerFrom(ctx).Info("Login denied", "subject", idToken.Subject, "email", claims.Email)
+		return echo.NewHTTPError(http.StatusForbidden, "you are not allowed to use this service")
+	}
+
+	subject := claims.Email
+	if subject == "" {
+		subject = idToken.Subject
+	}
+	// Only verified addresses can be matched against the recipients of secrets.
+	verifiedEmail := ""
+	if emailVerified {
+		verifiedEmail = claims.Email
+	}
+	expiry := a.signer.now().Add(a.sessionTTL)
+	sealed, err := a.signer.seal(sessionCookie, session{Subject: subject, Email: verifiedEmail, Groups: claims.Groups, Expiry: expiry.Unix()})
+	if err != nil {
+		return err
+	}
+	a.setCookie(c, sessionCookie, sealed, "/", expiry)
+	loggerFrom(ctx).Info("User logged in", "subject", subject)
+	return c.Redirect(http.StatusFound, login.Next)
+}
+
+// LogoutHandler handles requests ending the session of a user. The session with the
+// identity provider is kept.
+func (a *oidcAuth) LogoutHandler(c echo.Context) error {
+	a.setCookie(c, sessionCookie, "", "/", time.Time{})
+	return c.Redirect(http.StatusFound, "/")
+}
+
+// sessionMiddleware attaches the identity of logged in users to the request context.
+// It lets all the requests through, anonymous or not, and does nothing when a is nil.
+func sessionMiddleware(a *oidcAuth) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if a == nil || identityFrom(c.Request().Context()) != nil {
+				return next(c)
+			}
+			if id := a.identity(c.Request()); id != nil {
+				c.SetRequest(c.Request().WithContext(withIdentity(c.Request().Context(), id)))
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireLogin rejects anonymous requests when a is not nil: pages redirect to the login,
+// and API calls get a 401 response.
+func (a *oidcAuth) requireLogin() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if a == nil || identityFrom(c.Request().Context()) != nil {
+				return next(c)
+			}
+			if c.Request().Method == http.MethodGet {
+				return c.Redirect(http.StatusFound, loginPath+"?"+url.Values{"next": {c.Request().URL.RequestURI()}}.Encode())
+			}
+			return echo.NewHTTPError(http.StatusUnauthorized, "login required")
+		}
+	}
+}
+
+// requireLoginForRetrieval is requireLogin when users must also log in to retrieve secrets,
+// and lets all the requests through otherwise.
+func (a *oidcAuth) requireLoginForRetrieval() echo.MiddlewareFunc {
+	if a == nil || !a.requireForRetrieval {
+		return func(next echo.HandlerFunc) echo.HandlerFunc { return next }
+	}
+	return a.requireLogin()
+}
+
+// grpcRequireLogin rejects the anonymous gRPC calls creating secrets when a is not nil, and
+// those retrieving secrets when users must also log in to retrieve them, like requireLogin
+// and requireLoginForRetrieval. gRPC clients cannot log in: they get an Unauthenticated error
+// unless they authenticate with an API key or a client certificate.
+func (a *oidcAuth) grpcRequireLogin() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if a == nil || identityFrom(ctx) != nil {
+			return handler(ctx, req)
+		}
+		switch info.FullMethod {
+		case secretv1.SecretService_CreateSecret_FullMethodName:
+		case secretv1.SecretService_GetSecret_FullMethodName:
+			if !a.requireForRetrieval {
+				return handler(ctx, req)
+			}
+		default:
+			return handler(ctx, req)
+		}
+		return nil, status.Error(codes.Unauthenticated, "login required, authenticate with an API key or a client certificate")
+	}
+}
+
+// localPath returns p when it is a path on this server, to redirect to it safely, and the
+// message creation page otherwise.
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/msg"
+	}
+	return p
+}
+
+// lowerAll returns the lower case versions of values.
+func lowerAll(values []string) []string {
+	lower := make([]string, len(values))
+	for i, v := range values {
+		lower[i] = strings.ToLower(v)
+	}
+	return lower
+}
+
+// randomString returns a random string with 128 bits of entropy.
+func randomString() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
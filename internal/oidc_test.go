@@ -0,0 +1,440 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testRedirectURL is the OpenID Connect redirect URL of the test servers.
+const testRedirectURL = "http://secrets.example.com/auth/callback"
+
+// mockOIDCProvider is a local OpenID Connect provider, logging users in with the
+// authorization code flow and PKCE without asking for credentials.
+type mockOIDCProvider struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// user is the claims of the user logging in.
+	user map[string]any
+	// codes are the pending authorization requests, by code.
+	codes map[string]url.Values
+}
+
+// newMockOIDCProvider starts a mock provider, logging in users with the given claims. Their
+// email address is verified unless the email_verified claim says otherwise.
+func newMockOIDCProvider(t *testing.T, user map[string]any) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p := &mockOIDCProvider{t: t, key: key, user: user, codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: string(jose.RS256), Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// setUser changes the claims of the user logging in.
+func (p *mockOIDCProvider) setUser(user map[string]any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = user
+}
+
+// authorize logs the user in and redirects them to the client with an authorization code.
+func (p *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	assert.Equal(p.t, "code", q.Get("response_type"))
+	assert.Equal(p.t, "S256", q.Get("code_challenge_method"), "PKCE is used")
+	assert.Contains(p.t, q.Get("scope"), "openid")
+
+	code := randomString()
+	p.mu.Lock()
+	p.codes[code] = q
+	p.mu.Unlock()
+
+	redirect := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// token exchanges an authorization code for an ID token, checking the PKCE code verifier.
+func (p *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	auth, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	user := p.user
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.Get("code_challenge") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":            p.URL,
+		"sub":            "user-1",
+		"aud":            auth.Get("client_id"),
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          auth.Get("nonce"),
+		"email_verified": true,
+	}
+	// The claims of the user override the defaults, and nil values remove them.
+	for k, v := range user {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	payload, err := json.Marshal(claims)
+	require.NoError(p.t, err)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: p.key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	require.NoError(p.t, err)
+	jws, err := signer.Sign(payload)
+	require.NoError(p.t, err)
+	idToken, err := jws.CompactSerialize()
+	require.NoError(p.t, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// oidcTestConfig returns the configuration of a server logging users in with p.
+func oidcTestConfig(p *mockOIDCProvider) conf {
+	return conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		OIDCIssuer:         p.URL,
+		OIDCClientID:       "sup3r",
+		OIDCClientSecret:   "client-secret",
+		OIDCRedirectURL:    testRedirectURL,
+		RateLimits:         RateLimits{Default: RateLimit{Limit: 100, Period: time.Second}, Retrieve: RateLimit{Limit: 100, Period: time.Second}},
+	}
+}
+
+// serve sends req to server, with the given cookies.
+func serve(server *Server, req *http.Request, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+// responseCookie returns the cookie set by a response, or nil.
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// login goes through the login flow of server with provider p, and returns the response
+// of the callback.
+func login(t *testing.T, server *Server, p *mockOIDCProvider, next string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := serve(server, httptest.NewRequest(http.MethodGet, loginPath+"?next="+url.QueryEscape(next), nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+	loginCookie := responseCookie(rec, loginCookie)
+	require.NotNil(t, loginCookie)
+	assert.True(t, loginCookie.HttpOnly)
+	require.True(t, strings.HasPrefix(rec.Header().Get(echo.HeaderLocation), p.URL+"/authorize?"))
+
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(rec.Header().Get(echo.HeaderLocation))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get(echo.HeaderLocation))
+	require.NoError(t, err)
+	require.Equal(t, callbackPath, callback.Path)
+
+	return serve(server, httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil), loginCookie)
+}
+
+// loginAs logs a user in with the given claims and returns their session cookie.
+func loginAs(t *testing.T, server *Server, p *mockOIDCProvider, user map[string]any) *http.Cookie {
+	t.Helper()
+	p.setUser(user)
+	rec := login(t, server, p, "/msg")
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+	session := responseCookie(rec, sessionCookie)
+	require.NotNil(t, session)
+	return session
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newMockOIDCProvider(t, map[string]any{"email": "alice@example.com", "email_verified": true, "groups": []string{"eng"}})
+	cnf := oidcTestConfig(p)
+	cnf.OIDCAllowedDomains = []string{"Example.com"}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	rec := serve(server, httptest.NewRequest(http.MethodGet, "/msg", nil))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/auth/login?next=%2Fmsg", rec.Header().Get(echo.HeaderLocation))
+
+	rec = createSecret(t, server, nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = login(t, server, p, "/msg?from=test")
+	require.Equal(t, http.StatusFound, rec.Code, rec.Body.String())
+	assert.Equal(t, "/msg?from=test", rec.Header().Get(echo.HeaderLocation))
+	session := responseCookie(rec, sessionCookie)
+	require.NotNil(t, session)
+	assert.True(t, session.HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, session.SameSite)
+	assert.Equal(t, -1, responseCookie(rec, loginCookie).MaxAge, "the login cookie is deleted")
+
+	t.Chdir("../web")
+	rec = serve(server, httptest.NewRequest(http.MethodGet, "/msg", nil), session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = serve(server, httptest.NewRequest(http.MethodGet, logoutPath, nil), session)
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, -1, responseCookie(rec, sessionCookie).MaxAge)
+}
+
+func TestOIDCCreatorIsAudited(t *testing.T) {
+	p := newMockOIDCProvider(t, nil)
+	handlers := NewSecretHandlers(&FakeSecretMsgStorer{})
+	buf := &bytes.Buffer{}
+	handlers.SetAuditLog(NewAuditLog(buf, []byte("salt"), testAuditChainKey))
+	server := NewServer(oidcTestConfig(p), handlers)
+
+	session := loginAs(t, server, p, map[string]any{"email": "alice@example.com"})
+
+	rec := createSecret(t, server, nil, withCookies(session))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var entry AuditEntry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, AuditCreated, entry.Event)
+	assert.Equal(t, "alice@example.com", entry.Creator)
+}
+
+func TestOIDCAuthorization(t *testing.T) {
+	p := newMockOIDCProvider(t, nil)
+	cnf := oidcTestConfig(p)
+	cnf.OIDCAllowedGroups = []string{"security"}
+	cnf.OIDCAllowedDomains = []string{"example.com"}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	tests := []struct {
+		name     string
+		user     map[string]any
+		expected int
+	}{
+		{"allowed domain", map[string]any{"email": "alice@EXAMPLE.com"}, http.StatusFound},
+		{"allowed group", map[string]any{"email": "bob@partner.com", "groups": []string{"security"}}, http.StatusFound},
+		{"other domain", map[string]any{"email": "eve@example.org"}, http.StatusForbidden},
+		{"suffix domain", map[string]any{"email": "eve@evil-example.com"}, http.StatusForbidden},
+		{"unverified email", map[string]any{"email": "eve@example.com", "email_verified": false}, http.StatusForbidden},
+		{"email without verification claim", map[string]any{"email": "eve@example.com", "email_verified": nil}, http.StatusForbidden},
+		{"other group", map[string]any{"email": "eve@partner.com", "groups": []string{"sales"}}, http.StatusForbidden},
+		{"no email", map[string]any{}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.setUser(tt.user)
+			rec := login(t, server, p, "/msg")
+			assert.Equal(t, tt.expected, rec.Code)
+			if tt.expected != http.StatusFound {
+				assert.Nil(t, responseCookie(rec, sessionCookie))
+			}
+		})
+	}
+}
+
+func TestOIDCTrustUnverifiedEmail(t *testing.T) {
+	p := newMockOIDCProvider(t, nil)
+	cnf := oidcTestConfig(p)
+	cnf.OIDCAllowedDomains = []string{"example.com"}
+	cnf.OIDCTrustUnverifiedEmail = true
+	store := NewMemoryStore()
+	server := NewServer(cnf, NewSecretHandlers(store))
+
+	p.setUser(map[string]any{"email": "eve@example.com", "email_verified": false})
+	assert.Equal(t, http.StatusForbidden, login(t, server, p, "/msg").Code, "addresses reported unverified are not trusted")
+
+	bob := loginAs(t, server, p, map[string]any{"email": "bob@example.com", "email_verified": nil})
+	rec := createSecret(t, server, map[string]string{api.FieldRecipients: "bob@example.com"}, withCookies(bob))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var tr TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+	rec = serve(server, retrieveRequest(server, tr.Token), bob)
+	assert.Equal(t, http.StatusOK, rec.Code, "addresses without verification claim match the recipients")
+}
+
+func TestOIDCCallbackRejectsForgedLogins(t *testing.T) {
+	p := newMockOIDCProvider(t, map[string]any{"email": "alice@example.com"})
+	server := NewServer(oidcTestConfig(p), NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	rec := serve(server, httptest.NewRequest(http.MethodGet, loginPath, nil))
+	require.Equal(t, http.StatusFound, rec.Code)
+	loginCookie := responseCookie(rec, loginCookie)
+
+	tests := []struct {
+		name    string
+		query   string
+		cookies []*http.Cookie
+	}{
+		{"no login cookie", "?code=code&state=state", nil},
+		{"wrong state", "?code=code&state=state", []*http.Cookie{loginCookie}},
+		{"forged cookie", "?code=code&state=state", []*http.Cookie{{Name: loginCookie.Name, Value: "e30.forged"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(server, httptest.NewRequest(http.MethodGet, callbackPath+tt.query, nil), tt.cookies...)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Nil(t, responseCookie(rec, sessionCookie))
+		})
+	}
+}
+
+func TestOIDCSession(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newSigner(nil)
+	s.now = func() time.Time { return now }
+	a := newOIDCAuth(conf{OIDCIssuer: "https://idp.example.com", OIDCRedirectURL: "https://secrets.example.com/auth/callback"}, s)
+	assert.True(t, a.secure)
+	assert.Equal(t, DefaultSessionTTL, a.sessionTTL)
+
+	sealed, err := s.seal(sessionCookie, session{Subject: "alice@example.com", Groups: []string{"eng"}, Expiry: now.Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: sealed})
+	assert.Equal(t, &Identity{Subject: "alice@example.com", Method: IdentityOIDC, Groups: []string{"eng"}}, a.identity(req))
+
+	forged := httptest.NewRequest(http.MethodGet, "/", nil)
+	forged.AddCookie(&http.Cookie{Name: sessionCookie, Value: "eyJzdWIiOiJib2IifQ." + strings.SplitN(sealed, ".", 2)[1]})
+	assert.Nil(t, a.identity(forged))
+
+	now = now.Add(time.Hour)
+	assert.Nil(t, a.identity(req), "sessions expire")
+}
+
+func TestOIDCRetrieval(t *testing.T) {
+	p := newMockOIDCProvider(t, map[string]any{"email": "alice@example.com"})
+	store := NewMemoryStore()
+	token, err := store.Store(t.Context(), "my secret", "1h")
+	require.NoError(t, err)
+
+	anonymous := NewServer(oidcTestConfig(p), NewSecretHandlers(store))
+	rec := serve(anonymous, httptest.NewRequest(http.MethodHead, "/getmsg", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, "retrieval is anonymous by default")
+
+	cnf := oidcTestConfig(p)
+	cnf.OIDCRequireForRetrieval = true
+	server := NewServer(cnf, NewSecretHandlers(store))
+
+	rec = serve(server, httptest.NewRequest(http.MethodGet, "/getmsg?token="+token, nil))
+	assert.Equal(t, http.StatusFound, rec.Code)
+	assert.Equal(t, "/auth/login?next=%2Fgetmsg%3Ftoken%3D"+url.QueryEscape(token), rec.Header().Get(echo.HeaderLocation))
+	rec = serve(server, retrieveRequest(server, token))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	session := loginAs(t, server, p, map[string]any{"email": "alice@example.com"})
+	rec = serve(server, retrieveRequest(server, token), session)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "my secret")
+}
+
+func TestLocalPath(t *testing.T) {
+	for p, expected := range map[string]string{
+		"/getmsg?token=x":        "/getmsg?token=x",
+		"":                       "/msg",
+		"https://evil.example":   "/msg",
+		"//evil.example/msg":     "/msg",
+		"/\\evil.example":        "/msg",
+		"javascript:alert(1)":    "/msg",
+		"/msg#section":           "/msg#section",
+		"msg":                    "/msg",
+		"/auth/callback?code=xx": "/auth/callback?code=xx",
+	} {
+		assert.Equal(t, expected, localPath(p), p)
+	}
+}
+
+func TestGRPCRequireLogin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	key, _, err := MintAPIKey(path, APIKeyOptions{Label: "ci"})
+	require.NoError(t, err)
+	keys := newAPIKeys(conf{APIKeysFile: path})
+	authenticated := metadata.AppendToOutgoingContext(t.Context(), "authorization", "Bearer "+key)
+	create := &secretv1.CreateSecretRequest{Msg: "secret"}
+	get := &secretv1.GetSecretRequest{Token: "hvs.CABAAAAAAQAAAAAAAAAABBBB"}
+
+	client := newTestGRPCClient(t, &FakeSecretMsgStorer{msg: "secret"},
+		grpc.ChainUnaryInterceptor(grpcAPIKeyInterceptor(keys), (&oidcAuth{}).grpcRequireLogin()))
+	_, err = client.CreateSecret(t.Context(), create)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "anonymous clients cannot create secrets")
+	_, err = client.CreateSecret(authenticated, create)
+	assert.NoError(t, err, "programs can create secrets")
+	_, err = client.GetSecret(t.Context(), get)
+	assert.NoError(t, err, "retrieval stays anonymous")
+
+	client = newTestGRPCClient(t, &FakeSecretMsgStorer{msg: "secret"},
+		grpc.ChainUnaryInterceptor(grpcAPIKeyInterceptor(keys), (&oidcAuth{requireForRetrieval: true}).grpcRequireLogin()))
+	_, err = client.GetSecret(t.Context(), get)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.GetSecret(authenticated, get)
+	assert.NoError(t, err)
+
+	client = newTestGRPCClient(t, &FakeSecretMsgStorer{msg: "secret"},
+		grpc.ChainUnaryInterceptor((*oidcAuth)(nil).grpcRequireLogin()))
+	_, err = client.CreateSecret(t.Context(), create)
+	assert.NoError(t, err, "no login without single sign-on")
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pires/go-proxyproto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// parseNetworks parses network addresses, such as those of the trusted proxies: CIDRs
+// (e.g. "10.0.0.0/8") or single IP addresses. Empty items are ignored.
+func parseNetworks(addrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range addrs {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR %q", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether ip belongs to one of the networks.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIPExtractor returns the extractor of the client IP address used by ctx.RealIP(),
+// hence by rate limiting and logs. The X-Forwarded-For header is only trusted when set by
+// one of the trusted proxies: the client IP is the nearest address that is not a trusted
+// proxy. Other headers, such as X-Real-IP, are ignored, so that clients cannot spoof them.
+// Without trusted proxies, the client IP is the address of the peer.
+func clientIPExtractor(trusted []*net.IPNet) echo.IPExtractor {
+	opts := []echo.TrustOption{
+		// Echo trusts local and private addresses by default, which includes other clients
+		// of the same network.
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, n := range trusted {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+// grpcClientIPInterceptor resolves the client IP address of gRPC calls like
+// clientIPExtractor does for HTTP requests, from the x-forwarded-for metadata of the calls
+// of trusted proxies, or else from the peer address. The address is then used by the IP
+// filters, rate limiting, access policies and logs.
+func grpcClientIPInterceptor(trusted []*net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return handler(withClientIP(ctx, forwardedClientIP(ctx, trusted)), req)
+	}
+}
+
+// forwardedClientIP returns the client IP address of a gRPC call: the nearest address of
+// the x-forwarded-for metadata that is not a trusted proxy, when the peer is one.
+func forwardedClientIP(ctx context.Context, trusted []*net.IPNet) string {
+	peerIP := clientIPFrom(ctx)
+	if ip := net.ParseIP(peerIP); ip == nil || !containsIP(trusted, ip) {
+		return peerIP
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var forwarded []string
+	for _, v := range md.Get("x-forwarded-for") {
+		forwarded = append(forwarded, strings.Split(v, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			return peerIP
+		}
+		if !containsIP(trusted, ip) {
+			return ip.String()
+		}
+	}
+	if len(forwarded) > 0 {
+		// All the addresses are trusted proxies: the farthest one is the client.
+		return strings.TrimSpace(forwarded[0])
+	}
+	return peerIP
+}
+
+// proxyProtocolListener wraps ln to read the PROXY protocol (v1 or v2) header sent by
+// load balancers, so that the address of connections is the one of the client. Only
+// trusted proxies can send the header: the connections of other peers are rejected if
+// they do, and used as is otherwise.
+func proxyProtocolListener(ln net.Listener, trusted []*net.IPNet) net.Listener {
+	return &proxyproto.Listener{
+		Listener: ln,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			addr, ok := opts.Upstream.(*net.TCPAddr)
+			if ok && containsIP(trusted, addr.IP) {
+				return proxyproto.USE, nil
+			}
+			return proxyproto.REJECT, nil
+		},
+	}
+}
+
+// listen listens on the binding address addr of a public listener, reading the PROXY
+// protocol header of trusted proxies when enabled.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	ln, err := s.openListener(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.config.ProxyProtocol {
+		ln = proxyProtocolListener(ln, s.trustedProxies)
+	}
+	return ln, nil
+}
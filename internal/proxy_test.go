@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := parseNetworks([]string{"10.0.0.0/8", " 192.0.2.1 ", "", "2001:db8::/32", "2001:db8::1"})
+	require.NoError(t, err)
+	require.Len(t, nets, 4)
+	assert.Equal(t, "10.0.0.0/8", nets[0].String())
+	assert.Equal(t, "192.0.2.1/32", nets[1].String())
+	assert.Equal(t, "2001:db8::/32", nets[2].String())
+	assert.Equal(t, "2001:db8::1/128", nets[3].String())
+
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.example.com", "10.0.0"} {
+		_, err := parseNetworks([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestClientIPExtractor(t *testing.T) {
+	trusted, err := parseNetworks([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		trusted  []string
+		remote   string
+		headers  map[string]string
+		expected string
+	}{
+		{"no proxy", nil, "203.0.113.1", nil, "203.0.113.1"},
+		{"spoofed forwarded for", nil, "203.0.113.1", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}, "203.0.113.1"},
+		{"spoofed real IP", nil, "203.0.113.1", map[string]string{echo.HeaderXRealIP: "198.51.100.1"}, "203.0.113.1"},
+		{"private peers are not trusted by default", nil, "192.168.1.1", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}, "192.168.1.1"},
+		{"untrusted peer", []string{"10.0.0.0/8"}, "203.0.113.1", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}, "203.0.113.1"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.0.0.1", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", []string{"10.0.0.0/8"}, "10.0.0.1", map[string]string{echo.HeaderXForwardedFor: "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"spoofed entries before the client", []string{"10.0.0.0/8"}, "10.0.0.1", map[string]string{echo.HeaderXForwardedFor: "192.0.2.66, 198.51.100.1"}, "198.51.100.1"},
+		{"real IP from trusted proxy", []string{"10.0.0.0/8"}, "10.0.0.1", map[string]string{echo.HeaderXRealIP: "198.51.100.1"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets := trusted
+			if tt.trusted == nil {
+				nets = nil
+			}
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote + ":1234"
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.expected, clientIPExtractor(nets)(req))
+		})
+	}
+}
+
+func TestGRPCClientIP(t *testing.T) {
+	trusted, err := parseNetworks([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		expected  string
+	}{
+		{"no proxy", "203.0.113.1", nil, "203.0.113.1"},
+		{"untrusted peer", "203.0.113.1", []string{"198.51.100.1"}, "203.0.113.1"},
+		{"trusted proxy", "10.0.0.1", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without forwarded address", "10.0.0.1", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"several values", "10.0.0.1", []string{"192.0.2.66", "198.51.100.1"}, "198.51.100.1"},
+		{"spoofed entries before the client", "10.0.0.1", []string{"192.0.2.66, 198.51.100.1"}, "198.51.100.1"},
+		{"invalid forwarded address", "10.0.0.1", []string{"not an address"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 1234}})
+			md := metadata.MD{}
+			for _, v := range tt.forwarded {
+				md.Append("x-forwarded-for", v)
+			}
+			ctx = metadata.NewIncomingContext(ctx, md)
+
+			var got string
+			_, err := grpcClientIPInterceptor(trusted)(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+				got = clientIPFrom(ctx)
+				return nil, nil
+			})
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestRateLimitIgnoresSpoofedHeaders(t *testing.T) {
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	rejected := 0
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+		req.RemoteAddr = "203.0.113.10:1234"
+		// Each request pretends to come from a different client.
+		req.Header.Set(echo.HeaderXForwardedFor, fmt.Sprintf("198.51.100.%d", i))
+		req.Header.Set(echo.HeaderXRealIP, fmt.Sprintf("192.0.2.%d", i))
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code == http.StatusTooManyRequests {
+			rejected++
+		}
+	}
+	assert.Equal(t, 10, rejected, "spoofed headers must not bypass the rate limit")
+}
+
+func TestRateLimitBehindTrustedProxy(t *testing.T) {
+	server := NewServer(conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		TrustedProxies:     []string{"10.0.0.0/8"},
+	}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	// All the requests go through the same load balancer.
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, fmt.Sprintf("198.51.100.%d", i))
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, "clients behind the proxy are limited independently")
+	}
+}
+
+// proxyProtocolTestServer serves server on a loopback listener reading the PROXY protocol
+// headers of trusted, and returns its address.
+func proxyProtocolTestServer(t *testing.T, server *Server, trusted string) string {
+	t.Helper()
+	nets, err := parseNetworks([]string{trusted})
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	hs := &http.Server{Handler: server, ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = hs.Serve(proxyProtocolListener(ln, nets)) }()
+	t.Cleanup(func() { _ = hs.Close() })
+	return ln.Addr().String()
+}
+
+// sendWithProxyHeader sends a GET /limits request preceded by a PROXY protocol v1 header
+// for the client address 198.51.100.7, and returns the status of the response.
+func sendWithProxyHeader(t *testing.T, addr string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, err = fmt.Fprintf(conn, "PROXY TCP4 198.51.100.7 127.0.0.1 40000 80\r\nGET /limits HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProxyProtocol(t *testing.T) {
+	logs := captureLogs(t)
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	addr := proxyProtocolTestServer(t, server, "127.0.0.1")
+
+	assert.Equal(t, http.StatusOK, sendWithProxyHeader(t, addr))
+	assert.Equal(t, "198.51.100.7", logs.record(t, "Request")["remote_ip"])
+
+	// Connections without the header are served as is.
+	resp, err := http.Get("http://" + addr + "/limits")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestProxyProtocolFromUntrustedPeer(t *testing.T) {
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	addr := proxyProtocolTestServer(t, server, "10.0.0.0/8")
+
+	// Reading the connection fails, which the HTTP server answers with a 400 Bad Request.
+	assert.Equal(t, http.StatusBadRequest, sendWithProxyHeader(t, addr), "the header is rejected")
+
+	resp, err := http.Get("http://" + addr + "/limits")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "connections without the header are served")
+}
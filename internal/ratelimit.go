@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Route groups, each with its own rate limit and buckets, and IP filter.
+const (
+	routeGroupDefault  = "default"
+	routeGroupCreate   = "create"
+	routeGroupRetrieve = "retrieve"
+)
+
+// RateLimit allows Limit requests per Period, in bursts of up to Limit requests.
+// Requests are spread over the period: after a burst, a request is allowed again
+// every Period/Limit.
+type RateLimit struct {
+	// Limit is the number of requests allowed per Period.
+	Limit int
+	// Period is the window of the limit.
+	Period time.Duration
+}
+
+// parseRateLimit parses a rate limit in the "<limit>/<period>" format, where period is a
+// duration whose leading 1 can be omitted (e.g. "10/2s", "20/1m" or "20/m").
+func parseRateLimit(s string) (RateLimit, error) {
+	limit, period, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: must be <limit>/<period> (e.g. 20/1m)", s)
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: limit must be a positive integer", s)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q: period must be a positive duration", s)
+	}
+	return RateLimit{Limit: n, Period: d}, nil
+}
+
+// String formats r in the format parsed by parseRateLimit.
+func (r RateLimit) String() string {
+	period := r.Period.String()
+	if strings.HasSuffix(period, "m0s") {
+		period = strings.TrimSuffix(period, "0s")
+	}
+	if strings.HasSuffix(period, "h0m") {
+		period = strings.TrimSuffix(period, "0m")
+	}
+	return strconv.Itoa(r.Limit) + "/" + period
+}
+
+// interval returns the time it takes for a request to be allowed again after a burst.
+func (r RateLimit) interval() time.Duration {
+	return r.Period / time.Duration(r.Limit)
+}
+
+// RateLimits holds the limits of each route group. Zero fields are replaced by their
+// DefaultRateLimits value.
+type RateLimits struct {
+	// Default applies to the routes without a specific limit.
+	Default RateLimit
+	// Create applies to the creation of secrets (POST /secret).
+	Create RateLimit
+	// Retrieve applies to the retrieval of secrets (POST /secret/retrieve).
+	Retrieve RateLimit
+}
+
+// DefaultRateLimits returns the rate limits used when none is configured: 5 requests per
+// second in bursts of 10 (only humans should use this service), and 20 secrets created
+// per minute.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Default:  RateLimit{Limit: 10, Period: 2 * time.Second},
+		Create:   RateLimit{Limit: 20, Period: time.Minute},
+		Retrieve: RateLimit{Limit: 10, Period: 2 * time.Second},
+	}
+}
+
+// orDefault returns l with its zero fields replaced by their default value.
+func (l RateLimits) orDefault() RateLimits {
+	d := DefaultRateLimits()
+	if l.Default == (RateLimit{}) {
+		l.Default = d.Default
+	}
+	if l.Create == (RateLimit{}) {
+		l.Create = d.Create
+	}
+	if l.Retrieve == (RateLimit{}) {
+		l.Retrieve = d.Retrieve
+	}
+	return l
+}
+
+// group returns the limit of the given route group.
+func (l RateLimits) group(group string) RateLimit {
+	switch group {
+	case routeGroupCreate:
+		return l.Create
+	case routeGroupRetrieve:
+		return l.Retrieve
+	}
+	return l.Default
+}
+
+// RateLimitResult is the outcome of a rate limited request.
+type RateLimitResult struct {
+	// Allowed reports whether the request is allowed.
+	Allowed bool
+	// Remaining is the number of requests allowed right after this one.
+	Remaining int
+	// RetryAfter is how long to wait before a denied request is allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long it takes for the full limit to be available again.
+	ResetAfter time.Duration
+}
+
+// RateLimitStore keeps the state of rate limits, with the generic cell rate algorithm:
+// for each key, it stores the theoretical arrival time (TAT) of the next request, which
+// moves forward by the limit interval for each allowed request.
+type RateLimitStore interface {
+	// Allow counts a request against the limit of key.
+	Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// gcra applies the generic cell rate algorithm to a request at now, given the theoretical
+// arrival time of the key. It returns the result and the new theoretical arrival time.
+func gcra(now, tat time.Time, limit RateLimit) (RateLimitResult, time.Time) {
+	if tat.Before(now) {
+		tat = now
+	}
+	newTAT := tat.Add(limit.interval())
+	allowAt := newTAT.Add(-limit.Period)
+	if now.Before(allowAt) {
+		return RateLimitResult{RetryAfter: allowAt.Sub(now), ResetAfter: tat.Sub(now)}, tat
+	}
+	return RateLimitResult{
+		Allowed:    true,
+		Remaining:  int(now.Sub(allowAt) / limit.interval()),
+		ResetAfter: newTAT.Sub(now),
+	}, newTAT
+}
+
+// rateLimitSweepInterval is how often the memory store forgets the keys of clients
+// that recovered their full limit.
+const rateLimitSweepInterval = time.Minute
+
+// memoryRateLimitStore keeps the rate limits in memory, for a single replica.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	tats      map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryRateLimitStore returns a RateLimitStore local to the process. With several
+// replicas, each one has its own limits: use NewRedisRateLimitStore to share them.
+func NewMemoryRateLimitStore() RateLimitStore {
+	return &memoryRateLimitStore{tats: map[string]time.Time{}, now: time.Now}
+}
+
+// Allow implements RateLimitStore.
+func (m *memoryRateLimitStore) Allow(_ context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) >= rateLimitSweepInterval {
+		for k, tat := range m.tats {
+			if tat.Before(now) {
+				delete(m.tats, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	result, tat := gcra(now, m.tats[key], limit)
+	m.tats[key] = tat
+	return result, nil
+}
+
+// gcraScript applies the generic cell rate algorithm atomically in Redis, with the clock
+// of Redis so that replicas agree on time. Times are in microseconds.
+var gcraScript = redis.NewScript(`
+local interval = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local tat = tonumber(redis.call('GET', KEYS[1]))
+if not tat or tat < now then
+  tat = now
+end
+local new_tat = tat + interval
+local allow_at = new_tat - period
+if now < allow_at then
+  return {0, 0, allow_at - now, tat - now}
+end
+redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - allow_at) / interval), 0, new_tat - now}
+`)
+
+// redisRateLimitKeyPrefix prefixes the Redis keys of the rate limits.
+const redisRateLimitKeyPrefix = "supersecretmessage:ratelimit:"
+
+// redisRateLimitStore keeps the rate limits in Redis, shared by all replicas.
+type redisRateLimitStore struct {
+	client redis.UniversalClient
+}
+
+// NewRedisRateLimitStore returns a RateLimitStore shared by all the replicas using client.
+// Keys expire once their full limit is available again.
+func NewRedisRateLimitStore(client redis.UniversalClient) RateLimitStore {
+	return redisRateLimitStore{client: client}
+}
+
+// Allow implements RateLimitStore.
+func (r redisRateLimitStore) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	res, err := gcraScript.Run(ctx, r.client, []string{redisRateLimitKeyPrefix + key},
+		limit.interval().Microseconds(), limit.Period.Microseconds()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(res) != 4 {
+		return RateLimitResult{}, errors.New("unexpected rate limit script result")
+	}
+	return RateLimitResult{
+		Allowed:    res[0] == 1,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Microsecond,
+		ResetAfter: time.Duration(res[3]) * time.Microsecond,
+	}, nil
+}
+
+// newRateLimitStore returns the store configured by cnf.RateLimitRedisURL, and a function
+// releasing it. The URL is checked by conf.Validate: an invalid one falls back to the memory store.
+func newRateLimitStore(cnf conf) (RateLimitStore, func() error) {
+	if cnf.RateLimitRedisURL == "" {
+		return NewMemoryRateLimitStore(), func() error { return nil }
+	}
+	opts, err := redis.ParseURL(cnf.RateLimitRedisURL)
+	if err != nil {
+		slog.Error("Invalid rate limit Redis URL, using in-memory rate limits", "error", err)
+		return NewMemoryRateLimitStore(), func() error { return nil }
+	}
+	client := redis.NewClient(opts)
+	return NewRedisRateLimitStore(client), client.Close
+}
+
+// routeGroup returns the route group of the request, or "" if it is neither rate limited nor
+// filtered by IP address. Health probes are not limited, as probes of all the replicas may
+// come from the same address.
+func routeGroup(c echo.Context) string {
+	switch {
+	case strings.HasPrefix(c.Path(), "/health"):
+		return ""
+	case c.Path() == "/secret" && c.Request().Method == http.MethodPost:
+		return routeGroupCreate
+	case c.Path() == "/secret/retrieve":
+		return routeGroupRetrieve
+	}
+	return routeGroupDefault
+}
+
+// grpcRouteGroup returns the route group of a gRPC method: that of the HTTP route it mirrors.
+func grpcRouteGroup(fullMethod string) string {
+	switch fullMethod {
+	case secretv1.SecretService_CreateSecret_FullMethodName:
+		return routeGroupCreate
+	case secretv1.SecretService_GetSecret_FullMethodName:
+		return routeGroupRetrieve
+	}
+	return routeGroupDefault
+}
+
+// forRequest returns the rate limit of a request of the route group from the client IP
+// address ip, and the key of its bucket in the store: the client certificate or API key of
+// the request, if any, or else ip. API keys with their own rate limit have their own bucket.
+func (l RateLimits) forRequest(ctx context.Context, group, ip string) (RateLimit, string) {
+	limit, key := l.group(group), group+":"+ip
+	if id := identityFrom(ctx); id.isProgram() {
+		key = group + ":" + id.Subject
+	}
+	if k := apiKeyFrom(ctx); k != nil && k.RateLimit != (RateLimit{}) {
+		limit, key = k.RateLimit, "key:"+k.ID
+	}
+	return limit, key
+}
+
+// rateLimitMiddleware limits the requests of each client IP address per route group, those
+// of each client certificate per route group, and those of each API key with its own rate
+// limit, or per route group when it has none.
+// Responses carry the RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset and
+// RateLimit-Policy headers, and rejected requests get a 429 response with Retry-After.
+// Requests are allowed when the store fails, so that an unavailable Redis does not
+// prevent serving secrets.
+func rateLimitMiddleware(store RateLimitStore, limits RateLimits) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			group := routeGroup(c)
+			if group == "" {
+				return next(c)
+			}
+			ctx := c.Request().Context()
+			limit, key := limits.forRequest(ctx, group, c.RealIP())
+			result, err := store.Allow(ctx, key, limit)
+			if err != nil {
+				loggerFrom(ctx).Warn("Rate limit store failed, allowing request", "error", err)
+				return next(c)
+			}
+
+			h := c.Response().Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+			h.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Limit, ceilSeconds(limit.Period)))
+			if !result.Allowed {
+				rateLimitRejectionsTotal.WithLabelValues(metricsRoute(c)).Inc()
+				h.Set(echo.HeaderRetryAfter, strconv.Itoa(max(ceilSeconds(result.RetryAfter), 1)))
+				return c.JSON(http.StatusTooManyRequests, map[string]string{
+					"error": "rate limit exceeded",
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+// grpcRateLimitInterceptor applies the rate limits of rateLimitMiddleware to gRPC calls,
+// sharing their buckets, by the route group of their method (see grpcRouteGroup). Calls get
+// the same headers as metadata, and rejected calls a ResourceExhausted error with retry-after.
+func grpcRateLimitInterceptor(store RateLimitStore, limits RateLimits) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		limit, key := limits.forRequest(ctx, grpcRouteGroup(info.FullMethod), clientIPFrom(ctx))
+		result, err := store.Allow(ctx, key, limit)
+		if err != nil {
+			loggerFrom(ctx).Warn("Rate limit store failed, allowing request", "error", err)
+			return handler(ctx, req)
+		}
+
+		md := metadata.Pairs(
+			"ratelimit-limit", strconv.Itoa(limit.Limit),
+			"ratelimit-remaining", strconv.Itoa(result.Remaining),
+			"ratelimit-reset", strconv.Itoa(ceilSeconds(result.ResetAfter)),
+			"ratelimit-policy", fmt.Sprintf("%d;w=%d", limit.Limit, ceilSeconds(limit.Period)),
+		)
+		if !result.Allowed {
+			rateLimitRejectionsTotal.WithLabelValues(info.FullMethod).Inc()
+			md.Set("retry-after", strconv.Itoa(max(ceilSeconds(result.RetryAfter), 1)))
+			_ = grpc.SetHeader(ctx, md)
+			return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+		}
+		_ = grpc.SetHeader(ctx, md)
+		return handler(ctx, req)
+	}
+}
+
+// ceilSeconds returns d in seconds, rounded up.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected RateLimit
+		str      string
+	}{
+		{"10/2s", RateLimit{Limit: 10, Period: 2 * time.Second}, "10/2s"},
+		{"20/1m", RateLimit{Limit: 20, Period: time.Minute}, "20/1m"},
+		{"20/m", RateLimit{Limit: 20, Period: time.Minute}, "20/1m"},
+		{" 100/h ", RateLimit{Limit: 100, Period: time.Hour}, "100/1h"},
+		{"5/1m30s", RateLimit{Limit: 5, Period: 90 * time.Second}, "5/1m30s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			r, err := parseRateLimit(tt.input)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, r)
+			assert.Equal(t, tt.str, r.String())
+		})
+	}
+
+	for _, input := range []string{"", "10", "0/1s", "-1/1s", "ten/1s", "10/", "10/0s", "10/fortnight"} {
+		_, err := parseRateLimit(input)
+		assert.Error(t, err, input)
+	}
+}
+
+// testRateLimitStore checks the generic cell rate algorithm of store, whose clock is
+// controlled by setTime.
+func testRateLimitStore(t *testing.T, store RateLimitStore, setTime func(time.Time)) {
+	t.Helper()
+	ctx := context.Background()
+	limit := RateLimit{Limit: 3, Period: 3 * time.Second}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	setTime(now)
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		result, err := store.Allow(ctx, "client", limit)
+		require.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+
+	result, err := store.Allow(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed, "burst exhausted")
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 3*time.Second, result.ResetAfter)
+
+	result, err = store.Allow(ctx, "other", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed, "keys are limited independently")
+
+	// A request is allowed again every Period/Limit.
+	setTime(now.Add(time.Second))
+	result, err = store.Allow(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	result, err = store.Allow(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.False(t, result.Allowed)
+
+	setTime(now.Add(time.Hour))
+	result, err = store.Allow(ctx, "client", limit)
+	require.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 2, result.Remaining, "the full limit is available again")
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore().(*memoryRateLimitStore)
+	testRateLimitStore(t, store, func(now time.Time) { store.now = func() time.Time { return now } })
+	assert.Len(t, store.tats, 1, "keys of idle clients are forgotten")
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer func() { _ = client.Close() }()
+
+	testRateLimitStore(t, NewRedisRateLimitStore(client), mr.SetTime)
+
+	ttl := mr.TTL(redisRateLimitKeyPrefix + "client")
+	assert.Positive(t, ttl, "keys expire")
+	assert.LessOrEqual(t, ttl, time.Second)
+}
+
+// rateLimitTestServer returns a server with a create limit of 2 requests per minute,
+// sharing its rate limits through the Redis server at addr.
+func rateLimitTestServer(addr string) *Server {
+	return NewServer(conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		RateLimits:         RateLimits{Create: RateLimit{Limit: 2, Period: time.Minute}},
+		RateLimitRedisURL:  "redis://" + addr,
+	}, NewSecretHandlers(NewMemoryStore()))
+}
+
+func TestRateLimitSharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicas := []*Server{rateLimitTestServer(mr.Addr()), rateLimitTestServer(mr.Addr())}
+	defer func() {
+		for _, s := range replicas {
+			require.NoError(t, s.Shutdown(context.Background()))
+		}
+	}()
+
+	rec := createSecret(t, replicas[0], nil, fromIP("10.0.0.60"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "30", rec.Header().Get("RateLimit-Reset"))
+	assert.Equal(t, "2;w=60", rec.Header().Get("RateLimit-Policy"))
+
+	require.Equal(t, http.StatusOK, createSecret(t, replicas[1], nil, fromIP("10.0.0.60")).Code)
+
+	rec = createSecret(t, replicas[0], nil, fromIP("10.0.0.60"))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code, "the limit is shared by the replicas")
+	assert.Equal(t, "30", rec.Header().Get(echo.HeaderRetryAfter))
+	assert.Equal(t, "0", rec.Header().Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", rec.Header().Get("RateLimit-Reset"))
+	assert.JSONEq(t, `{"error":"rate limit exceeded"}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusOK, createSecret(t, replicas[1], nil, fromIP("10.0.0.61")).Code, "clients are limited independently")
+}
+
+func TestRateLimitPerRoute(t *testing.T) {
+	server := NewServer(conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		RateLimits:         RateLimits{Create: RateLimit{Limit: 1, Period: time.Minute}},
+	}, NewSecretHandlers(&FakeSecretMsgStorer{msg: "secret"}))
+
+	require.Equal(t, http.StatusOK, createSecret(t, server, nil, fromIP("10.0.0.62")).Code)
+	require.Equal(t, http.StatusTooManyRequests, createSecret(t, server, nil, fromIP("10.0.0.62")).Code)
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		req.RemoteAddr = "10.0.0.62:1234"
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		return serve(httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	rec := serve(retrieveRequest(server, "hvs.CABAAAAAAQAAAAAAAAAABBBB"))
+	assert.Equal(t, http.StatusOK, rec.Code, "retrieval has its own limit")
+	assert.Equal(t, "10", rec.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, http.StatusOK, get("/limits").Code)
+
+	for i := 0; i < 20; i++ {
+		rec := get("/health/ready")
+		require.Equal(t, http.StatusOK, rec.Code, "health probes are not limited")
+		assert.Empty(t, rec.Header().Get("RateLimit-Limit"))
+	}
+}
+
+func TestRateLimitStoreUnavailable(t *testing.T) {
+	logs := captureLogs(t)
+	mr := miniredis.RunT(t)
+	server := rateLimitTestServer(mr.Addr())
+	mr.Close()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, createSecret(t, server, nil, fromIP("10.0.0.63")).Code, "requests are allowed when Redis is down")
+	}
+	assert.Equal(t, "WARN", logs.record(t, "Rate limit store failed, allowing request")["level"])
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	limits := RateLimits{Create: RateLimit{Limit: 1, Period: time.Minute}}.orDefault()
+	client := newTestGRPCClient(t, &FakeSecretMsgStorer{msg: "secret"},
+		grpc.ChainUnaryInterceptor(grpcRateLimitInterceptor(NewMemoryRateLimitStore(), limits)))
+	ctx := context.Background()
+
+	var header metadata.MD
+	_, err := client.CreateSecret(ctx, &secretv1.CreateSecretRequest{Msg: "secret"}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, header.Get("ratelimit-limit"))
+	assert.Equal(t, []string{"0"}, header.Get("ratelimit-remaining"))
+	assert.Equal(t, []string{"1;w=60"}, header.Get("ratelimit-policy"))
+
+	_, err = client.CreateSecret(ctx, &secretv1.CreateSecretRequest{Msg: "secret"}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"60"}, header.Get("retry-after"))
+
+	_, err = client.GetSecret(ctx, &secretv1.GetSecretRequest{Token: "hvs.CABAAAAAAQAAAAAAAAAABBBB"}, grpc.Header(&header))
+	assert.NoError(t, err, "retrieval has its own limit")
+	assert.Equal(t, []string{"10"}, header.Get("ratelimit-limit"))
+}
@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+)
+
+// tokenPattern matches anything that looks like a Vault token, whether valid or not.
+// Error messages of the Vault client include request paths, which end with the token.
+var tokenPattern = regexp.MustCompile(`hv[sb]\.[A-Za-z0-9_-]+`)
+
+// redactToken replaces a token with a short hash of it, so that log lines about the
+// same secret can be correlated without disclosing a token that would allow reading it.
+func redactToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "[token:" + hex.EncodeToString(sum[:4]) + "]"
+}
+
+// redactTokens replaces the tokens found in s with their redacted form.
+func redactTokens(s string) string {
+	return tokenPattern.ReplaceAllStringFunc(s, redactToken)
+}
+
+// redactURI redacts the token query parameters of a request URI, whatever their format,
+// and the tokens found in the rest of the URI.
+func redactURI(uri string) string {
+	path, query, found := strings.Cut(uri, "?")
+	if !found {
+		return redactTokens(path)
+	}
+
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		if k, err := url.QueryUnescape(key); err == nil && k == api.ParamToken {
+			if v, err := url.QueryUnescape(value); err == nil {
+				value = v
+			}
+			params[i] = key + "=" + redactToken(value)
+		}
+	}
+	return redactTokens(path + "?" + strings.Join(params, "&"))
+}
+
+// redactedError hides the tokens found in the message of the wrapped error.
+type redactedError struct {
+	err error
+}
+
+// redactError wraps err so that its message does not disclose tokens.
+// The wrapped error is still available to errors.Is and errors.As.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return redactedError{err}
+}
+
+func (e redactedError) Error() string {
+	return redactTokens(e.err.Error())
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	secretv1 "github.com/algolia/sup3rS3cretMes5age/api/secret/v1"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactTokens(t *testing.T) {
+	const token = "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+	redactedToken := redactToken(token)
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"no token", "secret not found", "secret not found"},
+		{"vault error", "URL: GET http://vault:8200/v1/cubbyhole/" + token + "\nCode: 403", "URL: GET http://vault:8200/v1/cubbyhole/" + redactedToken + "\nCode: 403"},
+		{"batch token", "hvb.AAAA-BBBB_CCCC", redactToken("hvb.AAAA-BBBB_CCCC")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactTokens(tt.input))
+		})
+	}
+
+	assert.Equal(t, redactedToken, redactToken(token), "redaction is stable, for correlation")
+	assert.NotContains(t, redactedToken, "hvs.")
+}
+
+func TestRedactURI(t *testing.T) {
+	const token = "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+
+	tests := []struct {
+		name     string
+		uri      string
+		expected string
+	}{
+		{"no query", "/msg", "/msg"},
+		{"token", "/secret?token=" + token, "/secret?token=" + redactToken(token)},
+		{"invalid token", "/secret?token=not-a-token&x=1", "/secret?token=" + redactToken("not-a-token") + "&x=1"},
+		{"escaped token", "/secret?x=1&%74oken=hvs%2ECABAAAAAAQAAAAAAAAAABBBB", "/secret?x=1&%74oken=" + redactToken(token)},
+		{"token in path", "/secret/" + token, "/secret/" + redactToken(token)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, redactURI(tt.uri))
+		})
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	assert.NoError(t, redactError(nil))
+
+	cause := errors.New("read /cubbyhole/hvs.CABAAAAAAQAAAAAAAAAABBBB: permission denied")
+	err := redactError(cause)
+	assert.NotContains(t, err.Error(), "hvs.")
+	assert.ErrorIs(t, err, cause)
+}
+
+// TestLogsDoNotContainTokens goes through the lifecycle of a secret stored in Vault,
+// including failures, and checks that no token ends up in the logs.
+func TestLogsDoNotContainTokens(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	logs := captureLogs(t)
+
+	handlers := NewSecretHandlers(NewVault(c.Address(), "cubbyhole/", c.Token()))
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, handlers)
+
+	do := func(method, target string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.RemoteAddr = "10.0.0.30:1234"
+		if contentType != "" {
+			req.Header.Set(echo.HeaderContentType, contentType)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("msg", "my secret"))
+	require.NoError(t, writer.Close())
+	rec := do(http.MethodPost, "/secret", body, writer.FormDataContentType())
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var tr TokenResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+	require.Regexp(t, tokenPattern, tr.Token)
+
+	// Share URLs carry the token.
+	assert.Equal(t, http.StatusOK, do(http.MethodHead, "/getmsg?token="+tr.Token, nil, "").Code)
+	retrieve := func(token string) int {
+		req := retrieveRequest(server, token)
+		return do(req.Method, req.URL.String(), req.Body, req.Header.Get(echo.HeaderContentType)).Code
+	}
+	assert.Equal(t, http.StatusOK, retrieve(tr.Token))
+	// Vault errors on consumed secrets include the request path, hence the token.
+	assert.Equal(t, http.StatusNotFound, retrieve(tr.Token))
+	assert.Equal(t, http.StatusBadRequest, retrieve(tr.Token+"!"))
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/secret/"+tr.Token, nil, "").Code)
+
+	_, err := (&grpcSecretServer{handlers: handlers}).GetSecret(context.Background(), &secretv1.GetSecretRequest{Token: tr.Token})
+	assert.Error(t, err)
+
+	output := logs.String()
+	assert.Contains(t, output, redactToken(tr.Token), "requests are logged with the redacted token")
+	assert.Contains(t, output, "Failed to retrieve secret")
+	assert.Empty(t, tokenPattern.FindAllString(output, -1), "logs must not contain tokens:\n%s", output)
+}
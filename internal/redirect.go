@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTP listener modes.
+const (
+	// HTTPModeApp serves the application on the HTTP listener.
+	HTTPModeApp = "app"
+	// HTTPModeRedirect only serves the ACME HTTP-01 challenges of auto TLS on the HTTP
+	// listener, and redirects all the other requests to HTTPS.
+	HTTPModeRedirect = "redirect"
+)
+
+// httpsPort returns the public port of the HTTPS listener, which the HTTP requests are
+// redirected to: cnf.HttpsRedirectPort, or the port of the HTTPS binding address.
+func (cnf conf) httpsPort() int {
+	if cnf.HttpsRedirectPort != 0 {
+		return cnf.HttpsRedirectPort
+	}
+	if _, port, err := net.SplitHostPort(cnf.HttpsBindingAddress); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	return 443
+}
+
+// httpsRedirectHandler redirects the requests to the same host and URI over HTTPS, on
+// port, with a 308 response so that clients keep the method and body of their request.
+func httpsRedirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// redirectHandler returns the handler of the HTTP listener in HTTPModeRedirect: it answers
+// the ACME HTTP-01 challenges with auto TLS, and redirects the other requests to HTTPS.
+func (s *Server) redirectHandler() http.Handler {
+	redirect := httpsRedirectHandler(s.config.httpsPort())
+	if s.autoTLS == nil {
+		return redirect
+	}
+	return s.autoTLS.HTTPHandler(redirect)
+}
@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/labstack/echo/v4"
+)
+
+// confirmationNonceTTL is how long the confirmation nonce of a /getmsg page can be used
+// to retrieve its secret.
+const confirmationNonceTTL = 10 * time.Minute
+
+// getMsgPage is the template of the /getmsg page, relative to the working directory
+// like the other static files.
+const getMsgPage = "static/getmsg.html"
+
+// issueNonce returns a new confirmation nonce for retrieving the secret of token, valid for
+// confirmationNonceTTL. The nonce is bound to the token, so that it cannot be used for others.
+func (s *signer) issueNonce(token string) string {
+	expiry := strconv.FormatInt(s.now().Add(confirmationNonceTTL).Unix(), 10)
+	return expiry + "." + s.sign("confirmation", expiry+"."+token)
+}
+
+// checkNonce returns an error when nonce was not issued for token with the key of s, or
+// has expired.
+func (s *signer) checkNonce(nonce, token string) error {
+	expiry, sig, ok := strings.Cut(nonce, ".")
+	if !ok || !s.verify("confirmation", expiry+"."+token, sig) {
+		return errors.New("invalid confirmation nonce")
+	}
+	if s.expired(expiry) {
+		return errors.New("confirmation nonce expired, reload the page")
+	}
+	return nil
+}
+
+// linkPreviewAgents are parts of the User-Agent headers of the bots that fetch links
+// shared in chat apps and social networks to show their preview.
+var linkPreviewAgents = []string{
+	"slackbot",
+	"slack-imgproxy",
+	"discordbot",
+	"telegrambot",
+	"whatsapp",
+	"twitterbot",
+	"facebookexternalhit",
+	"facebot",
+	"linkedinbot",
+	"skypeuripreview",
+	"microsoftpreview",
+	"teamsbot",
+	"mattermost",
+	"rocket.chat",
+	"zoombot",
+	"googlebot",
+	"bingbot",
+	"bingpreview",
+	"applebot",
+	"embedly",
+	"iframely",
+	"pinterestbot",
+	"redditbot",
+	"vkshare",
+	"viber",
+	"snapchat",
+}
+
+// isLinkPreviewAgent reports whether userAgent is the one of a known link preview bot.
+func isLinkPreviewAgent(userAgent string) bool {
+	ua := strings.ToLower(userAgent)
+	for _, agent := range linkPreviewAgents {
+		if strings.Contains(ua, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// getMsgPageData is the data of the /getmsg page template.
+type getMsgPageData struct {
+	// Nonce is the confirmation nonce to send with the retrieval request of the message.
+	Nonce string
+	// FileNonce is the confirmation nonce to send with the retrieval request of the file, if any.
+	FileNonce string
+}
+
+// loadGetMsgPage parses the template of the /getmsg page. It returns nil when the template
+// cannot be loaded, e.g. when the working directory has no static files, the page being
+// then not found.
+func loadGetMsgPage() *template.Template {
+	tmpl, err := template.ParseFiles(getMsgPage)
+	if err != nil {
+		slog.Error("Failed to load the page template", "page", getMsgPage, "error", err)
+		return nil
+	}
+	return tmpl
+}
+
+// GetMsgPageHandler serves the /getmsg page, which retrieves a secret once the recipient
+// confirms it with the slider. The page embeds the confirmation nonces of the message and
+// file tokens of its URL, without which secrets cannot be retrieved. The nonce of the message
+// token is also sent in the X-Confirmation-Nonce header for API clients.
+// Serving the page never consumes the secret, so link previews can fetch it.
+func (s SecretHandlers) GetMsgPageHandler(ctx echo.Context) error {
+	nonce := s.signer.issueNonce(ctx.QueryParam(api.ParamToken))
+	h := ctx.Response().Header()
+	h.Set(api.HeaderConfirmationNonce, nonce)
+	h.Set(echo.HeaderCacheControl, "no-store")
+	if ctx.Request().Method == http.MethodHead {
+		return ctx.NoContent(http.StatusOK)
+	}
+
+	if s.getMsgPage == nil {
+		return echo.ErrNotFound
+	}
+	data := getMsgPageData{Nonce: nonce}
+	if fileToken := ctx.QueryParam(api.ParamFileToken); fileToken != "" {
+		data.FileNonce = s.signer.issueNonce(fileToken)
+	}
+	h.Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	ctx.Response().WriteHeader(http.StatusOK)
+	return s.getMsgPage.Execute(ctx.Response(), data)
+}
+
+// retrievalForbidden returns the 403 error of a secret that cannot be retrieved, with the
+// machine-readable code of the reason, e.g. api.ErrorCodeNotRecipient.
+func retrievalForbidden(code string, err error) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusForbidden, api.ErrorResponse{Message: err.Error(), Code: code})
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// retrieveRequest returns a POST /secret/retrieve request for token, with a confirmation
+// nonce issued by server.
+func retrieveRequest(server *Server, token string) *http.Request {
+	form := url.Values{api.FieldToken: {token}, api.FieldNonce: {server.handlers.signer.issueNonce(token)}}
+	req := httptest.NewRequest(http.MethodPost, "/secret/retrieve", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	return req
+}
+
+func TestConfirmationNonce(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	issuer, replica, other := newSigner(key), newSigner(key), newSigner(nil)
+	for _, s := range []*signer{issuer, replica, other} {
+		s.now = func() time.Time { return now }
+	}
+
+	const token = "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+	nonce := issuer.issueNonce(token)
+	assert.NoError(t, issuer.checkNonce(nonce, token))
+	assert.NoError(t, replica.checkNonce(nonce, token), "replicas sharing the key accept the nonce")
+	assert.Error(t, other.checkNonce(nonce, token), "nonces are bound to the key")
+	assert.Error(t, issuer.checkNonce(nonce, "hvs.CABAAAAAAQAAAAAAAAAACCCC"), "nonces are bound to the token")
+	assert.Error(t, issuer.checkNonce(nonce, ""))
+
+	expiry, sig, _ := strings.Cut(nonce, ".")
+	for _, invalid := range []string{"", "nonce", expiry, expiry + ".", "9" + expiry + "." + sig, expiry + "." + sig + "x"} {
+		assert.Error(t, issuer.checkNonce(invalid, token), invalid)
+	}
+
+	now = now.Add(confirmationNonceTTL + time.Second)
+	assert.ErrorContains(t, issuer.checkNonce(nonce, token), "expired")
+}
+
+func TestIsLinkPreviewAgent(t *testing.T) {
+	for _, ua := range []string{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)",
+		"Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)",
+		"TelegramBot (like TwitterBot)",
+		"WhatsApp/2.23.20.0",
+		"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)",
+		"LinkedInBot/1.0 (compatible; Mozilla/5.0; Apache-HttpClient +http://www.linkedin.com)",
+		"Mozilla/5.0 (Windows NT 6.1; WOW64) SkypeUriPreview Preview/0.5",
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+	} {
+		assert.True(t, isLinkPreviewAgent(ua), ua)
+	}
+
+	for _, ua := range []string{
+		"",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:130.0) Gecko/20100101 Firefox/130.0",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Safari/605.1.15",
+		"sup3rS3cretMes5age-client",
+	} {
+		assert.False(t, isLinkPreviewAgent(ua), ua)
+	}
+}
+
+func TestGetMsgPage(t *testing.T) {
+	// Serve the real page template.
+	t.Chdir("../web")
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+
+	const token, fileToken = "hvs.CABAAAAAAQAAAAAAAAAABBBB", "hvs.CABAAAAAAQAAAAAAAAAACCCC"
+	req := httptest.NewRequest(http.MethodGet, "/getmsg?token="+token+"&filetoken="+fileToken+"&filename=a.txt", nil)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, echo.MIMETextHTMLCharsetUTF8, rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(t, "no-store", rec.Header().Get(echo.HeaderCacheControl))
+
+	nonce := rec.Header().Get(api.HeaderConfirmationNonce)
+	require.NoError(t, server.handlers.signer.checkNonce(nonce, token))
+	assert.Contains(t, rec.Body.String(), `<meta name="confirmation-nonce" content="`+nonce+`">`)
+	fileNonce := regexp.MustCompile(`<meta name="confirmation-file-nonce" content="([^"]+)">`).FindStringSubmatch(rec.Body.String())
+	require.Len(t, fileNonce, 2)
+	assert.NoError(t, server.handlers.signer.checkNonce(fileNonce[1], fileToken))
+
+	req = httptest.NewRequest(http.MethodHead, "/getmsg?token="+token, nil)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, server.handlers.signer.checkNonce(rec.Header().Get(api.HeaderConfirmationNonce), token))
+	assert.Empty(t, rec.Body.String())
+}
+
+// TestPrefetchingDoesNotConsumeSecrets fetches a secret in all the ways link previews,
+// crawlers and security scanners do, and checks that it can still be retrieved afterwards.
+func TestPrefetchingDoesNotConsumeSecrets(t *testing.T) {
+	t.Chdir("../web")
+	store := NewMemoryStore()
+	server := NewServer(conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		RateLimits:         RateLimits{Default: RateLimit{Limit: 100, Period: time.Second}, Retrieve: RateLimit{Limit: 100, Period: time.Second}},
+	}, NewSecretHandlers(store))
+
+	token, err := store.Store(t.Context(), "my secret", "1h")
+	require.NoError(t, err)
+
+	form := func(values url.Values) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/secret/retrieve", strings.NewReader(values.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		return req
+	}
+	inQuery := form(url.Values{api.FieldNonce: {server.handlers.signer.issueNonce(token)}})
+	inQuery.URL.RawQuery = url.Values{api.ParamToken: {token}}.Encode()
+	unfurler := retrieveRequest(server, token)
+	unfurler.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+
+	tests := []struct {
+		name     string
+		req      *http.Request
+		expected int
+		code     string
+	}{
+		{"share page", httptest.NewRequest(http.MethodGet, "/getmsg?token="+token, nil), http.StatusOK, ""},
+		{"share page HEAD", httptest.NewRequest(http.MethodHead, "/getmsg?token="+token, nil), http.StatusOK, ""},
+		{"legacy GET", httptest.NewRequest(http.MethodGet, "/secret?token="+token, nil), http.StatusMethodNotAllowed, ""},
+		{"legacy HEAD", httptest.NewRequest(http.MethodHead, "/secret?token="+token, nil), http.StatusMethodNotAllowed, ""},
+		{"legacy OPTIONS", httptest.NewRequest(http.MethodOptions, "/secret?token="+token, nil), http.StatusNoContent, ""},
+		{"GET", httptest.NewRequest(http.MethodGet, "/secret/retrieve?token="+token, nil), http.StatusMethodNotAllowed, ""},
+		{"HEAD", httptest.NewRequest(http.MethodHead, "/secret/retrieve?token="+token, nil), http.StatusMethodNotAllowed, ""},
+		{"OPTIONS", httptest.NewRequest(http.MethodOptions, "/secret/retrieve?token="+token, nil), http.StatusNoContent, ""},
+		{"token in the query", inQuery, http.StatusBadRequest, ""},
+		{"without nonce", form(url.Values{api.FieldToken: {token}}), http.StatusForbidden, api.ErrorCodeInvalidNonce},
+		{"forged nonce", form(url.Values{api.FieldToken: {token}, api.FieldNonce: {"4102444800.forged"}}), http.StatusForbidden, api.ErrorCodeInvalidNonce},
+		{"nonce of another token", form(url.Values{api.FieldToken: {token}, api.FieldNonce: {server.handlers.signer.issueNonce("other")}}), http.StatusForbidden, api.ErrorCodeInvalidNonce},
+		{"link preview bot", unfurler, http.StatusForbidden, api.ErrorCodeLinkPreview},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.ServeHTTP(rec, tt.req)
+			assert.Equal(t, tt.expected, rec.Code)
+			assert.NotContains(t, rec.Body.String(), "my secret")
+			if tt.expected == http.StatusMethodNotAllowed {
+				assert.Contains(t, rec.Header().Get(echo.HeaderAllow), http.MethodPost)
+			}
+			if tt.code != "" {
+				var resp api.ErrorResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				assert.Equal(t, tt.code, resp.Code)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, retrieveRequest(server, token))
+	require.Equal(t, http.StatusOK, rec.Code, "the secret is still available")
+	var mr MsgResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &mr))
+	assert.Equal(t, "my secret", mr.Msg)
+
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, retrieveRequest(server, token))
+	assert.Equal(t, http.StatusNotFound, rec.Code, "the secret is consumed once retrieved")
+}
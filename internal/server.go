@@ -1,19 +1,24 @@
 // Package internal provides HTTP server setup and request handlers for the sup3rS3cretMes5age application.
-// It includes server lifecycle management with graceful shutdown, middleware configuration,
+// It includes server lifecycle management with graceful shutdown, middleware configuration, an optional gRPC listener,
 // route setup, and integration with HashiCorp Vault for secure message storage.
 package internal
 
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
-	"time"
+	"strconv"
+	"sync"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
 )
 
 // Server encapsulates the HTTP/HTTPS server configuration and lifecycle management.
@@ -24,30 +29,92 @@ type Server struct {
 	handlers    *SecretHandlers
 	httpServer  *http.Server
 	httpsServer *http.Server
+	grpcServer  *grpc.Server
+	adminServer *http.Server
+	// trustedProxies are the networks of the proxies trusted to forward the client address.
+	trustedProxies []*net.IPNet
+	// ipFilters are the IP filters of the route groups, applied to HTTP requests and gRPC calls.
+	ipFilters map[string]ipNetworks
+	// apiKeys authenticates the HTTP requests and gRPC calls sending an API key, nil when
+	// API keys are disabled.
+	apiKeys *apiKeys
+	// rateLimitStore holds the rate limits of the HTTP requests and the gRPC calls.
+	rateLimitStore RateLimitStore
+	// closeRateLimitStore releases the rate limit store, e.g. its Redis connections.
+	closeRateLimitStore func() error
+	// certReloader serves the manual TLS certificate to the HTTPS and gRPC listeners, nil
+	// until the first of them starts.
+	certReloader   *certReloader
+	certReloaderMu sync.Mutex
+	// autoTLS manages the auto TLS certificates, nil when auto TLS is disabled.
+	autoTLS *autocert.Manager
+	// closeAutoTLSCache releases the auto TLS cache, e.g. its Redis connections.
+	closeAutoTLSCache func() error
+	// listeners are the listeners opened by openListener, closed by Shutdown.
+	listeners   []net.Listener
+	listenersMu sync.Mutex
+	// shutdownOnce runs Shutdown once, as it is called both by Start and its caller.
+	shutdownOnce sync.Once
+	shutdownErr  error
 }
 
 // NewServer creates a new Server instance with the provided configuration and handlers.
 // It configures Echo with all middleware and routes but does not start the server.
 // This allows the server to be tested without binding to network ports.
+// The configured limits are applied to handlers, zero limits falling back to DefaultLimits,
+// and zero timeouts to DefaultTimeouts.
 func NewServer(cnf conf, handlers *SecretHandlers) *Server {
-	e := echo.New()
-	e.HideBanner = true
+	cnf.Limits = cnf.Limits.orDefault()
+	cnf.RateLimits = cnf.RateLimits.orDefault()
+	cnf.HTTPTimeouts = cnf.HTTPTimeouts.orDefault()
+	cnf.HTTPSTimeouts = cnf.HTTPSTimeouts.orDefault()
+	if cnf.UploadTimeout == 0 {
+		cnf.UploadTimeout = DefaultUploadTimeout
+	}
+	handlers.limits = cnf.Limits
+	handlers.signer = newSigner(signingKey(cnf))
+	handlers.auth = newOIDCAuth(cnf, handlers.signer)
+	handlers.getMsgPage = loadGetMsgPage()
+
+	trustedProxies, err := parseNetworks(cnf.TrustedProxies)
+	if err != nil {
+		slog.Error("Invalid trusted proxies, trusting none", "error", err)
+		trustedProxies = nil
+	}
 
-	// Configure Auto TLS if enabled
-	if cnf.TLSAutoDomain != "" {
-		e.AutoTLSManager.HostPolicy = autocert.HostWhitelist(cnf.TLSAutoDomain)
-		e.AutoTLSManager.Cache = autocert.DirCache("/var/www/.cache")
+	ipFilters, err := cnf.IPFilters.parse()
+	if err != nil {
+		slog.Error("Invalid IP filters, denying all the requests of their route groups", "error", err)
 	}
 
+	e := echo.New()
+	e.HideBanner = true
+	e.IPExtractor = clientIPExtractor(trustedProxies)
+
+	rateLimitStore, closeRateLimitStore := newRateLimitStore(cnf)
+	handlers.challenge = newChallenge(cnf, handlers.signer, rateLimitStore)
+	autoTLS, closeAutoTLSCache := newAutoTLSManager(cnf)
 	s := &Server{
-		echo:     e,
-		config:   cnf,
-		handlers: handlers,
+		echo:                e,
+		config:              cnf,
+		handlers:            handlers,
+		trustedProxies:      trustedProxies,
+		ipFilters:           ipFilters,
+		apiKeys:             newAPIKeys(cnf),
+		rateLimitStore:      rateLimitStore,
+		closeRateLimitStore: closeRateLimitStore,
+		autoTLS:             autoTLS,
+		closeAutoTLSCache:   closeAutoTLSCache,
 	}
 
-	setupMiddlewares(e, cnf)
+	setupMiddlewares(e, cnf, ipFilters, rateLimitStore, s.apiKeys, handlers.auth)
 	setupRoutes(e, handlers)
 
+	// Metrics are served on the admin listener when there is one, to keep them private.
+	if cnf.AdminBindingAddress == "" {
+		e.GET("/metrics", echo.WrapHandler(metricsHandler()))
+	}
+
 	return s
 }
 
@@ -55,13 +122,16 @@ func NewServer(cnf conf, handlers *SecretHandlers) *Server {
 // It supports three modes:
 // 1. HTTP only (when only HttpBindingAddress is set)
 // 2. HTTPS only with Auto TLS or Manual TLS
-// 3. Both HTTP and HTTPS (HTTP typically for redirect)
+// 3. Both HTTP and HTTPS (HTTP typically for redirect, see HTTPModeRedirect)
 //
+// A gRPC listener is started alongside when GrpcBindingAddress is set, and an admin
+// listener serving /metrics when AdminBindingAddress is set.
+// Each binding address can be a TCP address, a Unix domain socket or a systemd socket.
 // The function blocks until the server is shut down via context cancellation
 // or encounters a fatal error.
 func (s *Server) Start(ctx context.Context) error {
 	// Channel to collect errors from goroutines
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 4)
 
 	// Start HTTP server if configured
 	if s.config.HttpBindingAddress != "" {
@@ -85,7 +155,25 @@ func (s *Server) Start(ctx context.Context) error {
 	// Start HTTPS server if TLS is configured
 	if s.config.HttpsBindingAddress != "" || s.config.TLSAutoDomain != "" || s.config.TLSCertFilepath != "" {
 		go func() {
-			if err := s.startHTTPS(); err != nil && err != http.ErrServerClosed {
+			if err := s.startHTTPS(ctx); err != nil && err != http.ErrServerClosed {
+				errChan <- err
+			}
+		}()
+	}
+
+	// Start gRPC server if configured
+	if s.config.GrpcBindingAddress != "" {
+		go func() {
+			if err := s.startGRPC(ctx); err != nil && err != grpc.ErrServerStopped {
+				errChan <- err
+			}
+		}()
+	}
+
+	// Start admin server if configured
+	if s.config.AdminBindingAddress != "" {
+		go func() {
+			if err := s.startAdmin(); err != nil && err != http.ErrServerClosed {
 				errChan <- err
 			}
 		}()
@@ -100,106 +188,273 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
-// startHTTP starts the HTTP server on the configured binding address.
+// startHTTP starts the HTTP server on the configured binding address, accepting h2c when
+// enabled. In HTTPModeRedirect, it only serves the ACME challenges and redirects to HTTPS.
 func (s *Server) startHTTP() error {
-	s.httpServer = &http.Server{
-		Addr:           s.config.HttpBindingAddress,
-		Handler:        s.echo,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		IdleTimeout:    120 * time.Second,
-		MaxHeaderBytes: 1 << 20, // 1MB
+	var handler http.Handler = s.echo
+	if s.config.HttpMode == HTTPModeRedirect {
+		handler = s.redirectHandler()
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(s.config.H2CEnabled)
+	s.httpServer = newHTTPServer("http", s.config.HttpBindingAddress, handler, s.config.HTTPTimeouts, protocols)
+
+	ln, err := s.listen(s.config.HttpBindingAddress)
+	if err != nil {
+		return err
 	}
 
-	s.echo.Logger.Infof("Starting HTTP server on %s", s.config.HttpBindingAddress)
-	return s.httpServer.ListenAndServe()
+	slog.Info("Starting server", "server", "http", "address", s.config.HttpBindingAddress)
+	return s.httpServer.Serve(ln)
 }
 
-// startHTTPS starts the HTTPS server with TLS configuration.
-// Supports both automatic TLS (Let's Encrypt) and manual certificate configuration.
-func (s *Server) startHTTPS() error {
-	autoTLSManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Cache:  autocert.DirCache("/var/www/.cache"),
+// newHTTPServer returns the server of the listener named name, serving handler on addr with
+// the given timeouts and protocols (the http.Server defaults when nil).
+func newHTTPServer(name, addr string, handler http.Handler, timeouts Timeouts, protocols *http.Protocols) *http.Server {
+	srv := &http.Server{
+		Addr:           addr,
+		ErrorLog:       serverErrorLog(name),
+		Handler:        handler,
+		MaxHeaderBytes: 1 << 20, // 1MB
+		Protocols:      protocols,
 	}
+	timeouts.apply(srv)
+	return srv
+}
 
+// startHTTPS starts the HTTPS server with TLS configuration.
+// Supports both automatic TLS (Let's Encrypt) and manual certificate configuration, and HTTP/2.
+// Manual certificates are reloaded when their files change or on SIGHUP, until ctx is done.
+func (s *Server) startHTTPS(ctx context.Context) error {
 	// Use HTTPS binding address if set, otherwise default to :443
 	addr := s.config.HttpsBindingAddress
 	if addr == "" {
 		addr = ":443"
 	}
 
-	s.httpsServer = &http.Server{
-		Addr:           addr,
-		Handler:        s.echo,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		IdleTimeout:    120 * time.Second,
-		MaxHeaderBytes: 1 << 20, // 1MB
-		TLSConfig: &tls.Config{
-			GetCertificate:           autoTLSManager.GetCertificate,
-			NextProtos:               []string{acme.ALPNProto},
-			MinVersion:               tls.VersionTLS12,
-			CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.X25519, tls.CurveP256},
-			PreferServerCipherSuites: true,
-			CipherSuites: []uint16{
-				// TLS 1.2 safe cipher suites
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-				// TLS 1.3 cipher suites
-				tls.TLS_AES_128_GCM_SHA256,
-				tls.TLS_AES_256_GCM_SHA384,
-				tls.TLS_CHACHA20_POLY1305_SHA256,
-			},
+	getCertificate, err := s.getCertificate(ctx)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := s.tlsConfig(getCertificate)
+	if err != nil {
+		return err
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	s.httpsServer = newHTTPServer("https", addr, s.echo, s.config.HTTPSTimeouts, protocols)
+	s.httpsServer.TLSConfig = tlsConfig
+
+	ln, err := s.listen(addr)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Starting server", "server", "https", "address", addr)
+	return s.httpsServer.ServeTLS(ln, "", "")
+}
+
+// getCertificate returns the source of the certificates of the HTTPS and gRPC servers: the
+// manual certificate, reloaded until ctx is done, or the auto TLS manager.
+func (s *Server) getCertificate(ctx context.Context) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	if s.manualTLS() {
+		reloader, err := s.manualCertificate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return reloader.GetCertificate, nil
+	}
+	if s.autoTLS == nil {
+		return nil, errors.New("neither auto TLS nor manual TLS is configured")
+	}
+	return s.autoTLS.GetCertificate, nil
+}
+
+// manualTLS reports whether a manual TLS certificate is configured.
+func (s *Server) manualTLS() bool {
+	return s.config.TLSCertFilepath != "" && s.config.TLSCertKeyFilepath != ""
+}
+
+// manualCertificate returns the reloader of the manual TLS certificate, shared by the HTTPS
+// and gRPC listeners so that both serve renewed certificates. It is loaded on first use,
+// and reloaded until ctx is done.
+func (s *Server) manualCertificate(ctx context.Context) (*certReloader, error) {
+	s.certReloaderMu.Lock()
+	defer s.certReloaderMu.Unlock()
+	if s.certReloader == nil {
+		reloader, err := newCertReloader(s.config.TLSCertFilepath, s.config.TLSCertKeyFilepath)
+		if err != nil {
+			return nil, err
+		}
+		reloader.watch(ctx)
+		s.certReloader = reloader
+	}
+	return s.certReloader, nil
+}
+
+// tlsConfig returns the TLS configuration of the HTTPS server, serving the certificates of
+// getCertificate and verifying the client certificates as configured.
+func (s *Server) tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate:           getCertificate,
+		NextProtos:               []string{acme.ALPNProto},
+		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.X25519, tls.CurveP256},
+		PreferServerCipherSuites: true,
+		CipherSuites: []uint16{
+			// TLS 1.2 safe cipher suites
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			// TLS 1.3 cipher suites
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+			tls.TLS_CHACHA20_POLY1305_SHA256,
 		},
 	}
+	if err := withClientAuth(config, s.config); err != nil {
+		return nil, fmt.Errorf("client certificate authentication: %w", err)
+	}
+	return config, nil
+}
+
+// startGRPC starts the gRPC server on the configured binding address. Calls are filtered by
+// client IP address, authenticated with client certificates and API keys, rate limited,
+// required to log in and challenged like HTTP requests. It serves the certificates of the
+// HTTPS server when TLS is configured, the manual TLS certificate being reloaded until ctx
+// is done.
+func (s *Server) startGRPC(ctx context.Context) error {
+	var getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	if s.manualTLS() || s.autoTLS != nil {
+		var err error
+		if getCertificate, err = s.getCertificate(ctx); err != nil {
+			return err
+		}
+	}
+	opts, err := grpcServerOptions(s.config, getCertificate)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(
+		grpcClientIPInterceptor(s.trustedProxies),
+		grpcIPFilterInterceptor(s.ipFilters),
+		grpcClientCertInterceptor(s.config.TLSClientSubjects),
+		grpcAPIKeyInterceptor(s.apiKeys),
+		grpcRateLimitInterceptor(s.rateLimitStore, s.config.RateLimits),
+		s.handlers.auth.grpcRequireLogin(),
+		grpcChallengeInterceptor(s.handlers.challenge),
+	))
+	s.grpcServer = newGRPCServer(s.handlers, opts...)
+
+	ln, err := s.listen(s.config.GrpcBindingAddress)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Starting server", "server", "grpc", "address", s.config.GrpcBindingAddress)
+	return s.grpcServer.Serve(ln)
+}
 
-	s.echo.Logger.Infof("Starting HTTPS server on %s", addr)
+// startAdmin starts the admin HTTP server, serving /metrics, on the configured binding address.
+func (s *Server) startAdmin() error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler())
 
-	// Start with manual certificates if provided, otherwise use auto TLS
-	if s.config.TLSCertFilepath != "" && s.config.TLSCertKeyFilepath != "" {
-		return s.httpsServer.ListenAndServeTLS(s.config.TLSCertFilepath, s.config.TLSCertKeyFilepath)
+	s.adminServer = newHTTPServer("admin", s.config.AdminBindingAddress, mux, DefaultTimeouts(), nil)
+
+	ln, err := s.openListener(s.config.AdminBindingAddress)
+	if err != nil {
+		return err
 	}
 
-	return s.httpsServer.ListenAndServeTLS("", "")
+	slog.Info("Starting server", "server", "admin", "address", s.config.AdminBindingAddress)
+	return s.adminServer.Serve(ln)
 }
 
 // Shutdown gracefully shuts down the server without interrupting active connections.
 // It stops accepting new requests and waits for existing requests to complete
-// within the provided context timeout.
+// within the provided context timeout. The listeners are closed, removing their Unix domain sockets.
+// Only the first call shuts the server down: the later ones wait for it and return its error.
 func (s *Server) Shutdown(ctx context.Context) error {
-	s.echo.Logger.Info("Shutting down server...")
+	s.shutdownOnce.Do(func() { s.shutdownErr = s.shutdown(ctx) })
+	return s.shutdownErr
+}
+
+// shutdown shuts the servers down and releases their resources.
+func (s *Server) shutdown(ctx context.Context) error {
+	slog.Info("Shutting down server")
 
 	if s.httpServer != nil {
 		if err := s.httpServer.Shutdown(ctx); err != nil {
-			s.echo.Logger.Errorf("HTTP server shutdown error: %v", err)
+			slog.Error("Server shutdown error", "server", "http", "error", err)
 		}
 	}
 
 	if s.httpsServer != nil {
 		if err := s.httpsServer.Shutdown(ctx); err != nil {
-			s.echo.Logger.Errorf("HTTPS server shutdown error: %v", err)
+			slog.Error("Server shutdown error", "server", "https", "error", err)
+		}
+	}
+
+	if s.adminServer != nil {
+		if err := s.adminServer.Shutdown(ctx); err != nil {
+			slog.Error("Server shutdown error", "server", "admin", "error", err)
+		}
+	}
+
+	if s.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
 		}
 	}
 
+	// The servers close their listeners, except those that were not served yet.
+	s.closeListeners()
+
+	if err := s.closeRateLimitStore(); err != nil {
+		slog.Error("Rate limit store shutdown error", "error", err)
+	}
+
+	if err := s.closeAutoTLSCache(); err != nil {
+		slog.Error("Auto TLS cache shutdown error", "error", err)
+	}
+
 	return s.echo.Shutdown(ctx)
 }
 
+// ServeHTTP dispatches a request to the configured routes and middlewares.
+// It lets a Server be mounted in any http.Handler chain, such as httptest.NewServer.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.echo.ServeHTTP(w, r)
+}
+
 // handler returns the underlying http.Handler for testing purposes.
 // This allows tests to use httptest.ResponseRecorder without starting a real server.
 func (s *Server) handler() http.Handler {
 	return s.echo
 }
 
-// setupMiddlewares configures Echo's middleware stack with security, rate limiting, and logging.
-// It applies HTTPS redirect (if enabled), CORS policy, rate limiting (5 RPS), request logging,
-// security headers (CSP, XSS protection, HSTS), body size limits (50MB), and panic recovery.
+// setupMiddlewares configures Echo's middleware stack with security, sessions, rate limiting, and logging.
+// It applies HTTPS redirect (if enabled), CORS policy, IP filters (ipFilters, per route group), client certificates
+// (cnf.TLSClientSubjects, if verified by the HTTPS listener), API keys (keys, if enabled), OpenID Connect sessions
+// (auth, if enabled), rate limiting (cnf.RateLimits, in store), request logging,
+// security headers (CSP, allowing the CAPTCHA widget if any, XSS protection, HSTS), upload timeouts (cnf.UploadTimeout),
+// body size limits (Limits.BodyLimit), and panic recovery.
 // Middleware is applied in order: pre-routing (HTTPS redirect), then request-level middleware.
-func setupMiddlewares(e *echo.Echo, cnf conf) {
+func setupMiddlewares(e *echo.Echo, cnf conf, ipFilters map[string]ipNetworks, rateLimitStore RateLimitStore, keys *apiKeys, auth *oidcAuth) {
 	if cnf.HttpsRedirectEnabled {
 		e.Pre(middleware.HTTPSRedirect())
 	}
@@ -211,72 +466,24 @@ func setupMiddlewares(e *echo.Echo, cnf conf) {
 		MaxAge:       86400,
 	}))
 
-	// Limit to 5 RPS (burst 10) (only human should use this service)
-	e.Use(middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
-		Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-			middleware.RateLimiterMemoryStoreConfig{
-				Rate:      5,
-				Burst:     10,
-				ExpiresIn: 1 * time.Minute,
-			},
-		),
-		IdentifierExtractor: func(ctx echo.Context) (string, error) {
-			return ctx.RealIP(), nil
-		},
-		DenyHandler: func(ctx echo.Context, identifier string, err error) error {
-			return ctx.JSON(http.StatusTooManyRequests, map[string]string{
-				"error": "rate limit exceeded",
-			})
-		},
-	}))
-
-	// Keep the previous JSON access log format while moving off deprecated Logger middleware.
-	e.Use(middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
-		Skipper: func(c echo.Context) bool {
-			return c.Path() == "/health"
-		},
-		LogRemoteIP:      true,
-		LogHost:          true,
-		LogMethod:        true,
-		LogURI:           true,
-		LogUserAgent:     true,
-		LogStatus:        true,
-		LogError:         true,
-		LogLatency:       true,
-		LogContentLength: true,
-		LogResponseSize:  true,
-		LogRequestID:     true,
-		LogValuesFunc: func(c echo.Context, v middleware.RequestLoggerValues) error {
-			logEntry := map[string]any{
-				"time":          v.StartTime.UTC().Format(time.RFC3339Nano),
-				"id":            v.RequestID,
-				"remote_ip":     v.RemoteIP,
-				"host":          v.Host,
-				"method":        v.Method,
-				"uri":           v.URI,
-				"user_agent":    v.UserAgent,
-				"status":        v.Status,
-				"error":         "",
-				"latency":       v.Latency.Nanoseconds(),
-				"latency_human": v.Latency.String(),
-				"bytes_in":      v.ContentLength,
-				"bytes_out":     v.ResponseSize,
-			}
-
-			if v.Error != nil {
-				logEntry["error"] = v.Error.Error()
-			}
-
-			payload, err := json.Marshal(logEntry)
-			if err != nil {
-				return err
-			}
-
-			payload = append(payload, '\n')
-			_, err = e.Logger.Output().Write(payload)
-			return err
-		},
-	}))
+	// Record metrics before rate limiting so that rejected requests are counted.
+	e.Use(metricsMiddleware)
+	// Trace requests, continuing the caller's W3C trace context.
+	e.Use(tracingMiddleware)
+	// Correlate the logs of a request, after tracing to include its trace ID.
+	e.Use(requestContextMiddleware())
+	// Reject the clients outside of the allowed networks before doing any work for them.
+	e.Use(ipFilterMiddleware(ipFilters))
+	// Identify programs with a client certificate or an API key, then logged in users.
+	e.Use(clientCertMiddleware(cnf.TLSClientSubjects))
+	e.Use(apiKeyMiddleware(keys))
+	e.Use(sessionMiddleware(auth))
+
+	// Limit requests per client IP address or API key, and route group (only humans should use this service).
+	e.Use(rateLimitMiddleware(rateLimitStore, cnf.RateLimits))
+
+	// Log requests, with tokens redacted.
+	e.Use(accessLogMiddleware())
 
 	e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
 		XSSProtection:         "1; mode=block",
@@ -284,30 +491,50 @@ func setupMiddlewares(e *echo.Echo, cnf conf) {
 		XFrameOptions:         "DENY",
 		HSTSMaxAge:            31536000,
 		HSTSPreloadEnabled:    true,
-		ContentSecurityPolicy: "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; font-src 'self'; frame-ancestors 'none'",
+		ContentSecurityPolicy: contentSecurityPolicy(cnf),
 	}))
 
-	e.Use(middleware.BodyLimit("50M"))
+	// Give the uploads of the allowed requests more time than the listener timeouts.
+	e.Use(uploadTimeoutMiddleware(cnf.UploadTimeout))
+
+	e.Use(middleware.BodyLimit(strconv.FormatInt(cnf.Limits.BodyLimit, 10)))
 
 	e.Use(middleware.Recover())
 }
 
 // setupRoutes registers all HTTP endpoints and static file routes.
-// API endpoints: GET/POST /secret (secret management), ANY /health (health check), GET / (redirect).
-// Static routes: /msg and /getmsg (HTML pages), /static (assets), /robots.txt (SEO).
+// API endpoints: POST /secret (creation, after the challenge if any), POST /secret/retrieve (retrieval),
+// GET /limits (creation limits), GET /challenge (challenge to solve before creation),
+// ANY /health and GET /health/live (liveness), GET /health/ready (readiness), GET / (redirect). GET /metrics is added by NewServer.
+// Pages: /msg and /getmsg (HTML pages, /getmsg embedding a confirmation nonce), /static (assets), /robots.txt (SEO).
+// With OpenID Connect: GET /auth/login, GET /auth/callback and GET /auth/logout, /msg and POST /secret
+// requiring login, and retrieval too when configured.
 func setupRoutes(e *echo.Echo, handlers *SecretHandlers) {
 	e.GET("/", redirectHandler)
 
 	e.File("/robots.txt", "static/robots.txt")
 
 	e.Any("/health", healthHandler)
+	e.GET("/health/live", healthHandler)
+	e.GET("/health/ready", handlers.ReadinessHandler)
+
+	// Retrieval only answers POST requests, so that fetching links cannot consume secrets:
+	// other methods, including HEAD, get a 405 response and OPTIONS lists the allowed ones.
+	e.POST("/secret", handlers.CreateMsgHandler, handlers.auth.requireLogin(), challengeMiddleware(handlers.challenge))
+	e.POST("/secret/retrieve", handlers.GetMsgHandler, handlers.auth.requireLoginForRetrieval())
+	e.GET("/limits", handlers.LimitsHandler)
+	e.GET("/challenge", handlers.ChallengeHandler)
 
-	e.GET("/secret", handlers.GetMsgHandler)
-	e.POST("/secret", handlers.CreateMsgHandler)
+	e.File("/msg", "static/index.html", handlers.auth.requireLogin())
 
-	e.File("/msg", "static/index.html")
+	e.GET("/getmsg", handlers.GetMsgPageHandler, handlers.auth.requireLoginForRetrieval())
+	e.HEAD("/getmsg", handlers.GetMsgPageHandler, handlers.auth.requireLoginForRetrieval())
 
-	e.File("/getmsg", "static/getmsg.html")
+	if handlers.auth != nil {
+		e.GET(loginPath, handlers.auth.LoginHandler)
+		e.GET(callbackPath, handlers.auth.CallbackHandler)
+		e.GET(logoutPath, handlers.auth.LogoutHandler)
+	}
 
 	e.Static("/static", "static")
 }
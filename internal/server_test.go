@@ -1,13 +1,22 @@
 package internal
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -65,7 +74,8 @@ func TestServerRoutesRegistered(t *testing.T) {
 	}
 
 	assert.True(t, routeMap["POST /secret"], "POST /secret should be registered")
-	assert.True(t, routeMap["GET /secret"], "GET /secret should be registered")
+	assert.True(t, routeMap["POST /secret/retrieve"], "POST /secret/retrieve should be registered")
+	assert.False(t, routeMap["GET /secret"], "secrets must not be retrieved with GET")
 	assert.True(t, routeMap["GET /health"] || routeMap["POST /health"], "/health should be registered")
 	assert.True(t, routeMap["GET /"], "GET / should be registered")
 }
@@ -140,7 +150,10 @@ func TestServerWithTLSAutoDomain(t *testing.T) {
 	// Verify TLS domain is configured (checking the pointer to avoid copylocks)
 	assert.NotNil(t, server.echo)
 	assert.Equal(t, "example.com", server.config.TLSAutoDomain)
-	assert.Equal(t, autocert.DirCache("/var/www/.cache"), server.echo.AutoTLSManager.Cache)
+	assert.NotNil(t, server.autoTLS)
+	assert.Equal(t, autocert.DirCache("/var/www/.cache"), server.autoTLS.Cache)
+	assert.NoError(t, server.autoTLS.HostPolicy(context.Background(), "example.com"))
+	assert.Error(t, server.autoTLS.HostPolicy(context.Background(), "other.example.com"))
 }
 
 func TestServerGracefulShutdown(t *testing.T) {
@@ -159,6 +172,19 @@ func TestServerGracefulShutdown(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestServerShutdownOnce(t *testing.T) {
+	server := NewServer(conf{VaultPrefix: "cubbyhole/"}, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	closes := 0
+	server.closeRateLimitStore = func() error {
+		closes++
+		return nil
+	}
+
+	require.NoError(t, server.Shutdown(context.Background()))
+	require.NoError(t, server.Shutdown(context.Background()), "Start and its caller both shut the server down")
+	assert.Equal(t, 1, closes, "resources are released once")
+}
+
 func TestServerHandlersIntegration(t *testing.T) {
 	cnf := conf{
 		HttpBindingAddress: ":8080",
@@ -174,8 +200,8 @@ func TestServerHandlersIntegration(t *testing.T) {
 	handlers := NewSecretHandlers(storage)
 	server := NewServer(cnf, handlers)
 
-	// Test GET /secret with valid token
-	req := httptest.NewRequest(http.MethodGet, "/secret?token="+validToken, nil)
+	// Test POST /secret/retrieve with valid token
+	req := retrieveRequest(server, validToken)
 	rec := httptest.NewRecorder()
 	server.handler().ServeHTTP(rec, req)
 
@@ -201,8 +227,8 @@ func TestServerRateLimiting(t *testing.T) {
 	rateLimitCount := 0
 
 	for i := 0; i < 20; i++ {
-		req := httptest.NewRequest(http.MethodGet, "/health", nil)
-		req.Header.Set("X-Real-IP", "192.168.1.1")
+		req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+		req.RemoteAddr = "192.168.1.1:1234"
 		rec := httptest.NewRecorder()
 		server.handler().ServeHTTP(rec, req)
 
@@ -217,3 +243,194 @@ func TestServerRateLimiting(t *testing.T) {
 	// Should have some rate limited requests
 	assert.Greater(t, rateLimitCount, 0, "Rate limiter should have triggered")
 }
+
+func TestServerStartGRPCInvalidAddress(t *testing.T) {
+	cnf := conf{
+		GrpcBindingAddress: "invalid-address",
+		VaultPrefix:        "cubbyhole/",
+		AllowedOrigins:     []string{"*"},
+	}
+	handlers := NewSecretHandlers(&FakeSecretMsgStorer{})
+	server := NewServer(cnf, handlers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := server.Start(ctx)
+	assert.Error(t, err)
+}
+
+func TestServerLimits(t *testing.T) {
+	cnf := conf{
+		HttpBindingAddress: ":8080",
+		AllowedOrigins:     []string{"*"},
+		Limits: Limits{
+			MaxMessageSize: 16,
+			MaxFileSize:    32,
+			BodyLimit:      2 * 1024 * 1024,
+			MinTTL:         time.Hour,
+			MaxTTL:         24 * time.Hour,
+			DefaultTTL:     2 * time.Hour,
+		},
+	}
+	storage := &FakeSecretMsgStorer{token: "hvs.CABAAAAAAQAAAAAAAAAABBBB"}
+	server := NewServer(cnf, NewSecretHandlers(storage))
+
+	post := func(fields map[string]string, fileContent string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		w := multipart.NewWriter(body)
+		for k, v := range fields {
+			_ = w.WriteField(k, v)
+		}
+		if fileContent != "" {
+			fw, _ := w.CreateFormFile("file", "secret.txt")
+			_, _ = fw.Write([]byte(fileContent))
+		}
+		_ = w.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/secret", body)
+		req.Header.Set(echo.HeaderContentType, w.FormDataContentType())
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name           string
+		fields         map[string]string
+		file           string
+		expectedStatus int
+		expectedTTL    string
+	}{
+		{"default TTL applied", map[string]string{"msg": "secret"}, "", http.StatusOK, "2h0m0s"},
+		{"TTL within bounds", map[string]string{"msg": "secret", "ttl": "12h"}, "", http.StatusOK, "12h"},
+		{"TTL below minimum", map[string]string{"msg": "secret", "ttl": "30m"}, "", http.StatusBadRequest, ""},
+		{"TTL above maximum", map[string]string{"msg": "secret", "ttl": "48h"}, "", http.StatusBadRequest, ""},
+		{"message at limit", map[string]string{"msg": strings.Repeat("a", 16)}, "", http.StatusOK, "2h0m0s"},
+		{"message too large", map[string]string{"msg": strings.Repeat("a", 17)}, "", http.StatusBadRequest, ""},
+		{"file too large", map[string]string{"msg": "secret"}, strings.Repeat("a", 33), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage.lastTTL = ""
+			rec := post(tt.fields, tt.file)
+			assert.Equal(t, tt.expectedStatus, rec.Code, rec.Body.String())
+			assert.Equal(t, tt.expectedTTL, storage.lastTTL)
+		})
+	}
+
+	t.Run("body limit", func(t *testing.T) {
+		rec := post(map[string]string{"msg": "secret"}, strings.Repeat("a", 3*1024*1024))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("limits endpoint", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/limits", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.JSONEq(t, `{"max_message_size":16,"max_file_size":32,"min_ttl":3600,"max_ttl":86400,"default_ttl":7200,"max_reads":10}`, rec.Body.String())
+	})
+}
+
+func TestServerDefaultLimits(t *testing.T) {
+	cnf := conf{HttpBindingAddress: ":8080"}
+	handlers := NewSecretHandlers(&FakeSecretMsgStorer{})
+	NewServer(cnf, handlers)
+
+	assert.Equal(t, DefaultLimits(), handlers.limits)
+}
+
+func TestServerHTTPRedirectMode(t *testing.T) {
+	cacheDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(cacheDir, "token+http-01"), []byte("token.thumbprint"), 0o600))
+	cnf := conf{
+		HttpBindingAddress:  ":80",
+		HttpsBindingAddress: ":8443",
+		HttpMode:            HTTPModeRedirect,
+		TLSAutoDomain:       "secrets.example.com",
+		TLSAutoCacheDir:     cacheDir,
+	}
+	handler := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{})).redirectHandler()
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		code     int
+		location string
+	}{
+		{"page", http.MethodGet, "http://secrets.example.com/", http.StatusPermanentRedirect, "https://secrets.example.com:8443/"},
+		{"API", http.MethodPost, "http://secrets.example.com:8080/secret?ttl=1h", http.StatusPermanentRedirect, "https://secrets.example.com:8443/secret?ttl=1h"},
+		{"IPv6", http.MethodGet, "http://[2001:db8::1]/health", http.StatusPermanentRedirect, "https://[2001:db8::1]:8443/health"},
+		{"ACME challenge", http.MethodGet, "http://secrets.example.com/.well-known/acme-challenge/token", http.StatusOK, ""},
+		{"unknown ACME challenge", http.MethodGet, "http://secrets.example.com/.well-known/acme-challenge/other", http.StatusNotFound, ""},
+		{"ACME challenge of another host", http.MethodGet, "http://other.example.com/.well-known/acme-challenge/token", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			assert.Equal(t, tt.code, rec.Code)
+			assert.Equal(t, tt.location, rec.Header().Get(echo.HeaderLocation))
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://secrets.example.com/.well-known/acme-challenge/token", nil))
+	assert.Equal(t, "token.thumbprint", rec.Body.String())
+}
+
+func TestServerStartHTTPRedirectMode(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, key := selfSignedPEM(t, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+
+	cnf := conf{
+		HttpBindingAddress:  freeAddress(t),
+		HttpsBindingAddress: freeAddress(t),
+		HttpMode:            HTTPModeRedirect,
+		HttpsRedirectPort:   443,
+		TLSCertFilepath:     certPath,
+		TLSCertKeyFilepath:  keyPath,
+		AllowedOrigins:      []string{"*"},
+	}
+	server := NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{}))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	defer func() {
+		cancel()
+		assert.NoError(t, <-done)
+	}()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		resp, err = client.Get("http://" + cnf.HttpBindingAddress + "/limits")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusPermanentRedirect, resp.StatusCode, "the HTTP listener does not serve the application")
+	assert.Equal(t, "https://127.0.0.1/limits", resp.Header.Get(echo.HeaderLocation))
+
+	tlsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := tlsClient.Get("https://" + cnf.HttpsBindingAddress + "/limits")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "the HTTPS listener serves the application")
+}
+
+// freeAddress returns a free TCP address of localhost.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	return addr
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minSigningKeyLength is the minimum length of a configured signing key.
+const minSigningKeyLength = 32
+
+// signer signs the stateless tokens issued to clients, such as the confirmation nonces
+// of the /getmsg page, the proof-of-work challenges and the session cookies, so that any replica sharing the
+// key can check them.
+type signer struct {
+	key []byte
+	now func() time.Time
+}
+
+// newSigner returns a signer keyed with key, or with a random key when empty.
+func newSigner(key []byte) *signer {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
+	return &signer{key: key, now: time.Now}
+}
+
+// signingKey returns the configured signing key, or nil to use a random one. A random key
+// only works with a single replica, or sticky sessions.
+func signingKey(cnf conf) []byte {
+	if cnf.SigningKey == "" {
+		slog.Warn("No signing key configured, using a random one: confirmation nonces, challenges and sessions are only valid on this replica until it restarts")
+		return nil
+	}
+	return []byte(cnf.SigningKey)
+}
+
+// sign returns the HMAC-SHA256 of payload, for the given purpose so that a token issued
+// for one purpose cannot be used for another.
+func (s *signer) sign(purpose, payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(purpose + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify reports whether sig is the signature of payload for the given purpose.
+func (s *signer) verify(purpose, payload, sig string) bool {
+	return hmac.Equal([]byte(sig), []byte(s.sign(purpose, payload)))
+}
+
+// expired reports whether the expiry, in seconds since the epoch, has passed or is invalid.
+func (s *signer) expired(expiry string) bool {
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	return err != nil || s.now().After(time.Unix(unix, 0))
+}
+
+// seal returns v encoded in JSON and signed for the given purpose, to be handed to a
+// client and read back with open. v is readable by the client holding it.
+func (s *signer) seal(purpose string, v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + s.sign(purpose, payload), nil
+}
+
+// open decodes into v a value sealed for the given purpose, and returns an error when it
+// was not sealed with the key of s.
+func (s *signer) open(purpose, sealed string, v any) error {
+	payload, sig, ok := strings.Cut(sealed, ".")
+	if !ok || !s.verify(purpose, payload, sig) {
+		return errors.New("invalid signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultUploadTimeout is how long the requests of the upload routes can take to be read
+// and answered when no upload timeout is configured.
+const DefaultUploadTimeout = 10 * time.Minute
+
+// Timeouts holds the timeouts of a listener. Zero fields are replaced by their
+// DefaultTimeouts value.
+type Timeouts struct {
+	// ReadHeader is how long reading the headers of a request can take.
+	ReadHeader time.Duration
+	// Read is how long reading a request, including its body, can take.
+	Read time.Duration
+	// Write is how long writing a response can take, from the end of the request headers.
+	Write time.Duration
+	// Idle is how long a keep-alive connection waits for the next request.
+	Idle time.Duration
+}
+
+// DefaultTimeouts returns the timeouts used when none is configured: 10 seconds to read a
+// request and write its response, and 2 minutes between the requests of a connection.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		ReadHeader: 10 * time.Second,
+		Read:       10 * time.Second,
+		Write:      10 * time.Second,
+		Idle:       120 * time.Second,
+	}
+}
+
+// orDefault returns t with its zero fields replaced by their default value.
+func (t Timeouts) orDefault() Timeouts {
+	d := DefaultTimeouts()
+	if t.ReadHeader == 0 {
+		t.ReadHeader = d.ReadHeader
+	}
+	if t.Read == 0 {
+		t.Read = d.Read
+	}
+	if t.Write == 0 {
+		t.Write = d.Write
+	}
+	if t.Idle == 0 {
+		t.Idle = d.Idle
+	}
+	return t
+}
+
+// Validate checks that the timeouts of the listener are not negative. listener is the key
+// prefix of its settings, e.g. "http".
+func (t Timeouts) Validate(listener string) error {
+	var errs []error
+	for _, d := range []struct {
+		name, key string
+		value     time.Duration
+	}{
+		{"read header", "read_header_timeout", t.ReadHeader},
+		{"read", "read_timeout", t.Read},
+		{"write", "write_timeout", t.Write},
+		{"idle", "idle_timeout", t.Idle},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s %s timeout (%s_%s) must not be negative", strings.ToUpper(listener), d.name, listener, d.key))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// apply sets the timeouts of srv.
+func (t Timeouts) apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.ReadHeader
+	srv.ReadTimeout = t.Read
+	srv.WriteTimeout = t.Write
+	srv.IdleTimeout = t.Idle
+}
+
+// uploadTimeoutMiddleware extends the read and write deadlines of the requests of the upload
+// routes (secret creation) to timeout, so that large files can be uploaded on slow links
+// while the other routes keep the short timeouts of their listener.
+func uploadTimeoutMiddleware(timeout time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if routeGroup(c) == routeGroupCreate {
+				deadline := time.Now().Add(timeout)
+				rc := http.NewResponseController(c.Response())
+				if err := rc.SetReadDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					return err
+				}
+				if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+					return err
+				}
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowReader returns its data in chunks of size bytes, waiting delay before each one.
+type slowReader struct {
+	data  []byte
+	size  int
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// startServer starts server until the end of the test, and waits for addr to accept connections.
+func startServer(t *testing.T, server *Server, addr string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + addr + "/health")
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestTimeoutsOrDefault(t *testing.T) {
+	assert.Equal(t, DefaultTimeouts(), Timeouts{}.orDefault())
+	timeouts := Timeouts{Read: time.Minute, Idle: time.Second}.orDefault()
+	assert.Equal(t, Timeouts{ReadHeader: 10 * time.Second, Read: time.Minute, Write: 10 * time.Second, Idle: time.Second}, timeouts)
+}
+
+func TestTimeoutsValidate(t *testing.T) {
+	assert.NoError(t, DefaultTimeouts().Validate("http"))
+	assert.NoError(t, Timeouts{}.Validate("http"))
+	err := Timeouts{ReadHeader: -time.Second, Idle: -time.Second}.Validate("https")
+	assert.ErrorContains(t, err, "HTTPS read header timeout (https_read_header_timeout) must not be negative")
+	assert.ErrorContains(t, err, "HTTPS idle timeout (https_idle_timeout) must not be negative")
+	assert.NotContains(t, err.Error(), "https_read_timeout")
+}
+
+func TestServerUploadTimeout(t *testing.T) {
+	addr := freeAddress(t)
+	cnf := conf{
+		HttpBindingAddress: addr,
+		HTTPTimeouts:       Timeouts{Read: 300 * time.Millisecond, Write: 300 * time.Millisecond},
+		UploadTimeout:      10 * time.Second,
+		AllowedOrigins:     []string{"*"},
+	}
+	startServer(t, NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{})), addr)
+
+	// The bodies take about a second to be sent, longer than the read timeout of the listener.
+	send := func(path string, body []byte, contentType string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+addr+path, &slowReader{data: body, size: len(body)/10 + 1, delay: 100 * time.Millisecond})
+		require.NoError(t, err)
+		req.ContentLength = int64(len(body))
+		req.Header.Set(echo.HeaderContentType, contentType)
+		return http.DefaultClient.Do(req)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField(api.FieldMsg, "my secret"))
+	part, err := writer.CreateFormFile(api.FieldFile, "large.bin")
+	require.NoError(t, err)
+	_, err = part.Write(bytes.Repeat([]byte("x"), 64<<10))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	resp, err := send("/secret", body.Bytes(), writer.FormDataContentType())
+	require.NoError(t, err, "uploads get the upload timeout")
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	form := url.Values{api.FieldToken: {strings.Repeat("x", 500)}}.Encode()
+	resp, err = send("/secret/retrieve", []byte(form), echo.MIMEApplicationForm)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+	assert.Error(t, err, "the other routes keep the timeouts of the listener")
+}
+
+func TestServerHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, key := selfSignedPEM(t, 1, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	writeCertFiles(t, certPath, keyPath, cert, key)
+
+	cnf := conf{
+		HttpBindingAddress:  freeAddress(t),
+		HttpsBindingAddress: freeAddress(t),
+		TLSCertFilepath:     certPath,
+		TLSCertKeyFilepath:  keyPath,
+		H2CEnabled:          true,
+		AllowedOrigins:      []string{"*"},
+	}
+	startServer(t, NewServer(cnf, NewSecretHandlers(&FakeSecretMsgStorer{})), cnf.HttpBindingAddress)
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	tlsClient := &http.Client{Transport: &http.Transport{Protocols: protocols, TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := tlsClient.Get("https://" + cnf.HttpsBindingAddress + "/limits")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor, "HTTP/2 is negotiated over TLS")
+
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	h2cClient := &http.Client{Transport: &http.Transport{Protocols: h2c}}
+	resp, err = h2cClient.Get("http://" + cnf.HttpBindingAddress + "/limits")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, resp.ProtoMajor, "h2c is accepted when enabled")
+
+	resp, err = http.Get("http://" + cnf.HttpBindingAddress + "/limits")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, 1, resp.ProtoMajor, "HTTP/1 is still accepted")
+
+	addr := freeAddress(t)
+	startServer(t, NewServer(conf{HttpBindingAddress: addr}, NewSecretHandlers(&FakeSecretMsgStorer{})), addr)
+	_, err = h2cClient.Get("http://" + addr + "/limits")
+	assert.Error(t, err, "h2c is disabled by default")
+}
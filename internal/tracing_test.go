@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceParent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// testCollector is a local OTLP/HTTP trace collector.
+type testCollector struct {
+	mu     sync.Mutex
+	bodies [][]byte
+	spans  []*tracepb.Span
+}
+
+func newTestCollector(t *testing.T) (*testCollector, *httptest.Server) {
+	t.Helper()
+	col := &testCollector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !assert.Equal(t, "/v1/traces", r.URL.Path) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		req := &coltracepb.ExportTraceServiceRequest{}
+		require.NoError(t, proto.Unmarshal(body, req))
+
+		col.mu.Lock()
+		col.bodies = append(col.bodies, body)
+		for _, rs := range req.GetResourceSpans() {
+			for _, ss := range rs.GetScopeSpans() {
+				col.spans = append(col.spans, ss.GetSpans()...)
+			}
+		}
+		col.mu.Unlock()
+
+		resp, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+		w.Header().Set(echo.HeaderContentType, "application/x-protobuf")
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return col, srv
+}
+
+// span returns the received span with the given name.
+func (col *testCollector) span(t *testing.T, name string) *tracepb.Span {
+	t.Helper()
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	for _, s := range col.spans {
+		if s.GetName() == name {
+			return s
+		}
+	}
+	require.Failf(t, "span not found", "no span named %q", name)
+	return nil
+}
+
+// resetTracerProvider disables tracing at the end of the test.
+func resetTracerProvider(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+}
+
+func TestSetupTracingDisabled(t *testing.T) {
+	shutdown, err := SetupTracing(context.Background(), conf{}, "test")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
+
+func TestTracingExportsRequestSpans(t *testing.T) {
+	const (
+		token = "hvs.CABAAAAAAQAAAAAAAAAABBBB"
+		msg   = "my very secret message"
+	)
+
+	col, collector := newTestCollector(t)
+	resetTracerProvider(t)
+	shutdown, err := SetupTracing(context.Background(), conf{OTLPEndpoint: collector.URL}, "test")
+	require.NoError(t, err)
+
+	server := NewServer(conf{HttpBindingAddress: ":8080", AllowedOrigins: []string{"*"}},
+		NewSecretHandlers(&FakeSecretMsgStorer{token: token, msg: msg}))
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	require.NoError(t, writer.WriteField("msg", msg))
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/secret", body)
+	req.Header.Set(echo.HeaderContentType, writer.FormDataContentType())
+	req.RemoteAddr = "10.0.0.20:1234"
+	req.Header.Set("traceparent", testTraceParent)
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	req = retrieveRequest(server, token)
+	req.RemoteAddr = "10.0.0.20:1234"
+	req.Header.Set("traceparent", testTraceParent)
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Flush the pending spans to the collector.
+	require.NoError(t, shutdown(context.Background()))
+
+	for _, chain := range [][]string{
+		{"POST /secret", "CreateMsgHandler", "storage.store"},
+		{"POST /secret/retrieve", "GetMsgHandler", "storage.get"},
+	} {
+		parent := col.span(t, chain[0])
+		assert.Equal(t, tracepb.Span_SPAN_KIND_SERVER, parent.GetKind())
+		assert.Equal(t, "00f067aa0ba902b7", trace.SpanID(parent.GetParentSpanId()).String(), "the incoming trace context is continued")
+
+		for _, name := range chain[1:] {
+			s := col.span(t, name)
+			assert.Equal(t, testTraceID, trace.TraceID(s.GetTraceId()).String())
+			assert.Equal(t, parent.GetSpanId(), s.GetParentSpanId(), "%s is a child of %s", name, parent.GetName())
+			parent = s
+		}
+	}
+
+	// Neither the token nor the message may appear anywhere in the exported data.
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	require.NotEmpty(t, col.bodies)
+	for _, b := range col.bodies {
+		assert.NotContains(t, string(b), token)
+		assert.NotContains(t, string(b), msg)
+	}
+}
+
+func TestVaultSpans(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	exporter := tracetest.NewInMemoryExporter()
+	resetTracerProvider(t)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	ctx, parent := tracer().Start(context.Background(), "test")
+	v := NewVault(c.Address(), "secret/test/", c.Token())
+	secret := "my secret"
+	token, err := v.Store(ctx, secret, "1h")
+	require.NoError(t, err)
+	_, err = v.Get(ctx, token)
+	require.NoError(t, err)
+	parent.End()
+
+	var names []string
+	for _, s := range exporter.GetSpans() {
+		names = append(names, s.Name)
+		assert.Equal(t, parent.SpanContext().TraceID(), s.SpanContext.TraceID())
+		if s.Name == "test" {
+			continue
+		}
+		assert.Equal(t, trace.SpanKindClient, s.SpanKind)
+		for _, attr := range s.Attributes {
+			assert.NotContains(t, attr.Value.Emit(), token)
+			assert.NotContains(t, attr.Value.Emit(), secret)
+		}
+	}
+	assert.Equal(t, []string{"vault.token.create", "vault.write", "vault.read", "test"}, names)
+}
+
+func TestVaultPropagatesTraceContext(t *testing.T) {
+	_, err := SetupTracing(context.Background(), conf{}, "test")
+	require.NoError(t, err)
+	resetTracerProvider(t)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	ctx, span := tracer().Start(context.Background(), "test")
+	defer span.End()
+
+	_, err = NewVault(srv.URL, "cubbyhole/", "fake-token").Get(ctx, "hvs.CABAAAAAAQAAAAAAAAAABBBB")
+	assert.Error(t, err)
+	assert.Contains(t, traceparent, span.SpanContext().TraceID().String())
+}
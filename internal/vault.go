@@ -1,21 +1,82 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
 
 	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// errMissingTTL is returned by the stores when a secret is stored without TTL.
+var errMissingTTL = errors.New("missing TTL")
+
 // SecretMsgStorer defines the interface for storing and retrieving self-destructing messages.
 // Implementations must ensure messages are deleted after first retrieval (one-time access).
+// The context carries the request deadline and trace.
 type SecretMsgStorer interface {
 	// Store saves a message with the specified TTL and returns a unique retrieval token.
-	Store(string, ttl string) (token string, err error)
+	// The TTL is required: callers resolve it with the configured default, see Limits.
+	Store(ctx context.Context, msg string, ttl string) (token string, err error)
 	// Get retrieves a message by token and deletes it from storage (one-time read).
-	Get(token string) (msg string, err error)
+	Get(ctx context.Context, token string) (msg string, err error)
+}
+
+// SecretMsgRevoker is implemented by storage backends that can destroy a secret
+// without reading it. It is optional: callers must check for it with a type assertion.
+type SecretMsgRevoker interface {
+	// Revoke deletes the message identified by token without returning it.
+	Revoke(ctx context.Context, token string) error
+}
+
+// MultiReadStorer is implemented by storage backends that can keep a message readable
+// more than once. It is optional: callers must check for it with a type assertion.
+type MultiReadStorer interface {
+	// StoreWithReads saves a message that can be retrieved up to reads times.
+	StoreWithReads(ctx context.Context, msg string, ttl string, reads int) (token string, err error)
 }
 
+// PolicyStorer is implemented by storage backends that can keep an access policy alongside
+// a message. It is optional: callers must check for it with a type assertion.
+type PolicyStorer interface {
+	// StoreWithPolicy saves a message that can be retrieved up to reads times, by the clients
+	// allowed by policy.
+	StoreWithPolicy(ctx context.Context, msg string, ttl string, reads int, policy AccessPolicy) (token string, err error)
+	// Policy returns the access policy of the message identified by token without consuming
+	// it. Messages stored without a policy have an empty one.
+	Policy(ctx context.Context, token string) (AccessPolicy, error)
+}
+
+// ExpiryNotifier is implemented by storage backends that detect the expiry of unread
+// secrets. It is optional: callers must check for it with a type assertion.
+type ExpiryNotifier interface {
+	// NotifyExpired registers fn to be called with the ID of each expired secret, computed
+	// by id from its token, so that backends need not keep tokens until secrets expire.
+	NotifyExpired(id func(token string) string, fn func(id string))
+}
+
+// HealthChecker is implemented by storage backends that can report whether they are able
+// to serve requests. It is optional: backends without it are considered always ready.
+type HealthChecker interface {
+	// CheckHealth returns an error if the backend cannot currently store or retrieve messages.
+	CheckHealth(ctx context.Context) error
+}
+
+// policyMetadataKey is the token metadata key holding the access policy of a message.
+const policyMetadataKey = "access_policy"
+
+// tokenLookupPath is the Vault path used by Policy to look up the token of a message.
+const tokenLookupPath = "auth/token/lookup"
+
 // vault implements SecretMsgStorer using HashiCorp Vault's cubbyhole backend.
 // It manages one-time tokens and automatic token renewal for secure message storage.
 type vault struct {
@@ -25,61 +86,88 @@ type vault struct {
 	prefix string
 	// token is the Vault authentication token (read from VAULT_TOKEN if empty).
 	token string
+	// expiry tracks the stored secrets once NotifyExpired has been called.
+	expiry *vaultExpiry
 }
 
 // NewVault creates a new vault client and starts a background goroutine for token renewal.
 // If address or token are empty, they will be read from VAULT_ADDR and VAULT_TOKEN
 // environment variables respectively. The prefix determines the Vault storage path.
 func NewVault(address string, prefix string, token string) *vault {
-	v := &vault{address, prefix, token}
+	v := &vault{address: address, prefix: prefix, token: token, expiry: newVaultExpiry()}
 
 	go v.newVaultClientToRenewToken()
 	return v
 }
 
-// Store saves a message to Vault with the specified time-to-live (TTL).
-// Default TTL is 48 hours if not specified. Maximum TTL is 168 hours (7 days).
+// Store saves a message to Vault with the specified time-to-live (TTL), which is required.
 // Returns a unique one-time token for retrieving the message.
 // The token can be used exactly twice: once to store and once to retrieve.
-func (v vault) Store(msg string, ttl string) (token string, err error) {
-	// Default TTL
+func (v vault) Store(ctx context.Context, msg string, ttl string) (token string, err error) {
+	return v.StoreWithReads(ctx, msg, ttl, 1)
+}
+
+// StoreWithReads saves a message to Vault that can be retrieved up to reads times.
+// The token is created with one use to write the message plus one use per read.
+func (v vault) StoreWithReads(ctx context.Context, msg string, ttl string, reads int) (token string, err error) {
+	return v.StoreWithPolicy(ctx, msg, ttl, reads, AccessPolicy{})
+}
+
+// StoreWithPolicy saves a message to Vault that can be retrieved up to reads times by the
+// clients allowed by policy. The policy is kept in the metadata of the token, so that it can
+// be looked up without using the token.
+func (v vault) StoreWithPolicy(ctx context.Context, msg string, ttl string, reads int, policy AccessPolicy) (token string, err error) {
 	if ttl == "" {
-		ttl = "48h"
+		return "", errMissingTTL
 	}
 
-	t, err := v.createOneTimeToken(ttl)
+	metadata := map[string]string{"name": "placeholder"}
+	if policy.restricted() {
+		b, err := json.Marshal(policy)
+		if err != nil {
+			return "", err
+		}
+		metadata[policyMetadataKey] = string(b)
+	}
+
+	auth, err := v.createToken(ctx, ttl, reads+1, metadata)
 	if err != nil {
-		return "", err
+		return "", redactError(err)
 	}
 
-	if v.writeMsgToVault(t, msg) != nil {
-		return "", err
+	if err := v.writeMsgToVault(ctx, auth.ClientToken, msg); err != nil {
+		return "", redactError(err)
 	}
-	return t, nil
+	v.expiry.track(auth, reads)
+	return auth.ClientToken, nil
 }
 
-// createOneTimeToken creates a non-renewable Vault token with exactly 2 uses.
-// The token is used once to write the message and once to read it, ensuring
-// one-time access. The token automatically expires after the specified TTL.
-func (v vault) createOneTimeToken(ttl string) (string, error) {
+// createToken creates a non-renewable Vault token with the given number of uses.
+// For a one-time secret, the token has exactly 2 uses: once to write the message
+// and once to read it. The token automatically expires after the specified TTL.
+func (v vault) createToken(ctx context.Context, ttl string, uses int, metadata map[string]string) (auth *api.SecretAuth, err error) {
+	ctx, span := v.startSpan(ctx, "vault.token.create")
+	defer func() { endSpan(span, err) }()
+
 	c, err := v.newVaultClient()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	injectTraceContext(ctx, c)
 	t := c.Auth().Token()
 
 	var notRenewable bool
-	s, err := t.Create(&api.TokenCreateRequest{
-		Metadata:       map[string]string{"name": "placeholder"},
+	s, err := t.CreateWithContext(ctx, &api.TokenCreateRequest{
+		Metadata:       metadata,
 		ExplicitMaxTTL: ttl,
-		NumUses:        2, //1 to create 2 to get
+		NumUses:        uses, // 1 to create, then 1 per read
 		Renewable:      &notRenewable,
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return s.Auth.ClientToken, nil
+	return s.Auth, nil
 }
 
 // newVaultClient creates a new Vault API client with the configured address and token.
@@ -109,60 +197,174 @@ func (v vault) newVaultClient() (*api.Client, error) {
 
 // writeMsgToVault writes a message to Vault using the provided one-time token.
 // The message is stored at the path: /<prefix>/<token>.
-// This consumes the first use of the two-use token.
-func (v vault) writeMsgToVault(token, msg string) error {
-	c, err := v.newVaultClientWithToken(token)
+// This consumes the first use of the token.
+func (v vault) writeMsgToVault(ctx context.Context, token, msg string) (err error) {
+	ctx, span := v.startSpan(ctx, "vault.write")
+	defer func() { endSpan(span, err) }()
+
+	c, err := v.newVaultClientWithToken(ctx, token)
 	if err != nil {
 		return err
 	}
 
 	raw := map[string]interface{}{"msg": msg}
 
-	_, err = c.Logical().Write("/"+v.prefix+token, raw)
+	_, err = c.Logical().WriteWithContext(ctx, "/"+v.prefix+token, raw)
 
 	return err
 }
 
-// Get retrieves and deletes a message from Vault using the provided token.
-// This consumes the second (final) use of the two-use token, automatically
-// deleting both the message and the token from Vault, ensuring one-time access.
-func (v vault) Get(token string) (msg string, err error) {
-	c, err := v.newVaultClientWithToken(token)
+// Get retrieves a message from Vault using the provided token, consuming one of its uses.
+// The final read consumes the last use, automatically deleting both the message and the
+// token from Vault, so that the message is read at most the allowed number of times.
+// Like those of Store and Revoke, its errors have tokens redacted so that they can be logged.
+func (v vault) Get(ctx context.Context, token string) (msg string, err error) {
+	ctx, span := v.startSpan(ctx, "vault.read")
+	defer func() { endSpan(span, err) }()
+
+	c, err := v.newVaultClientWithToken(ctx, token)
 	if err != nil {
 		return "", err
 	}
 
-	r, err := c.Logical().Read(v.prefix + token)
+	r, err := c.Logical().ReadWithContext(ctx, v.prefix+token)
 	if err != nil {
-		return "", err
+		return "", redactError(err)
 	}
+	v.expiry.read(token)
 	return r.Data["msg"].(string), nil
 }
 
+// Policy returns the access policy of a message, kept in the metadata of its token. The token
+// is looked up with the configured token, which needs the permission to do so: this does not
+// use the token, so the message is not consumed.
+func (v vault) Policy(ctx context.Context, token string) (policy AccessPolicy, err error) {
+	ctx, span := v.startSpan(ctx, "vault.token.lookup")
+	defer func() { endSpan(span, err) }()
+
+	c, err := v.newVaultClient()
+	if err != nil {
+		return AccessPolicy{}, err
+	}
+	injectTraceContext(ctx, c)
+
+	s, err := c.Auth().Token().LookupWithContext(ctx, token)
+	if err != nil {
+		return AccessPolicy{}, redactError(err)
+	}
+	meta, _ := s.Data["meta"].(map[string]interface{})
+	raw, _ := meta[policyMetadataKey].(string)
+	if raw == "" {
+		return AccessPolicy{}, nil
+	}
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		return AccessPolicy{}, fmt.Errorf("invalid access policy: %w", err)
+	}
+	return policy, nil
+}
+
+// Revoke deletes a message from Vault without reading it, whatever its remaining reads.
+// Like Get, this consumes one use of the token, which has one use to store the message
+// and one per read: the token is revoked by Vault once its uses run out or it expires,
+// and cannot read the deleted message in the meantime.
+func (v vault) Revoke(ctx context.Context, token string) (err error) {
+	ctx, span := v.startSpan(ctx, "vault.delete")
+	defer func() { endSpan(span, err) }()
+
+	c, err := v.newVaultClientWithToken(ctx, token)
+	if err != nil {
+		return err
+	}
+
+	if _, err = c.Logical().DeleteWithContext(ctx, v.prefix+token); err != nil {
+		return redactError(err)
+	}
+	v.expiry.forget(token)
+	return nil
+}
+
+// CheckHealth checks that Vault is initialized and unsealed, that the configured token is
+// still valid by looking it up, and that it can look up the tokens of the secrets to read
+// their access policies, as checked on every retrieval.
+func (v vault) CheckHealth(ctx context.Context) error {
+	c, err := v.newVaultClient()
+	if err != nil {
+		return err
+	}
+
+	health, err := c.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return fmt.Errorf("vault health: %w", redactError(err))
+	}
+	if !health.Initialized {
+		return errors.New("vault is not initialized")
+	}
+	if health.Sealed {
+		return errors.New("vault is sealed")
+	}
+
+	if _, err := c.Auth().Token().LookupSelfWithContext(ctx); err != nil {
+		return fmt.Errorf("vault token lookup: %w", redactError(err))
+	}
+
+	capabilities, err := c.Sys().CapabilitiesSelfWithContext(ctx, tokenLookupPath)
+	if err != nil {
+		return fmt.Errorf("vault token capabilities: %w", redactError(err))
+	}
+	if !slices.Contains(capabilities, "update") && !slices.Contains(capabilities, "root") {
+		return fmt.Errorf("vault token cannot look up the tokens of secrets: the update capability on %s is required", tokenLookupPath)
+	}
+	return nil
+}
+
 // newVaultClientWithToken creates a Vault client authenticated with a specific token.
 // Used for one-time token operations when storing and retrieving messages.
-func (v vault) newVaultClientWithToken(token string) (*api.Client, error) {
+// The trace context of ctx is propagated to Vault.
+func (v vault) newVaultClientWithToken(ctx context.Context, token string) (*api.Client, error) {
 	c, err := v.newVaultClient()
 	if err != nil {
 		return nil, err
 	}
 	c.SetToken(token)
+	injectTraceContext(ctx, c)
 	return c, nil
 }
 
+// startSpan starts a client span for a Vault call. Only the storage prefix is recorded:
+// paths contain tokens, which must never end up in traces.
+func (v vault) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("vault.prefix", v.prefix)),
+	)
+}
+
+// injectTraceContext adds the W3C trace context headers of ctx to the requests made by c.
+func injectTraceContext(ctx context.Context, c *api.Client) {
+	headers := http.Header{}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(headers))
+	for k, values := range headers {
+		for _, value := range values {
+			c.AddHeader(k, value)
+		}
+	}
+}
+
 // newVaultClientToRenewToken runs in a background goroutine to automatically renew
 // the main Vault authentication token before it expires. This ensures continuous
 // operation of the service without manual token refresh.
 func (v vault) newVaultClientToRenewToken() {
+	logger := slog.Default().With("component", "vault_token_renewal")
+
 	c, err := v.newVaultClient()
 	if err != nil {
-		log.Println(err)
+		logger.Error("Unable to create Vault client", "error", err)
+		return
 	}
 	client_auth_token := &api.Secret{Auth: &api.SecretAuth{ClientToken: c.Token(), Renewable: true}}
 
-	/* */
-	log.Println("renew cycle: begin")
-	defer log.Println("renew cycle: end")
+	logger.Info("Renew cycle begin")
+	defer logger.Info("Renew cycle end")
 
 	// auth token
 	authTokenWatcher, err := c.NewLifetimeWatcher(&api.LifetimeWatcherInput{
@@ -170,12 +372,13 @@ func (v vault) newVaultClientToRenewToken() {
 	})
 
 	if err != nil {
-		err := fmt.Errorf("unable to initialize auth token lifetime watcher: %w", err)
-		fmt.Println(err.Error())
+		logger.Error("Unable to initialize auth token lifetime watcher", "error", err)
+		return
 	}
 
 	go authTokenWatcher.Start()
 	defer authTokenWatcher.Stop()
+	vaultTokenRenewing.Set(1)
 
 	// monitor events from both watchers
 	for {
@@ -183,12 +386,22 @@ func (v vault) newVaultClientToRenewToken() {
 
 		case err := <-authTokenWatcher.DoneCh():
 			// Leases created by a token get revoked when the token is revoked.
-			fmt.Println("Error is :", err)
+			if err != nil {
+				logger.Error("Auth token renewal failed", "error", err)
+			} else {
+				logger.Warn("Auth token renewal stopped: the token is not renewable or reached its maximum TTL")
+			}
+			vaultTokenRenewalsTotal.WithLabelValues("failure").Inc()
+			vaultTokenRenewing.Set(0)
+			return
 
 		// RenewCh is a channel that receives a message when a successful
 		// renewal takes place and includes metadata about the renewal.
 		case info := <-authTokenWatcher.RenewCh():
-			log.Printf("auth token: successfully renewed; remaining duration: %ds", info.Secret.Auth.LeaseDuration)
+			logger.Info("Auth token renewed", "lease_duration", time.Duration(info.Secret.Auth.LeaseDuration)*time.Second)
+			vaultTokenRenewalsTotal.WithLabelValues("success").Inc()
+			vaultTokenLeaseDuration.Set(float64(info.Secret.Auth.LeaseDuration))
+			vaultTokenLastRenewal.SetToCurrentTime()
 		}
 	}
 }
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// vaultExpiryInterval is how often the secrets stored in Vault are checked for expiry.
+const vaultExpiryInterval = 30 * time.Second
+
+// vaultExpiry detects the expiry of the secrets stored by this process in Vault, which does
+// not report it: once a token is gone, whether it expired or was used up cannot be told.
+// Each secret is therefore looked up by the accessor of its token, so that tokens are not
+// kept, during the last interval before its expiry: a secret still unread then is reported
+// as expired at its expiry, unless its last read goes through this process meanwhile.
+// Secrets stored before a restart are not tracked.
+type vaultExpiry struct {
+	// interval is how often the secrets are checked, vaultExpiryInterval except in tests.
+	interval time.Duration
+	now      func() time.Time
+
+	mu sync.Mutex
+	// id and fn are set by NotifyExpired: secrets are only tracked once they are.
+	id func(token string) string
+	fn func(id string)
+	// pending holds the tracked secrets, by ID.
+	pending map[string]*pendingSecret
+}
+
+// pendingSecret is a secret tracked for expiry.
+type pendingSecret struct {
+	accessor  string
+	expiresAt time.Time
+	// reads is the number of reads left, as far as this process knows.
+	reads int
+	// unread is set when the token was found unused during the last interval before expiry.
+	unread bool
+}
+
+// newVaultExpiry returns an expiry tracker that tracks nothing until a callback is registered.
+func newVaultExpiry() *vaultExpiry {
+	return &vaultExpiry{interval: vaultExpiryInterval, now: time.Now, pending: map[string]*pendingSecret{}}
+}
+
+// NotifyExpired registers fn to be called with the ID of each secret stored from now on
+// that expires unread. The configured token needs the permission to look up token accessors
+// (auth/token/lookup-accessor).
+func (v *vault) NotifyExpired(id func(token string) string, fn func(id string)) {
+	v.expiry.mu.Lock()
+	defer v.expiry.mu.Unlock()
+	start := v.expiry.fn == nil
+	v.expiry.id, v.expiry.fn = id, fn
+	if start {
+		go v.watchExpiry()
+	}
+}
+
+// watchExpiry runs in a background goroutine to check the tracked secrets every interval.
+func (v vault) watchExpiry() {
+	ticker := time.NewTicker(v.expiry.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		v.checkExpiry(context.Background())
+	}
+}
+
+// checkExpiry reports the secrets that expired unread, and looks up those expiring before
+// the next check.
+func (v vault) checkExpiry(ctx context.Context) {
+	e := v.expiry
+	now := e.now()
+	var expired []string
+	lookups := map[string]string{}
+	e.mu.Lock()
+	for id, p := range e.pending {
+		switch {
+		case p.unread && !now.Before(p.expiresAt):
+			expired = append(expired, id)
+			delete(e.pending, id)
+		case !p.unread && !now.Before(p.expiresAt):
+			// Expired or used up before it could be looked up.
+			delete(e.pending, id)
+		case !p.unread && now.Add(e.interval).After(p.expiresAt):
+			lookups[id] = p.accessor
+		}
+	}
+	fn := e.fn
+	e.mu.Unlock()
+
+	for _, id := range expired {
+		secretsExpiredTotal.Inc()
+		fn(id)
+	}
+
+	for id, accessor := range lookups {
+		used, err := v.tokenUsed(ctx, accessor)
+		if err != nil {
+			slog.Warn("Failed to look up the token of a secret for expiry", "component", "vault_expiry", "error", redactError(err))
+			continue
+		}
+		e.mu.Lock()
+		if p, ok := e.pending[id]; ok {
+			if used {
+				delete(e.pending, id)
+			} else {
+				p.unread = true
+			}
+		}
+		e.mu.Unlock()
+	}
+}
+
+// tokenUsed reports whether the token of accessor was used up or revoked.
+func (v vault) tokenUsed(ctx context.Context, accessor string) (bool, error) {
+	c, err := v.newVaultClient()
+	if err != nil {
+		return false, err
+	}
+	s, err := c.Auth().Token().LookupAccessorWithContext(ctx, accessor)
+	var respErr *api.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusBadRequest {
+		// Vault answers "invalid accessor" once the token is gone.
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// Tokens being revoked after their last use have -1 uses.
+	uses, _ := s.TokenRemainingUses()
+	return uses < 0, nil
+}
+
+// track starts tracking the secret whose token is described by auth, readable reads times.
+func (e *vaultExpiry) track(auth *api.SecretAuth, reads int) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fn == nil {
+		return
+	}
+	e.pending[e.id(auth.ClientToken)] = &pendingSecret{
+		accessor:  auth.Accessor,
+		expiresAt: e.now().Add(time.Duration(auth.LeaseDuration) * time.Second),
+		reads:     reads,
+	}
+}
+
+// read records a read of the secret of token, which is no longer tracked after its last read.
+func (e *vaultExpiry) read(token string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fn == nil {
+		return
+	}
+	id := e.id(token)
+	if p, ok := e.pending[id]; ok {
+		if p.reads--; p.reads <= 0 {
+			delete(e.pending, id)
+		}
+	}
+}
+
+// forget stops tracking the secret of token, e.g. once it is revoked.
+func (e *vaultExpiry) forget(token string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.fn != nil {
+		delete(e.pending, e.id(token))
+	}
+}
@@ -1,13 +1,16 @@
 package internal
 
 import (
+	"context"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	vaulthttp "github.com/hashicorp/vault/http"
 	hashivault "github.com/hashicorp/vault/vault"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func createTestVault(t *testing.T) (net.Listener, *api.Client) {
@@ -41,9 +44,9 @@ func TestStoreAndGet(t *testing.T) {
 
 	v := NewVault(c.Address(), "secret/test/", c.Token())
 	secret := "my secret"
-	token, err := v.Store(secret, "")
+	token, err := v.Store(context.Background(), secret, "1h")
 	if assert.NoError(t, err) {
-		msg, err := v.Get(token)
+		msg, err := v.Get(context.Background(), token)
 		assert.NoError(t, err)
 		assert.Equal(t, secret, msg)
 	}
@@ -55,19 +58,127 @@ func TestMsgCanOnlyBeAccessedOnce(t *testing.T) {
 
 	v := NewVault(c.Address(), "secret/test/", c.Token())
 	secret := "my secret"
-	token, err := v.Store(secret, "")
+	token, err := v.Store(context.Background(), secret, "1h")
 	if assert.NoError(t, err) {
-		_, err = v.Get(token)
+		_, err = v.Get(context.Background(), token)
 		assert.NoError(t, err)
 
-		_, err = v.Get(token)
+		_, err = v.Get(context.Background(), token)
 		assert.Error(t, err)
 	}
 }
 
 func TestStoreWithInvalidAddress(t *testing.T) {
 	v := NewVault("http://invalid:9999", "secret/", "fake-token")
-	_, err := v.Store("msg", "1h")
+	_, err := v.Store(context.Background(), "msg", "1h")
 
 	assert.Error(t, err)
 }
+
+func TestRevoke(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	v := NewVault(c.Address(), "secret/test/", c.Token())
+	token, err := v.Store(context.Background(), "my secret", "1h")
+	if assert.NoError(t, err) {
+		err = v.Revoke(context.Background(), token)
+		assert.NoError(t, err)
+
+		_, err = v.Get(context.Background(), token)
+		assert.Error(t, err)
+	}
+}
+
+func TestStoreWithReads(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	v := NewVault(c.Address(), "secret/test/", c.Token())
+	token, err := v.StoreWithReads(context.Background(), "my secret", "1h", 3)
+	if assert.NoError(t, err) {
+		for i := 0; i < 3; i++ {
+			msg, err := v.Get(context.Background(), token)
+			assert.NoError(t, err)
+			assert.Equal(t, "my secret", msg)
+		}
+
+		_, err = v.Get(context.Background(), token)
+		assert.Error(t, err)
+	}
+}
+
+func TestStoreWithPolicy(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	v := NewVault(c.Address(), "secret/test/", c.Token())
+	policy := AccessPolicy{Recipients: []string{"bob@example.com"}, Groups: []string{"ops"}}
+	token, err := v.StoreWithPolicy(context.Background(), "my secret", "1h", 1, policy)
+	if assert.NoError(t, err) {
+		for i := 0; i < 3; i++ {
+			p, err := v.Policy(context.Background(), token)
+			assert.NoError(t, err)
+			assert.Equal(t, policy, p)
+		}
+
+		msg, err := v.Get(context.Background(), token)
+		assert.NoError(t, err, "looking the policy up does not use the token")
+		assert.Equal(t, "my secret", msg)
+
+		_, err = v.Policy(context.Background(), token)
+		assert.Error(t, err)
+	}
+
+	token, err = v.Store(context.Background(), "my secret", "1h")
+	if assert.NoError(t, err) {
+		p, err := v.Policy(context.Background(), token)
+		assert.NoError(t, err)
+		assert.False(t, p.restricted())
+	}
+}
+
+func TestVaultNotifyExpired(t *testing.T) {
+	ln, c := createTestVault(t)
+	defer func() { _ = ln.Close() }()
+
+	v := NewVault(c.Address(), "secret/test/", c.Token())
+	now := time.Now()
+	v.expiry.now = func() time.Time { return now }
+	var expired []string
+	v.NotifyExpired(func(token string) string { return "id:" + token }, func(id string) { expired = append(expired, id) })
+
+	ctx := context.Background()
+	unread, err := v.Store(ctx, "my secret", "1h")
+	require.NoError(t, err)
+	read, err := v.StoreWithReads(ctx, "my secret", "1h", 2)
+	require.NoError(t, err)
+	partlyRead, err := v.StoreWithReads(ctx, "my secret", "1h", 2)
+	require.NoError(t, err)
+	readElsewhere, err := v.Store(ctx, "my secret", "1h")
+	require.NoError(t, err)
+	revoked, err := v.Store(ctx, "my secret", "1h")
+	require.NoError(t, err)
+
+	for _, token := range []string{read, read, partlyRead} {
+		_, err = v.Get(ctx, token)
+		require.NoError(t, err)
+	}
+	// Another replica reads the secret.
+	_, err = NewVault(c.Address(), "secret/test/", c.Token()).Get(ctx, readElsewhere)
+	require.NoError(t, err)
+	require.NoError(t, v.Revoke(ctx, revoked))
+
+	v.checkExpiry(ctx)
+	assert.Len(t, v.expiry.pending, 3, "read and revoked secrets are no longer tracked")
+
+	now = now.Add(time.Hour - 10*time.Second)
+	v.checkExpiry(ctx)
+	assert.Empty(t, expired, "secrets are looked up before their expiry")
+	assert.Len(t, v.expiry.pending, 2)
+
+	now = now.Add(20 * time.Second)
+	v.checkExpiry(ctx)
+	assert.ElementsMatch(t, []string{"id:" + unread, "id:" + partlyRead}, expired)
+	assert.Empty(t, v.expiry.pending)
+}
@@ -0,0 +1,149 @@
+// Package api defines the request and response types of the sup3rS3cretMes5age HTTP API.
+// It has no dependencies so that it can be shared by the server, the client SDK and the CLI.
+package api
+
+// Form field names accepted by POST /secret.
+const (
+	// FieldMsg is the form field holding the secret message (required).
+	FieldMsg = "msg"
+	// FieldTTL is the form field holding the time-to-live as a Go duration (optional).
+	FieldTTL = "ttl"
+	// FieldFile is the multipart form field holding an uploaded file (optional).
+	FieldFile = "file"
+	// FieldReads is the form field holding how many times the secret can be retrieved (optional, default 1).
+	FieldReads = "reads"
+	// FieldRecipients is the form field holding the comma separated email addresses of the
+	// users allowed to retrieve the secret (optional). Recipients must log in to retrieve it.
+	FieldRecipients = "recipients"
+	// FieldRecipientGroups is the form field holding the comma separated groups whose members
+	// are allowed to retrieve the secret (optional).
+	FieldRecipientGroups = "recipient_groups"
+	// FieldAllowedCIDRs is the form field holding the comma separated networks, CIDRs or IP
+	// addresses, from which the secret can be retrieved (optional).
+	FieldAllowedCIDRs = "allowed_cidrs"
+	// FieldChallenge is the form field holding the proof-of-work challenge issued by GET /challenge,
+	// when the server requires one.
+	FieldChallenge = "challenge"
+	// FieldSolution is the form field holding the solution of the proof-of-work challenge.
+	FieldSolution = "solution"
+	// FieldCaptcha is the form field holding the response of the CAPTCHA widget, when the server
+	// requires one. The fields set by the hCaptcha and Turnstile widgets are accepted too.
+	FieldCaptcha = "captcha"
+)
+
+// Challenge types returned by GET /challenge.
+const (
+	// ChallengeNone means that secrets can be created without solving a challenge.
+	ChallengeNone = "none"
+	// ChallengeProofOfWork is a proof-of-work: find a Solution, a decimal number, such that the
+	// SHA-256 of "<challenge>:<solution>" starts with Difficulty zero bits.
+	ChallengeProofOfWork = "pow"
+	// ChallengeHCaptcha is an hCaptcha widget, whose response is sent in FieldCaptcha.
+	ChallengeHCaptcha = "hcaptcha"
+	// ChallengeTurnstile is a Cloudflare Turnstile widget, whose response is sent in FieldCaptcha.
+	ChallengeTurnstile = "turnstile"
+)
+
+// Form field names accepted by POST /secret/retrieve.
+const (
+	// FieldToken is the form field holding the token of the secret to retrieve (required).
+	FieldToken = "token"
+	// FieldNonce is the form field holding the confirmation nonce issued by the /getmsg page (required).
+	FieldNonce = "nonce"
+)
+
+// HeaderConfirmationNonce is the response header of the /getmsg page holding the
+// confirmation nonce, for clients that do not parse the page.
+const HeaderConfirmationNonce = "X-Confirmation-Nonce"
+
+// Query parameter names used by the /getmsg share page.
+const (
+	// ParamToken is the query parameter holding the message token.
+	ParamToken = "token"
+	// ParamFileToken is the query parameter holding the file token on share URLs.
+	ParamFileToken = "filetoken"
+	// ParamFileName is the query parameter holding the file name on share URLs.
+	ParamFileName = "filename"
+)
+
+// TokenResponse represents the API response when creating a new secret message.
+// It includes a token for retrieving the message, and optional file token and name
+// if a file was uploaded alongside the message.
+type TokenResponse struct {
+	// Token is the unique identifier for retrieving the secret message.
+	Token string `json:"token"`
+	// FileToken is the unique identifier for retrieving an uploaded file (optional).
+	FileToken string `json:"filetoken,omitempty"`
+	// FileName is the original name of the uploaded file (optional).
+	FileName string `json:"filename,omitempty"`
+}
+
+// MsgResponse represents the API response when retrieving a secret message.
+type MsgResponse struct {
+	// Msg is the secret message content retrieved from Vault.
+	Msg string `json:"msg"`
+}
+
+// Limits represents the API response of GET /limits, describing the bounds the server
+// enforces when creating secrets. Durations are expressed in seconds.
+type Limits struct {
+	// MaxMessageSize is the maximum size of a secret message, in bytes.
+	MaxMessageSize int64 `json:"max_message_size"`
+	// MaxFileSize is the maximum size of an uploaded file, in bytes.
+	MaxFileSize int64 `json:"max_file_size"`
+	// MinTTL is the shortest accepted time-to-live, in seconds.
+	MinTTL int64 `json:"min_ttl"`
+	// MaxTTL is the longest accepted time-to-live, in seconds.
+	MaxTTL int64 `json:"max_ttl"`
+	// DefaultTTL is the time-to-live applied when none is given, in seconds.
+	DefaultTTL int64 `json:"default_ttl"`
+	// MaxReads is the maximum number of times a secret can be retrieved.
+	MaxReads int `json:"max_reads"`
+	// RecipientRestrictions reports whether secrets can be restricted to recipients, who
+	// log in with single sign-on to retrieve them.
+	RecipientRestrictions bool `json:"recipient_restrictions,omitempty"`
+	// NetworkRestrictions reports whether secrets can be restricted to the networks they are
+	// retrieved from.
+	NetworkRestrictions bool `json:"network_restrictions,omitempty"`
+}
+
+// Challenge represents the API response of GET /challenge, describing the challenge to
+// solve before creating a secret. Authenticated clients do not need to solve it.
+type Challenge struct {
+	// Type is one of ChallengeNone, ChallengeProofOfWork, ChallengeHCaptcha or ChallengeTurnstile.
+	Type string `json:"type"`
+	// Challenge is the proof-of-work challenge, to send back in FieldChallenge.
+	Challenge string `json:"challenge,omitempty"`
+	// Difficulty is the number of leading zero bits of the proof-of-work hash.
+	Difficulty int `json:"difficulty,omitempty"`
+	// ExpiresIn is the number of seconds the proof-of-work challenge can be used for.
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// SiteKey is the site key of the CAPTCHA widget.
+	SiteKey string `json:"site_key,omitempty"`
+}
+
+// ErrorResponse represents an error returned by the API.
+// Validation and storage errors set Message, while rate limiting sets Error.
+type ErrorResponse struct {
+	// Message is the error description returned by request handlers.
+	Message string `json:"message,omitempty"`
+	// Error is the error description returned by middlewares (e.g. rate limiting).
+	Error string `json:"error,omitempty"`
+	// Code is the machine-readable reason of the error, for the 403 responses of secret
+	// retrieval: one of the ErrorCode constants.
+	Code string `json:"code,omitempty"`
+}
+
+// Reasons why a secret cannot be retrieved, in ErrorResponse.Code. The secret is not consumed.
+const (
+	// ErrorCodeLinkPreview is returned to known link preview bots.
+	ErrorCodeLinkPreview = "link_preview"
+	// ErrorCodeInvalidNonce is returned when the confirmation nonce is missing, was not
+	// issued for the token or has expired: reload the /getmsg page to get a new one.
+	ErrorCodeInvalidNonce = "invalid_nonce"
+	// ErrorCodeNotRecipient is returned when the secret is restricted to other recipients.
+	ErrorCodeNotRecipient = "not_recipient"
+	// ErrorCodeNetworkNotAllowed is returned when the secret cannot be retrieved from the
+	// network of the client.
+	ErrorCodeNetworkNotAllowed = "network_not_allowed"
+)
@@ -0,0 +1,464 @@
+// Package client is a Go SDK for the sup3rS3cretMes5age HTTP API.
+// It creates and retrieves self-destructing secret messages and files,
+// builds share URLs, and retries rate-limited requests with backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+)
+
+// Default retry settings used when a request is rate limited.
+const (
+	// DefaultMaxRetries is the number of times a rate-limited request is retried.
+	DefaultMaxRetries = 3
+	// DefaultBackoff is the initial delay before retrying a rate-limited request.
+	DefaultBackoff = 500 * time.Millisecond
+	// DefaultMaxBackoff caps the delay between two retries.
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// userAgent identifies the SDK in request headers.
+const userAgent = "sup3rS3cretMes5age-client"
+
+// Client talks to a sup3rS3cretMes5age server.
+// A Client is safe for concurrent use by multiple goroutines.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	userAgent  string
+	apiKey     string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used to send requests (http.DefaultClient by default).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithRetries sets how many times a rate-limited request is retried, and the initial and
+// maximum delay between retries. The delay doubles after each attempt unless the server
+// sends a Retry-After header. A maxRetries of 0 disables retries.
+func WithRetries(maxRetries int, backoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with each request.
+func WithUserAgent(ua string) Option {
+	return func(c *Client) {
+		c.userAgent = ua
+	}
+}
+
+// WithAPIKey authenticates requests with an API key minted by the server operator, which
+// lets programs create secrets without logging in or solving challenges.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// New creates a Client for the server at baseURL (e.g. "https://secrets.example.com").
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL: scheme must be http or https")
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL: missing host")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		maxRetries: DefaultMaxRetries,
+		backoff:    DefaultBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		userAgent:  userAgent,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// CreateOptions holds optional settings for a new secret.
+type CreateOptions struct {
+	// TTL is how long the secret is kept if nobody reads it. The server default applies when zero.
+	TTL time.Duration
+	// Reads is how many times the secret can be retrieved. The server default (1) applies when zero.
+	Reads int
+	// Recipients are the email addresses of the users allowed to retrieve the secret, after
+	// logging in with single sign-on. Anyone holding the token can retrieve it when empty.
+	Recipients []string
+	// RecipientGroups are the groups whose members are allowed to retrieve the secret.
+	RecipientGroups []string
+	// AllowedCIDRs are the networks, CIDRs (e.g. "10.0.0.0/8") or IP addresses, from which the
+	// secret can be retrieved. It can be retrieved from anywhere when empty.
+	AllowedCIDRs []string
+}
+
+// File is a file to upload alongside a secret message.
+type File struct {
+	// Name is the file name shown to the recipient. It must not contain path separators.
+	Name string
+	// Content is read until EOF when the secret is created.
+	Content io.Reader
+}
+
+// CreateSecret stores a text message and returns the tokens needed to retrieve it.
+func (c *Client) CreateSecret(ctx context.Context, msg string, opts *CreateOptions) (*api.TokenResponse, error) {
+	return c.CreateSecretWithFile(ctx, msg, nil, opts)
+}
+
+// CreateSecretWithFile stores a text message and an optional file, solving the
+// proof-of-work challenge first when the server requires one.
+// The returned TokenResponse holds a FileToken and FileName when a non-empty file was uploaded.
+func (c *Client) CreateSecretWithFile(ctx context.Context, msg string, file *File, opts *CreateOptions) (*api.TokenResponse, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	if err := w.WriteField(api.FieldMsg, msg); err != nil {
+		return nil, err
+	}
+	if opts != nil && opts.TTL != 0 {
+		if err := w.WriteField(api.FieldTTL, opts.TTL.String()); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && opts.Reads != 0 {
+		if err := w.WriteField(api.FieldReads, strconv.Itoa(opts.Reads)); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && len(opts.Recipients) > 0 {
+		if err := w.WriteField(api.FieldRecipients, strings.Join(opts.Recipients, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && len(opts.RecipientGroups) > 0 {
+		if err := w.WriteField(api.FieldRecipientGroups, strings.Join(opts.RecipientGroups, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && len(opts.AllowedCIDRs) > 0 {
+		if err := w.WriteField(api.FieldAllowedCIDRs, strings.Join(opts.AllowedCIDRs, ",")); err != nil {
+			return nil, err
+		}
+	}
+	if file != nil {
+		part, err := w.CreateFormFile(api.FieldFile, file.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, file.Content); err != nil {
+			return nil, fmt.Errorf("reading file: %w", err)
+		}
+	}
+	if err := c.answerChallenge(ctx, w); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var tr api.TokenResponse
+	err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint("/secret", nil), bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		return req, nil
+	}, &tr)
+	if err != nil {
+		return nil, err
+	}
+	return &tr, nil
+}
+
+// answerChallenge writes the solution of the challenge the server requires to create
+// secrets, if any, to w.
+func (c *Client) answerChallenge(ctx context.Context, w *multipart.Writer) error {
+	var ch api.Challenge
+	err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/challenge", nil), nil)
+	}, &ch)
+	if errors.Is(err, ErrNotFound) {
+		// Servers predating challenges.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch ch.Type {
+	case api.ChallengeNone:
+		return nil
+	case api.ChallengeProofOfWork:
+		solution, err := solveProofOfWork(ctx, ch.Challenge, ch.Difficulty)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteField(api.FieldChallenge, ch.Challenge); err != nil {
+			return err
+		}
+		return w.WriteField(api.FieldSolution, solution)
+	case api.ChallengeHCaptcha, api.ChallengeTurnstile:
+		return ErrCaptchaRequired
+	}
+	return fmt.Errorf("unsupported challenge %q", ch.Type)
+}
+
+// solveProofOfWork returns a number whose SHA-256 of "<challenge>:<number>" has at least
+// difficulty leading zero bits.
+func solveProofOfWork(ctx context.Context, challenge string, difficulty int) (string, error) {
+	for i := 0; ; i++ {
+		if i%(1<<16) == 0 && ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		solution := strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(challenge + ":" + solution))
+		n := 0
+		for _, b := range sum {
+			n += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if n >= difficulty {
+			return solution, nil
+		}
+	}
+}
+
+// GetSecret retrieves a secret message. The message is destroyed on the server once
+// it has been read as many times as allowed (once by default).
+func (c *Client) GetSecret(ctx context.Context, token string) (string, error) {
+	nonce, err := c.confirmationNonce(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	body := url.Values{api.FieldToken: {token}, api.FieldNonce: {nonce}}.Encode()
+	var mr api.MsgResponse
+	err = c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint("/secret/retrieve", nil), strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}, &mr)
+	if err != nil {
+		return "", err
+	}
+	return mr.Msg, nil
+}
+
+// confirmationNonce returns the nonce issued by the /getmsg page of token, required to
+// retrieve its secret. The page is requested with HEAD, which never consumes a secret.
+func (c *Client) confirmationNonce(ctx context.Context, token string) (string, error) {
+	resp, err := c.send(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodHead, c.endpoint("/getmsg", url.Values{api.ParamToken: {token}}), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+
+	nonce := resp.Header.Get(api.HeaderConfirmationNonce)
+	if nonce == "" {
+		return "", fmt.Errorf("missing %s header", api.HeaderConfirmationNonce)
+	}
+	return nonce, nil
+}
+
+// GetFile retrieves and decodes a file uploaded alongside a secret message.
+// The file is destroyed on the server once read.
+func (c *Client) GetFile(ctx context.Context, fileToken string) ([]byte, error) {
+	encoded, err := c.GetSecret(ctx, fileToken)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding file: %w", err)
+	}
+	return b, nil
+}
+
+// Limits returns the size and time-to-live bounds the server enforces when creating secrets.
+func (c *Client) Limits(ctx context.Context) (*api.Limits, error) {
+	var l api.Limits
+	err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/limits", nil), nil)
+	}, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ShareURL builds the /getmsg link to send to the recipient of a secret.
+func (c *Client) ShareURL(tr *api.TokenResponse) string {
+	q := url.Values{api.ParamToken: {tr.Token}}
+	if tr.FileToken != "" {
+		q.Set(api.ParamFileToken, tr.FileToken)
+		q.Set(api.ParamFileName, tr.FileName)
+	}
+	return c.endpoint("/getmsg", q)
+}
+
+// ParseShareURL extracts the tokens and file name from a /getmsg share URL.
+func ParseShareURL(shareURL string) (*api.TokenResponse, error) {
+	u, err := url.Parse(shareURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid share URL: %w", err)
+	}
+
+	q := u.Query()
+	tr := &api.TokenResponse{
+		Token:     q.Get(api.ParamToken),
+		FileToken: q.Get(api.ParamFileToken),
+		FileName:  q.Get(api.ParamFileName),
+	}
+	if tr.Token == "" {
+		return nil, fmt.Errorf("invalid share URL: missing %s parameter", api.ParamToken)
+	}
+	return tr, nil
+}
+
+// endpoint returns the absolute URL of path on the server, with an optional query.
+func (c *Client) endpoint(path string, q url.Values) string {
+	u := *c.baseURL
+	u.Path += path
+	if q != nil {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// do sends the request built by newReq, retrying while rate limited, and decodes
+// a successful JSON response into out. newReq is called for each attempt.
+func (c *Client) do(ctx context.Context, newReq func() (*http.Request, error), out any) error {
+	resp, err := c.send(ctx, newReq)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// send sends the request built by newReq, retrying while rate limited, and returns the
+// successful response, whose body must be closed. newReq is called for each attempt.
+func (c *Client) send(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	delay := c.backoff
+
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", c.userAgent)
+		req.Header.Set("Accept", "application/json")
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		apiErr := newAPIError(resp)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= c.maxRetries {
+			return nil, apiErr
+		}
+
+		wait := delay
+		if apiErr.RetryAfter > 0 {
+			wait = apiErr.RetryAfter
+		}
+		if c.maxBackoff > 0 && wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// newAPIError builds an APIError from a non-200 response.
+func newAPIError(resp *http.Response) *APIError {
+	e := &APIError{StatusCode: resp.StatusCode}
+
+	var er api.ErrorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&er); err == nil {
+		e.Message, e.Code = er.Message, er.Code
+		if e.Message == "" {
+			e.Message = er.Error
+		}
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+
+	if ra := resp.Header.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil && secs >= 0 {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(ra); err == nil {
+			e.RetryAfter = time.Until(t)
+		}
+	}
+	return e
+}
@@ -0,0 +1,304 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/algolia/sup3rS3cretMes5age/internal"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/api"
+	"github.com/algolia/sup3rS3cretMes5age/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient starts a real server backed by an in-memory store and returns a client for it.
+func newTestClient(t *testing.T) *client.Client {
+	t.Helper()
+
+	cnf := internal.DefaultConfig()
+	cnf.AllowedOrigins = []string{"*"}
+	server := internal.NewServer(cnf, internal.NewSecretHandlers(internal.NewMemoryStore()))
+
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+
+	c, err := client.New(ts.URL)
+	require.NoError(t, err)
+	return c
+}
+
+func TestCreateAndGetSecret(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	tr, err := c.CreateSecret(ctx, "my secret", &client.CreateOptions{TTL: time.Hour})
+	require.NoError(t, err)
+	assert.NotEmpty(t, tr.Token)
+	assert.Empty(t, tr.FileToken)
+
+	msg, err := c.GetSecret(ctx, tr.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "my secret", msg)
+}
+
+func TestSecretCanOnlyBeReadOnce(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	tr, err := c.CreateSecret(ctx, "my secret", nil)
+	require.NoError(t, err)
+
+	_, err = c.GetSecret(ctx, tr.Token)
+	require.NoError(t, err)
+
+	_, err = c.GetSecret(ctx, tr.Token)
+	assert.ErrorIs(t, err, client.ErrNotFound)
+
+	var apiErr *client.APIError
+	if assert.ErrorAs(t, err, &apiErr) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	}
+}
+
+func TestCreateSecretWithReads(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	tr, err := c.CreateSecret(ctx, "my secret", &client.CreateOptions{Reads: 2})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		msg, err := c.GetSecret(ctx, tr.Token)
+		require.NoError(t, err)
+		assert.Equal(t, "my secret", msg)
+	}
+
+	_, err = c.GetSecret(ctx, tr.Token)
+	assert.ErrorIs(t, err, client.ErrNotFound)
+}
+
+func TestCreateSecretWithAllowedCIDRs(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	tr, err := c.CreateSecret(ctx, "my secret", &client.CreateOptions{AllowedCIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+	_, err = c.GetSecret(ctx, tr.Token)
+	assert.ErrorContains(t, err, "cannot be retrieved from your network")
+
+	tr, err = c.CreateSecret(ctx, "my secret", &client.CreateOptions{AllowedCIDRs: []string{"127.0.0.0/8", "::1"}})
+	require.NoError(t, err)
+	msg, err := c.GetSecret(ctx, tr.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "my secret", msg)
+}
+
+func TestCreateSecretWithFile(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	content := []byte("file content \x00\x01\x02")
+	tr, err := c.CreateSecretWithFile(ctx, "see attached", &client.File{
+		Name:    "config.env",
+		Content: strings.NewReader(string(content)),
+	}, nil)
+	require.NoError(t, err)
+	assert.NotEmpty(t, tr.FileToken)
+	assert.Equal(t, "config.env", tr.FileName)
+
+	got, err := c.GetFile(ctx, tr.FileToken)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	msg, err := c.GetSecret(ctx, tr.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "see attached", msg)
+}
+
+func TestCreateSecretValidationErrors(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	_, err := c.CreateSecret(ctx, "", nil)
+	assert.ErrorIs(t, err, client.ErrInvalidRequest)
+
+	_, err = c.CreateSecret(ctx, "my secret", &client.CreateOptions{TTL: 30 * time.Second})
+	assert.ErrorIs(t, err, client.ErrInvalidRequest)
+
+	_, err = c.CreateSecretWithFile(ctx, "my secret", &client.File{
+		Name:    "../etc/passwd",
+		Content: strings.NewReader("malicious"),
+	}, nil)
+	assert.ErrorIs(t, err, client.ErrInvalidRequest)
+
+	_, err = c.GetSecret(ctx, "invalid-token")
+	assert.ErrorIs(t, err, client.ErrInvalidRequest)
+}
+
+func TestLimits(t *testing.T) {
+	c := newTestClient(t)
+
+	l, err := c.Limits(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &api.Limits{
+		MaxMessageSize:      1024 * 1024,
+		MaxFileSize:         50 * 1024 * 1024,
+		MinTTL:              60,
+		MaxTTL:              168 * 3600,
+		DefaultTTL:          48 * 3600,
+		MaxReads:            10,
+		NetworkRestrictions: true,
+	}, l)
+}
+
+func TestShareURL(t *testing.T) {
+	c, err := client.New("https://secrets.example.com/base/")
+	require.NoError(t, err)
+
+	u := c.ShareURL(&api.TokenResponse{Token: "hvs.abc"})
+	assert.Equal(t, "https://secrets.example.com/base/getmsg?token=hvs.abc", u)
+
+	u = c.ShareURL(&api.TokenResponse{Token: "hvs.abc", FileToken: "hvs.def", FileName: "my file.txt"})
+	tr, err := client.ParseShareURL(u)
+	require.NoError(t, err)
+	assert.Equal(t, &api.TokenResponse{Token: "hvs.abc", FileToken: "hvs.def", FileName: "my file.txt"}, tr)
+
+	_, err = client.ParseShareURL("https://secrets.example.com/getmsg")
+	assert.Error(t, err)
+}
+
+func TestNewInvalidBaseURL(t *testing.T) {
+	for _, u := range []string{"", "secrets.example.com", "ftp://secrets.example.com", "https://"} {
+		_, err := client.New(u)
+		assert.Error(t, err, u)
+	}
+}
+
+func TestCreateSecretSolvesProofOfWork(t *testing.T) {
+	cnf := internal.DefaultConfig()
+	cnf.AllowedOrigins = []string{"*"}
+	cnf.Challenge = api.ChallengeProofOfWork
+	cnf.ChallengeDifficulty = 8
+	ts := httptest.NewServer(internal.NewServer(cnf, internal.NewSecretHandlers(internal.NewMemoryStore())))
+	defer ts.Close()
+
+	c, err := client.New(ts.URL)
+	require.NoError(t, err)
+
+	tr, err := c.CreateSecret(context.Background(), "my secret", nil)
+	require.NoError(t, err)
+	msg, err := c.GetSecret(context.Background(), tr.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "my secret", msg)
+}
+
+func TestCreateSecretWithCaptcha(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/challenge", r.URL.Path, "the secret is not sent")
+		_, _ = w.Write([]byte(`{"type":"turnstile","site_key":"site-key"}`))
+	}))
+	defer ts.Close()
+
+	c, err := client.New(ts.URL)
+	require.NoError(t, err)
+
+	_, err = c.CreateSecret(context.Background(), "my secret", nil)
+	assert.ErrorIs(t, err, client.ErrCaptchaRequired)
+}
+
+func TestCreateSecretWithAPIKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.yaml")
+	key, _, err := internal.MintAPIKey(path, internal.APIKeyOptions{Label: "ci"})
+	require.NoError(t, err)
+
+	cnf := internal.DefaultConfig()
+	cnf.AllowedOrigins = []string{"*"}
+	cnf.APIKeysFile = path
+	cnf.Challenge = api.ChallengeTurnstile
+	cnf.CaptchaSiteKey = "site-key"
+	cnf.CaptchaSecret = "captcha-secret"
+	ts := httptest.NewServer(internal.NewServer(cnf, internal.NewSecretHandlers(internal.NewMemoryStore())))
+	defer ts.Close()
+
+	c, err := client.New(ts.URL, client.WithAPIKey(key))
+	require.NoError(t, err)
+	tr, err := c.CreateSecret(context.Background(), "my secret", nil)
+	require.NoError(t, err, "clients with an API key are not challenged")
+	msg, err := c.GetSecret(context.Background(), tr.Token)
+	require.NoError(t, err)
+	assert.Equal(t, "my secret", msg)
+
+	c, err = client.New(ts.URL, client.WithAPIKey(key+"x"))
+	require.NoError(t, err)
+	_, err = c.CreateSecret(context.Background(), "my secret", nil)
+	assert.ErrorContains(t, err, "invalid API key")
+}
+
+func TestRateLimitRetry(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			assert.Equal(t, "hvs.CABAAAAAAQAAAAAAAAAABBBB", r.URL.Query().Get(api.ParamToken), "nonces are issued for the token")
+			w.Header().Set(api.HeaderConfirmationNonce, "nonce")
+			return
+		}
+		if calls.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":"rate limit exceeded"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"msg":"my secret"}`))
+	}))
+	defer ts.Close()
+
+	c, err := client.New(ts.URL, client.WithRetries(3, time.Millisecond, 10*time.Millisecond))
+	require.NoError(t, err)
+
+	msg, err := c.GetSecret(context.Background(), "hvs.CABAAAAAAQAAAAAAAAAABBBB")
+	require.NoError(t, err)
+	assert.Equal(t, "my secret", msg)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestRateLimitExhausted(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte(`{"error":"rate limit exceeded"}`))
+	}))
+	defer ts.Close()
+
+	c, err := client.New(ts.URL, client.WithRetries(2, time.Millisecond, 10*time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = c.CreateSecret(context.Background(), "my secret", nil)
+	assert.True(t, errors.Is(err, client.ErrRateLimited))
+	assert.Contains(t, err.Error(), "rate limit exceeded")
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestRateLimitRetryHonoursContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	c, err := client.New(ts.URL, client.WithRetries(3, time.Second, time.Minute))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.GetSecret(ctx, "hvs.CABAAAAAAQAAAAAAAAAABBBB")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
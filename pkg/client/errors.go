@@ -0,0 +1,62 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Sentinel errors matched by APIError through errors.Is.
+var (
+	// ErrInvalidRequest is returned when the server rejects a request (HTTP 400),
+	// e.g. an empty or too large message, an invalid TTL or a malformed token.
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrNotFound is returned when a secret does not exist, has expired or was already read (HTTP 404).
+	ErrNotFound = errors.New("secret not found or already consumed")
+	// ErrTooLarge is returned when the request body exceeds the server limit (HTTP 413).
+	ErrTooLarge = errors.New("request too large")
+	// ErrRateLimited is returned when the request is still rate limited after all retries (HTTP 429).
+	ErrRateLimited = errors.New("rate limit exceeded")
+	// ErrLoginRequired is returned when the server requires single sign-on, e.g. to retrieve
+	// a secret restricted to recipients (HTTP 401).
+	ErrLoginRequired = errors.New("login required")
+	// ErrCaptchaRequired is returned when the server requires a CAPTCHA, only solvable in a
+	// browser, to create secrets.
+	ErrCaptchaRequired = errors.New("CAPTCHA required to create secrets")
+)
+
+// APIError is returned when the server answers with a non-200 status code.
+type APIError struct {
+	// StatusCode is the HTTP status code returned by the server.
+	StatusCode int
+	// Message is the error message returned by the server.
+	Message string
+	// Code is the machine-readable reason returned by the server, if any, e.g.
+	// api.ErrorCodeInvalidNonce.
+	Code string
+	// RetryAfter is the delay requested by the server before retrying, if any.
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return fmt.Sprintf("sup3rS3cretMes5age: %s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// Is reports whether the error matches one of the package sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrInvalidRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrTooLarge:
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrLoginRequired:
+		return e.StatusCode == http.StatusUnauthorized
+	}
+	return false
+}
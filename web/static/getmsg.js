@@ -2,8 +2,9 @@
  * Secret Message Retrieval Interface
  * 
  * Provides slider-based confirmation UI for retrieving one-time secret messages
- * from the /secret API endpoint. Supports both text messages and file downloads
- * with automatic base64 decoding. All event handlers are CSP-compliant.
+ * from the /secret/retrieve API endpoint, with the confirmation nonce embedded in
+ * the page. Supports both text messages and file downloads with automatic base64
+ * decoding. All event handlers are CSP-compliant.
  */
 
 // Initialize clipboard functionality
@@ -23,43 +24,78 @@ document.querySelector('.encrypt[name="newMsg"]').addEventListener('click', func
     window.location.href = '/';
 });
 
-function validateSecretUrl(token) {
+function validateToken(token) {
     // Validate token format
     if (!token || typeof token !== 'string' || !/^[A-Za-z0-9_\-\.]+$/.test(token)) {
         console.error('Invalid token format');
         showMsg("Invalid or missing token");
-        return null;
+        return false;
     }
+    return true;
+}
 
-    // Properly encode URL parameters
-    const url = new URL('/secret', window.location.origin);
-    url.searchParams.set('token', token);
-    return url.toString();
+// Secrets are retrieved with a POST request carrying the confirmation nonce issued
+// with this page for their token (nonceName), so that fetching the link (e.g. for a chat
+// preview) cannot consume them.
+function retrieveSecret(token, nonceName) {
+    const nonce = document.querySelector('meta[name="' + nonceName + '"]').content;
+    return fetch('/secret/retrieve', {
+        method: 'POST',
+        body: new URLSearchParams({ token: token, nonce: nonce })
+    })
+    .then(response => {
+        if (response.status === 401) {
+            // The secret is restricted to recipients: log in, then come back to this page
+            const next = window.location.pathname + window.location.search;
+            window.location.assign('/auth/login?next=' + encodeURIComponent(next));
+            return new Promise(() => {});
+        }
+        if (response.status === 403) {
+            // The reason is given by the code of the error (see ErrorResponse in pkg/api)
+            return response.json().then(data => {
+                switch (data.code) {
+                case 'network_not_allowed':
+                    throw new Error('Wrong network');
+                case 'not_recipient':
+                    throw new Error('Not a recipient');
+                default:
+                    throw new Error('Confirmation expired');
+                }
+            });
+        }
+        if (!response.ok) {
+            throw new Error('Network response was not ok');
+        }
+        return response.json();
+    });
 }
 
 function showSecret() {
     const params = (new URL(window.location)).searchParams;
 
-    const urlStr = validateSecretUrl(params.get('token'));
-    if (!urlStr) {
+    const token = params.get('token');
+    if (!validateToken(token)) {
         return;
     }
 
-    // Replace jQuery AJAX with fetch
-    fetch(urlStr, {
-        method: 'GET'
-    })
-    .then(response => {
-        if (!response.ok) {
-            throw new Error('Network response was not ok');
-        }
-        return response.json();
-    })
+    retrieveSecret(token, 'confirmation-nonce')
     .then(data => {
         showMsg(data.msg, params.get('filetoken'), params.get('filename'));
     })
     .catch(error => {
         console.error(`An error occurred: ${error}`);
+        if (error.message === 'Confirmation expired') {
+            showMsg("This page has expired, please reload it");
+            return;
+        }
+        if (error.message === 'Not a recipient') {
+            showMsg("This message is not for you, it was not deleted");
+            return;
+        }
+        if (error.message === 'Wrong network') {
+            showMsg("This message cannot be opened from your network, it was not deleted");
+            return;
+        }
         showMsg("Message was already deleted :(");
     });
 };
@@ -104,16 +140,12 @@ function showMsg(msg, filetoken, filename) {
 }
 
 function getSecret(token, name) {
-    const urlStr = validateSecretUrl(token);
-    if (!urlStr) {
+    if (!validateToken(token)) {
         return;
     }
 
-    fetch(urlStr, {
-        method: 'get'
-    }).then(response =>
-        response.json()
-    ).then(json => {
+    retrieveSecret(token, 'confirmation-file-nonce')
+    .then(json => {
         saveData(json.msg, name);
     }).catch(function (err) {
         console.error(`An error occurred: ${err}`);
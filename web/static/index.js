@@ -3,6 +3,7 @@
  *
  * Processes message creation requests with optional file uploads and custom TTL.
  * Submits data to /secret API endpoint and returns a shareable one-time link.
+ * Solves the proof-of-work challenge or shows the CAPTCHA widget required by the server.
  * All event handlers are CSP-compliant.
  */
 
@@ -11,16 +12,182 @@ function setStyles(element, styles) {
   Object.assign(element.style, styles);
 }
 
+// Server limits, loaded from /limits (null until loaded)
+let limits = null;
+
+// Formats a size in bytes for display
+function formatSize(bytes) {
+  const units = ['bytes', 'KB', 'MB', 'GB'];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1 && bytes % 1024 === 0) {
+    bytes /= 1024;
+    i++;
+  }
+  return `${bytes} ${units[i]}`;
+}
+
+// Fetches the server limits, then restricts the TTL choices and shows the size limits
+function loadLimits() {
+  fetch('/limits')
+    .then(response => response.ok ? response.json() : Promise.reject(response.status))
+    .then(data => {
+      limits = data;
+
+      const select = $("#ttl");
+      for (const option of Array.from(select.options)) {
+        const seconds = parseInt(option.value, 10) * 3600;
+        if (seconds < limits.min_ttl || seconds > limits.max_ttl) {
+          option.remove();
+        }
+      }
+
+      // Select the server default, adding it when it is not one of the choices
+      const d = limits.default_ttl;
+      const defaultValue = d % 3600 === 0 ? `${d / 3600}h` : d % 60 === 0 ? `${d / 60}m` : `${d}s`;
+      const match = Array.from(select.options).find(o => parseInt(o.value, 10) * 3600 === limits.default_ttl);
+      if (match) {
+        match.selected = true;
+      } else {
+        const option = new Option(defaultValue, defaultValue, true, true);
+        select.add(option);
+      }
+
+      $("#limits").textContent =
+        `Max message size: ${formatSize(limits.max_message_size)}, max file size: ${formatSize(limits.max_file_size)}`;
+
+      // Secrets can be restricted to recipients when they log in to retrieve them
+      $("#recipients").hidden = !limits.recipient_restrictions;
+      // and to the networks they are retrieved from
+      $("#networks").hidden = !limits.network_restrictions;
+    })
+    .catch(error => console.error(`Could not load limits: ${error}`));
+}
+
+// Challenge to solve before creating a secret, loaded from /challenge (null until loaded)
+let challenge = null;
+// Promise of the proof-of-work solution of the current challenge
+let solution = null;
+
+// CAPTCHA widgets, by challenge type
+const captchaWidgets = {
+  hcaptcha: { className: 'h-captcha', script: 'https://js.hcaptcha.com/1/api.js' },
+  turnstile: { className: 'cf-turnstile', script: 'https://challenges.cloudflare.com/turnstile/v0/api.js' }
+};
+
+// Returns the number of leading zero bits of a hash
+function leadingZeroBits(hash) {
+  let bits = 0;
+  for (const byte of new Uint8Array(hash)) {
+    if (byte !== 0) {
+      return bits + Math.clz32(byte) - 24;
+    }
+    bits += 8;
+  }
+  return bits;
+}
+
+// Finds a number whose SHA-256 of "<challenge>:<number>" has the required leading zero
+// bits, hashing in batches to keep the page responsive
+async function solveProofOfWork(data) {
+  const encoder = new TextEncoder();
+  const batch = 1000;
+  for (let start = 0; ; start += batch) {
+    const hashes = await Promise.all(Array.from({ length: batch }, (_, i) =>
+      crypto.subtle.digest('SHA-256', encoder.encode(`${data.challenge}:${start + i}`))));
+    const i = hashes.findIndex(hash => leadingZeroBits(hash) >= data.difficulty);
+    if (i >= 0) {
+      return String(start + i);
+    }
+  }
+}
+
+// Fetches a new challenge, solving it in the background for proof-of-work challenges or
+// showing the CAPTCHA widget
+function loadChallenge() {
+  fetch('/challenge')
+    .then(response => response.ok ? response.json() : Promise.reject(response.status))
+    .then(data => {
+      challenge = data;
+      if (data.type === 'pow') {
+        solution = solveProofOfWork(data);
+        // Challenges expire, so get a new one before this one does
+        setTimeout(loadChallenge, Math.max(data.expires_in - 60, 1) * 1000);
+        return;
+      }
+
+      const widget = captchaWidgets[data.type];
+      if (widget && !$(`.${widget.className}`)) {
+        const div = document.createElement('div');
+        div.className = widget.className;
+        div.dataset.sitekey = data.site_key;
+        $("#captcha").appendChild(div);
+        const script = document.createElement('script');
+        script.src = widget.script;
+        script.async = true;
+        document.head.appendChild(script);
+      }
+    })
+    .catch(error => console.error(`Could not load challenge: ${error}`));
+}
+
+// Adds the solution of the challenge to the form, and resets the challenge for the next
+// secret since solutions can only be used once
+async function answerChallenge(formData) {
+  if (!challenge) {
+    return;
+  }
+  if (challenge.type === 'pow') {
+    formData.set('challenge', challenge.challenge);
+    formData.set('solution', await solution);
+    loadChallenge();
+  } else if (challenge.type === 'hcaptcha' && window.hcaptcha) {
+    window.hcaptcha.reset();
+  } else if (challenge.type === 'turnstile' && window.turnstile) {
+    window.turnstile.reset();
+  }
+}
+
+// Returns an error message when the form exceeds the server limits, or null
+function checkLimits(formData) {
+  if (!limits) {
+    return null;
+  }
+  if (new TextEncoder().encode(formData.get('msg')).length > limits.max_message_size) {
+    return `The message exceeds the maximum size of ${formatSize(limits.max_message_size)}.`;
+  }
+  const file = formData.get('file');
+  if (file && file.size > limits.max_file_size) {
+    return `The file exceeds the maximum size of ${formatSize(limits.max_file_size)}.`;
+  }
+  return null;
+}
+
 // Form submission handler
 document.addEventListener('DOMContentLoaded', function() {
   // Initialize clipboard functionality
   new ClipboardJS('.btn');
   const form = $("#secretform");
+  loadLimits();
+  loadChallenge();
 
-  form.addEventListener('submit', function(e) {
+  form.addEventListener('submit', async function(e) {
     e.preventDefault();
 
     const formData = new FormData(form);
+    const limitError = checkLimits(formData);
+    if (limitError) {
+      alert(limitError);
+      return;
+    }
+
+    // The CAPTCHA widget adds its response to the form, so it is reset once read
+    try {
+      await answerChallenge(formData);
+    } catch (error) {
+      console.error(`Could not solve the challenge: ${error}`);
+      alert('An error occurred while solving the challenge, please reload the page.');
+      return;
+    }
 
     // Make AJAX request using fetch
     fetch('/secret', {
@@ -28,6 +195,18 @@ document.addEventListener('DOMContentLoaded', function() {
       body: formData
     })
     .then(response => {
+      if (response.status === 401) {
+        // The session expired: log in again
+        window.location.assign('/auth/login?next=/msg');
+        return new Promise(() => {});
+      }
+      if (response.status === 400) {
+        // Show validation errors, e.g. invalid recipients
+        return response.json().then(data => {
+          alert(data.message);
+          return new Promise(() => {});
+        });
+      }
       if (!response.ok) {
         throw new Error(`Request failed with status ${response.status}: ${response.statusText}`);
       }
@@ -54,6 +233,18 @@ document.addEventListener('DOMContentLoaded', function() {
         visibility: 'hidden'
       });
 
+      setStyles($(".recipients"), {
+        opacity: '0',
+        pointerEvents: 'none',
+        visibility: 'hidden'
+      });
+
+      setStyles($(".networks"), {
+        opacity: '0',
+        pointerEvents: 'none',
+        visibility: 'hidden'
+      });
+
       setStyles($(".input-field"), {
         opacity: '0',
         visibility: 'hidden',